@@ -0,0 +1,112 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// MaxPooledBodyBytes is the capacity above which request body buffers are dropped rather than pooled
+const MaxPooledBodyBytes = 1 << 20
+
+// Pools the buffers of request bodies replayed on retries, keeping allocations flat at high rates
+var bodyBuffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// A request body buffered to be replayed on each attempt
+// The buffer returns to the pool once Do and every attempt's transport are done with it
+type replayableBody struct {
+	buffer *bytes.Buffer
+	refs   int64
+}
+
+// Buffers and closes the body
+func newReplayableBody(body io.ReadCloser) (*replayableBody, error) {
+	defer body.Close()
+
+	buffer := bodyBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+
+	if _, err := buffer.ReadFrom(body); err != nil {
+		bodyBuffers.Put(buffer)
+		return nil, err
+	}
+
+	return &replayableBody{buffer: buffer, refs: 1}, nil
+}
+
+// Returns a reader of the body for an attempt, which the transport closes once done
+func (b *replayableBody) reader() io.ReadCloser {
+	atomic.AddInt64(&b.refs, 1)
+	return &replayReader{Reader: bytes.NewReader(b.buffer.Bytes()), body: b}
+}
+
+// Releases a reference to the buffer, returning it to the pool with the last one
+func (b *replayableBody) release() {
+	if atomic.AddInt64(&b.refs, -1) != 0 {
+		return
+	}
+
+	if b.buffer.Cap() <= MaxPooledBodyBytes {
+		bodyBuffers.Put(b.buffer)
+	}
+
+	b.buffer = nil
+}
+
+// Reader of an attempt's body
+type replayReader struct {
+	*bytes.Reader
+
+	body   *replayableBody
+	closed int32
+}
+
+func (r *replayReader) Close() error {
+	if atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		r.body.release()
+	}
+
+	return nil
+}
+
+// Body of a response canceling its attempt's context once closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Returns the request with a GetBody, buffering its body if it has none, so it can be sent again later
+// The request is shallow copied first, leaving the caller's as is apart from its body being read and closed
+func withGetBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return req, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(req.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	return req, nil
+}
@@ -0,0 +1,284 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxCachedBodyBytes is the maximum size of a response's body kept in a Cache
+const MaxCachedBodyBytes = 1 << 20
+
+// Cache stores the responses of the proxy's GETs by method and URL, e.g. in memory with NewMemoryCache or in a store
+// shared by several senders
+// Its methods are called concurrently, and the responses it is given and returns must not be modified
+type Cache interface {
+	// Get returns the response stored under the key, if any
+	Get(key string) (*CachedResponse, bool)
+
+	// Set stores the response under the key
+	Set(key string, resp *CachedResponse)
+}
+
+// CachedResponse is a response stored in a Cache
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// Expires is when the response becomes stale, after which it is revalidated before being used again
+	Expires time.Time
+
+	// VaryValues are the request's values of the headers listed in the response's Vary header
+	VaryValues map[string]string
+}
+
+// Returns whether the response can answer the request, by the headers it varies by
+func (c *CachedResponse) matches(req *http.Request) bool {
+	for name, value := range c.VaryValues {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns a new response to the request of the cached one
+func (c *CachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%v %v", c.StatusCode, http.StatusText(c.StatusCode)),
+		StatusCode:    c.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(c.Body)),
+		ContentLength: int64(len(c.Body)),
+		Request:       req,
+	}
+}
+
+// Cache of responses in memory, bounded by its number of entries
+type memoryCache struct {
+	sync.Mutex
+	responses  map[string]*CachedResponse
+	maxEntries int
+}
+
+// NewMemoryCache returns a Cache in memory of at most maxEntries responses
+// Once full, stale responses are evicted first, then any response
+func NewMemoryCache(maxEntries int) Cache {
+	return &memoryCache{responses: map[string]*CachedResponse{}, maxEntries: maxEntries}
+}
+
+func (c *memoryCache) Get(key string) (*CachedResponse, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	resp, ok := c.responses[key]
+	return resp, ok
+}
+
+func (c *memoryCache) Set(key string, resp *CachedResponse) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.responses[key]; !ok && len(c.responses) >= c.maxEntries {
+		now := time.Now()
+		for other, cached := range c.responses {
+			if now.After(cached.Expires) {
+				delete(c.responses, other)
+			}
+		}
+
+		for other := range c.responses {
+			if len(c.responses) < c.maxEntries {
+				break
+			}
+
+			delete(c.responses, other)
+		}
+	}
+
+	if c.maxEntries > 0 {
+		c.responses[key] = resp
+	}
+}
+
+// Returns whether the request's response can be cached, only GETs without a body
+func isCacheable(req *http.Request) bool {
+	return (req.Method == "" || req.Method == http.MethodGet) && (req.Body == nil || req.Body == http.NoBody)
+}
+
+// Parses a Cache-Control header into its directives
+func parseCacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "" {
+				continue
+			}
+
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				directives[directive[:i]] = strings.Trim(directive[i+1:], `"`)
+			} else {
+				directives[directive] = ""
+			}
+		}
+	}
+
+	return directives
+}
+
+// Returns how long the response is fresh and whether it may be stored at all
+// The client's cache is private, so responses marked private are stored, and s-maxage does not apply
+func freshness(header http.Header) (time.Duration, bool) {
+	directives := parseCacheControl(header)
+	if _, ok := directives["no-store"]; ok {
+		return 0, false
+	}
+
+	// Responses without a lifetime are only stored to be revalidated
+	var lifetime time.Duration
+	if value, ok := directives["max-age"]; ok {
+		seconds, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return 0, false
+		}
+
+		lifetime = time.Duration(seconds) * time.Second
+	}
+
+	if _, ok := directives["no-cache"]; ok {
+		lifetime = 0
+	}
+
+	return lifetime, lifetime > 0 || header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// Answers the GET from the cache while fresh, revalidates it through the proxies once stale, and caches the responses
+// that allow it
+func (p *Proxy) doCached(client *http.Client, req *http.Request) (*http.Response, error) {
+	directives := parseCacheControl(req.Header)
+	if _, ok := directives["no-store"]; ok {
+		return p.send(client, req)
+	}
+
+	key := http.MethodGet + " " + req.URL.String()
+	now := p.clock().Now()
+
+	cached, ok := p.Config.Cache.Get(key)
+	if ok && !cached.matches(req) {
+		cached, ok = nil, false
+	}
+
+	if _, noCache := directives["no-cache"]; ok && !noCache && now.Before(cached.Expires) {
+		return cached.response(req), nil
+	}
+
+	// Revalidate the stale response, unless the caller sends its own conditions
+	sent := req
+	if ok && req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+		etag, lastModified := cached.Header.Get("ETag"), cached.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			sent = req.Clone(req.Context())
+			if etag != "" {
+				sent.Header.Set("If-None-Match", etag)
+			}
+
+			if lastModified != "" {
+				sent.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	resp, err := p.send(client, sent)
+	if err != nil {
+		return nil, err
+	}
+
+	if sent != req && resp.StatusCode == http.StatusNotModified {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		// The 304's headers update the cached ones, e.g. with a new lifetime
+		refreshed := *cached
+		refreshed.Header = cached.Header.Clone()
+		for name, values := range resp.Header {
+			if name != "Content-Length" {
+				refreshed.Header[name] = values
+			}
+		}
+
+		lifetime, _ := freshness(refreshed.Header)
+		refreshed.Expires = now.Add(lifetime)
+		p.Config.Cache.Set(key, &refreshed)
+		return refreshed.response(req), nil
+	}
+
+	return p.storeResponse(key, req, resp, now)
+}
+
+// Stores the response to the request if it allows it, returning it with its body read again from the start
+func (p *Proxy) storeResponse(key string, req *http.Request, resp *http.Response, now time.Time) (*http.Response, error) {
+	// Only the recipient's own 200s, not the proxies' 202s or 429s
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" {
+		return resp, nil
+	}
+
+	if proxyStatus := resp.Header.Get("Proxy-Status"); proxyStatus != "" && proxyStatus != strconv.Itoa(http.StatusOK) {
+		return resp, nil
+	}
+
+	lifetime, storable := freshness(resp.Header)
+	if !storable {
+		return resp, nil
+	}
+
+	// Bodies too large to cache are returned whole, from what was read and the rest
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxCachedBodyBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, newProxyError("Do", "send", -1, req.URL, 1, err)
+	}
+
+	if len(body) > MaxCachedBodyBytes {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+
+	resp.Body.Close()
+
+	cached := &CachedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		Body:       body,
+		Expires:    now.Add(lifetime),
+		VaryValues: map[string]string{},
+	}
+
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				cached.VaryValues[name] = req.Header.Get(name)
+			}
+		}
+	}
+
+	p.Config.Cache.Set(key, cached)
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
@@ -0,0 +1,139 @@
+package client_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Clock of the system, moved forward by the test
+type offsetClock struct {
+	mu     sync.Mutex
+	offset time.Duration
+}
+
+func (c *offsetClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return time.Now().Add(c.offset)
+}
+
+func (c *offsetClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (c *offsetClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.offset += d
+	c.mu.Unlock()
+}
+
+// Returns the body of the GET's response
+func getBody(t *testing.T, p *client.Proxy, server *proxytest.Server, u string) string {
+	req, _ := http.NewRequest(http.MethodGet, u, nil)
+
+	resp, err := p.Do(server.HTTPClient(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body)
+}
+
+// Fresh responses are served from the cache, and stale ones revalidated with their ETag
+func TestCacheRevalidates(t *testing.T) {
+	server := proxytest.NewServer()
+	defer server.Close()
+
+	var mu sync.Mutex
+	var requests, revalidations int
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidations++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Write([]byte("cached"))
+	}))
+
+	defer recipient.Close()
+
+	clock := &offsetClock{}
+	p := newReadySender(t, server, client.Config{Cache: client.NewMemoryCache(10), Clock: clock})
+
+	for i := 0; i < 3; i++ {
+		if body := getBody(t, p, server, recipient.URL); body != "cached" {
+			t.Fatalf("got body %q", body)
+		}
+	}
+
+	mu.Lock()
+	if requests != 1 {
+		t.Errorf("the recipient received %v requests while the response was fresh, expected 1", requests)
+	}
+	mu.Unlock()
+
+	// Once stale the response is revalidated, and the 304 renews it
+	clock.advance(2 * time.Minute)
+	for i := 0; i < 2; i++ {
+		if body := getBody(t, p, server, recipient.URL); body != "cached" {
+			t.Fatalf("got body %q from the revalidated response", body)
+		}
+	}
+
+	mu.Lock()
+	if requests != 2 || revalidations != 1 {
+		t.Errorf("got %v requests and %v revalidations once stale, expected 2 and 1", requests, revalidations)
+	}
+	mu.Unlock()
+}
+
+// Responses of no-store are always sent through the proxies
+func TestCacheNoStore(t *testing.T) {
+	server := proxytest.NewServer()
+	defer server.Close()
+
+	var mu sync.Mutex
+	requests := 0
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+
+		w.Header().Set("Cache-Control", "no-store, max-age=60")
+		w.Write([]byte("uncached"))
+	}))
+
+	defer recipient.Close()
+
+	p := newReadySender(t, server, client.Config{Cache: client.NewMemoryCache(10)})
+
+	for i := 0; i < 2; i++ {
+		getBody(t, p, server, recipient.URL)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if requests != 2 {
+		t.Errorf("the recipient received %v requests, expected 2", requests)
+	}
+}
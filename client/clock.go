@@ -0,0 +1,102 @@
+package client
+
+import "time"
+
+// Clock tells the time and sleeps for the proxy, so timing-dependent behaviors can be tested without real sleeps
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// Sleep pauses the current goroutine for the duration
+	Sleep(d time.Duration)
+}
+
+// Ticker delivers ticks at an interval, like a time.Ticker
+type Ticker interface {
+	// C returns the channel the ticks are delivered on
+	C() <-chan time.Time
+
+	// Stop turns off the ticker
+	Stop()
+}
+
+// TickerClock is a Clock making its own tickers, otherwise the pings' ticker is made from the Clock's Sleep
+type TickerClock interface {
+	Clock
+
+	// NewTicker returns a ticker ticking every duration
+	NewTicker(d time.Duration) Ticker
+}
+
+// Clock of the system
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// Ticker of the system
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// Ticker sleeping on a Clock between ticks
+// Like a time.Ticker, ticks are dropped while the previous one is not received
+type sleepTicker struct {
+	c    chan time.Time
+	stop chan struct{}
+}
+
+func (t *sleepTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *sleepTicker) Stop() {
+	close(t.stop)
+}
+
+// Returns the configured clock, or else the system's
+func (p *Proxy) clock() Clock {
+	if p.Config.Clock == nil {
+		return realClock{}
+	}
+
+	return p.Config.Clock
+}
+
+// Returns a ticker of the configured clock
+// Tickers made from a Clock's Sleep stop after the sleep they are in when stopped
+func (p *Proxy) newTicker(d time.Duration) Ticker {
+	clock := p.clock()
+	if tickerClock, ok := clock.(TickerClock); ok {
+		return tickerClock.NewTicker(d)
+	}
+
+	t := &sleepTicker{c: make(chan time.Time, 1), stop: make(chan struct{})}
+	go func() {
+		for {
+			clock.Sleep(d)
+
+			select {
+			case <-t.stop:
+				return
+			case t.c <- clock.Now():
+			default:
+			}
+		}
+	}()
+
+	return t
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Clock of wall times without a monotonic reading, which can be stepped like the system's wall clock by NTP
+type steppedClock struct {
+	now time.Time
+}
+
+func (c *steppedClock) Now() time.Time {
+	return c.now
+}
+
+func (c *steppedClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestLastResponseKeepsMonotonicReading(t *testing.T) {
+	pod := &Pod{}
+	if !pod.LastResponse().IsZero() || !pod.needsPing(time.Now()) {
+		t.Fatalf("a pod without responses has a last response")
+	}
+
+	now := time.Now()
+	pod.setLastResponse(now)
+
+	last := pod.LastResponse()
+	if !last.Equal(now) {
+		t.Errorf("got last response %v, expected %v", last, now)
+	}
+
+	// Comparisons with the system clock use the monotonic reading, so wall clock steps do not affect them
+	if !strings.Contains(last.String(), "m=") {
+		t.Errorf("the last response %v has no monotonic reading", last)
+	}
+
+	if since := time.Since(last); since < 0 || since > time.Minute {
+		t.Errorf("got %v since the last response", since)
+	}
+
+	if pod.needsPing(now.Add(500 * time.Millisecond)) {
+		t.Errorf("a pod that just responded needs a ping")
+	}
+}
+
+// The deprecated Timestamp is kept up to date until it is removed
+func TestTimestampUpdated(t *testing.T) {
+	pod := &Pod{}
+
+	now := time.Now()
+	pod.setLastResponse(now)
+
+	pod.RLock()
+	defer pod.RUnlock()
+
+	if !pod.Timestamp.Equal(now) {
+		t.Errorf("got Timestamp %v, expected the last response %v", pod.Timestamp, now)
+	}
+}
+
+func TestClockSteps(t *testing.T) {
+	clock := &steppedClock{now: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	start := clock.now
+
+	pod := &Pod{}
+	pod.setLastResponse(clock.Now())
+
+	for _, c := range []struct {
+		name  string
+		step  time.Duration
+		ping  bool
+		stale time.Duration
+	}{
+		{"just responded", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		{"idle", 2 * time.Second, true, 2 * time.Second},
+		{"stepped back", -time.Hour, true, -time.Hour},
+		{"stepped forward", time.Hour, true, time.Hour},
+	} {
+		now := start.Add(c.step)
+
+		if ping := pod.needsPing(now); ping != c.ping {
+			t.Errorf("%v: needs a ping: %v, expected %v", c.name, ping, c.ping)
+		}
+
+		if stale := pod.staleFor(now); stale != c.stale {
+			t.Errorf("%v: stale for %v, expected %v", c.name, stale, c.stale)
+		}
+	}
+
+	// A ping after the step back records the response at the stepped time, so the pod is fresh again
+	clock.now = start.Add(-time.Hour)
+	pod.setLastResponse(clock.Now())
+	if pod.needsPing(clock.Now().Add(500*time.Millisecond)) || pod.staleFor(clock.Now()) != 0 {
+		t.Errorf("the pod is not fresh after responding at the stepped time")
+	}
+}
+
+// Pods are evicted by the client's clock, so only its steps, not the system's, affect the eviction
+func TestEvictionFollowsClock(t *testing.T) {
+	clock := &steppedClock{now: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+
+	p, err := NewWithConfig("http://proxy.test:8080/", Config{Clock: clock, PodTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Destroy()
+
+	header := testHeader(0, 1, 10, 1, testList(2))
+	updateKnownProxies(p, &header)
+	header = testHeader(1, 1, 10, 1, testList(2))
+	updateKnownProxies(p, &header)
+
+	// Stepping back keeps the pods
+	clock.now = clock.now.Add(-time.Hour)
+	p.evictStalePods()
+	if s := p.snapshot(); s.count != 2 || s.bestOrdinal() < 0 {
+		t.Fatalf("got %v pods after stepping back", s.count)
+	}
+
+	// Past the TTL, the pods are no longer selected, and past twice the TTL removed
+	clock.now = clock.now.Add(time.Hour + 90*time.Second)
+	p.evictStalePods()
+	if s := p.snapshot(); s.count != 2 || s.bestOrdinal() >= 0 {
+		t.Fatalf("got %v pods, with best pod %v, past the TTL", s.count, s.bestOrdinal())
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	p.evictStalePods()
+	if s := p.snapshot(); s.count != 0 {
+		t.Fatalf("got %v pods past twice the TTL", s.count)
+	}
+}
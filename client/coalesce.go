@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A GET sent through the proxies on behalf of the identical GETs arriving while it is in flight
+type coalescedCall struct {
+	// done is closed once the response's body is read, or the request failed
+	done chan struct{}
+
+	resp *http.Response
+	body []byte
+	err  error
+}
+
+// Returns a copy of the call's response, with its own header and body
+func (c *coalescedCall) response() *http.Response {
+	resp := *c.resp
+	resp.Header = c.resp.Header.Clone()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(c.body))
+	return &resp
+}
+
+// Returns whether the request can share the response of an identical one, only GETs without a body
+func isCoalescable(req *http.Request) bool {
+	return (req.Method == "" || req.Method == http.MethodGet) && (req.Body == nil || req.Body == http.NoBody)
+}
+
+// Returns the key identical requests share, their URL and headers, so requests of different credentials (e.g.
+// Authorization or Cookie) are never coalesced
+func coalesceKey(req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(req.URL.String())
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			b.WriteString("\n")
+			b.WriteString(name)
+			b.WriteString(": ")
+			b.WriteString(value)
+		}
+	}
+
+	return b.String()
+}
+
+// Sends the GET through the proxies, or waits for the response of an identical one in flight
+// Each caller gets its own copy of the response, whose body is read in full
+func (p *Proxy) doCoalesced(client *http.Client, req *http.Request) (*http.Response, error) {
+	key := coalesceKey(req)
+
+	p.coalesceMu.Lock()
+	if call, ok := p.coalescing[key]; ok {
+		p.coalesceMu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-req.Context().Done():
+			return nil, newProxyError("Do", "select", -1, nil, 1, req.Context().Err())
+		}
+
+		// The request sent for the others was canceled by its own caller, send this one instead
+		if call.err != nil && (errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded)) && req.Context().Err() == nil {
+			return p.do(client, req)
+		}
+
+		if call.err != nil {
+			return nil, call.err
+		}
+
+		return call.response(), nil
+	}
+
+	call := &coalescedCall{done: make(chan struct{})}
+	if p.coalescing == nil {
+		p.coalescing = map[string]*coalescedCall{}
+	}
+
+	p.coalescing[key] = call
+	p.coalesceMu.Unlock()
+
+	defer func() {
+		p.coalesceMu.Lock()
+		delete(p.coalescing, key)
+		p.coalesceMu.Unlock()
+
+		close(call.done)
+	}()
+
+	call.resp, call.err = p.do(client, req)
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	call.body, call.err = ioutil.ReadAll(call.resp.Body)
+	call.resp.Body.Close()
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	return call.response(), nil
+}
@@ -0,0 +1,122 @@
+package client_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Recipient holding the requests until released, counting them
+type heldRecipient struct {
+	*httptest.Server
+
+	requests int64
+	received chan struct{}
+	release  chan struct{}
+}
+
+func newHeldRecipient(t *testing.T) *heldRecipient {
+	r := &heldRecipient{received: make(chan struct{}, 100), release: make(chan struct{})}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&r.requests, 1)
+		r.received <- struct{}{}
+
+		<-r.release
+		w.Write([]byte("response of " + req.Header.Get("Authorization")))
+	}))
+
+	t.Cleanup(r.Close)
+	return r
+}
+
+// Sends the GETs at once, the first alone until it reaches the recipient, and returns the bodies of their responses
+func doConcurrently(t *testing.T, p *client.Proxy, server *proxytest.Server, r *heldRecipient, authorizations []string) []string {
+	bodies := make([]string, len(authorizations))
+
+	var wg sync.WaitGroup
+	send := func(i int) {
+		defer wg.Done()
+
+		req, _ := http.NewRequest(http.MethodGet, r.URL+"/resource", nil)
+		req.Header.Set("Authorization", authorizations[i])
+
+		resp, err := p.Do(server.HTTPClient(), req)
+		if err != nil {
+			t.Errorf("request %v failed: %v", i, err)
+			return
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		bodies[i] = string(body)
+	}
+
+	wg.Add(1)
+	go send(0)
+
+	select {
+	case <-r.received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the recipient received no request")
+	}
+
+	for i := 1; i < len(authorizations); i++ {
+		wg.Add(1)
+		go send(i)
+	}
+
+	// Let the others join the request in flight
+	time.Sleep(100 * time.Millisecond)
+	close(r.release)
+	wg.Wait()
+
+	return bodies
+}
+
+// Identical GETs in flight at once are sent once, each caller getting the response
+func TestCoalesceGets(t *testing.T) {
+	server := proxytest.NewServerWithConfig(proxytest.Config{ProxyTimeout: 5 * time.Second})
+	defer server.Close()
+
+	recipient := newHeldRecipient(t)
+	p := newReadySender(t, server, client.Config{CoalesceGets: true})
+
+	bodies := doConcurrently(t, p, server, recipient, []string{"a", "a", "a", "a", "a"})
+
+	if requests := atomic.LoadInt64(&recipient.requests); requests != 1 {
+		t.Errorf("the recipient received %v requests, expected 1", requests)
+	}
+
+	for i, body := range bodies {
+		if body != "response of a" {
+			t.Errorf("got body %q for request %v", body, i)
+		}
+	}
+}
+
+// GETs of different headers, e.g. credentials, are never coalesced
+func TestCoalesceGetsByHeaders(t *testing.T) {
+	server := proxytest.NewServerWithConfig(proxytest.Config{ProxyTimeout: 5 * time.Second})
+	defer server.Close()
+
+	recipient := newHeldRecipient(t)
+	p := newReadySender(t, server, client.Config{CoalesceGets: true})
+
+	bodies := doConcurrently(t, p, server, recipient, []string{"a", "b"})
+
+	if requests := atomic.LoadInt64(&recipient.requests); requests != 2 {
+		t.Errorf("the recipient received %v requests, expected 2", requests)
+	}
+
+	if bodies[0] != "response of a" || bodies[1] != "response of b" {
+		t.Errorf("got bodies %q, expected each its own", bodies)
+	}
+}
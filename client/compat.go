@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Pods of several versions answer the client during rolling upgrades, so the formats of the Proxy-* headers are
+// detected rather than assumed, and replaced formats are still parsed for at least one protocol version
+
+// legacyHeaders maps the Proxy-* headers to the names older versions use, which requests are also sent under and
+// responses are read under when missing
+var legacyHeaders = map[string][]string{
+	// Version 1 proxies only read the header without the prefix
+	"Proxy-Ensure-Requests": {"Ensure-Requests"},
+}
+
+// Sets the Proxy-* request header, and its legacy names
+func setProxyHeader(header http.Header, name string, value string) {
+	header.Set(name, value)
+	for _, legacyName := range legacyHeaders[name] {
+		header.Set(legacyName, value)
+	}
+}
+
+// Deletes the Proxy-* request header, and its legacy names
+func deleteProxyHeader(header http.Header, name string) {
+	header.Del(name)
+	for _, legacyName := range legacyHeaders[name] {
+		header.Del(legacyName)
+	}
+}
+
+// Returns the value of the Proxy-* response header, or else of its legacy names
+func proxyHeader(header http.Header, name string) string {
+	if value := header.Get(name); value != "" {
+		return value
+	}
+
+	for _, legacyName := range legacyHeaders[name] {
+		if value := header.Get(legacyName); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// Parses a Proxy-List in the compact format: the IPs in ordinal order, empty for the ordinals without a ready pod,
+// e.g. 10.0.0.1,,10.0.0.3
+func parseCompactProxyList(str string, maxPods int) (map[int]string, error) {
+	ips := strings.Split(str, ",")
+	if len(ips) > maxPods {
+		return nil, fmt.Errorf("proxy list has more than %v ordinals", maxPods)
+	}
+
+	result := map[int]string{}
+	for ordinal, ip := range ips {
+		ip = strings.TrimSpace(ip)
+		if ip == "" {
+			continue
+		}
+
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("proxy list IP %q of ordinal %v is invalid", ip, ordinal)
+		}
+
+		result[ordinal] = ip
+	}
+
+	return result, nil
+}
+
+// Decodes a Proxy-List by its Proxy-List-Encoding
+// Proxies compress large lists with gzip and base64 to fit in the header size limits of ingresses, the decoded list is
+// bounded by MaxProxyListBytes like a plain one
+func decodeProxyList(str string, encoding string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return str, nil
+	case "gzip":
+	default:
+		return "", fmt.Errorf("proxy list encoding %q is not supported", encoding)
+	}
+
+	if len(str) > MaxProxyListBytes {
+		return "", fmt.Errorf("proxy list is larger than %v bytes", MaxProxyListBytes)
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(str))
+	if err != nil {
+		return "", fmt.Errorf("proxy list is not base64: %w", err)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", fmt.Errorf("proxy list is not gzip: %w", err)
+	}
+
+	defer reader.Close()
+
+	list, err := ioutil.ReadAll(io.LimitReader(reader, MaxProxyListBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("proxy list is not gzip: %w", err)
+	}
+
+	if len(list) > MaxProxyListBytes {
+		return "", fmt.Errorf("decoded proxy list is larger than %v bytes", MaxProxyListBytes)
+	}
+
+	return string(list), nil
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Returns the list compressed like the proxies' large lists
+func gzipList(list string) string {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write([]byte(list))
+	writer.Close()
+
+	return base64.StdEncoding.EncodeToString(buffer.Bytes())
+}
+
+func TestParseProxyList(t *testing.T) {
+	for _, c := range []struct {
+		list string
+		ips  map[int]string
+	}{
+		{`{}`, map[int]string{}},
+		{`{"0": "10.0.0.1", "2": "10.0.0.3"}`, map[int]string{0: "10.0.0.1", 2: "10.0.0.3"}},
+		{` {"1":"::1"} `, map[int]string{1: "::1"}},
+		{`10.0.0.1,,10.0.0.3`, map[int]string{0: "10.0.0.1", 2: "10.0.0.3"}},
+		{`,`, map[int]string{}},
+	} {
+		ips, err := parseProxyList(c.list, 4)
+		if err != nil {
+			t.Errorf("%q failed: %v", c.list, err)
+			continue
+		}
+
+		if fmt.Sprint(ips) != fmt.Sprint(c.ips) {
+			t.Errorf("%q parsed as %v, expected %v", c.list, ips, c.ips)
+		}
+	}
+}
+
+func TestParseProxyListRejects(t *testing.T) {
+	for _, list := range []string{
+		`{"-1": "10.0.0.1"}`,
+		`{"4": "10.0.0.1"}`,
+		`{"x": "10.0.0.1"}`,
+		`{"0": "10.0.0.1", "0": "10.0.0.2"}`,
+		`{"0": "10.0.0.1", "00": "10.0.0.2"}`,
+		`{"0": "not an ip"}`,
+		`{"0": 1}`,
+		`{"0": "10.0.0.1"} {}`,
+		`{"0": "10.0.0.1"`,
+		`[]`,
+		`10.0.0.1,10.0.0.2,10.0.0.3,10.0.0.4,10.0.0.5`,
+		`10.0.0.1,nope`,
+		`{"0": "` + strings.Repeat("1", MaxProxyListBytes) + `"}`,
+	} {
+		if ips, err := parseProxyList(list, 4); err == nil {
+			name := list
+			if len(name) > 64 {
+				name = name[:64] + "..."
+			}
+
+			t.Errorf("%q parsed as %v", name, ips)
+		}
+	}
+}
+
+func TestDecodeProxyList(t *testing.T) {
+	list := `{"0": "10.0.0.1"}`
+
+	for _, encoding := range []string{"", "identity"} {
+		if decoded, err := decodeProxyList(list, encoding); err != nil || decoded != list {
+			t.Errorf("%q decoded %q as %q: %v", encoding, list, decoded, err)
+		}
+	}
+
+	if decoded, err := decodeProxyList(gzipList(list), "gzip"); err != nil || decoded != list {
+		t.Errorf("decoded the gzip list as %q: %v", decoded, err)
+	}
+
+	// A small header must not decompress into a huge list
+	bomb := gzipList(strings.Repeat(" ", MaxProxyListBytes+1))
+	if len(bomb) > MaxProxyListBytes {
+		t.Fatalf("the compressed list is %v bytes", len(bomb))
+	}
+
+	for _, c := range []struct{ list, encoding string }{
+		{bomb, "gzip"},
+		{"not base64!", "gzip"},
+		{base64.StdEncoding.EncodeToString([]byte("not gzip")), "gzip"},
+		{list, "br"},
+	} {
+		if _, err := decodeProxyList(c.list, c.encoding); err == nil {
+			t.Errorf("decoded a %q list of %v bytes", c.encoding, len(c.list))
+		}
+	}
+}
+
+// Checks the invariants of a parsed list, which the client trusts once parsed
+func checkProxyList(t *testing.T, ips map[int]string, maxPods int) {
+	if len(ips) > maxPods {
+		t.Fatalf("parsed %v pods, more than %v", len(ips), maxPods)
+	}
+
+	for ordinal, ip := range ips {
+		if ordinal < 0 || ordinal >= maxPods {
+			t.Fatalf("parsed ordinal %v, not in [0, %v)", ordinal, maxPods)
+		}
+
+		if net.ParseIP(ip) == nil {
+			t.Fatalf("parsed IP %q of ordinal %v", ip, ordinal)
+		}
+	}
+}
+
+func FuzzParseProxyList(f *testing.F) {
+	for _, list := range []string{
+		`{"0": "10.0.0.1", "2": "10.0.0.3"}`,
+		`{"0": "10.0.0.1", "0": "10.0.0.2"}`,
+		`{"-1": "::1"}`,
+		`10.0.0.1,,10.0.0.3`,
+		`{}`,
+		``,
+	} {
+		f.Add(list, 8)
+	}
+
+	f.Fuzz(func(t *testing.T, list string, maxPods int) {
+		if maxPods <= 0 || maxPods > DefaultMaxPods {
+			maxPods = DefaultMaxPods
+		}
+
+		ips, err := parseProxyList(list, maxPods)
+		if err != nil {
+			return
+		}
+
+		checkProxyList(t, ips, maxPods)
+	})
+}
+
+func FuzzDecodeProxyList(f *testing.F) {
+	f.Add(gzipList(`{"0": "10.0.0.1"}`), "gzip")
+	f.Add(`{"0": "10.0.0.1"}`, "")
+	f.Add(`10.0.0.1`, "identity")
+
+	f.Fuzz(func(t *testing.T, list string, encoding string) {
+		decoded, err := decodeProxyList(list, encoding)
+		if err != nil {
+			return
+		}
+
+		if len(decoded) > MaxProxyListBytes {
+			t.Fatalf("decoded a list of %v bytes", len(decoded))
+		}
+
+		if ips, err := parseProxyList(decoded, DefaultMaxPods); err == nil {
+			checkProxyList(t, ips, DefaultMaxPods)
+		}
+	})
+}
+
+func TestLegacyHeaders(t *testing.T) {
+	header := http.Header{}
+	setProxyHeader(header, "Proxy-Ensure-Requests", "3")
+	if header.Get("Proxy-Ensure-Requests") != "3" || header.Get("Ensure-Requests") != "3" {
+		t.Errorf("got headers %v, expected both names", header)
+	}
+
+	// Responses of older versions are read under the legacy name
+	header.Del("Proxy-Ensure-Requests")
+	if value := proxyHeader(header, "Proxy-Ensure-Requests"); value != "3" {
+		t.Errorf("got %q under the legacy name, expected 3", value)
+	}
+
+	deleteProxyHeader(header, "Proxy-Ensure-Requests")
+	if len(header) != 0 {
+		t.Errorf("got headers %v after deleting them", header)
+	}
+
+	// Headers without a legacy name are only set under theirs
+	setProxyHeader(header, "Proxy-Sender", "sender")
+	if len(header) != 1 {
+		t.Errorf("got headers %v, expected only Proxy-Sender", header)
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DeadLetterVersion is the newest version of the dead letters' schema DecodeDeadLetter decodes
+const DeadLetterVersion = 1
+
+// DeadLetterSchema is the JSON schema of the dead letters, for receivers validating them outside of Go
+//
+//go:embed deadletter.schema.json
+var DeadLetterSchema string
+
+// DeadLetter is a request the proxies dropped without delivering it, as written to their deadLetter sink or POSTed
+// to its webhook
+type DeadLetter struct {
+	// Version is the version of the schema, 0 for dead letters predating versioning
+	Version int `json:"version"`
+
+	// Time is when the proxy dropped the request
+	Time time.Time `json:"time"`
+
+	// Reason is the failure class, e.g. "expired" for requests dropped for their Proxy-TTL
+	// Classes may be added in the same version, receivers should handle unknown ones
+	Reason string `json:"reason"`
+
+	RequestID string `json:"requestId"`
+	Sender    string `json:"sender,omitempty"`
+	Tenant    string `json:"tenant"`
+
+	// The request as it would have been forwarded, to redeliver it, Target being its Forward-To
+	Method string      `json:"method"`
+	Target string      `json:"target"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+
+	// ReceivedAt is when the proxy received the request, zero before version 1, and QueueWait the time in
+	// milliseconds between receiving and dropping it
+	ReceivedAt time.Time `json:"receivedAt"`
+	QueueWait  float64   `json:"queueWaitMs"`
+
+	// Attempts is the number of times the request was forwarded to the recipient
+	Attempts int `json:"attempts"`
+
+	// Response is the recipient's last response, nil if it did not respond
+	Response *DeadLetterResponse `json:"response,omitempty"`
+}
+
+// DeadLetterResponse is a snapshot of a recipient's response to a dead letter's request
+type DeadLetterResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// DecodeDeadLetter decodes a dead letter, e.g. the body of a webhook's request, or a line of a sink
+// Dead letters of a newer version than DeadLetterVersion are rejected, as their fields may have changed meaning
+func DecodeDeadLetter(r io.Reader) (*DeadLetter, error) {
+	var letter DeadLetter
+	if err := json.NewDecoder(r).Decode(&letter); err != nil {
+		return nil, fmt.Errorf("error decoding dead letter: %w", err)
+	}
+
+	if letter.Version > DeadLetterVersion {
+		return nil, fmt.Errorf("dead letter version %v is newer than the supported %v", letter.Version, DeadLetterVersion)
+	}
+
+	// Canonicalize the header names, as they are not when decoded
+	letter.Header = canonicalHeader(letter.Header)
+	if letter.Response != nil {
+		letter.Response.Header = canonicalHeader(letter.Response.Header)
+	}
+
+	return &letter, nil
+}
+
+// Returns the header with its names canonicalized
+func canonicalHeader(header http.Header) http.Header {
+	if header == nil {
+		return nil
+	}
+
+	canonical := make(http.Header, len(header))
+	for k, values := range header {
+		for _, v := range values {
+			canonical.Add(k, v)
+		}
+	}
+
+	return canonical
+}
@@ -0,0 +1,272 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeliveryState is the state of a request the proxies answered with a 202
+type DeliveryState int
+
+const (
+	// DeliveryPending is a request not done yet, scheduled, queued or being forwarded to the recipient
+	DeliveryPending DeliveryState = iota
+
+	// DeliveryDelivered is a request the recipient responded to
+	DeliveryDelivered
+
+	// DeliveryFailed is a request the proxy failed to forward, e.g. as the recipient was unreachable
+	DeliveryFailed
+
+	// DeliveryForwarding is a request being forwarded to the recipient, only told apart from pending ones by
+	// DeliveryStatuses
+	DeliveryForwarding
+
+	// DeliveryExpired is a request dropped for its Proxy-TTL, or forgotten by the proxies past their affinityTTL
+	DeliveryExpired
+
+	// DeliveryLost is a request whose proxy is gone along with it
+	DeliveryLost
+
+	// DeliveryUnknown is a request whose state could not be known, e.g. as its proxy was unreachable
+	DeliveryUnknown
+)
+
+// deliveryStates are the names of the states, as the proxies report them to status queries
+var deliveryStates = []string{"pending", "delivered", "failed", "forwarding", "expired", "lost", "unknown"}
+
+func (s DeliveryState) String() string {
+	if s < 0 || int(s) >= len(deliveryStates) {
+		return "unknown"
+	}
+
+	return deliveryStates[s]
+}
+
+// Returns the state with the name, DeliveryUnknown if there is none
+func parseDeliveryState(name string) DeliveryState {
+	for s, stateName := range deliveryStates {
+		if stateName == name {
+			return DeliveryState(s)
+		}
+	}
+
+	return DeliveryUnknown
+}
+
+// Delivery is the outcome of a request the proxies answered with a 202, as known to the proxy holding it
+type Delivery struct {
+	State DeliveryState
+
+	// StatusCode, Header and Body are the recipient's response, once delivered
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// Err is why the proxy failed to forward the request, once failed
+	Err error
+}
+
+// Delivery asks the proxies for the outcome of the request with the Proxy-Affinity token of its 202, e.g. an
+// AcceptedError's Affinity. The proxy holding the request waits up to its timeout for a pending one
+// ErrUnknownDelivery is returned once the proxies forgot the request, and ErrDeliveryLost if its proxy is gone
+func (p *Proxy) Delivery(ctx context.Context, client *http.Client, affinity string) (*Delivery, error) {
+	if p.Closed() {
+		return nil, ErrClosed
+	}
+
+	p.use()
+
+	// Any proxy routes the follow-up to the one holding the request
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Service.String(), nil)
+	if err != nil {
+		return nil, newProxyError("Delivery", "send", -1, p.Service, 1, err)
+	}
+
+	req.Header.Set("Proxy-Affinity", affinity)
+	req.Header.Set("Proxy-Protocol-Version", strconv.Itoa(ProtocolVersion))
+	req.Header.Set("Proxy-Sender", p.Config.SenderID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, newProxyError("Delivery", "send", -1, req.URL, 1, err)
+	}
+
+	defer resp.Body.Close()
+
+	proxyStatus, err := updateKnownProxies(p, &resp.Header)
+	if err != nil {
+		return nil, newProxyError("Delivery", "parse", -1, req.URL, 1, err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, newProxyError("Delivery", "send", -1, req.URL, 1, err)
+	}
+
+	switch proxyStatus {
+	case http.StatusOK:
+		removeProxyHeaders(resp.Header)
+		return &Delivery{State: DeliveryDelivered, StatusCode: resp.StatusCode, Header: resp.Header, Body: body}, nil
+	case http.StatusAccepted:
+		return &Delivery{State: DeliveryPending}, nil
+	case http.StatusInternalServerError:
+		return &Delivery{State: DeliveryFailed, Err: errors.New(string(body))}, nil
+	case http.StatusNotFound:
+		return nil, ErrUnknownDelivery
+	case http.StatusGone:
+		return nil, ErrDeliveryLost
+	}
+
+	return nil, &ProxyError{
+		Op:      "Delivery",
+		Phase:   "status",
+		Ordinal: -1,
+		IP:      req.URL.Hostname(),
+		Attempt: 1,
+		Status:  proxyStatus,
+		Err:     errors.New("Unexpected proxy status code " + strconv.Itoa(proxyStatus)),
+	}
+}
+
+// WaitDelivered polls the proxies with Delivery until the request with the affinity token is delivered or failed,
+// returning the context's error if it is done first
+// Each poll is held by the proxy up to its timeout, and polls are spaced by the PingInterval
+func (p *Proxy) WaitDelivered(ctx context.Context, client *http.Client, affinity string) (*Delivery, error) {
+	for {
+		delivery, err := p.Delivery(ctx, client, affinity)
+		if err != nil || delivery.State != DeliveryPending {
+			return delivery, err
+		}
+
+		timer := time.NewTimer(p.Config.PingInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-p.ctx.Done():
+			timer.Stop()
+			return nil, ErrClosed
+		case <-timer.C:
+		}
+	}
+}
+
+// StatusQueryContentType is the content type of the status queries of DeliveryStatuses
+const StatusQueryContentType = "application/x-proxy-status+json"
+
+// MaxStatusQuery is the number of tokens DeliveryStatuses sends per query, the proxies' default maxBatchSize
+const MaxStatusQuery = 1000
+
+// DeliveryStatus is the state of a request the proxies answered with a 202, as reported by DeliveryStatuses
+type DeliveryStatus struct {
+	State DeliveryState
+
+	// StatusCode is the recipient's status, once delivered
+	StatusCode int
+
+	// Err is why the request failed, or its state is unknown
+	Err string
+}
+
+// Status query of the protocol, and its answer
+type statusQuery struct {
+	Affinity []string `json:"affinity"`
+}
+
+type statusQueryResult struct {
+	Statuses []struct {
+		Affinity string `json:"affinity"`
+		State    string `json:"state"`
+		Status   int    `json:"status"`
+		Error    string `json:"error"`
+	} `json:"statuses"`
+}
+
+// DeliveryStatuses asks the proxies for the states of the requests with the Proxy-Affinity tokens at once, e.g. to
+// reconcile many 202s, returning them by token. Unlike Delivery it does not wait for pending requests, nor return
+// the recipients' responses
+// The tokens are sent in queries of at most MaxStatusQuery, which the proxy answering gathers from the other proxies
+func (p *Proxy) DeliveryStatuses(ctx context.Context, client *http.Client, affinities []string) (map[string]DeliveryStatus, error) {
+	statuses := make(map[string]DeliveryStatus, len(affinities))
+	for start := 0; start < len(affinities); start += MaxStatusQuery {
+		end := start + MaxStatusQuery
+		if end > len(affinities) {
+			end = len(affinities)
+		}
+
+		if err := p.queryStatuses(ctx, client, affinities[start:end], statuses); err != nil {
+			return nil, err
+		}
+	}
+
+	return statuses, nil
+}
+
+// Sends a status query of the tokens, adding their statuses
+func (p *Proxy) queryStatuses(ctx context.Context, client *http.Client, affinities []string, statuses map[string]DeliveryStatus) error {
+	if p.Closed() {
+		return ErrClosed
+	}
+
+	p.use()
+
+	body, err := json.Marshal(statusQuery{Affinity: affinities})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Service.String(), bytes.NewReader(body))
+	if err != nil {
+		return newProxyError("DeliveryStatuses", "send", -1, p.Service, 1, err)
+	}
+
+	req.Header.Set("Content-Type", StatusQueryContentType)
+	req.Header.Set("Proxy-Protocol-Version", strconv.Itoa(ProtocolVersion))
+	req.Header.Set("Proxy-Sender", p.Config.SenderID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return newProxyError("DeliveryStatuses", "send", -1, req.URL, 1, err)
+	}
+
+	defer resp.Body.Close()
+
+	proxyStatus, err := updateKnownProxies(p, &resp.Header)
+	if err != nil {
+		return newProxyError("DeliveryStatuses", "parse", -1, req.URL, 1, err)
+	}
+
+	if proxyStatus != http.StatusOK {
+		return &ProxyError{
+			Op:      "DeliveryStatuses",
+			Phase:   "status",
+			Ordinal: -1,
+			IP:      req.URL.Hostname(),
+			Attempt: 1,
+			Status:  proxyStatus,
+			Err:     errors.New("Unexpected proxy status code " + strconv.Itoa(proxyStatus)),
+		}
+	}
+
+	var result statusQueryResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return newProxyError("DeliveryStatuses", "parse", -1, req.URL, 1, err)
+	}
+
+	for _, status := range result.Statuses {
+		statuses[status.Affinity] = DeliveryStatus{
+			State:      parseDeliveryState(status.State),
+			StatusCode: status.Status,
+			Err:        status.Error,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Returns the affinity token of a request the pods answer with a 202, as its recipient outlives their timeout
+func acceptedAffinity(t *testing.T, p *client.Proxy, server *proxytest.Server, target string) string {
+	req, _ := http.NewRequest(http.MethodPost, target, nil)
+
+	_, _, err := client.DoJSON[struct{}](context.Background(), p, server.HTTPClient(), req)
+
+	var accepted *client.AcceptedError
+	if !errors.As(err, &accepted) || accepted.Affinity == "" {
+		t.Fatalf("got %v, expected a 202 with an affinity token", err)
+	}
+
+	return accepted.Affinity
+}
+
+// The outcome of a 202 is followed up on until the recipient responded
+func TestWaitDelivered(t *testing.T) {
+	server := proxytest.NewServer()
+	defer server.Close()
+
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+
+		w.Header().Set("X-Recipient", "true")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+
+	defer recipient.Close()
+
+	p := newReadySender(t, server, client.Config{PingInterval: 50 * time.Millisecond})
+	affinity := acceptedAffinity(t, p, server, recipient.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	delivery, err := p.WaitDelivered(ctx, server.HTTPClient(), affinity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if delivery.State != client.DeliveryDelivered || delivery.StatusCode != http.StatusCreated || string(delivery.Body) != "created" {
+		t.Errorf("got %+v, expected the recipient's response", delivery)
+	}
+
+	if delivery.Header.Get("X-Recipient") != "true" || delivery.Header.Get("Proxy-List") != "" {
+		t.Errorf("got header %v, expected the recipient's without the pod list", delivery.Header)
+	}
+}
+
+// Follow-ups of requests the proxies forgot, or whose proxy is gone, fail
+func TestDeliveryErrors(t *testing.T) {
+	server := proxytest.NewServer()
+	defer server.Close()
+
+	p := newReadySender(t, server, client.Config{})
+
+	for _, c := range []struct {
+		affinity string
+		err      error
+	}{
+		{"0.1000", client.ErrUnknownDelivery},
+		{"5.1", client.ErrDeliveryLost},
+	} {
+		if _, err := p.Delivery(context.Background(), server.HTTPClient(), c.affinity); !errors.Is(err, c.err) {
+			t.Errorf("got %v for %v, expected %v", err, c.affinity, c.err)
+		}
+	}
+}
+
+// The states of many 202s are queried at once, in queries of at most MaxStatusQuery tokens
+func TestDeliveryStatuses(t *testing.T) {
+	server := proxytest.NewServer()
+	defer server.Close()
+
+	recipient := newHeldRecipient(t)
+	p := newReadySender(t, server, client.Config{PingInterval: 50 * time.Millisecond})
+	affinity := acceptedAffinity(t, p, server, recipient.URL)
+
+	// Tokens past the first query's
+	affinities := []string{affinity, "0.1000", "4.1"}
+	for i := len(affinities); i <= client.MaxStatusQuery; i++ {
+		affinities = append(affinities, "malformed-"+strconv.Itoa(i))
+	}
+
+	last := affinities[client.MaxStatusQuery]
+
+	statuses, err := p.DeliveryStatuses(context.Background(), server.HTTPClient(), affinities)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statuses) != len(affinities) {
+		t.Fatalf("got %v statuses, expected %v", len(statuses), len(affinities))
+	}
+
+	for token, state := range map[string]client.DeliveryState{
+		affinity: client.DeliveryForwarding,
+		"0.1000": client.DeliveryExpired,
+		"4.1":    client.DeliveryLost,
+		last:     client.DeliveryUnknown,
+	} {
+		if statuses[token].State != state {
+			t.Errorf("got state %v for %v, expected %v", statuses[token].State, token, state)
+		}
+	}
+
+	close(recipient.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := p.WaitDelivered(ctx, server.HTTPClient(), affinity); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err = p.DeliveryStatuses(context.Background(), server.HTTPClient(), []string{affinity})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := statuses[affinity]; status.State != client.DeliveryDelivered || status.StatusCode != http.StatusOK {
+		t.Errorf("got %+v once delivered, expected the recipient's 200", status)
+	}
+}
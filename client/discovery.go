@@ -0,0 +1,93 @@
+package client
+
+import (
+	"net"
+	"net/url"
+	"sync"
+)
+
+// Discovery discovers and pings the pods of a StatefulSet on behalf of several Proxy values, attached to it with
+// Config.Discovery, e.g. proxies of different paths or services of the same pods. They share its pod list and pings
+// rather than each keeping and pinging their own
+type Discovery struct {
+	// proxy holds the pod list and runs the pings, it sends no requests of its own
+	proxy *Proxy
+
+	mu       sync.Mutex
+	attached map[*Proxy]struct{}
+}
+
+// NewDiscovery constructs a discovery of the pods behind the proxy service URL
+// The pings are configured by the config's ping settings, which the attached proxies' are ignored in favor of, and
+// start with the first request of an attached proxy
+func NewDiscovery(proxyServiceURL string, config Config) (*Discovery, error) {
+	config.Discovery = nil
+
+	proxy, err := NewWithConfig(proxyServiceURL, config)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Discovery{proxy: proxy, attached: map[*Proxy]struct{}{}}
+	proxy.discovery = d
+
+	return d, nil
+}
+
+// Close stops the pings, it should only be called once the attached proxies are destroyed
+func (d *Discovery) Close() {
+	d.proxy.Destroy()
+}
+
+// Attaches the proxy, until it is destroyed
+func (d *Discovery) attach(p *Proxy) {
+	d.mu.Lock()
+	d.attached[p] = struct{}{}
+	d.mu.Unlock()
+
+	go func() {
+		<-p.ctx.Done()
+
+		d.mu.Lock()
+		delete(d.attached, p)
+		d.mu.Unlock()
+	}()
+}
+
+// Sends the requests the attached proxies buffered while the proxies were unreachable
+func (d *Discovery) flushOffline() {
+	d.mu.Lock()
+	proxies := make([]*Proxy, 0, len(d.attached))
+	for p := range d.attached {
+		proxies = append(proxies, p)
+	}
+	d.mu.Unlock()
+
+	for _, p := range proxies {
+		p.flushOffline()
+	}
+}
+
+// Returns the proxy holding the pod list and running the pings, its discovery's or else itself
+func (p *Proxy) table() *Proxy {
+	if p.discovery != nil {
+		return p.discovery.proxy
+	}
+
+	return p
+}
+
+// Returns the URL of the pod for the proxy, whose scheme, port and path may differ from its discovery's service
+func (p *Proxy) podURL(pod *Pod) (*url.URL, error) {
+	u, err := pod.proxyURL()
+	if err != nil || p.discovery == nil || p.discovery.proxy == p {
+		return u, err
+	}
+
+	u.Scheme = p.Service.Scheme
+	u.Host = net.JoinHostPort(pod.IP, p.Service.Port())
+	u.Path = p.Service.Path
+	u.RawPath = p.Service.RawPath
+
+	return u, nil
+}
@@ -0,0 +1,90 @@
+package client_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Tracer counting the attempts, and setting a header on each
+type attemptTracer chan uint
+
+func (tracer attemptTracer) StartAttempt(req *http.Request, ordinal int, attempt uint) func(resp *http.Response, err error) {
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	tracer <- attempt
+	return nil
+}
+
+// Reader without a known length, so requests of it have no GetBody
+type opaqueReader struct {
+	io.Reader
+}
+
+// The caller's request is left as it was after being sent, retried and answered, with or without a GetBody
+func TestDoLeavesRequest(t *testing.T) {
+	received := make(chan string, 1)
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r.URL.RequestURI() + " " + string(body)
+	}))
+
+	defer recipient.Close()
+
+	for name, body := range map[string]io.Reader{"buffered": opaqueReader{strings.NewReader("order")}, "GetBody": strings.NewReader("order")} {
+		t.Run(name, func(t *testing.T) {
+			server := proxytest.NewServer()
+			defer server.Close()
+
+			p := newReadySender(t, server, client.Config{Attempts: 3})
+
+			tracer := make(attemptTracer, 3)
+			p.SetTracer(tracer)
+
+			req, _ := http.NewRequest(http.MethodPut, recipient.URL+"/orders?id=1", body)
+			req.Header.Set("X-Request-Id", "request")
+
+			header, u, requestBody, getBody := req.Header.Clone(), *req.URL, req.Body, req.GetBody != nil
+
+			// The first attempt to the pod is refused, the retry going through the service
+			server.Kill(0)
+
+			resp, err := p.Do(server.HTTPClient(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp.Body.Close()
+
+			if len(tracer) != 2 {
+				t.Errorf("made %v attempts, expected a retry", len(tracer))
+			}
+
+			if sent := <-received; sent != "/orders?id=1 order" {
+				t.Errorf("the recipient received %q, expected the caller's URI and body", sent)
+			}
+
+			if !reflect.DeepEqual(req.Header, header) {
+				t.Errorf("got the caller's header %v after Do, expected %v", req.Header, header)
+			}
+
+			if *req.URL != u || req.Host != u.Host {
+				t.Errorf("got the caller's URL %v and host %v after Do, expected %v", req.URL, req.Host, u.String())
+			}
+
+			if req.Body != requestBody || (req.GetBody != nil) != getBody {
+				t.Errorf("the caller's body was replaced")
+			}
+
+			if resp.Request == req {
+				t.Errorf("the response's request is the caller's, expected the last attempt's clone")
+			}
+		})
+	}
+}
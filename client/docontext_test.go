@@ -0,0 +1,96 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Returns a sender knowing the pods of the server
+func newReadySender(t *testing.T, server *proxytest.Server, config client.Config) *client.Proxy {
+	config.PingClient = server.HTTPClient()
+
+	p, err := client.NewWithConfig(server.URL, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(p.Destroy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := p.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// The attempt in flight stops once the context is done, rather than waiting for the recipient
+func TestDoContextDeadline(t *testing.T) {
+	server := proxytest.NewServerWithConfig(proxytest.Config{ProxyTimeout: 5 * time.Second})
+	defer server.Close()
+
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+
+	defer recipient.Close()
+
+	p := newReadySender(t, server, client.Config{Attempts: 5})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequest(http.MethodGet, recipient.URL, nil)
+
+	start := time.Now()
+	_, err := p.DoContext(ctx, server.HTTPClient(), req)
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("DoContext returned after %v, past its deadline", elapsed)
+	}
+
+	var proxyErr *client.ProxyError
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &proxyErr) || proxyErr.Kind != client.ErrorTimeout {
+		t.Errorf("got %v, expected a *ProxyError wrapping the deadline", err)
+	}
+
+	// The request's own context is left as it was
+	if req.Context() != context.Background() {
+		t.Errorf("the caller's request got another context")
+	}
+}
+
+// Requests whose context is already canceled are not sent
+func TestDoContextCanceled(t *testing.T) {
+	server := proxytest.NewServer()
+	defer server.Close()
+
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer recipient.Close()
+
+	p := newReadySender(t, server, client.Config{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req, _ := http.NewRequest(http.MethodGet, recipient.URL, nil)
+	if _, err := p.DoContext(ctx, server.HTTPClient(), req); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, expected the context's error", err)
+	}
+
+	if requests := server.Pod(0).Requests(); requests != 0 {
+		t.Errorf("the pod forwarded %v requests of a canceled context", requests)
+	}
+}
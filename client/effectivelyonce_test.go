@@ -0,0 +1,287 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Recipient counting the requests it received by path, taking the delay before responding
+type countingRecipient struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received map[string]int
+	delay    time.Duration
+}
+
+func newCountingRecipient(t *testing.T, delay time.Duration) *countingRecipient {
+	r := &countingRecipient{received: map[string]int{}, delay: delay}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		r.received[req.URL.Path]++
+		r.mu.Unlock()
+
+		time.Sleep(r.delay)
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	t.Cleanup(r.Close)
+	return r
+}
+
+// Waits for the recipient to receive the request with the path, then for duplicates to arrive, returning the number
+// of times it was received
+func (r *countingRecipient) await(path string) int {
+	count := func() int {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		return r.received[path]
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); count() == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	time.Sleep(r.delay + 200*time.Millisecond)
+	return count()
+}
+
+// Spool of a sender crashing before it records the proxies' responses, so its requests are left in it
+type crashingSpool struct {
+	client.Spool
+}
+
+func (s crashingSpool) Remove(key string) error {
+	return nil
+}
+
+// Returns a sender in the effectively-once mode with the spool
+func newEffectivelyOnceSender(t *testing.T, server *proxytest.Server, spool client.Spool) *client.Proxy {
+	p, err := client.NewWithConfig(server.URL, client.Config{
+		Spool:           spool,
+		SpoolClient:     server.HTTPClient(),
+		PingClient:      server.HTTPClient(),
+		EffectivelyOnce: true,
+		AttemptTimeout:  time.Second,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(p.Destroy)
+	return p
+}
+
+// Waits for the spool to be emptied by the resubmission of its requests
+func awaitEmptySpool(t *testing.T, spool client.Spool) {
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		requests, err := spool.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(requests) == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%v requests are left in the spool", len(requests))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEffectivelyOnceRequiresSpool(t *testing.T) {
+	if _, err := client.NewWithConfig("http://proxy.test:8080/", client.Config{EffectivelyOnce: true}); err == nil {
+		t.Errorf("made an effectively-once proxy without a spool")
+	}
+}
+
+// Attempts timing out while the recipient processes the request are retried at the pod deduplicating them
+func TestEffectivelyOnceRetry(t *testing.T) {
+	server := proxytest.NewServerWithConfig(proxytest.Config{Pods: 3, ProxyTimeout: 500 * time.Millisecond})
+	defer server.Close()
+
+	recipient := newCountingRecipient(t, 200*time.Millisecond)
+
+	spool, err := client.NewFileSpool(filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := client.NewWithConfig(server.URL, client.Config{
+		Spool:           spool,
+		SpoolClient:     server.HTTPClient(),
+		PingClient:      server.HTTPClient(),
+		EffectivelyOnce: true,
+		AttemptTimeout:  50 * time.Millisecond,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Destroy()
+
+	req, _ := http.NewRequest(http.MethodPost, recipient.URL+"/retry", strings.NewReader("body"))
+	resp, err := p.Do(server.HTTPClient(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if count := recipient.await("/retry"); count != 1 {
+		t.Errorf("the recipient received the request %v times", count)
+	}
+
+	awaitEmptySpool(t, spool)
+}
+
+// Senders restarting with requests left in their spool, whether they reached the recipient, are still in flight or
+// were never sent, send them again, and the recipient receives each once
+func TestEffectivelyOnceRestart(t *testing.T) {
+	for _, c := range []struct {
+		name string
+
+		// Whether the crashed sender sent the request, and the time after which it crashed
+		sent  bool
+		crash time.Duration
+
+		// Number of restarts crashing again before the one resubmitting the request
+		crashes int
+	}{
+		{"delivered", true, 0, 0},
+		{"in flight", true, 50 * time.Millisecond, 0},
+		{"unsent", false, 0, 0},
+		{"crashing again", true, 0, 2},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server := proxytest.NewServerWithConfig(proxytest.Config{Pods: 3, ProxyTimeout: 500 * time.Millisecond})
+			defer server.Close()
+
+			recipient := newCountingRecipient(t, 200*time.Millisecond)
+			path := filepath.Join(t.TempDir(), "spool")
+			target := recipient.URL + "/" + strings.Replace(c.name, " ", "-", -1)
+
+			spool, err := client.NewFileSpool(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.sent {
+				p := newEffectivelyOnceSender(t, server, crashingSpool{spool})
+
+				ctx := context.Background()
+				if c.crash > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, c.crash)
+					defer cancel()
+				}
+
+				req, _ := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader("body"))
+				if resp, err := p.Do(server.HTTPClient(), req); err == nil {
+					resp.Body.Close()
+				} else if c.crash == 0 {
+					t.Fatal(err)
+				}
+
+				p.Destroy()
+			} else {
+				err := spool.Add(&client.SpooledRequest{
+					Key:    "unsent",
+					Method: http.MethodPost,
+					URL:    target,
+					Body:   []byte("body"),
+					Added:  time.Now(),
+				})
+
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if requests, err := spool.Load(); err != nil || len(requests) != 1 {
+				t.Fatalf("got %v requests in the spool (%v), expected the crashed sender's", len(requests), err)
+			}
+
+			for i := 0; i < c.crashes; i++ {
+				spool, err := client.NewFileSpool(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				p := newEffectivelyOnceSender(t, server, crashingSpool{spool})
+				time.Sleep(100 * time.Millisecond)
+				p.Destroy()
+			}
+
+			spool, err = client.NewFileSpool(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			newEffectivelyOnceSender(t, server, spool)
+			awaitEmptySpool(t, spool)
+
+			if count := recipient.await(target[len(recipient.URL):]); count != 1 {
+				t.Errorf("the recipient received the request %v times", count)
+			}
+		})
+	}
+}
+
+// Keyed requests fail rather than going to the service while no pod is found, also without a budget
+func TestEffectivelyOnceNoPods(t *testing.T) {
+	spool, err := client.NewFileSpool(filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := client.NewWithConfig("http://127.0.0.1:1/", client.Config{
+		Spool:           spool,
+		EffectivelyOnce: true,
+		RequestBudget:   -1,
+		Attempts:        2,
+		PingInterval:    50 * time.Millisecond,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Destroy()
+
+	done := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPost, "http://recipient.test/", strings.NewReader("body"))
+		resp, err := p.Do(http.DefaultClient, req)
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, client.ErrAllPodsDead) {
+			t.Errorf("got error %v, expected one matching ErrAllPodsDead", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the request is still waiting for a pod")
+	}
+}
@@ -0,0 +1,242 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ProxyError is the error of a request to the proxies, carrying the context it failed in
+// It wraps the underlying error, so both can be inspected with errors.As and errors.Is
+type ProxyError struct {
+	// Op is the operation of the client that failed: Do, Ensure or ping
+	Op string
+
+	// Phase is the phase the operation failed in: select (choosing a pod), send (the request failed), parse
+	// (the response's Proxy-* headers were invalid) or status (the proxy answered with an unexpected Proxy-Status)
+	Phase string
+
+	// Ordinal is the ordinal of the pod the request was sent to, -1 if it was sent to the service
+	Ordinal int
+
+	// IP is the IP of the pod, or the host of the service, the request was sent to
+	IP string
+
+	// Attempt is the attempt that failed, starting at 1
+	Attempt uint
+
+	// Status is the Proxy-Status of the response, 0 if there was none
+	Status int
+
+	// Kind classifies the underlying error, ErrorOther if it is not a network error
+	Kind ErrorKind
+
+	// Err is the underlying error
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	target := "service"
+	if e.Ordinal >= 0 {
+		target = fmt.Sprintf("pod %v", e.Ordinal)
+	}
+
+	if e.IP != "" {
+		target += fmt.Sprintf(" (%v)", e.IP)
+	}
+
+	return fmt.Sprintf("proxy %v: %v, %v, attempt %v: %v", e.Op, e.Phase, target, e.Attempt, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the error of the operation's phase against the pod at the URL, nil if err is
+func newProxyError(op string, phase string, ordinal int, u *url.URL, attempt uint, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	e := &ProxyError{Op: op, Phase: phase, Ordinal: ordinal, Attempt: attempt, Kind: classifyError(err), Err: err}
+	if u != nil {
+		e.IP = u.Hostname()
+	}
+
+	return e
+}
+
+// ErrorKind classifies the network errors of requests to the proxies
+type ErrorKind int
+
+const (
+	// ErrorOther is any other error
+	ErrorOther ErrorKind = iota
+
+	// ErrorTimeout is a timeout, of the connection or of the attempt (Config.AttemptTimeout)
+	ErrorTimeout
+
+	// ErrorRefused is a refused connection, the pod never received the request
+	ErrorRefused
+
+	// ErrorReset is a connection reset or broken by the pod
+	ErrorReset
+
+	// ErrorDNS is a failure to resolve the host
+	ErrorDNS
+
+	// ErrorCanceled is a request canceled through its context
+	ErrorCanceled
+
+	errorKinds
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorTimeout:
+		return "timeout"
+	case ErrorRefused:
+		return "refused"
+	case ErrorReset:
+		return "reset"
+	case ErrorDNS:
+		return "dns"
+	case ErrorCanceled:
+		return "canceled"
+	default:
+		return "other"
+	}
+}
+
+// Classifies the error by its type rather than its message
+func classifyError(err error) ErrorKind {
+	var dnsErr *net.DNSError
+	var timeoutErr interface{ Timeout() bool }
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE):
+		return ErrorReset
+	case errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	case errors.As(err, &timeoutErr) && timeoutErr.Timeout():
+		return ErrorTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	default:
+		return ErrorOther
+	}
+}
+
+// Error of an attempt exceeding Config.AttemptTimeout
+type attemptTimeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *attemptTimeoutError) Error() string {
+	return fmt.Sprintf("attempt timed out after %v: %v", e.timeout, e.err)
+}
+
+func (e *attemptTimeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *attemptTimeoutError) Timeout() bool {
+	return true
+}
+
+// Error matching a sentinel error, besides the errors it wraps, keeping their message
+type sentinelError struct {
+	sentinel error
+	err      error
+}
+
+func (e *sentinelError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sentinelError) Unwrap() error {
+	return e.err
+}
+
+func (e *sentinelError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+// ErrClosed is returned by the proxy's requests once it is destroyed
+var ErrClosed = errors.New("proxy is destroyed")
+
+// ErrProxyDestroyed is ErrClosed, named like the other errors of failed requests
+var ErrProxyDestroyed = ErrClosed
+
+// ErrAllPodsDead is matched by the errors of Do failing against the service, which requests go to while no live pod
+// is known, e.g. once every known pod failed
+var ErrAllPodsDead = errors.New("no live pod is known")
+
+// ErrInvalidProxyHeaders is matched by the errors of responses with invalid Proxy-* headers, or none at all, e.g. of
+// a server other than the proxies
+var ErrInvalidProxyHeaders = errors.New("response has invalid proxy headers")
+
+// ErrAttemptsExhausted is matched by the errors of Do failing on its last attempt, by Config.Attempts, or past
+// Config.RequestBudget, with an error that would have been retried otherwise
+var ErrAttemptsExhausted = errors.New("attempts are exhausted")
+
+// ErrBuffered is returned by Do for requests buffered while the proxies were unreachable, with Config.OfflineBuffer
+// They are sent once a pod responds again, and their responses discarded
+var ErrBuffered = errors.New("proxies are unreachable, request buffered")
+
+// ErrNoRoute is returned by Router.Do for requests no route matches
+var ErrNoRoute = errors.New("no route matches the request")
+
+// ErrUnknownDelivery is returned by Delivery for requests the proxies do not know, e.g. forgotten past their affinityTTL
+var ErrUnknownDelivery = errors.New("proxies do not know the request")
+
+// ErrDeliveryLost is returned by Delivery for requests whose proxy is gone, which only kept their outcome in memory
+var ErrDeliveryLost = errors.New("proxy holding the request is gone")
+
+// ErrMaxScaleReached is returned by Ensure when the proxies are at their maximum number of pods and can not scale up
+// for the requests. Ensure then returns it without sending requests until the proxies report headroom again, e.g. once
+// their maxProxies is raised
+var ErrMaxScaleReached = errors.New("proxies are at their maximum scale")
+
+// ErrEnsureCooldown is returned by Ensure without sending a request within Config.EnsureCooldown of the previous one
+var ErrEnsureCooldown = errors.New("ensure request is cooling down")
+
+// ErrDenied is returned by DoJSON when the proxies were saturated and denied the request (a 429)
+var ErrDenied = errors.New("proxy denied the request")
+
+// AcceptedError is returned by DoJSON when the recipient did not respond within the proxies' timeout (a 202)
+// The recipient still processes the request, whose outcome can be followed up on with the affinity token
+type AcceptedError struct {
+	// Affinity is the Proxy-Affinity token of the request, empty if the proxies did not keep its outcome
+	Affinity string
+
+	// RequestID is the Proxy-Request-Id of the request
+	RequestID string
+}
+
+func (e *AcceptedError) Error() string {
+	return "proxy accepted the request without the recipient's response"
+}
+
+// StatusError is returned by DoJSON when the recipient, or the proxies, answered with a status other than 2xx
+type StatusError struct {
+	// StatusCode is the status of the response
+	StatusCode int
+
+	// Body is the start of the response's body
+	Body []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %v: %s", e.StatusCode, e.Body)
+}
@@ -0,0 +1,103 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Responses of servers other than the proxies match ErrInvalidProxyHeaders
+func TestErrInvalidProxyHeaders(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer service.Close()
+
+	p, err := client.NewWithConfig(service.URL, client.Config{Attempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Destroy()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://recipient.test/", nil)
+	_, err = p.Do(service.Client(), req)
+
+	var proxyErr *client.ProxyError
+	if !errors.Is(err, client.ErrInvalidProxyHeaders) || !errors.As(err, &proxyErr) {
+		t.Errorf("got %v, expected a *ProxyError matching ErrInvalidProxyHeaders", err)
+	}
+}
+
+// Requests failing against the service, while no pod is known, match ErrAllPodsDead
+func TestErrAllPodsDead(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	service.Close()
+
+	p, err := client.NewWithConfig(service.URL, client.Config{Attempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Destroy()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://recipient.test/", nil)
+	if _, err := p.Do(http.DefaultClient, req); !errors.Is(err, client.ErrAllPodsDead) {
+		t.Errorf("got %v, expected ErrAllPodsDead", err)
+	}
+}
+
+// Requests failing on their last attempt match ErrAttemptsExhausted, and still unwrap to the attempt's error
+func TestErrAttemptsExhausted(t *testing.T) {
+	server := proxytest.NewServerWithConfig(proxytest.Config{Pods: 3})
+	defer server.Close()
+
+	p, err := client.NewWithConfig(server.URL, client.Config{Attempts: 2, PingClient: server.HTTPClient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Destroy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := p.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for ordinal := 0; ordinal < 3; ordinal++ {
+		server.Kill(ordinal)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://recipient.test/", nil)
+	_, err = p.Do(server.HTTPClient(), req)
+
+	var proxyErr *client.ProxyError
+	if !errors.Is(err, client.ErrAttemptsExhausted) || !errors.As(err, &proxyErr) || proxyErr.Attempt != 2 {
+		t.Fatalf("got %v, expected the second attempt's error matching ErrAttemptsExhausted", err)
+	}
+
+	if errors.Is(err, client.ErrAllPodsDead) || proxyErr.Kind != client.ErrorRefused {
+		t.Errorf("got %v of kind %v, expected a killed pod", err, proxyErr.Kind)
+	}
+}
+
+// Requests of destroyed proxies match ErrProxyDestroyed
+func TestErrProxyDestroyed(t *testing.T) {
+	p, err := client.New("http://proxy.test:8080/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Destroy()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://recipient.test/", nil)
+	if _, err := p.Do(http.DefaultClient, req); !errors.Is(err, client.ErrProxyDestroyed) || !errors.Is(err, client.ErrClosed) {
+		t.Errorf("got %v, expected ErrProxyDestroyed", err)
+	}
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"net/http"
+	"time"
+)
+
+// Metrics receives the measurements of the proxy's requests, set with SetMetrics
+// Its methods are called concurrently, on the paths of the requests, so they must be quick
+type Metrics interface {
+	// Attempt is called after each attempt of Do, with the ordinal of its pod (-1 for the service), the Proxy-Status
+	// of its response (0 if it failed or had none), its error (a *ProxyError, whose Kind classifies it) or nil, and
+	// its latency until the response's headers
+	Attempt(ordinal int, status int, err error, latency time.Duration)
+
+	// Ping is called after each ping, with the ordinal of its pod (-1 for the service), whether it succeeded and its
+	// latency
+	Ping(ordinal int, ok bool, latency time.Duration)
+}
+
+// Tracer traces the attempts of Do, set with SetTracer
+type Tracer interface {
+	// StartAttempt is called before each attempt of Do is sent, with the request it sends, whose headers it may set
+	// (e.g. a traceparent), and returns the function called with the attempt's outcome
+	StartAttempt(req *http.Request, ordinal int, attempt uint) func(resp *http.Response, err error)
+}
+
+// Holders of the hooks, as an atomic.Value only stores values of one concrete type
+type metricsHolder struct{ Metrics }
+type tracerHolder struct{ Tracer }
+
+// SetMetrics sets the metrics the proxy's requests report to, nil to stop reporting
+// It can be called at any time, while disabled the requests only pay for an atomic load
+func (p *Proxy) SetMetrics(metrics Metrics) {
+	p.metrics.Store(metricsHolder{metrics})
+}
+
+// SetTracer sets the tracer of the proxy's requests, nil to stop tracing
+// It can be called at any time, while disabled the requests only pay for an atomic load
+func (p *Proxy) SetTracer(tracer Tracer) {
+	p.tracer.Store(tracerHolder{tracer})
+}
+
+// Returns the metrics set, nil if there are none
+func (p *Proxy) loadMetrics() Metrics {
+	holder, _ := p.metrics.Load().(metricsHolder)
+	return holder.Metrics
+}
+
+// Returns the tracer set, nil if there is none
+func (p *Proxy) loadTracer() Tracer {
+	holder, _ := p.tracer.Load().(tracerHolder)
+	return holder.Tracer
+}
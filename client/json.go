@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// MaxStatusErrorBody is the maximum number of bytes of a response's body kept in a StatusError
+const MaxStatusErrorBody = 4096
+
+// DoJSON sends the request through the proxies like DoContext, and decodes a 2xx response's JSON body
+// into a new T, returning it with the response's status
+// A 202 of the proxies returns an *AcceptedError, a 429 ErrDenied and other statuses a *StatusError, each with a nil
+// result. An empty body also returns a nil result
+func DoJSON[T any](ctx context.Context, p *Proxy, client *http.Client, req *http.Request) (*T, int, error) {
+	resp, err := p.DoContext(ctx, client, req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer resp.Body.Close()
+
+	switch proxyStatus, _ := strconv.Atoi(resp.Header.Get("Proxy-Status")); proxyStatus {
+	case http.StatusAccepted:
+		return nil, http.StatusAccepted, &AcceptedError{
+			Affinity:  resp.Header.Get("Proxy-Affinity"),
+			RequestID: resp.Header.Get("Proxy-Request-Id"),
+		}
+	case http.StatusTooManyRequests:
+		return nil, http.StatusTooManyRequests, ErrDenied
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, MaxStatusErrorBody))
+		return nil, resp.StatusCode, &StatusError{StatusCode: resp.StatusCode, Body: body}
+	}
+
+	var result T
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		if err == io.EOF {
+			return nil, resp.StatusCode, nil
+		}
+
+		return nil, resp.StatusCode, fmt.Errorf("error decoding the response: %w", err)
+	}
+
+	return &result, resp.StatusCode, nil
+}
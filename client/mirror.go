@@ -0,0 +1,52 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+)
+
+// Returns whether the request is to be mirrored to the MirrorURL
+func (p *Proxy) shouldMirror() bool {
+	return p.mirrorURL != nil && p.Config.MirrorPercent > 0 && rand.Float64()*100 < p.Config.MirrorPercent
+}
+
+// Mirrors the request to the MirrorURL through the proxies in the background, discarding the response
+// Returns the request to send instead of the caller's, whose body is buffered if it can not be read again
+func (p *Proxy) mirror(client *http.Client, req *http.Request) (*http.Request, error) {
+	req, err := withGetBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The mirrored request outlives the caller's, until the proxy is destroyed
+	shadow := req.Clone(p.ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+
+		shadow.Body = body
+	}
+
+	shadowURL := *req.URL
+	shadowURL.Scheme = p.mirrorURL.Scheme
+	shadowURL.Host = p.mirrorURL.Host
+	shadow.URL = &shadowURL
+	shadow.Host = ""
+
+	go func() {
+		resp, err := p.do(client, shadow)
+		if err != nil {
+			p.debugPrint(2, "Failed to mirror request to %v: %v", shadowURL.Host, err)
+			return
+		}
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	return req, nil
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OfflineStats are the counts of the requests buffered while the proxies were unreachable
+type OfflineStats struct {
+	// Buffered is the number of requests buffered, and Queued the number still in the buffer
+	Buffered uint64
+	Queued   int
+
+	// Flushed is the number of buffered requests sent once the proxies were reachable again
+	Flushed uint64
+
+	// Dropped is the number of requests dropped, as the buffer was full or they expired before being flushed
+	Dropped uint64
+}
+
+// A request buffered while the proxies were unreachable
+type offlineRequest struct {
+	client  *http.Client
+	req     *http.Request
+	expires time.Time
+
+	// spoolKey is the key of the request in the Config.Spool, empty if it is not spooled
+	spoolKey string
+}
+
+// Requests buffered while the proxies were unreachable, flushed in order once a pod responds again
+type offlineBuffer struct {
+	sync.Mutex
+	requests []offlineRequest
+
+	// flushing is 1 while the buffer is flushed, accessed atomically
+	flushing int32
+
+	buffered uint64
+	flushed  uint64
+	dropped  uint64
+}
+
+// Returns whether the request failed as the proxies could not be reached, and can be sent again later
+// Like retries, requests the proxies may have received before a timeout or reset are only sent again if idempotent
+func (p *Proxy) canBuffer(req *http.Request, err error) bool {
+	var proxyErr *ProxyError
+	if !errors.As(err, &proxyErr) || proxyErr.Phase != "send" {
+		return false
+	}
+
+	switch proxyErr.Kind {
+	case ErrorRefused, ErrorDNS:
+		return true
+	case ErrorTimeout, ErrorReset:
+		return p.Config.RetryNonIdempotent || isIdempotent(req)
+	default:
+		return false
+	}
+}
+
+// Buffers the request, whose attempts failed to reach the proxies, returning false if the buffer is full
+func (p *Proxy) bufferOffline(client *http.Client, req *http.Request, spoolKey string) bool {
+	b := &p.offline
+
+	// The buffered request outlives the caller's, until the proxy is destroyed
+	buffered := req.Clone(p.ctx)
+
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.requests) >= p.Config.OfflineBuffer {
+		atomic.AddUint64(&b.dropped, 1)
+		return false
+	}
+
+	b.requests = append(b.requests, offlineRequest{client: client, req: buffered, expires: p.clock().Now().Add(p.Config.OfflineTTL), spoolKey: spoolKey})
+	atomic.AddUint64(&b.buffered, 1)
+	return true
+}
+
+// Flushes the buffered requests in the background, once a pod responded again
+func (p *Proxy) flushOffline() {
+	b := &p.offline
+
+	b.Lock()
+	empty := len(b.requests) == 0
+	b.Unlock()
+
+	if empty || !atomic.CompareAndSwapInt32(&b.flushing, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&b.flushing, 0)
+
+		for !p.Closed() {
+			b.Lock()
+			if len(b.requests) == 0 {
+				b.Unlock()
+				return
+			}
+
+			next := b.requests[0]
+			b.requests = b.requests[1:]
+			b.Unlock()
+
+			if p.clock().Now().After(next.expires) {
+				atomic.AddUint64(&b.dropped, 1)
+				continue
+			}
+
+			req := next.req
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					atomic.AddUint64(&b.dropped, 1)
+					continue
+				}
+
+				req = req.Clone(p.ctx)
+				req.Body = body
+			}
+
+			resp, err := p.do(next.client, req)
+			if err != nil {
+				// Unreachable again, keep it first in line for the next flush
+				if p.canBuffer(req, err) {
+					b.Lock()
+					b.requests = append([]offlineRequest{next}, b.requests...)
+					b.Unlock()
+					return
+				}
+
+				p.debugPrint(1, "Failed to flush buffered request to %v: %v", req.URL, err)
+				atomic.AddUint64(&b.dropped, 1)
+				if next.spoolKey != "" {
+					p.unspool(next.spoolKey)
+				}
+
+				continue
+			}
+
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if next.spoolKey != "" {
+				p.unspool(next.spoolKey)
+			}
+
+			atomic.AddUint64(&b.flushed, 1)
+		}
+	}()
+}
+
+// OfflineStats returns the counts of the requests buffered while the proxies were unreachable
+func (p *Proxy) OfflineStats() OfflineStats {
+	b := &p.offline
+
+	b.Lock()
+	queued := len(b.requests)
+	b.Unlock()
+
+	return OfflineStats{
+		Buffered: atomic.LoadUint64(&b.buffered),
+		Queued:   queued,
+		Flushed:  atomic.LoadUint64(&b.flushed),
+		Dropped:  atomic.LoadUint64(&b.dropped),
+	}
+}
@@ -0,0 +1,124 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Returns a sender knowing the pods of the fixture, pinging them often so it notices them respond again
+func newOfflineSender(t *testing.T, f *proxytest.Fixture, config client.Config) *client.Proxy {
+	config.Client = f.Client()
+	config.PingClient = f.Client()
+	config.Attempts = 1
+	config.PingInterval = 20 * time.Millisecond
+	config.MaxPingBackoff = 40 * time.Millisecond
+
+	p, err := client.NewWithConfig(f.URL, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(p.Destroy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := p.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// Returns the Forward-To of the requests the pod forwarded
+func forwarded(f *proxytest.Fixture, pod *proxytest.FixturePod) []string {
+	f.Lock()
+	defer f.Unlock()
+
+	var targets []string
+	for _, req := range pod.Requests {
+		targets = append(targets, req.Header.Get("Forward-To"))
+	}
+
+	return targets
+}
+
+// Waits for the offline stats to satisfy the condition, returning them
+func awaitOfflineStats(p *client.Proxy, condition func(stats client.OfflineStats) bool) client.OfflineStats {
+	for deadline := time.Now().Add(5 * time.Second); !condition(p.OfflineStats()) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return p.OfflineStats()
+}
+
+// Requests failing to reach the proxies are buffered up to OfflineBuffer, and sent in order once a pod responds again
+func TestOfflineBufferFlushed(t *testing.T) {
+	f := proxytest.NewFixture(1, 10)
+	p := newOfflineSender(t, f, client.Config{OfflineBuffer: 2})
+
+	f.Kill(0)
+
+	for i, target := range []string{"http://recipient.test/first", "http://recipient.test/second", "http://recipient.test/third"} {
+		req, _ := http.NewRequest(http.MethodPost, target, strings.NewReader(target))
+
+		_, err := p.Do(f.Client(), req)
+		if i < 2 && err != client.ErrBuffered {
+			t.Fatalf("got %v for %v, expected ErrBuffered", err, target)
+		}
+
+		// The buffer is full
+		var proxyErr *client.ProxyError
+		if i == 2 && (errors.Is(err, client.ErrBuffered) || !errors.As(err, &proxyErr) || proxyErr.Kind != client.ErrorRefused) {
+			t.Fatalf("got %v for %v, expected the refused connection", err, target)
+		}
+	}
+
+	if stats := p.OfflineStats(); stats.Buffered != 2 || stats.Queued != 2 || stats.Dropped != 1 || stats.Flushed != 0 {
+		t.Fatalf("got %+v while offline", stats)
+	}
+
+	// Once the pod is back the pod list was cleared, so the service answers the pings
+	f.Pod(0).Restart()
+
+	if stats := awaitOfflineStats(p, func(stats client.OfflineStats) bool { return stats.Flushed == 2 }); stats.Flushed != 2 || stats.Queued != 0 {
+		t.Fatalf("got %+v once the pod responds again", stats)
+	}
+
+	if targets := forwarded(f, f.Pod(0)); strings.Join(targets, ",") != "http://recipient.test/first,http://recipient.test/second" {
+		t.Errorf("the pod forwarded %v, expected the buffered requests in order", targets)
+	}
+}
+
+// Buffered requests older than OfflineTTL are dropped rather than sent
+func TestOfflineBufferExpired(t *testing.T) {
+	f := proxytest.NewFixture(1, 10)
+
+	clock := &offsetClock{}
+	p := newOfflineSender(t, f, client.Config{OfflineBuffer: 1, OfflineTTL: time.Minute, Clock: clock})
+
+	f.Kill(0)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://recipient.test/expired", nil)
+	if _, err := p.Do(f.Client(), req); err != client.ErrBuffered {
+		t.Fatalf("got %v, expected ErrBuffered", err)
+	}
+
+	clock.advance(2 * time.Minute)
+	f.Pod(0).Restart()
+
+	if stats := awaitOfflineStats(p, func(stats client.OfflineStats) bool { return stats.Dropped == 1 }); stats.Dropped != 1 || stats.Flushed != 0 || stats.Queued != 0 {
+		t.Errorf("got %+v, expected the request dropped", stats)
+	}
+
+	if targets := forwarded(f, f.Pod(0)); len(targets) != 0 {
+		t.Errorf("the pod forwarded %v after they expired", targets)
+	}
+}
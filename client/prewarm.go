@@ -0,0 +1,242 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrewarmSchedule ensures requests ahead of a known traffic peak, e.g. 40 requests from 09:00 on weekdays, so the
+// first burst is not denied while the proxies scale up
+type PrewarmSchedule struct {
+	// Spec is when the schedule triggers, as a cron spec of minute, hour, day of month, month and day of week (0 or 7
+	// being Sunday), e.g. "0 9 * * 1-5". Fields are *, values, ranges and lists of them, each with an optional /step
+	Spec string
+
+	// Requests is the number of requests ensured
+	Requests int
+
+	// Duration is the time the requests are ensured for from each trigger, after which the expectation is released
+	// and the proxies scale down once idle, default 1 hour
+	Duration time.Duration
+
+	// Location is the time zone of the Spec, default the local one
+	Location *time.Location
+}
+
+// A parsed schedule, and its next trigger and the end of its current window
+type prewarm struct {
+	schedule PrewarmSchedule
+	spec     *cronSpec
+
+	next  time.Time
+	until time.Time
+}
+
+// Parses the schedules of the config
+func parsePrewarmSchedules(schedules []PrewarmSchedule) ([]*prewarm, error) {
+	var prewarms []*prewarm
+	for _, schedule := range schedules {
+		spec, err := parseCronSpec(schedule.Spec)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing Prewarm %q: %w", schedule.Spec, err)
+		}
+
+		if schedule.Duration == 0 {
+			schedule.Duration = time.Hour
+		}
+
+		if schedule.Location == nil {
+			schedule.Location = time.Local
+		}
+
+		prewarms = append(prewarms, &prewarm{schedule: schedule, spec: spec})
+	}
+
+	return prewarms, nil
+}
+
+// Ensures the requests of the schedules during their windows, every PrewarmInterval, until the proxy is destroyed
+func (p *Proxy) runPrewarm(prewarms []*prewarm) {
+	now := p.clock().Now()
+	for _, prewarm := range prewarms {
+		prewarm.next = prewarm.spec.next(now.In(prewarm.schedule.Location))
+	}
+
+	ticker := p.newTicker(p.Config.PrewarmInterval)
+	defer ticker.Stop()
+
+	for {
+		now := p.clock().Now()
+
+		// Overlapping windows ensure the largest of their requests
+		requests := 0
+		for _, prewarm := range prewarms {
+			if !prewarm.next.IsZero() && !now.Before(prewarm.next) {
+				prewarm.until = prewarm.next.Add(prewarm.schedule.Duration)
+				prewarm.next = prewarm.spec.next(now.In(prewarm.schedule.Location))
+			}
+
+			if now.Before(prewarm.until) && prewarm.schedule.Requests > requests {
+				requests = prewarm.schedule.Requests
+			}
+		}
+
+		if requests > 0 {
+			p.debugPrint(2, "Prewarming %v requests", requests)
+
+			err := p.Ensure(p.client(), requests)
+			if errors.Is(err, ErrClosed) {
+				return
+			}
+
+			if err != nil {
+				p.debugPrint(1, "Failed to prewarm %v requests: %v", requests, err)
+			}
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// Cron spec, the allowed values of each field
+type cronSpec struct {
+	minutes, hours, days, months, weekdays uint64
+
+	// Restricted days of month and of week match when either does, like cron
+	anyDay, anyWeekday bool
+}
+
+// Parses a cron spec of minute, hour, day of month, month and day of week
+func parseCronSpec(spec string) (*cronSpec, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %v", len(fields))
+	}
+
+	var s cronSpec
+	var err error
+	for i, field := range []struct {
+		value    *uint64
+		min, max int
+	}{
+		{&s.minutes, 0, 59},
+		{&s.hours, 0, 23},
+		{&s.days, 1, 31},
+		{&s.months, 1, 12},
+		{&s.weekdays, 0, 7},
+	} {
+		if *field.value, err = parseCronField(fields[i], field.min, field.max); err != nil {
+			return nil, err
+		}
+	}
+
+	// Sunday is both 0 and 7
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays |= 1
+	}
+
+	s.anyDay = fields[2] == "*"
+	s.anyWeekday = fields[4] == "*"
+
+	return &s, nil
+}
+
+// Parses a field of a cron spec as a bit set of its values
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var values uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", field)
+			}
+
+			part = part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", field)
+			}
+
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range in %q", field)
+				}
+			} else if step > 1 {
+				// A value with a step starts a range to the maximum
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is not in [%v, %v]", field, min, max)
+		}
+
+		for value := start; value <= end; value += step {
+			values |= 1 << uint(value)
+		}
+	}
+
+	return values, nil
+}
+
+// Returns whether the spec triggers at the minute
+func (s *cronSpec) matches(t time.Time) bool {
+	return s.minutes&(1<<uint(t.Minute())) != 0 && s.matchesHour(t)
+}
+
+// Returns whether the spec triggers within the hour
+func (s *cronSpec) matchesHour(t time.Time) bool {
+	if s.hours&(1<<uint(t.Hour())) == 0 || s.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	}
+
+	return day || weekday
+}
+
+// Returns the first minute after t the spec triggers at, in t's location, the zero time if none within 5 years
+func (s *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		// Skip the hours the spec does not trigger within, rather than every minute of them
+		if !s.matchesHour(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.matches(t) {
+			return t
+		}
+
+		t = t.Add(time.Minute)
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,114 @@
+package client_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Clock set by the test, whose tickers of an interval tick when the test sends on them
+type prewarmClock struct {
+	mu  sync.Mutex
+	now time.Time
+
+	interval time.Duration
+	ticks    chan time.Time
+}
+
+func (c *prewarmClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *prewarmClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (c *prewarmClock) NewTicker(d time.Duration) client.Ticker {
+	if d != c.interval {
+		return realTicker{time.NewTicker(d)}
+	}
+
+	return prewarmTicker{c.ticks}
+}
+
+// Sets the time and ticks, returning once the prewarm has handled a tick at the time
+func (c *prewarmClock) tick(now time.Time) {
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+
+	// The ticks are not buffered, so the second is only received once the prewarm is done with the first, while the
+	// prewarm may still be handling the second when this returns
+	c.ticks <- now
+	c.ticks <- now
+}
+
+type prewarmTicker struct {
+	ticks chan time.Time
+}
+
+func (t prewarmTicker) C() <-chan time.Time {
+	return t.ticks
+}
+
+func (t prewarmTicker) Stop() {}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// Schedules ensure their requests during their windows only
+func TestPrewarmWindow(t *testing.T) {
+	server := proxytest.NewServerWithConfig(proxytest.Config{MaxRequests: 10})
+	defer server.Close()
+
+	// Monday 08:59, a minute before the schedule triggers
+	monday := time.Date(2026, 10, 12, 8, 59, 0, 0, time.UTC)
+	clock := &prewarmClock{now: monday, interval: time.Hour, ticks: make(chan time.Time)}
+
+	newReadySender(t, server, client.Config{
+		Client:          server.HTTPClient(),
+		Clock:           clock,
+		PrewarmInterval: clock.interval,
+		Prewarm: []client.PrewarmSchedule{
+			{Spec: "0 9 * * 1-5", Requests: 30, Duration: 30 * time.Minute, Location: time.UTC},
+		},
+	})
+
+	clock.tick(monday.Add(30 * time.Second))
+	if pods := server.PodCount(); pods != 1 {
+		t.Fatalf("got %v pods before the window, expected 1", pods)
+	}
+
+	clock.tick(monday.Add(2 * time.Minute))
+	if pods := server.PodCount(); pods != 3 {
+		t.Fatalf("got %v pods during the window, expected 3", pods)
+	}
+
+	// Past the window the requests are no longer ensured, so the pods can scale down
+	clock.tick(monday.Add(45 * time.Minute))
+	server.Scale(1)
+	clock.tick(monday.Add(50 * time.Minute))
+	if pods := server.PodCount(); pods != 1 {
+		t.Errorf("got %v pods after the window, expected 1", pods)
+	}
+}
+
+func TestPrewarmInvalidSpec(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 9-5 * * *", "*/0 * * * *", "* * * * mon"} {
+		_, err := client.NewWithConfig("http://proxy.test:8080/", client.Config{Prewarm: []client.PrewarmSchedule{{Spec: spec, Requests: 1}}})
+		if err == nil {
+			t.Errorf("Prewarm %q was accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrometheusLatencyBuckets are the upper bounds (in seconds) of the attempt latency histogram buckets, the same as the
+// proxies' proxy_recipient_latency_seconds
+var PrometheusLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics are Metrics kept for Prometheus, served in its text exposition format
+// Their names share the proxy_ prefix of the proxies' metrics, and label pods by their ordinal like the proxies'
+// proxy_info, and Proxy-Statuses by code like their proxy_responses_total, so both sides of a request can be joined
+type PrometheusMetrics struct {
+	mu sync.Mutex
+
+	// attempts counts the attempts by ordinal and Proxy-Status, errors the failed ones by ordinal and kind, and
+	// pings the pings by ordinal and outcome
+	attempts map[[2]int]uint64
+	errors   map[prometheusErrorKey]uint64
+	pings    map[prometheusPingKey]uint64
+
+	latency struct {
+		Buckets []uint64
+		Count   uint64
+		Sum     float64
+	}
+}
+
+type prometheusErrorKey struct {
+	Ordinal int
+	Kind    string
+}
+
+type prometheusPingKey struct {
+	Ordinal int
+	OK      bool
+}
+
+// NewPrometheusMetrics returns metrics to set with SetMetrics, e.g. on several proxies, and serve on /metrics
+func NewPrometheusMetrics() *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		attempts: map[[2]int]uint64{},
+		errors:   map[prometheusErrorKey]uint64{},
+		pings:    map[prometheusPingKey]uint64{},
+	}
+
+	m.latency.Buckets = make([]uint64, len(PrometheusLatencyBuckets))
+	return m
+}
+
+func (m *PrometheusMetrics) Attempt(ordinal int, status int, err error, latency time.Duration) {
+	seconds := latency.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.attempts[[2]int{ordinal, status}]++
+
+	if err != nil {
+		kind := ErrorOther
+		var proxyErr *ProxyError
+		if errors.As(err, &proxyErr) {
+			kind = proxyErr.Kind
+		}
+
+		m.errors[prometheusErrorKey{ordinal, kind.String()}]++
+	}
+
+	for i, bound := range PrometheusLatencyBuckets {
+		if seconds <= bound {
+			m.latency.Buckets[i]++
+		}
+	}
+
+	m.latency.Count++
+	m.latency.Sum += seconds
+}
+
+func (m *PrometheusMetrics) Ping(ordinal int, ok bool, latency time.Duration) {
+	m.mu.Lock()
+	m.pings[prometheusPingKey{ordinal, ok}]++
+	m.mu.Unlock()
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	m.mu.Lock()
+
+	// Sort the series so the output is stable between scrapes
+	attempts := make([][2]int, 0, len(m.attempts))
+	for key := range m.attempts {
+		attempts = append(attempts, key)
+	}
+
+	sort.Slice(attempts, func(i, j int) bool {
+		return attempts[i][0] < attempts[j][0] || (attempts[i][0] == attempts[j][0] && attempts[i][1] < attempts[j][1])
+	})
+
+	fmt.Fprintf(&b, "# HELP proxy_client_attempts_total Number of attempts of Do by pod ordinal (-1 for the service) and Proxy-Status (0 for none).\n")
+	fmt.Fprintf(&b, "# TYPE proxy_client_attempts_total counter\n")
+	for _, key := range attempts {
+		fmt.Fprintf(&b, "proxy_client_attempts_total{ordinal=\"%v\",code=\"%v\"} %v\n", key[0], key[1], m.attempts[key])
+	}
+
+	errorKeys := make([]prometheusErrorKey, 0, len(m.errors))
+	for key := range m.errors {
+		errorKeys = append(errorKeys, key)
+	}
+
+	sort.Slice(errorKeys, func(i, j int) bool {
+		return errorKeys[i].Ordinal < errorKeys[j].Ordinal || (errorKeys[i].Ordinal == errorKeys[j].Ordinal && errorKeys[i].Kind < errorKeys[j].Kind)
+	})
+
+	fmt.Fprintf(&b, "# HELP proxy_client_attempt_errors_total Number of failed attempts of Do by pod ordinal and error kind.\n")
+	fmt.Fprintf(&b, "# TYPE proxy_client_attempt_errors_total counter\n")
+	for _, key := range errorKeys {
+		fmt.Fprintf(&b, "proxy_client_attempt_errors_total{ordinal=\"%v\",kind=%q} %v\n", key.Ordinal, key.Kind, m.errors[key])
+	}
+
+	fmt.Fprintf(&b, "# HELP proxy_client_attempt_latency_seconds Time taken by the attempts of Do until their response's headers.\n")
+	fmt.Fprintf(&b, "# TYPE proxy_client_attempt_latency_seconds histogram\n")
+	for i, bound := range PrometheusLatencyBuckets {
+		fmt.Fprintf(&b, "proxy_client_attempt_latency_seconds_bucket{le=\"%v\"} %v\n", bound, m.latency.Buckets[i])
+	}
+	fmt.Fprintf(&b, "proxy_client_attempt_latency_seconds_bucket{le=\"+Inf\"} %v\n", m.latency.Count)
+	fmt.Fprintf(&b, "proxy_client_attempt_latency_seconds_sum %v\n", m.latency.Sum)
+	fmt.Fprintf(&b, "proxy_client_attempt_latency_seconds_count %v\n", m.latency.Count)
+
+	pings := make([]prometheusPingKey, 0, len(m.pings))
+	for key := range m.pings {
+		pings = append(pings, key)
+	}
+
+	sort.Slice(pings, func(i, j int) bool {
+		return pings[i].Ordinal < pings[j].Ordinal || (pings[i].Ordinal == pings[j].Ordinal && !pings[i].OK && pings[j].OK)
+	})
+
+	fmt.Fprintf(&b, "# HELP proxy_client_pings_total Number of pings by pod ordinal and result.\n")
+	fmt.Fprintf(&b, "# TYPE proxy_client_pings_total counter\n")
+	for _, key := range pings {
+		result := "failed"
+		if key.OK {
+			result = "ok"
+		}
+
+		fmt.Fprintf(&b, "proxy_client_pings_total{ordinal=\"%v\",result=%q} %v\n", key.Ordinal, result, m.pings[key])
+	}
+
+	m.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics, e.g. on /metrics of the sender
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
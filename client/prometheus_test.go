@@ -0,0 +1,37 @@
+package client
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	m.Attempt(0, 200, nil, 20*time.Millisecond)
+	m.Attempt(0, 200, nil, time.Second)
+	m.Attempt(1, 0, &ProxyError{Op: "Do", Kind: ErrorTimeout, Err: errors.New("timeout")}, 3*time.Second)
+	m.Ping(1, false, time.Millisecond)
+	m.Ping(1, true, time.Millisecond)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		`proxy_client_attempts_total{ordinal="0",code="200"} 2`,
+		`proxy_client_attempts_total{ordinal="1",code="0"} 1`,
+		`proxy_client_attempt_errors_total{ordinal="1",kind="timeout"} 1`,
+		`proxy_client_attempt_latency_seconds_bucket{le="0.025"} 1`,
+		`proxy_client_attempt_latency_seconds_bucket{le="1"} 2`,
+		`proxy_client_attempt_latency_seconds_bucket{le="+Inf"} 3`,
+		`proxy_client_attempt_latency_seconds_count 3`,
+		`proxy_client_pings_total{ordinal="1",result="failed"} 1`,
+		`proxy_client_pings_total{ordinal="1",result="ok"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("the metrics are missing %v:\n%v", line, w.Body.String())
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package client
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -21,482 +28,1685 @@ type Pod struct {
 	// IP represents the proxy pod's internal IP
 	IP string
 
-	// Timestamp represents the local timestamp of the proxy's last response
+	// Timestamp represents the local timestamp of the proxy's last response, written with the pod locked
+	//
+	// Deprecated: Use LastResponse, which takes no lock. Timestamp is still updated until it is removed.
 	Timestamp time.Time
 
 	// Counter is a strictly increasing, pod local count for ordering requests
 	// If it is -1, then the pod has been marked dead
+	// It is accessed atomically, so selecting a pod takes no locks
 	Counter int64
 
 	// Free represents the predicted number of requests the pod can support before denying
+	// It is accessed atomically, so selecting a pod takes no locks
 	Free int64
+
+	// ProtocolVersion is the version of the protocol the pod speaks, 0 until it responds
+	// It is accessed atomically
+	ProtocolVersion int64
+
+	// lastResponse is the local time of the pod's last response as nanoseconds since timeBase, 0 if it has not
+	// responded, accessed atomically
+	lastResponse int64
+
+	// pingFailures is the number of consecutive failed pings, and nextPing the time before which the pod is not pinged
+	// again as nanoseconds since timeBase, both accessed atomically
+	pingFailures int64
+	nextPing     int64
+
+	// pinging is 1 while a ping to the pod is in flight, accessed atomically
+	pinging int32
+
+	// listed is the time of the last pod list listing the pod as nanoseconds since timeBase, accessed atomically
+	listed int64
+
+	// epoch is the Proxy-Epoch of the pod's process its counter belongs to, 0 if it predates the header, accessed
+	// atomically
+	epoch int64
+
+	// url is the pod's URL, built once when the pod is added, as pods are replaced when their IP changes
+	url       *url.URL
+	urlString string
+	urlErr    error
+}
+
+// timeBase is the time the pods' response times are stored relative to
+// Unlike Unix times, the offsets keep the system clock's monotonic reading, so staleness checks are not thrown off by
+// the wall clock jumping (e.g. NTP steps)
+var timeBase = time.Now()
+
+// LastResponse returns the local time of the pod's last response, the zero time if it has not responded
+// Times of the system clock carry a monotonic reading, so they should only be compared with times of the same clock
+func (pod *Pod) LastResponse() time.Time {
+	offset := atomic.LoadInt64(&pod.lastResponse)
+	if offset == 0 {
+		return time.Time{}
+	}
+
+	return timeBase.Add(time.Duration(offset))
+}
+
+// Records the time of the pod's last response
+func (pod *Pod) setLastResponse(now time.Time) {
+	offset := int64(now.Sub(timeBase))
+	if offset == 0 {
+		offset = 1
+	}
+
+	atomic.StoreInt64(&pod.lastResponse, offset)
+
+	// Keep the deprecated Timestamp up to date for the users still reading it, locking only this pod
+	pod.Lock()
+	pod.Timestamp = now
+	pod.Unlock()
+}
+
+// Returns whether the pod has not responded within the last second, or its last response is in the future as the clock
+// stepped back (e.g. a Config.Clock without a monotonic reading), which would otherwise suppress its pings until the
+// clock caught up
+func (pod *Pod) needsPing(now time.Time) bool {
+	since := now.Sub(pod.LastResponse())
+	return since > time.Second || since < 0
+}
+
+// Returns whether the pod's ping backoff is over
+func (pod *Pod) pingDue(now time.Time) bool {
+	return int64(now.Sub(timeBase)) >= atomic.LoadInt64(&pod.nextPing)
+}
+
+// Backs off pinging the pod after a failed ping, exponentially from the interval up to the maximum, returning the
+// number of consecutive failures
+func (pod *Pod) backOffPings(now time.Time, interval time.Duration, max time.Duration) int64 {
+	failures := atomic.AddInt64(&pod.pingFailures, 1)
+
+	backoff := max
+	if failures < 32 && interval<<uint(failures-1) < max {
+		backoff = interval << uint(failures-1)
+	}
+
+	atomic.StoreInt64(&pod.nextPing, int64(now.Add(backoff).Sub(timeBase)))
+	return failures
+}
+
+// Returns the time since the pod last responded, or was last listed if later
+func (pod *Pod) staleFor(now time.Time) time.Duration {
+	// Offsets are 0 while unset, and negative for times before timeBase (e.g. of a Config.Clock)
+	last := atomic.LoadInt64(&pod.lastResponse)
+	if listed := atomic.LoadInt64(&pod.listed); listed != 0 && (last == 0 || listed > last) {
+		last = listed
+	}
+
+	return time.Duration(int64(now.Sub(timeBase)) - last)
+}
+
+// Claims the pod's ping, returning false if one is already in flight
+func (pod *Pod) startPing() bool {
+	return atomic.CompareAndSwapInt32(&pod.pinging, 0, 1)
+}
+
+// Releases the pod's ping claimed by startPing
+func (pod *Pod) endPing() {
+	atomic.StoreInt32(&pod.pinging, 0)
+}
+
+// Resets the pod's ping backoff, so it is pinged again right away
+func (pod *Pod) resetPingBackoff() {
+	atomic.StoreInt64(&pod.pingFailures, 0)
+	atomic.StoreInt64(&pod.nextPing, 0)
 }
 
 // Proxy maintains the proxy url and proxy pods
+// Service, Version, Pods and LastPodOrdinal are guarded by the lock, and published as an immutable snapshot whenever
+// they change, which requests read without locks
 type Proxy struct {
 	sync.RWMutex
 
 	// Service represents the service URL of any proxy, used as a backup
+	// It is not modified after construction
 	Service *url.URL
 
 	// Version represents the proxy's StatefulSet's resourceVersion
 	Version int64
 
-	// Pods represents the known proxy pods
-	Pods map[int]*Pod
+	// Pods represents the known proxy pods, indexed by ordinal and nil for the ordinals without a pod
+	// A new slice is assigned on each change, so published slices are never modified
+	Pods []*Pod
 
 	// LastPodOrdinal represents the last known pod ordinal
 	LastPodOrdinal int
 
 	// Config represents the custom user configuration for this proxy struct
 	Config Config
+
+	// pods holds the current *podSnapshot
+	pods atomic.Value
+
+	// list is the raw Proxy-List the pods were parsed from, guarded by the lock
+	list string
+
+	// claimedVersion is the newest version whose pod list is being applied, accessed atomically
+	claimedVersion int64
+
+	// pingClient is the client pings are sent with, PingClient or else one made for the proxy
+	pingClient *http.Client
+
+	// closed is set to 1 by Destroy, accessed atomically
+	closed int32
+
+	// ctx is canceled on Destroy, stopping the pings
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wake wakes the pings early when the pod list changes
+	wake chan struct{}
+
+	// changed is closed and replaced whenever a snapshot is published or a round of pings is done, guarded by the lock
+	changed chan struct{}
+
+	// pinging is 1 while the pings run, accessed atomically
+	pinging int32
+
+	// lastUse is the time of the last request as nanoseconds since timeBase, accessed atomically
+	lastUse int64
+
+	// senders is the latest Proxy-Senders of the proxies, 0 until reported, accessed atomically
+	senders int64
+
+	// lastEnsure is the time of the last ensure request as nanoseconds since timeBase, 0 before any, accessed
+	// atomically
+	lastEnsure int64
+
+	// maxProxies and headroom are the latest Proxy-Max-Proxies and Proxy-Headroom of the proxies, maxProxies being 0
+	// while their scale is unbounded or not reported, accessed atomically
+	maxProxies int64
+	headroom   int64
+
+	// coalescing maps the keys of the GETs in flight to their calls, with Config.CoalesceGets
+	coalesceMu sync.Mutex
+	coalescing map[string]*coalescedCall
+
+	// offline buffers the requests while the proxies are unreachable, with Config.OfflineBuffer
+	offline offlineBuffer
+
+	// mirrorURL is the parsed MirrorURL, nil without one
+	mirrorURL *url.URL
+
+	// metrics and tracer hold the hooks set with SetMetrics and SetTracer
+	metrics atomic.Value
+	tracer  atomic.Value
+
+	// errorCounts counts the failed attempts of Do by ErrorKind, accessed atomically
+	errorCounts [errorKinds]uint64
+
+	// transport is the transport of the clients the proxy creates, following the TLSPolicy, nil without one
+	transport http.RoundTripper
+
+	// sensitiveHeaders are the lower cased patterns of the headers redacted from the tracing output
+	sensitiveHeaders []string
+
+	// discovery is the Discovery the proxy is attached to, or holds the pod list of, nil for proxies keeping their own
+	discovery *Discovery
 }
 
 // Config provides extra control over the proxy
 type Config struct {
 	// NumberOfSenders represents the number of senders, including this one
-	// This value is used for free count prediction
+	// This value is used for free count prediction, default the count the proxies report in Proxy-Senders, or 1 until
+	// they do
 	NumberOfSenders uint
 
-	// Attempts is an upper bound of attempts to make a proxy request before giving up
+	// SenderID identifies this sender to the proxies in Proxy-Sender, which count the senders by it, default a random one
+	SenderID string
+
+	// Attempts is an upper bound of attempts to make a proxy request before giving up, default DefaultAttempts
+	// UnlimitedAttempts retries until the RequestBudget runs out, or forever without one
 	Attempts uint
 
-	// PingClient is the HTTP client to use for ping requests
+	// RequestBudget bounds the time Do keeps retrying a request, from its first attempt, default 30 seconds
+	// A negative budget retries for as long as Attempts allows
+	RequestBudget time.Duration
+
+	// RetryNonIdempotent retries requests of any method after failures the pod may have received them before (e.g.
+	// timeouts), which can execute them twice. Otherwise only idempotent requests, or requests with a
+	// Proxy-Idempotency-Key, are retried then. Refused connections are always retried
+	RetryNonIdempotent bool
+
+	// CoalesceGets makes Do send identical GETs (same URL and headers) in flight at once as a single request through
+	// the proxies, whose response is shared. Their bodies are read in full before Do returns
+	CoalesceGets bool
+
+	// Cache caches the responses of GETs, honoring their Cache-Control, ETag and Vary, e.g. a NewMemoryCache, default
+	// nil (none). Stale responses with an ETag or Last-Modified are revalidated through the proxies
+	Cache Cache
+
+	// OfflineBuffer is the number of requests buffered while the proxies are unreachable, which Do returns ErrBuffered
+	// for and sends in order once a pod responds again, discarding their responses, default 0 (none)
+	// It suits telemetry-like requests, which tolerate delay but not loss
+	OfflineBuffer int
+
+	// OfflineTTL is the time buffered requests are kept before being dropped, default 1 minute
+	OfflineTTL time.Duration
+
+	// Spool durably records the requests of Do other than GETs, HEADs, OPTIONS and TRACEs until the proxies respond to
+	// them, e.g. a NewFileSpool, default nil (none). The requests it holds when the proxy is made are sent again in
+	// the background once it is ready. Requests get a Proxy-Idempotency-Key if they have none, so the proxies
+	// deduplicate those sent again
+	Spool Spool
+
+	// SpoolClient is the HTTP client the requests of the Spool are sent again with, default http.DefaultClient, or one
+	// following the TLS policy
+	SpoolClient *http.Client
+
+	// EffectivelyOnce makes the requests of Do recorded in the Spool, which it requires, reach their recipient once
+	// across retries and the sender's restarts: the attempts of a request with a Proxy-Idempotency-Key all go to the
+	// pod its key hashes to, even while marked dead, which deduplicates them. Duplicates remain possible if that pod
+	// leaves the Proxy-List or restarts with the request in flight, or if a request is sent again after the proxies'
+	// idempotencyTTL
+	// Keyed requests wait for the pods to be known rather than going to the service, failing with ErrAllPodsDead if
+	// none is found within the RequestBudget, or a PingInterval per attempt without one
+	EffectivelyOnce bool
+
+	// MirrorURL is the URL of a shadow recipient, whose scheme and host replace those of the mirrored requests, e.g.
+	// to test a new version of a recipient with production traffic
+	MirrorURL string
+
+	// MirrorPercent is the percentage of requests of Do also sent, in the background, to the MirrorURL through the
+	// proxies, whose responses are discarded, default 0 (none)
+	MirrorPercent float64
+
+	// AttemptTimeout bounds each attempt of Do until the response's headers arrive, so one hung connection does not
+	// consume the request's whole deadline, default 0 (none). It should exceed the proxies' timeout, after which they
+	// answer with a 202
+	AttemptTimeout time.Duration
+
+	// PingClient is the HTTP client to use for ping requests, default one with keep-alives shared by the proxy's pings
 	PingClient *http.Client
 
+	// PingTimeout bounds each ping, including with a PingClient, default 5 seconds
+	PingTimeout time.Duration
+
+	// MaxConcurrentPings bounds the pings sent at once, default 16
+	MaxConcurrentPings int
+
+	// PingMaxConnsPerHost bounds the connections to each pod when PingClient is nil, default 2
+	PingMaxConnsPerHost int
+
+	// Client is the HTTP client Get, Post, PostJSON and PostForm send requests to the proxies with, default a new one
+	Client *http.Client
+
 	// PingInterval is the time between each ping, default 1 second
 	PingInterval time.Duration
 
+	// PodTTL is the time without a response after which a pod is no longer selected, and after twice as long removed
+	// from the pod list until a new version lists it, default 30 seconds. A negative TTL keeps the pods
+	PodTTL time.Duration
+
+	// PingIdleTimeout is the time without requests after which the pings suspend until the next request, default 5
+	// minutes. A negative timeout never suspends them
+	PingIdleTimeout time.Duration
+
+	// MaxPingBackoff bounds the time between pings of a pod failing them, which doubles from PingInterval with each
+	// failure, default 30 seconds
+	MaxPingBackoff time.Duration
+
 	// DebugLevel is the debug verbosity level, default 0 (no debugging)
 	DebugLevel int
 
 	// DebugPrint is the debug print function used by the proxy methods for debugging
 	DebugPrint func(string, ...interface{})
+
+	// Clock schedules the pings and times the pods' responses, default the system's
+	Clock Clock
+
+	// MaxPods bounds the ordinals accepted in Proxy-List and Proxy-Ordinal headers, default DefaultMaxPods
+	MaxPods int
+
+	// TLS restricts the TLS of the clients the proxy creates: the ping client, the Client and SpoolClient defaults,
+	// and the defaults of Transport and HTTPClient. Clients given to the proxy are used as they are
+	TLS *TLSPolicy
+
+	// SensitiveHeaders are patterns (e.g. "X-*-Token", matched case-insensitively like path.Match) of the headers
+	// whose values are redacted from the requests and responses shown to the Tracer, besides DefaultSensitiveHeaders
+	SensitiveHeaders []string
+
+	// Discovery shares the pod list and pings of a Discovery of the same pods, rather than keeping and pinging them
+	// for this proxy alone. The ping settings of this config are then ignored for the Discovery's, and the Pods,
+	// Version and LastPodOrdinal fields of the proxy are not updated
+	Discovery *Discovery
+
+	// EnsureMaxPods bounds the pods Ensure asks the proxies to scale up to, and EnsureStep the pods each Ensure adds,
+	// bounding what a burst of ensures costs. Both are sent to the proxies with the request, 0 leaves them unbounded
+	EnsureMaxPods uint
+	EnsureStep    uint
+
+	// Prewarm are the schedules ensuring requests ahead of known traffic peaks, sent with the Client every
+	// PrewarmInterval during their windows, default 30 seconds
+	Prewarm         []PrewarmSchedule
+	PrewarmInterval time.Duration
+
+	// EnsureCooldown is the minimum time between ensure requests, Ensure returning ErrEnsureCooldown without sending
+	// one within it, default 0 (no cool-down)
+	EnsureCooldown time.Duration
+}
+
+// ProtocolVersion is the version of the Proxy-* protocol the client speaks, sent in Proxy-Protocol-Version
+// Pods advertise theirs in the same header, pods without it speak version 1
+const ProtocolVersion = 2
+
+// DefaultMaxPods is the default bound of the pod ordinals accepted from the proxies
+const DefaultMaxPods = 1024
+
+// DefaultAttempts is the default number of attempts of a proxy request
+const DefaultAttempts = 5
+
+// UnlimitedAttempts is the Attempts retrying a proxy request until its budget runs out
+const UnlimitedAttempts = math.MaxUint32
+
+// MaxProxyListBytes is the maximum size of a Proxy-List header accepted from the proxies
+const MaxProxyListBytes = 64 * 1024
+
+// New constructs a new proxy with the proxy service URL
+// The proxy service URL's path and port will be used for subsequent proxy requests
+func New(proxyServiceURL string) (*Proxy, error) {
+	return NewWithConfig(proxyServiceURL, Config{})
+}
+
+// NewWithConfig constructs a new proxy with the proxy service URL and config
+// The proxy service URL's path and port will be used for subsequent proxy requests
+func NewWithConfig(proxyServiceURL string, config Config) (*Proxy, error) {
+	u, err := url.Parse(proxyServiceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.SenderID == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		config.SenderID = hex.EncodeToString(id)
+	}
+
+	if config.Attempts == 0 {
+		config.Attempts = DefaultAttempts
+	}
+
+	if config.RequestBudget == 0 {
+		config.RequestBudget = 30 * time.Second
+	}
+
+	if config.PingInterval == 0 {
+		config.PingInterval = time.Second
+	}
+
+	if config.OfflineTTL == 0 {
+		config.OfflineTTL = time.Minute
+	}
+
+	if config.PodTTL == 0 {
+		config.PodTTL = 30 * time.Second
+	}
+
+	if config.PingIdleTimeout == 0 {
+		config.PingIdleTimeout = 5 * time.Minute
+	}
+
+	if config.MaxPingBackoff == 0 {
+		config.MaxPingBackoff = 30 * time.Second
+	}
+
+	if config.PingTimeout == 0 {
+		config.PingTimeout = 5 * time.Second
+	}
+
+	if config.MaxConcurrentPings <= 0 {
+		config.MaxConcurrentPings = 16
+	}
+
+	if config.PingMaxConnsPerHost == 0 {
+		config.PingMaxConnsPerHost = 2
+	}
+
+	if config.PrewarmInterval == 0 {
+		config.PrewarmInterval = 30 * time.Second
+	}
+
+	prewarms, err := parsePrewarmSchedules(config.Prewarm)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &Proxy{
+		Service:    u,
+		Config:     config,
+		pingClient: config.PingClient,
+		wake:       make(chan struct{}, 1),
+	}
+
+	if proxy.sensitiveHeaders, err = parseSensitiveHeaders(config.SensitiveHeaders); err != nil {
+		return nil, err
+	}
+
+	if config.EffectivelyOnce && config.Spool == nil {
+		return nil, fmt.Errorf("EffectivelyOnce requires a Spool")
+	}
+
+	if config.MirrorURL != "" {
+		if proxy.mirrorURL, err = url.Parse(config.MirrorURL); err != nil {
+			return nil, fmt.Errorf("error parsing MirrorURL: %w", err)
+		}
+	}
+
+	proxy.ctx, proxy.cancel = context.WithCancel(context.Background())
+
+	var tlsConfig *tls.Config
+	if config.TLS != nil {
+		if tlsConfig, err = config.TLS.config(); err != nil {
+			return nil, err
+		}
+
+		proxy.transport = newPolicyTransport(tlsConfig)
+	}
+
+	if proxy.pingClient == nil && config.Discovery == nil {
+		proxy.pingClient = newPingClient(config, tlsConfig)
+	}
+
+	proxy.publish()
+
+	if config.Discovery != nil {
+		proxy.discovery = config.Discovery
+		config.Discovery.attach(proxy)
+	}
+
+	if config.Spool != nil {
+		requests, err := config.Spool.Load()
+		if err != nil {
+			return nil, fmt.Errorf("error loading Spool: %w", err)
+		}
+
+		if len(requests) > 0 {
+			client := config.SpoolClient
+			if client == nil {
+				client = proxy.defaultClient()
+			}
+
+			go proxy.resubmitSpooled(client, requests)
+		}
+	}
+
+	if len(prewarms) > 0 {
+		go proxy.runPrewarm(prewarms)
+	}
+
+	return proxy, nil
+}
+
+// Destroy cleans the proxy and stops its pings
+// Requests through the proxy afterwards fail with ErrClosed, destroying it again does nothing
+func (p *Proxy) Destroy() {
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return
+	}
+
+	p.cancel()
+}
+
+// WaitReady starts the pings, which ping the service right away to discover the pods, and blocks until a live pod is
+// known, so the first requests are balanced across the pods rather than sent to the service
+// The service is pinged again every PingInterval until then, and the context's error is returned if it is done first
+func (p *Proxy) WaitReady(ctx context.Context) error {
+	p.use()
+
+	for attempt := 0; ; attempt++ {
+		// Take the channel first, so a change in between is not missed
+		next := p.nextChange()
+
+		if p.Closed() {
+			return ErrClosed
+		}
+
+		if p.snapshot().bestOrdinal() >= 0 {
+			return nil
+		}
+
+		// Wake pings that were already running, later rounds follow every PingInterval
+		if attempt == 0 {
+			select {
+			case p.table().wake <- struct{}{}:
+			default:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.ctx.Done():
+			return ErrClosed
+		case <-next:
+		}
+	}
+}
+
+// Marks the proxy as used, starting the pings if they are not running
+// The pings of a Discovery run while any of its attached proxies is used
+func (p *Proxy) use() {
+	if p.Closed() {
+		return
+	}
+
+	p = p.table()
+	atomic.StoreInt64(&p.lastUse, int64(p.clock().Now().Sub(timeBase)))
+
+	if !p.Closed() && atomic.CompareAndSwapInt32(&p.pinging, 0, 1) {
+		go p.pingProxies()
+	}
+}
+
+// Returns whether the proxy has not been used within the PingIdleTimeout
+func (p *Proxy) idle() bool {
+	if p.Config.PingIdleTimeout < 0 {
+		return false
+	}
+
+	return int64(p.clock().Now().Sub(timeBase))-atomic.LoadInt64(&p.lastUse) > int64(p.Config.PingIdleTimeout)
+}
+
+// Closed returns whether the proxy was destroyed
+func (p *Proxy) Closed() bool {
+	return atomic.LoadInt32(&p.closed) != 0
+}
+
+// Returns the number of senders the free requests are predicted with, configured or else reported by the proxies
+func (p *Proxy) numberOfSenders() int64 {
+	if p.Config.NumberOfSenders > 0 {
+		return int64(p.Config.NumberOfSenders)
+	}
+
+	if senders := atomic.LoadInt64(&p.table().senders); senders > 0 {
+		return senders
+	}
+
+	return 1
+}
+
+// Returns the bound of the pod ordinals accepted from the proxies
+func (p *Proxy) maxPods() int {
+	if p.Config.MaxPods <= 0 {
+		return DefaultMaxPods
+	}
+
+	return p.Config.MaxPods
+}
+
+func (p *Proxy) debugPrint(level int, format string, args ...interface{}) {
+	if p.Config.DebugPrint == nil || level > p.Config.DebugLevel {
+		return
+	}
+
+	p.Config.DebugPrint(format, args...)
+}
+
+// Returns the client pings are sent with when there is no PingClient
+// Its connections are kept alive between pings, which are sent to the same pods every interval
+func newPingClient(config Config, tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   config.PingTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: config.PingMaxConnsPerHost,
+			MaxConnsPerHost:     config.PingMaxConnsPerHost,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: config.PingTimeout,
+	}
+}
+
+// Pings a specific proxy pod (performs a locking operation on success)
+func (p *Proxy) pingProxy(proxyOrdinal int, proxyURL string) error {
+	// The timeout also bounds pings through a PingClient without one
+	ctx, cancel := context.WithTimeout(p.ctx, p.Config.PingTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", proxyURL, nil)
+	if err != nil {
+		return newProxyError("ping", "send", proxyOrdinal, nil, 1, err)
+	}
+
+	req.Header.Set("Proxy-Protocol-Version", strconv.Itoa(ProtocolVersion))
+	req.Header.Set("Proxy-Sender", p.Config.SenderID)
+
+	metrics := p.loadMetrics()
+	var start time.Time
+	if metrics != nil {
+		start = p.clock().Now()
+	}
+
+	resp, err := p.pingClient.Do(req)
+	if metrics != nil {
+		metrics.Ping(proxyOrdinal, err == nil, p.clock().Now().Sub(start))
+	}
+
+	if err != nil {
+		p.markProxyPodAsDead(proxyOrdinal)
+
+		p.debugPrint(2, "Failed to ping proxy %v (%v): %v", proxyOrdinal, proxyURL, err)
+		return newProxyError("ping", "send", proxyOrdinal, req.URL, 1, err)
+	}
+
+	// Drain the body so the connection is reused
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	_, err = updateKnownProxies(p, &resp.Header)
+	return newProxyError("ping", "parse", proxyOrdinal, req.URL, 1, err)
+}
+
+// Pings the proxies every interval for metrics, and as soon as the pod list changes, until destroyed or idle
+func (p *Proxy) pingProxies() {
+	// The idle connections of the client made for the pings are closed with the proxy
+	if p.Config.PingClient == nil {
+		defer p.pingClient.CloseIdleConnections()
+	}
+
+	// The ticker starts after the first round, so the rounds stay an interval apart however long they take
+	var ticker Ticker
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	for {
+		if p.Closed() {
+			return
+		}
+
+		s := p.snapshot()
+
+		var wg sync.WaitGroup
+		var successes int64
+
+		// Bounds the pings in flight, so large deployments on a slow network do not spike goroutines and sockets
+		semaphore := make(chan struct{}, p.Config.MaxConcurrentPings)
+
+		// Go through each pod and ping it
+		for i, proxyPod := range s.pods {
+			if proxyPod == nil {
+				continue
+			}
+
+			// Has it been more than a second since the last response?
+			now := p.clock().Now()
+			if proxyPod.needsPing(now) {
+				// Pods failing pings are backed off, but still probed for recovery
+				if proxyPod.urlErr != nil || !proxyPod.pingDue(now) {
+					continue
+				}
+
+				// A pod is pinged once at a time, even if a round overlaps the previous one's pings
+				if !proxyPod.startPing() {
+					p.debugPrint(3, "Skipping proxy %v (%v), its ping is in flight", i, proxyPod.IP)
+					continue
+				}
+
+				wg.Add(1)
+				semaphore <- struct{}{}
+
+				p.debugPrint(2, "Pinging proxy %v: %v", i, proxyPod.IP)
+
+				// If so, ping it
+				go func(proxyOrdinal int, proxyPod *Pod) {
+					defer wg.Done()
+					defer func() { <-semaphore }()
+					defer proxyPod.endPing()
+
+					if p.pingProxy(proxyOrdinal, proxyPod.urlString) == nil {
+						proxyPod.resetPingBackoff()
+						atomic.AddInt64(&successes, 1)
+						return
+					}
+
+					if proxyPod.backOffPings(p.clock().Now(), p.Config.PingInterval, p.Config.MaxPingBackoff) == 1 {
+						p.debugPrint(1, "Proxy %v (%v) failed its ping, backing off", proxyOrdinal, proxyPod.IP)
+					}
+				}(i, proxyPod)
+			} else {
+				atomic.AddInt64(&successes, 1)
+			}
+		}
+
+		wg.Wait()
+
+		// After the pings, so pods are not evicted for the time the pings were suspended
+		p.evictStalePods()
+
+		if successes == 0 {
+			// If we got no successes, select a proxy to possibly reset the list back to host
+			proxyOrdinal, proxyHost, _, err := p.selectProxy(0, "")
+
+			if proxyOrdinal == -1 && err == nil && p.pingProxy(proxyOrdinal, proxyHost.String()) == nil {
+				successes++
+			}
+		}
+
+		// A pod responds, or the service once the pod list was cleared, send the requests buffered while the proxies
+		// were unreachable
+		if successes > 0 {
+			if p.discovery != nil {
+				p.discovery.flushOffline()
+			} else {
+				p.flushOffline()
+			}
+		}
+
+		p.Lock()
+		p.signalChange()
+		p.Unlock()
+
+		// Suspend until the next request while idle, unless one comes in while suspending
+		if p.idle() {
+			atomic.StoreInt32(&p.pinging, 0)
+			if p.idle() || !atomic.CompareAndSwapInt32(&p.pinging, 0, 1) {
+				p.debugPrint(2, "Suspending the pings while idle")
+				return
+			}
+		}
+
+		if ticker == nil {
+			ticker = p.newTicker(p.Config.PingInterval)
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C():
+		case <-p.wake:
+		}
+	}
+}
+
+// Selects the best proxy and takes the requests from its predicted free count, to be released once they are done
+// No locks are taken, unless all of the pods are dead and the pod list must be cleared
+func (p *Proxy) selectProxy(requests int64, key string) (int, *url.URL, reservation, error) {
+	s := p.snapshot()
+
+	// Requests with a key go to the pod it hashes to, and the others to the most free one
+	var ordinal int
+	if key != "" {
+		ordinal = s.keyOrdinal(key)
+	} else {
+		ordinal = s.bestOrdinal()
+	}
+
+	if ordinal >= 0 {
+		pod := s.pods[ordinal]
+
+		// Decrement free count as a prediction
+		r := reservation{pod: pod, counter: atomic.LoadInt64(&pod.Counter), requests: requests}
+		atomic.AddInt64(&pod.Free, -requests)
+
+		u, err := p.podURL(pod)
+		if err != nil {
+			r.rollback()
+			return ordinal, nil, reservation{}, err
+		}
+
+		return ordinal, u, r, nil
+	}
+
+	// Is there no best proxy?
+	if s.count != 0 {
+		p.table().clearDeadPods()
+	}
+
+	// Copy the service URL, as the caller's request takes it
+	u := *p.Service
+	return -1, &u, reservation{}, nil
+}
+
+// Requests taken from a pod's predicted free count
+type reservation struct {
+	pod      *Pod
+	counter  int64
+	requests int64
+}
+
+// Returns the requests to the pod's predicted free count once they are done
+// If the pod reported its free count since, the report replaced the prediction and already counts the requests as
+// done or in flight, so nothing is returned. A report racing with the release may be credited, until the next one
+func (r reservation) release() {
+	if r.pod == nil || r.requests == 0 {
+		return
+	}
+
+	if atomic.LoadInt64(&r.pod.Counter) == r.counter {
+		atomic.AddInt64(&r.pod.Free, r.requests)
+	}
+}
+
+// Returns the requests to the pod's predicted free count when they were not sent, even if the pod reported its free
+// count since, as the report can not count requests the pod never received
+func (r reservation) rollback() {
+	if r.pod == nil || r.requests == 0 {
+		return
+	}
+
+	atomic.AddInt64(&r.pod.Free, r.requests)
+}
+
+// Clears the pod list to try the host if all of the pods are dead (performs a locking operation)
+func (p *Proxy) clearDeadPods() {
+	p.Lock()
+	defer p.Unlock()
+
+	// Check again, a pod may have come back or the list changed
+	if s := p.snapshot(); s.count == 0 || s.bestOrdinal() >= 0 {
+		return
+	}
+
+	p.debugPrint(1, "All pods dead, clearing pod list")
+
+	p.Pods = nil
+	p.LastPodOrdinal = 0
+	p.list = ""
+	p.publish()
+}
+
+// Evicts the pods without a response for the PodTTL from selection, and for twice as long from the pod list, so pods
+// that left without a new version (e.g. while the control plane is down) stop being selected and pinged
+// The pod list is parsed again from the next version's list, bringing back the evicted pods still listed
+func (p *Proxy) evictStalePods() {
+	if p.Config.PodTTL < 0 {
+		return
+	}
+
+	now := p.clock().Now()
+	evict := false
+	for ordinal, pod := range p.snapshot().pods {
+		if pod == nil {
+			continue
+		}
+
+		stale := pod.staleFor(now)
+		if stale > 2*p.Config.PodTTL {
+			evict = true
+		} else if stale > p.Config.PodTTL && atomic.LoadInt64(&pod.Counter) >= 0 {
+			p.debugPrint(1, "Proxy %v (%v) has not responded in %v, no longer selecting it", ordinal, pod.IP, p.Config.PodTTL)
+			p.markProxyPodAsDead(ordinal)
+		}
+	}
+
+	if !evict {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	newPods := make([]*Pod, len(p.Pods))
+	for ordinal, pod := range p.Pods {
+		if pod == nil {
+			continue
+		}
+
+		if pod.staleFor(now) > 2*p.Config.PodTTL {
+			p.debugPrint(1, "Proxy %v (%v) has not responded in %v, removing it", ordinal, pod.IP, 2*p.Config.PodTTL)
+			continue
+		}
+
+		newPods[ordinal] = pod
+	}
+
+	p.Pods = newPods
+	p.list = ""
+	p.publish()
+}
+
+// Parses a proxy list header and returns the IP list
+// The header is untrusted, so it must be a JSON object of at most maxPods distinct ordinals (0 <= ordinal < maxPods) to IPs,
+// or else a list in the compact format of at most maxPods IPs
+func parseProxyList(str string, maxPods int) (map[int]string, error) {
+	if len(str) > MaxProxyListBytes {
+		return nil, fmt.Errorf("proxy list is larger than %v bytes", MaxProxyListBytes)
+	}
+
+	// Detect the format, a JSON object starts with a brace
+	if trimmed := strings.TrimSpace(str); trimmed != "" && trimmed[0] != '{' {
+		return parseCompactProxyList(trimmed, maxPods)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(str))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errors.New("proxy list is not a JSON object")
+	}
+
+	result := map[int]string{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		key, _ := token.(string)
+		ordinal, err := strconv.Atoi(key)
+		if err != nil || ordinal < 0 || ordinal >= maxPods {
+			return nil, fmt.Errorf("proxy list ordinal %q is not in [0, %v)", key, maxPods)
+		}
+
+		if _, ok := result[ordinal]; ok {
+			return nil, fmt.Errorf("proxy list ordinal %v is duplicated", ordinal)
+		}
+
+		var ip string
+		if err := decoder.Decode(&ip); err != nil {
+			return nil, fmt.Errorf("proxy list IP of ordinal %v is not a string: %w", ordinal, err)
+		}
+
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("proxy list IP %q of ordinal %v is invalid", ip, ordinal)
+		}
+
+		result[ordinal] = ip
+	}
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('}') {
+		return nil, errors.New("proxy list is not a JSON object")
+	}
+
+	// Reject anything after the object
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("proxy list has trailing data")
+	}
+
+	return result, nil
+}
+
+// Marks a proxy pod as dead
+func (p *Proxy) markProxyPodAsDead(proxyOrdinal int) {
+	if pod := p.snapshot().pod(proxyOrdinal); pod != nil {
+		atomic.StoreInt64(&pod.Counter, -1)
+	}
+}
+
+// Updates a specific proxy pod
+func (p *Proxy) updateProxyPod(proxyOrdinal int, proxyCounter int64, proxyFree int64, protocolVersion int64, epoch int64) {
+	proxyPod := p.snapshot().pod(proxyOrdinal)
+	if proxyPod == nil {
+		return
+	}
+
+	// Only the newest data is kept, claimed through the counter
+	// A concurrent update claiming a newer counter can still be overwritten by this one's free count, which the pod's
+	// next response corrects
+	for {
+		// A restarted pod counts from 0 again, so its counter is reset once it reports its new epoch
+		podEpoch := atomic.LoadInt64(&proxyPod.epoch)
+		if epoch < podEpoch {
+			return
+		}
+
+		if epoch > podEpoch {
+			if atomic.CompareAndSwapInt64(&proxyPod.epoch, podEpoch, epoch) {
+				p.debugPrint(1, "Proxy %v restarted, resetting its counter", proxyOrdinal)
+				atomic.StoreInt64(&proxyPod.Counter, 0)
+			}
+
+			continue
+		}
+
+		counter := atomic.LoadInt64(&proxyPod.Counter)
+
+		// Is this data too old?
+		if proxyCounter <= counter {
+			return
+		}
+
+		if !atomic.CompareAndSwapInt64(&proxyPod.Counter, counter, proxyCounter) {
+			continue
+		}
+
+		// Undo the claim if the pod restarted meanwhile, unless a newer update claimed the counter since
+		if atomic.LoadInt64(&proxyPod.epoch) != epoch {
+			atomic.CompareAndSwapInt64(&proxyPod.Counter, proxyCounter, 0)
+			return
+		}
+
+		break
+	}
+
+	// Fill in data
+	atomic.StoreInt64(&proxyPod.Free, proxyFree)
+	atomic.StoreInt64(&proxyPod.ProtocolVersion, protocolVersion)
+	proxyPod.setLastResponse(p.clock().Now())
 }
 
-// New constructs a new proxy with the proxy service URL
-// The proxy service URL's path and port will be used for subsequent proxy requests
-func New(proxyServiceURL string) (*Proxy, error) {
-	u, err := url.Parse(proxyServiceURL)
-	if err != nil {
-		return nil, err
+// Parses an integer Proxy-* header, ok is false if it is missing
+func parseProxyInt(header http.Header, name string) (value int64, ok bool, err error) {
+	str := proxyHeader(header, name)
+	if str == "" {
+		return 0, false, nil
 	}
 
-	proxy := &Proxy{
-		Service: u,
-		Pods:    map[int]*Pod{},
-		Config: Config{
-			NumberOfSenders: 1,
-			Attempts:        math.MaxUint32,
-			PingInterval:    time.Second,
-		},
+	value, err = strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("error parsing %v: %w", name, err)
 	}
 
-	go proxy.pingProxies()
-
-	return proxy, nil
+	return value, true, nil
 }
 
-// NewWithConfig constructs a new proxy with the proxy service URL and config
-// The proxy service URL's path and port will be used for subsequent proxy requests
-func NewWithConfig(proxyServiceURL string, config Config) (*Proxy, error) {
-	proxy, err := New(proxyServiceURL)
+// Updates the proxy's dataset (performs a locking operation)
+// Missing headers (e.g. stripped by an ingress) are tolerated, updating what the others allow, and the status is 0
+// without Proxy-Status. Only responses without any of the headers, or with an invalid one, fail, matching
+// ErrInvalidProxyHeaders
+// The Proxy-List is only parsed for a newer Proxy-Version with a different list, so most responses do not allocate
+func updateKnownProxies(p *Proxy, header *http.Header) (int, error) {
+	proxyStatus, err := updateKnownProxiesFromHeaders(p, header)
 	if err != nil {
-		return nil, err
+		return 0, &sentinelError{sentinel: ErrInvalidProxyHeaders, err: err}
 	}
 
-	if config.NumberOfSenders == 0 {
-		config.NumberOfSenders = proxy.Config.NumberOfSenders
-	}
+	return proxyStatus, nil
+}
 
-	if config.Attempts == 0 {
-		config.Attempts = proxy.Config.Attempts
-	}
+// Updates the proxy's dataset from the headers of a response, see updateKnownProxies
+func updateKnownProxiesFromHeaders(p *Proxy, header *http.Header) (int, error) {
+	// The responses of attached proxies update their discovery's pods
+	p = p.table()
 
-	if config.PingInterval == 0 {
-		config.PingInterval = proxy.Config.PingInterval
+	// Parse data from headers
+	newProxyFree, hasFree, err := parseProxyInt(*header, "Proxy-Free")
+	if err != nil {
+		return 0, err
 	}
 
-	proxy.Config = config
-	return proxy, nil
-}
-
-// Destroy cleans the proxy and kills the corresponding ping thread
-func (p *Proxy) Destroy() {
-	p.Service = nil
-}
+	proxyOrdinal, hasOrdinal, err := parseProxyInt(*header, "Proxy-Ordinal")
+	if err != nil {
+		return 0, err
+	}
 
-func (p *Proxy) debugPrint(level int, format string, args ...interface{}) {
-	if p.Config.DebugPrint == nil || level > p.Config.DebugLevel {
-		return
+	version, hasVersion, err := parseProxyInt(*header, "Proxy-Version")
+	if err != nil {
+		return 0, err
 	}
 
-	p.Config.DebugPrint(format, args...)
-}
+	proxyCounter, hasCounter, err := parseProxyInt(*header, "Proxy-Counter")
+	if err != nil {
+		return 0, err
+	}
 
-func (p *Proxy) formatURL(ip string) string {
-	// Format the URL into scheme://ip:port/path
-	return fmt.Sprintf("%v://%v:%v%v", p.Service.Scheme, ip, p.Service.Port(), p.Service.Path)
-}
+	proxyStatus, hasStatus, err := parseProxyInt(*header, "Proxy-Status")
+	if err != nil {
+		return 0, err
+	}
 
-// Pings a specific proxy pod (performs a locking operation on success)
-func (p *Proxy) pingProxy(proxyOrdinal int, proxyURL string) error {
-	client := p.Config.PingClient
-	if client == nil {
-		client = &http.Client{}
+	// Pods predating the header speak version 1
+	protocolVersion := int64(1)
+	if value := proxyHeader(*header, "Proxy-Protocol-Version"); value != "" {
+		protocolVersion, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || protocolVersion < 1 {
+			return 0, fmt.Errorf("error parsing Proxy-Protocol-Version: %v", value)
+		}
 	}
 
-	resp, err := client.Get(proxyURL)
+	// Proxies predating the header do not count the senders
+	senders, hasSenders, err := parseProxyInt(*header, "Proxy-Senders")
 	if err != nil {
-		p.markProxyPodAsDead(proxyOrdinal)
+		return 0, err
+	}
 
-		p.debugPrint(1, "Failed to ping proxy %v (%v): %v", proxyOrdinal, proxyURL, err)
-		return err
+	// Proxies predating the headers, or with an unbounded scale, do not report it
+	maxProxies, hasMaxProxies, err := parseProxyInt(*header, "Proxy-Max-Proxies")
+	if err != nil {
+		return 0, err
 	}
 
-	defer resp.Body.Close()
-	updateKnownProxies(p, &resp.Header)
-	return nil
-}
+	headroom, hasHeadroom, err := parseProxyInt(*header, "Proxy-Headroom")
+	if err != nil {
+		return 0, err
+	}
 
-// Pings the proxies every second for metrics
-func (p *Proxy) pingProxies() {
-	for {
-		if p.Service == nil {
-			return
+	// Pods predating the header have no epoch
+	var epoch int64
+	if value := proxyHeader(*header, "Proxy-Epoch"); value != "" {
+		epoch, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || epoch < 0 {
+			return 0, fmt.Errorf("error parsing Proxy-Epoch: %v", value)
 		}
+	}
 
-		var wg sync.WaitGroup
-		var successes int64
-
-		p.RLock()
+	if hasOrdinal && (proxyOrdinal < 0 || proxyOrdinal >= int64(p.maxPods())) {
+		return 0, fmt.Errorf("error parsing Proxy-Ordinal: %v is not in [0, %v)", proxyOrdinal, p.maxPods())
+	}
 
-		// Go through each pod and ping it
-		for i, proxyPod := range p.Pods {
-			proxyPod.RLock()
+	list := proxyHeader(*header, "Proxy-List")
+	hasList := list != ""
 
-			// Has it been more than a second since the last response?
-			if time.Since(proxyPod.Timestamp) > time.Second {
-				wg.Add(1)
+	if !hasFree && !hasOrdinal && !hasVersion && !hasCounter && !hasStatus && !hasList {
+		return 0, errors.New("response has no proxy headers")
+	}
 
-				p.debugPrint(2, "Pinging proxy %v: %v", i, proxyPod.IP)
+	if !hasFree || !hasOrdinal || !hasVersion || !hasCounter || !hasStatus || !hasList {
+		p.debugPrint(1, "Response is missing some of Proxy-Free, Proxy-Ordinal, Proxy-Version, Proxy-Counter, Proxy-Status and Proxy-List")
+	}
 
-				// If so, ping it
-				go func(proxyOrdinal int, proxyPod *Pod) {
-					defer wg.Done()
+	// Do we need to update the pod list? Lists of versions not newer than ours are ignored, unparsed
+	if hasVersion && hasList && version > p.snapshot().version && p.claimListUpdate(version) {
+		if err := p.updateProxyList(version, list, proxyHeader(*header, "Proxy-List-Encoding")); err != nil {
+			// Let another response of the version apply its list
+			atomic.CompareAndSwapInt64(&p.claimedVersion, version, p.snapshot().version)
+			return 0, err
+		}
+	}
 
-					if p.pingProxy(proxyOrdinal, p.formatURL(proxyPod.IP)) == nil {
-						atomic.AddInt64(&successes, 1)
-					}
-				}(i, proxyPod)
-			} else {
-				atomic.AddInt64(&successes, 1)
-			}
+	if hasSenders && senders > 0 {
+		atomic.StoreInt64(&p.senders, senders)
+	}
 
-			proxyPod.RUnlock()
-		}
+	if hasMaxProxies && hasHeadroom && maxProxies > 0 && headroom >= 0 {
+		atomic.StoreInt64(&p.headroom, headroom)
+		atomic.StoreInt64(&p.maxProxies, maxProxies)
+	}
 
-		p.RUnlock()
-		wg.Wait()
+	// Update the pod, if the response says which and its metrics
+	if hasOrdinal && hasCounter && hasFree {
+		p.updateProxyPod(int(proxyOrdinal), proxyCounter, newProxyFree, protocolVersion, epoch)
+	}
 
-		if successes == 0 {
-			// If we got no successes, call determineBestProxy to possibly reset the list back to host
-			p.Lock()
-			proxyOrdinal, proxyHost, _ := p.determineBestProxy()
-			p.Unlock()
+	return int(proxyStatus), nil
+}
 
-			if proxyOrdinal == -1 {
-				p.pingProxy(proxyOrdinal, proxyHost.String())
-			}
+// Claims applying the pod list of the version, false if it or a newer one is already being applied by another response
+// A burst of responses carrying a new version thus has a single writer, and the others do not wait for the lock
+func (p *Proxy) claimListUpdate(version int64) bool {
+	for {
+		claimed := atomic.LoadInt64(&p.claimedVersion)
+		if version <= claimed {
+			return false
 		}
 
-		time.Sleep(p.Config.PingInterval)
+		if atomic.CompareAndSwapInt64(&p.claimedVersion, claimed, version) {
+			return true
+		}
 	}
 }
 
-// Determines the best proxy based on current metrics
-func (p *Proxy) determineBestProxy() (int, *url.URL, error) {
-	if len(p.Pods) == 0 {
-		return -1, p.Service, nil
+// Updates the pod list to a newer version (performs a locking operation)
+// The raw list is compared first, so versions listing the same pods (e.g. StatefulSet changes other than scaling) are
+// taken without parsing it
+func (p *Proxy) updateProxyList(version int64, list string, encoding string) error {
+	var newProxyList map[int]string
+	if list != p.snapshot().list {
+		decoded, err := decodeProxyList(list, encoding)
+		if err != nil {
+			return fmt.Errorf("error parsing Proxy-List: %w", err)
+		}
+
+		if newProxyList, err = parseProxyList(decoded, p.maxPods()); err != nil {
+			return fmt.Errorf("error parsing Proxy-List: %w", err)
+		}
 	}
 
-	determineBestProxyOrdinal := func() int {
-		bestOrdinal := -1
-		bestFree := int64(-math.MaxInt64)
+	p.Lock()
+	defer p.Unlock()
 
-		// Pick the most free pod that isn't the last one
-		for ordinal := 0; ordinal <= p.LastPodOrdinal; ordinal++ {
-			pod, ok := p.Pods[ordinal]
-			if !ok || pod.Counter < 0 {
-				continue
-			}
+	// Check if we are still the latest
+	if p.Version >= version {
+		return nil
+	}
 
-			if ordinal == p.LastPodOrdinal && bestFree > 0 {
-				break
-			}
+	// The same pods, only the version changed
+	if newProxyList == nil && list == p.list {
+		p.Version = version
+		p.publish()
+		return nil
+	}
 
-			if pod.Free > bestFree {
-				bestOrdinal = ordinal
-				bestFree = pod.Free
-			}
+	// The list changed since it was compared, parse it after all
+	if newProxyList == nil {
+		decoded, err := decodeProxyList(list, encoding)
+		if err != nil {
+			return fmt.Errorf("error parsing Proxy-List: %w", err)
 		}
 
-		return bestOrdinal
+		if newProxyList, err = parseProxyList(decoded, p.maxPods()); err != nil {
+			return fmt.Errorf("error parsing Proxy-List: %w", err)
+		}
 	}
 
-	ordinal := determineBestProxyOrdinal()
-
-	// Is there no best proxy?
-	if ordinal < 0 {
-		p.debugPrint(1, "All pods dead, clearing pod list")
-
-		// Clear the pod list and try the host
-		p.Pods = map[int]*Pod{}
-		p.LastPodOrdinal = 0
-		return -1, p.Service, nil
+	newLastPodOrdinal := 0
+	for ordinal := range newProxyList {
+		if ordinal > newLastPodOrdinal {
+			newLastPodOrdinal = ordinal
+		}
 	}
 
-	u, err := url.Parse(p.formatURL(p.Pods[ordinal].IP))
-	if err != nil {
-		return 0, nil, err
+	var newPods []*Pod
+	if len(newProxyList) != 0 {
+		newPods = make([]*Pod, newLastPodOrdinal+1)
 	}
 
-	return ordinal, u, nil
-}
+	listed := int64(p.clock().Now().Sub(timeBase))
+	if listed == 0 {
+		listed = 1
+	}
 
-// Parses a proxy list header and returns the IP list
-func parseProxyList(str string) (map[int]string, error) {
-	var result map[int]string
+	for ordinal, newIP := range newProxyList {
+		if ordinal < len(p.Pods) && p.Pods[ordinal] != nil && p.Pods[ordinal].IP == newIP {
+			// Probe it again right away, the new version may have brought it back
+			p.Pods[ordinal].resetPingBackoff()
+			atomic.StoreInt64(&p.Pods[ordinal].listed, listed)
+			newPods[ordinal] = p.Pods[ordinal]
+			continue
+		}
 
-	if err := json.Unmarshal([]byte(str), &result); err != nil {
-		return result, err
+		newPods[ordinal] = newPod(p.Service, newIP)
+		newPods[ordinal].listed = listed
 	}
 
-	return result, nil
+	p.Pods = newPods
+	p.Version = version
+	p.LastPodOrdinal = newLastPodOrdinal
+	p.list = list
+	p.publish()
+	return nil
 }
 
-// Returns whether the proxy pod list needs to be updated (was there a change?)
-func (p *Proxy) shouldUpdateProxyList(newProxyList map[int]string, version int64) bool {
-	// Don't update for the same version. Version changes on modified StatefulSet
-	if version <= p.Version {
+// Returns whether the request can be retried after an error of the kind
+// These errors occur in edge cases where the last proxy terminates just as the client gets a burst of messages
+// A refused connection never reached the pod, but the pod may have received the request before a timeout or reset, so
+// only idempotent requests are retried then, unless opted in
+func (p *Proxy) canRetry(req *http.Request, kind ErrorKind) bool {
+	switch kind {
+	case ErrorRefused:
+		return true
+	case ErrorTimeout, ErrorReset:
+		return p.Config.RetryNonIdempotent || isIdempotent(req)
+	default:
 		return false
 	}
+}
 
-	if len(p.Pods) != len(newProxyList) {
-		return true
-	}
+// Returns whether a request first attempted at start can still be retried
+func (p *Proxy) withinBudget(start time.Time) bool {
+	return p.Config.RequestBudget < 0 || p.clock().Now().Sub(start) < p.Config.RequestBudget
+}
 
-	for ordinal, ip := range newProxyList {
-		if pod, ok := p.Pods[ordinal]; !ok || ip != pod.IP {
-			return true
-		}
+// ErrorCounts returns the number of failed attempts of Do by the kind of their error, for metrics
+func (p *Proxy) ErrorCounts() map[ErrorKind]uint64 {
+	counts := make(map[ErrorKind]uint64, errorKinds)
+	for kind := ErrorOther; kind < errorKinds; kind++ {
+		counts[kind] = atomic.LoadUint64(&p.errorCounts[kind])
 	}
 
-	return false
+	return counts
 }
 
-// Marks a proxy pod as dead
-func (p *Proxy) markProxyPodAsDead(proxyOrdinal int) {
-	p.RLock()
-	defer p.RUnlock()
-
-	pod, ok := p.Pods[proxyOrdinal]
-	if !ok {
-		return
+// Returns whether sending the request twice has the same effect as once: its method is idempotent (RFC 9110), or it
+// has a Proxy-Idempotency-Key the proxies deduplicate it by
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
 	}
 
-	pod.Counter = -1
+	return req.Header.Get("Proxy-Idempotency-Key") != ""
 }
 
-// Updates a specific proxy pod
-func (p *Proxy) updateProxyPod(proxyOrdinal int, proxyCounter int64, proxyFree int64) {
-	proxyPod, ok := p.Pods[proxyOrdinal]
-	if !ok {
-		return
-	}
+// Do forwards a non-blocking HTTP request to the proxy
+// Each attempt sends a clone of the request, which is left as is apart from its body being read and closed, like with
+// http.Client.Do. The response's Request is the clone sent by the last attempt. A request without a body, or with a
+// GetBody, can be sent by several Do calls at once
+// With Config.CoalesceGets, identical GETs in flight at once share the response of a single request
+// With Config.MirrorPercent, a share of the requests is also sent to the Config.MirrorURL
+// With Config.Cache, GETs are answered from the cache while fresh, and revalidated through the proxies once stale
+func (p *Proxy) Do(client *http.Client, req *http.Request) (*http.Response, error) {
+	p.use()
 
-	// Is this data too old?
-	if proxyCounter <= proxyPod.Counter {
-		return
+	if p.Config.Cache != nil && isCacheable(req) {
+		return p.doCached(client, req)
 	}
 
-	proxyPod.Lock()
-	defer proxyPod.Unlock()
-
-	// Check again
-	if proxyCounter <= proxyPod.Counter {
-		return
-	}
+	return p.send(client, req)
+}
 
-	// Fill in data
-	proxyPod.Counter = proxyCounter
-	proxyPod.Free = proxyFree
-	proxyPod.Timestamp = time.Now()
+// DoContext forwards the request like Do, with the context in place of the request's own
+// Once the context is done, the pod selection, the attempt in flight and its retries stop, returning a *ProxyError
+// wrapping the context's error. A request waiting for a coalesced response stops waiting, while a buffered or
+// mirrored one outlives the context, until it is sent or the proxy is destroyed
+func (p *Proxy) DoContext(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	return p.Do(client, req.WithContext(ctx))
 }
 
-// Updates the proxy's dataset (performs a locking operation)
-func updateKnownProxies(p *Proxy, header *http.Header) (int, error) {
-	// Parse data from headers
-	newProxyFree, err := strconv.ParseInt(header.Get("Proxy-Free"), 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("error parsing Proxy-Free: %v", err)
+// Sends the request through the proxies, mirrored, spooled, buffered and coalesced as configured
+func (p *Proxy) send(client *http.Client, req *http.Request) (*http.Response, error) {
+	if p.shouldMirror() {
+		var err error
+		if req, err = p.mirror(client, req); err != nil {
+			return nil, newProxyError("Do", "send", -1, nil, 1, err)
+		}
 	}
 
-	proxyOrdinal, err := strconv.ParseInt(header.Get("Proxy-Ordinal"), 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("error parsing Proxy-Ordinal: %v", err)
+	if p.Config.Spool == nil || !isSpoolable(req) {
+		return p.sendOffline(client, req, "")
 	}
 
-	version, err := strconv.ParseInt(header.Get("Proxy-Version"), 10, 64)
+	req, key, err := p.spool(req)
 	if err != nil {
-		return 0, fmt.Errorf("error parsing Proxy-Version: %v", err)
+		return nil, newProxyError("Do", "send", -1, nil, 1, err)
 	}
 
-	proxyCounter, err := strconv.ParseInt(header.Get("Proxy-Counter"), 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("error parsing Proxy-Counter: %v", err)
+	// Requests that could not reach the proxies are kept, to be sent again after a restart
+	resp, err := p.sendOffline(client, req, key)
+	if err == nil || (err != ErrBuffered && !p.canBuffer(req, err)) {
+		p.unspool(key)
 	}
 
-	proxyStatus, err := strconv.ParseInt(header.Get("Proxy-Status"), 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("error parsing Proxy-Status: %v", err)
+	return resp, err
+}
+
+// Sends the request through the proxies, buffering it while they are unreachable as configured
+// The spool key of a buffered request is removed from the spool once it is flushed
+func (p *Proxy) sendOffline(client *http.Client, req *http.Request, key string) (*http.Response, error) {
+	if p.Config.OfflineBuffer <= 0 {
+		return p.dispatch(client, req)
 	}
 
-	newProxyList, err := parseProxyList(header.Get("Proxy-List"))
+	// Keep the body to buffer the request
+	req, err := withGetBody(req)
 	if err != nil {
-		return 0, fmt.Errorf("error parsing Proxy-List: %v", err)
+		return nil, newProxyError("Do", "send", -1, nil, 1, err)
 	}
 
-	// Do we need to update the pod list?
-	p.RLock()
-	proxyListNeedsUpdate := p.shouldUpdateProxyList(newProxyList, version)
-	p.RUnlock()
+	resp, err := p.dispatch(client, req)
+	if err != nil && req.Context().Err() == nil && p.canBuffer(req, err) && p.bufferOffline(client, req, key) {
+		p.debugPrint(2, "Proxies are unreachable, buffered request to %v", req.URL)
+		return nil, ErrBuffered
+	}
 
-	// We need to update
-	if proxyListNeedsUpdate {
-		p.Lock()
+	return resp, err
+}
 
-		// Check if we are still the latest
-		if p.Version < version {
-			newPods := map[int]*Pod{}
+// Sends the request through the proxies, coalesced as configured
+func (p *Proxy) dispatch(client *http.Client, req *http.Request) (*http.Response, error) {
+	if p.Config.CoalesceGets && isCoalescable(req) {
+		return p.doCoalesced(client, req)
+	}
 
-			newLastPodOrdinal := 0
-			for ordinal, newIP := range newProxyList {
-				if ordinal > newLastPodOrdinal {
-					newLastPodOrdinal = ordinal
-				}
+	return p.do(client, req)
+}
 
-				if pod, ok := p.Pods[ordinal]; ok {
-					if pod.IP == newIP {
-						newPods[ordinal] = pod
-						continue
-					}
-				}
+// Forwards the request to the proxy, retrying it as configured
+func (p *Proxy) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	// Bodies that can not be recreated are buffered, so they can be replayed on retries
+	var body *replayableBody
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil && p.Config.Attempts > 1 {
+		var err error
+		if body, err = newReplayableBody(req.Body); err != nil {
+			return nil, newProxyError("Do", "send", -1, nil, 1, err)
+		}
 
-				newPods[ordinal] = &Pod{IP: newIP}
-			}
+		defer body.release()
+	}
 
-			p.Pods = newPods
-			p.Version = version
-			p.LastPodOrdinal = newLastPodOrdinal
-		}
+	start := p.clock().Now()
 
-		p.Unlock()
+	// Effectively once, the attempts go to the pod deduplicating the key
+	var key string
+	if p.Config.EffectivelyOnce {
+		key = req.Header.Get("Proxy-Idempotency-Key")
 	}
 
-	// Update the pod
-	p.RLock()
-	p.updateProxyPod(int(proxyOrdinal), proxyCounter, newProxyFree)
-	p.RUnlock()
+	// The pod of the key is only known with the pods, the service may route the request to any pod, so the request
+	// fails rather than going to it if no pod is found in time
+	// Without a budget, the wait is bounded by a round of pings per attempt, unless the attempts are unlimited
+	if key != "" && p.snapshot().count == 0 {
+		wait := p.Config.RequestBudget
+		if wait < 0 && p.Config.Attempts != UnlimitedAttempts {
+			wait = time.Duration(p.Config.Attempts) * p.Config.PingInterval
+		}
 
-	return int(proxyStatus), nil
-}
+		ctx := req.Context()
+		if wait > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, wait)
+			defer cancel()
+		}
 
-// These errors occur in edge cases where the last proxy terminates just as the client gets a burst of messages
-// This means the client thinks the last proxy is still alive when it actually isn't
-func isRetryError(err error) bool {
-	return strings.Contains(err.Error(), "connection timed out") || strings.Contains(err.Error(), "connection refused")
-}
+		if err := p.WaitReady(ctx); err != nil {
+			if err == ErrClosed {
+				return nil, err
+			}
+
+			return nil, newProxyError("Do", "select", -1, nil, 1, &sentinelError{sentinel: ErrAllPodsDead, err: err})
+		}
+	}
 
-// Do forwards a non-blocking HTTP request to the proxy
-func (p *Proxy) Do(client *http.Client, req *http.Request) (*http.Response, error) {
 	for attempt := uint(1); ; attempt++ {
-		p.Lock()
+		// Stop retrying once destroyed or canceled
+		if p.Closed() {
+			return nil, ErrClosed
+		}
 
-		// Determine the best proxy
-		proxyOrdinal, proxyURL, err := p.determineBestProxy()
-		if err != nil {
-			p.Unlock()
-			return nil, err
+		if err := req.Context().Err(); err != nil {
+			return nil, newProxyError("Do", "select", -1, nil, attempt, err)
 		}
 
-		if proxyOrdinal >= 0 {
-			// Decrement free count as a prediction
-			atomic.AddInt64(&p.Pods[proxyOrdinal].Free, -1*int64(p.Config.NumberOfSenders))
+		// Determine the best proxy
+		proxyOrdinal, proxyURL, reserved, err := p.selectProxy(p.numberOfSenders(), key)
+		if err != nil {
+			return nil, newProxyError("Do", "select", proxyOrdinal, nil, attempt, err)
 		}
 
 		p.debugPrint(3, "Sending request to proxy %v: %v", proxyOrdinal, proxyURL.String())
-		p.Unlock()
 
-		// Do the actual request
-		req.Header.Set("Forward-To", req.URL.String())
-		req.URL = proxyURL
+		// Do the actual request, with a fresh body on retries
+		attemptReq := req.Clone(req.Context())
+		attemptReq.Header.Set("Forward-To", req.URL.String())
+		attemptReq.Header.Set("Proxy-Protocol-Version", strconv.Itoa(ProtocolVersion))
+		if attemptReq.Header.Get("Proxy-Sender") == "" {
+			attemptReq.Header.Set("Proxy-Sender", p.Config.SenderID)
+		}
+		attemptReq.URL = proxyURL
+		attemptReq.RequestURI = ""
+
+		if body != nil {
+			attemptReq.Body = body.reader()
+		} else if attempt > 1 && req.GetBody != nil {
+			if attemptReq.Body, err = req.GetBody(); err != nil {
+				reserved.rollback()
+				return nil, newProxyError("Do", "send", proxyOrdinal, proxyURL, attempt, err)
+			}
+		}
 
 		// Pass along the client's TLS setting for the Proxy to use
 		transport, ok := client.Transport.(*http.Transport)
 		if ok && transport.TLSClientConfig != nil {
 			if transport.TLSClientConfig.InsecureSkipVerify {
-				req.Header.Set("Insecure-Skip-Verify", "true")
+				attemptReq.Header.Set("Insecure-Skip-Verify", "true")
 			}
 		}
 
-		resp, err := client.Do(req)
+		// The hooks cost an atomic load each while disabled
+		metrics := p.loadMetrics()
+		var sent time.Time
+		if metrics != nil {
+			sent = p.clock().Now()
+		}
+
+		var finish func(*http.Response, error)
+		if tracer := p.loadTracer(); tracer != nil {
+			finish = p.traceAttempt(tracer, attemptReq, proxyOrdinal, attempt)
+		}
+
+		resp, err := p.sendAttempt(client, attemptReq)
+		if finish != nil {
+			finish(resp, err)
+		}
+
 		if err != nil {
+			// The pod most likely never received the request (e.g. connection refused)
+			reserved.rollback()
+
+			kind := classifyError(err)
+			atomic.AddUint64(&p.errorCounts[kind], 1)
+
+			if metrics != nil {
+				metrics.Attempt(proxyOrdinal, 0, newProxyError("Do", "send", proxyOrdinal, proxyURL, attempt, err), p.clock().Now().Sub(sent))
+			}
+
+			// A canceled request says nothing about the pod
+			if req.Context().Err() != nil {
+				return nil, newProxyError("Do", "send", proxyOrdinal, proxyURL, attempt, err)
+			}
+
 			if proxyOrdinal >= 0 {
 				p.markProxyPodAsDead(proxyOrdinal)
 
 				// Retry if needed
-				if attempt < p.Config.Attempts && isRetryError(err) {
-					continue
+				if p.canRetry(req, kind) {
+					if attempt < p.Config.Attempts && p.withinBudget(start) {
+						continue
+					}
+
+					err = &sentinelError{sentinel: ErrAttemptsExhausted, err: err}
 				}
+			} else {
+				// No live pod was known, and the service failed as well
+				err = &sentinelError{sentinel: ErrAllPodsDead, err: err}
 			}
 
-			return nil, err
+			return nil, newProxyError("Do", "send", proxyOrdinal, proxyURL, attempt, err)
+		}
+
+		// Parse the response, whose free count replaces the prediction
+		proxyStatus, err := updateKnownProxies(p, &resp.Header)
+		reserved.release()
+
+		err = newProxyError("Do", "parse", proxyOrdinal, proxyURL, attempt, err)
+		if metrics != nil {
+			metrics.Attempt(proxyOrdinal, proxyStatus, err, p.clock().Now().Sub(sent))
 		}
 
-		// Parse the response
-		_, err = updateKnownProxies(p, &resp.Header)
 		if err != nil {
 			// Only fails if the proxy sends back invalid headers
+			resp.Body.Close()
 			return nil, err
 		}
 
 		// Return response without proxy headers, except Proxy-Status
-		resp.Header.Del("Proxy-Free")
-		resp.Header.Del("Proxy-Ordinal")
-		resp.Header.Del("Proxy-Version")
-		resp.Header.Del("Proxy-List")
+		removeProxyHeaders(resp.Header)
 		return resp, nil
 	}
 }
 
+// Removes the headers describing the pod from a response, except Proxy-Status
+func removeProxyHeaders(header http.Header) {
+	header.Del("Proxy-Free")
+	header.Del("Proxy-Ordinal")
+	header.Del("Proxy-Version")
+	header.Del("Proxy-List")
+	header.Del("Proxy-Protocol-Version")
+	header.Del("Proxy-Epoch")
+	header.Del("Proxy-List-Encoding")
+	header.Del("Proxy-Senders")
+	header.Del("Proxy-Max-Proxies")
+	header.Del("Proxy-Headroom")
+	header.Del("Proxy-Max-Scale")
+	for _, name := range []string{"Proxy-Free", "Proxy-Ordinal", "Proxy-Version", "Proxy-List", "Proxy-Protocol-Version"} {
+		for _, legacyName := range legacyHeaders[name] {
+			header.Del(legacyName)
+		}
+	}
+}
+
+// Sends an attempt of Do, bounded by AttemptTimeout until the response's headers arrive
+// The attempt's context lasts until its body is closed, so the timeout can not cut the body short
+func (p *Proxy) sendAttempt(client *http.Client, req *http.Request) (*http.Response, error) {
+	timeout := p.Config.AttemptTimeout
+	if timeout <= 0 {
+		return client.Do(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+
+	resp, err := client.Do(req.WithContext(ctx))
+
+	// The timer may fire just as the headers arrive, canceling the body
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+			err = context.Canceled
+		}
+
+		cancel()
+		return nil, &attemptTimeoutError{timeout: timeout, err: err}
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
 // Ensure attempts to ensure there are enough proxies to handle the predicted incoming requests
+// ErrMaxScaleReached is returned when the proxies are at their maximum scale and can not take them all, and
+// ErrEnsureCooldown when the previous ensure was within the EnsureCooldown
 func (p *Proxy) Ensure(client *http.Client, ensureRequests int) error {
+	if p.Closed() {
+		return ErrClosed
+	}
+
+	p.use()
+
+	// The proxies can not scale up past their maximum, until a response reports headroom again
+	if max, headroom, ok := p.MaxScale(); ok && headroom == 0 {
+		p.debugPrint(2, "Not sending ensure request, the proxies are at their maximum of %v", max)
+		return ErrMaxScaleReached
+	}
+
+	// Claim the cool-down, so concurrent ensures within it send a single request
+	if p.Config.EnsureCooldown > 0 {
+		now := int64(p.clock().Now().Sub(timeBase))
+		last := atomic.LoadInt64(&p.lastEnsure)
+		if last != 0 && now-last < int64(p.Config.EnsureCooldown) || !atomic.CompareAndSwapInt64(&p.lastEnsure, last, now) {
+			p.debugPrint(2, "Not sending ensure request, cooling down")
+			return ErrEnsureCooldown
+		}
+	}
+
 	// Create the request
 	req, err := http.NewRequest("POST", p.Service.String(), nil)
 	if err != nil {
-		return err
+		return newProxyError("Ensure", "send", -1, p.Service, 1, err)
+	}
+
+	// Encode the Proxy-Ensure-Requests header, also under its legacy name, and the constraints of the scaling
+	setProxyHeader(req.Header, "Proxy-Ensure-Requests", strconv.Itoa(ensureRequests))
+	if p.Config.EnsureMaxPods > 0 {
+		req.Header.Set("Proxy-Ensure-Max-Proxies", strconv.FormatUint(uint64(p.Config.EnsureMaxPods), 10))
 	}
 
-	// Encode the Ensure-Request header
-	req.Header.Set("Ensure-Requests", strconv.Itoa(ensureRequests))
+	if p.Config.EnsureStep > 0 {
+		req.Header.Set("Proxy-Ensure-Step", strconv.FormatUint(uint64(p.Config.EnsureStep), 10))
+	}
+	req.Header.Set("Proxy-Protocol-Version", strconv.Itoa(ProtocolVersion))
+	req.Header.Set("Proxy-Sender", p.Config.SenderID)
 
 	p.debugPrint(2, "Sending ensure request to: %v", p.Service.String())
 
 	// Do the request
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return newProxyError("Ensure", "send", -1, req.URL, 1, err)
 	}
 
 	defer resp.Body.Close()
@@ -505,14 +1715,73 @@ func (p *Proxy) Ensure(client *http.Client, ensureRequests int) error {
 	proxyStatus, err := updateKnownProxies(p, &resp.Header)
 	if err != nil {
 		// Only fails if the proxy sends back invalid headers
-		return err
+		return newProxyError("Ensure", "parse", -1, req.URL, 1, err)
+	}
+
+	// Without Proxy-Status, the response's status is the proxy's
+	if proxyStatus == 0 {
+		proxyStatus = resp.StatusCode
 	}
 
 	if proxyStatus == http.StatusOK {
+		// The proxies scaled up as far as they can, but not enough for the requests
+		if proxyHeader(resp.Header, "Proxy-Max-Scale") == "true" {
+			return ErrMaxScaleReached
+		}
+
 		// Ensure request succeeded
 		return nil
 	}
 
 	// Unexpected error with the request
-	return errors.New("Unexpected proxy status code " + strconv.Itoa(proxyStatus))
+	return &ProxyError{
+		Op:      "Ensure",
+		Phase:   "status",
+		Ordinal: -1,
+		IP:      req.URL.Hostname(),
+		Attempt: 1,
+		Status:  proxyStatus,
+		Err:     errors.New("Unexpected proxy status code " + strconv.Itoa(proxyStatus)),
+	}
+}
+
+// MaxScale returns the maximum number of pods the proxies scale up to, and how many more pods they can scale up, as
+// last reported by the proxies. ok is false while they are unbounded or have not reported it
+func (p *Proxy) MaxScale() (max int, headroom int, ok bool) {
+	t := p.table()
+	maxProxies := atomic.LoadInt64(&t.maxProxies)
+	if maxProxies == 0 {
+		return 0, 0, false
+	}
+
+	return int(maxProxies), int(atomic.LoadInt64(&t.headroom)), true
+}
+
+// ProtocolVersion returns the version of the protocol spoken with every known pod, the lowest of the client's and the
+// pods', so features of newer versions can be used only once no older pod remains, e.g. during rolling upgrades
+// It is 1 until a pod responds
+func (p *Proxy) ProtocolVersion() int {
+	version := int64(ProtocolVersion)
+	known := false
+	for _, pod := range p.snapshot().pods {
+		if pod == nil {
+			continue
+		}
+
+		podVersion := atomic.LoadInt64(&pod.ProtocolVersion)
+		if podVersion == 0 {
+			continue
+		}
+
+		known = true
+		if podVersion < version {
+			version = podVersion
+		}
+	}
+
+	if !known {
+		return 1
+	}
+
+	return int(version)
 }
@@ -0,0 +1,371 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Returns the IPs of count pods by ordinal
+func testList(count int) map[int]string {
+	list := map[int]string{}
+	for ordinal := 0; ordinal < count; ordinal++ {
+		list[ordinal] = fmt.Sprintf("10.0.%v.%v", ordinal/256, ordinal%256)
+	}
+
+	return list
+}
+
+// Returns the headers of a response of the pod
+func testHeader(ordinal int, counter int64, free int64, version int64, list map[int]string) http.Header {
+	listJSON, _ := json.Marshal(list)
+
+	header := http.Header{}
+	header.Set("Proxy-Counter", strconv.FormatInt(counter, 10))
+	header.Set("Proxy-Free", strconv.FormatInt(free, 10))
+	header.Set("Proxy-Ordinal", strconv.Itoa(ordinal))
+	header.Set("Proxy-Status", "200")
+	header.Set("Proxy-Version", strconv.FormatInt(version, 10))
+	header.Set("Proxy-List", string(listJSON))
+	header.Set("Proxy-Protocol-Version", strconv.Itoa(ProtocolVersion))
+	header.Set("Proxy-Epoch", "1")
+	return header
+}
+
+// Returns a proxy knowing count pods, each with the free requests
+func newTestProxy(tb testing.TB, count int, free int64) *Proxy {
+	p, err := New("http://proxy.test:8080/")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(p.Destroy)
+
+	list := testList(count)
+	for ordinal := 0; ordinal < count; ordinal++ {
+		header := testHeader(ordinal, 1, free, 1, list)
+		if _, err := updateKnownProxies(p, &header); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return p
+}
+
+func TestUpdateKnownProxies(t *testing.T) {
+	p := newTestProxy(t, 3, 10)
+
+	s := p.snapshot()
+	if s.version != 1 || s.count != 3 {
+		t.Fatalf("got version %v with %v pods, expected version 1 with 3", s.version, s.count)
+	}
+
+	// Older counters are ignored, newer ones replace the free count
+	header := testHeader(1, 1, 2, 1, testList(3))
+	updateKnownProxies(p, &header)
+	if free := s.pod(1).Free; free != 10 {
+		t.Errorf("a stale response set the free count to %v", free)
+	}
+
+	header = testHeader(1, 2, 2, 1, testList(3))
+	updateKnownProxies(p, &header)
+	if free := s.pod(1).Free; free != 2 {
+		t.Errorf("got free count %v, expected 2", free)
+	}
+
+	// A newer version replaces the pods
+	header = testHeader(0, 3, 10, 2, testList(2))
+	updateKnownProxies(p, &header)
+	if s := p.snapshot(); s.version != 2 || s.count != 2 {
+		t.Errorf("got version %v with %v pods, expected version 2 with 2", s.version, s.count)
+	}
+}
+
+// Responses of the known version are parsed without allocating, and a newer version listing the same pods does not
+// parse the list again
+func TestUpdateKnownProxiesAllocs(t *testing.T) {
+	p := newTestProxy(t, 10, 10)
+	list := testList(10)
+
+	const runs = 100
+	headers := make([]http.Header, runs+1)
+	for i := range headers {
+		headers[i] = testHeader(i%10, int64(i+2), 10, 1, list)
+	}
+
+	i := 0
+	allocs := testing.AllocsPerRun(runs, func() {
+		updateKnownProxies(p, &headers[i])
+		i++
+	})
+
+	if allocs != 0 {
+		t.Errorf("got %v allocations for a response of the known version, expected 0", allocs)
+	}
+
+	// Only the new snapshot is allocated, far fewer than parsing the list takes
+	for i := range headers {
+		headers[i] = testHeader(i%10, int64(i+runs+2), 10, int64(i+2), list)
+	}
+
+	i = 0
+	allocs = testing.AllocsPerRun(runs, func() {
+		updateKnownProxies(p, &headers[i])
+		i++
+	})
+
+	if allocs > 2 {
+		t.Errorf("got %v allocations for a new version with the same list, expected at most 2", allocs)
+	}
+
+	s := p.snapshot()
+	if s.version != runs+2 || s.count != 10 {
+		t.Errorf("got version %v with %v pods, expected version %v with 10", s.version, s.count, runs+2)
+	}
+
+	// A different list is parsed
+	header := testHeader(0, 2*runs+3, 10, runs+3, testList(9))
+	updateKnownProxies(p, &header)
+	if s := p.snapshot(); s.version != runs+3 || s.count != 9 {
+		t.Errorf("got version %v with %v pods, expected version %v with 9", s.version, s.count, runs+3)
+	}
+}
+
+// Proxies predating the Proxy- prefix only read Ensure-Requests
+func TestEnsureSendsLegacyHeader(t *testing.T) {
+	// The pings are GETs
+	received := make(chan http.Header, 1)
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			received <- r.Header.Clone()
+		}
+
+		for k, values := range testHeader(0, 1, 10, 1, testList(1)) {
+			w.Header()[k] = values
+		}
+	}))
+
+	defer service.Close()
+
+	p, err := New(service.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Destroy()
+
+	if err := p.Ensure(service.Client(), 7); err != nil {
+		t.Fatal(err)
+	}
+
+	header := <-received
+	for _, name := range []string{"Proxy-Ensure-Requests", "Ensure-Requests"} {
+		if value := header.Get(name); value != "7" {
+			t.Errorf("got %v %q, expected 7", name, value)
+		}
+	}
+}
+
+func TestSelectProxy(t *testing.T) {
+	p := newTestProxy(t, 4, 10)
+
+	// The last pod is spared while others are free, so it can scale down
+	for ordinal, free := range map[int]int64{1: 50, 3: 100} {
+		header := testHeader(ordinal, 2, free, 1, testList(4))
+		updateKnownProxies(p, &header)
+	}
+
+	ordinal, u, reserved, err := p.selectProxy(1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ordinal != 1 || u.Hostname() != "10.0.0.1" {
+		t.Errorf("selected pod %v at %v, expected the most free pod 1", ordinal, u)
+	}
+
+	if free := p.snapshot().pod(1).Free; free != 49 {
+		t.Errorf("got free count %v after the reservation, expected 49", free)
+	}
+
+	reserved.rollback()
+	if free := p.snapshot().pod(1).Free; free != 50 {
+		t.Errorf("got free count %v after the rollback, expected 50", free)
+	}
+
+	// Keyed requests always go to the same pod
+	first, _, _, _ := p.selectProxy(1, "key")
+	for i := 0; i < 10; i++ {
+		if ordinal, _, _, _ := p.selectProxy(1, "key"); ordinal != first {
+			t.Fatalf("the key went to pod %v, then %v", first, ordinal)
+		}
+	}
+}
+
+func BenchmarkSelectProxy(b *testing.B) {
+	for _, count := range []int{1, 10, 100} {
+		b.Run(strconv.Itoa(count), func(b *testing.B) {
+			p := newTestProxy(b, count, int64(b.N)+1)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p.selectProxy(1, "")
+			}
+		})
+	}
+}
+
+func BenchmarkSelectProxyKey(b *testing.B) {
+	p := newTestProxy(b, 100, int64(b.N)+1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.selectProxy(1, "key")
+	}
+}
+
+func BenchmarkSelectProxyParallel(b *testing.B) {
+	p := newTestProxy(b, 10, 1<<40)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, _, reserved, _ := p.selectProxy(1, "")
+			reserved.release()
+		}
+	})
+}
+
+func BenchmarkParseProxyInt(b *testing.B) {
+	header := testHeader(0, 123456, 42, 7, testList(1))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parseProxyInt(header, "Proxy-Counter")
+	}
+}
+
+func BenchmarkParseProxyList(b *testing.B) {
+	for _, count := range []int{1, 10, 100} {
+		list := testList(count)
+		listJSON, _ := json.Marshal(list)
+
+		compact := make([]string, count)
+		for ordinal, ip := range list {
+			compact[ordinal] = ip
+		}
+
+		for _, format := range []struct {
+			name string
+			list string
+		}{
+			{"json", string(listJSON)},
+			{"compact", strings.Join(compact, ",")},
+		} {
+			b.Run(fmt.Sprintf("%v/%v", format.name, count), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := parseProxyList(format.list, DefaultMaxPods); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// The common case, a response of a known version
+func BenchmarkUpdateKnownProxies(b *testing.B) {
+	p := newTestProxy(b, 10, 10)
+	list := testList(10)
+
+	headers := make([]http.Header, b.N)
+	for i := range headers {
+		headers[i] = testHeader(i%10, int64(i+2), 10, 1, list)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := updateKnownProxies(p, &headers[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Every response brings a new version with a different list, the worst case
+func BenchmarkUpdateKnownProxiesNewList(b *testing.B) {
+	p := newTestProxy(b, 10, 10)
+
+	headers := make([]http.Header, b.N)
+	for i := range headers {
+		headers[i] = testHeader(0, int64(i+2), 10, int64(i+2), testList(9+i%2))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := updateKnownProxies(p, &headers[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func FuzzUpdateKnownProxies(f *testing.F) {
+	f.Add("1", "10", "0", "200", "2", `{"0": "10.0.0.1", "1": "10.0.0.2"}`, "", "1")
+	f.Add("-5", "-1", "7", "abc", "0", `10.0.0.1,,10.0.0.3`, "", "")
+	f.Add("1", "1", "1023", "429", "9", gzipList(`{"1023": "10.0.0.1"}`), "gzip", "0")
+	f.Add("", "", "", "", "", "", "", "")
+
+	f.Fuzz(func(t *testing.T, counter, free, ordinal, status, version, list, encoding, epoch string) {
+		p, err := NewWithConfig("http://proxy.test:8080/", Config{MaxPods: 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer p.Destroy()
+
+		header := http.Header{}
+		for name, value := range map[string]string{
+			"Proxy-Counter":       counter,
+			"Proxy-Free":          free,
+			"Proxy-Ordinal":       ordinal,
+			"Proxy-Status":        status,
+			"Proxy-Version":       version,
+			"Proxy-List":          list,
+			"Proxy-List-Encoding": encoding,
+			"Proxy-Epoch":         epoch,
+		} {
+			if value != "" {
+				header.Set(name, value)
+			}
+		}
+
+		// Twice, the second time against the state of the first
+		for i := 0; i < 2; i++ {
+			updateKnownProxies(p, &header)
+
+			s := p.snapshot()
+			if len(s.pods) > 16 || s.count > len(s.pods) || s.version < 0 {
+				t.Fatalf("got %v pods (%v ordinals) of version %v", s.count, len(s.pods), s.version)
+			}
+
+			for ordinal, pod := range s.pods {
+				if pod != nil && net.ParseIP(pod.IP) == nil {
+					t.Fatalf("pod %v has IP %q", ordinal, pod.IP)
+				}
+			}
+
+			p.selectProxy(1, "")
+			p.selectProxy(1, list)
+		}
+	})
+}
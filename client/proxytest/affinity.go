@@ -0,0 +1,130 @@
+package proxytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Registers the outcome of a request answered with a 202, returning its affinity token ("<ordinal>.<id>")
+func (pod *Pod) registerJob(o *outcome) string {
+	id := strconv.FormatUint(atomic.AddUint64(&pod.lastJob, 1), 10)
+
+	pod.outcomesMu.Lock()
+	pod.pruneOutcomes()
+	pod.jobs[id] = o
+	pod.outcomesMu.Unlock()
+
+	return fmt.Sprintf("%v.%v", pod.Ordinal, id)
+}
+
+// Answers a follow-up on the request with the affinity token, from the pod holding it like the proxies: its outcome,
+// a 202 while pending, a 404 if unknown and a 410 if the pod is gone
+func (pod *Pod) followUp(w http.ResponseWriter, token string) {
+	parts := strings.SplitN(token, ".", 2)
+	ordinal, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 {
+		pod.writeProxyMetrics(w, http.StatusBadRequest)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	holder := pod.server.Pod(ordinal)
+	if holder == nil {
+		pod.writeProxyMetrics(w, http.StatusGone)
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	holder.outcomesMu.Lock()
+	holder.pruneOutcomes()
+	o, ok := holder.jobs[parts[1]]
+	holder.outcomesMu.Unlock()
+
+	if !ok {
+		pod.writeProxyMetrics(w, http.StatusNotFound)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !pod.await(o) {
+		pod.writeAccepted(w)
+		return
+	}
+
+	pod.writeOutcome(w, o, false)
+}
+
+// Status of a request answered with a 202, as answered to status queries
+type requestStatus struct {
+	Affinity string `json:"affinity"`
+	State    string `json:"state"`
+	Status   int    `json:"status,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Answers a status query of affinity tokens like the proxies, from the pods holding the requests
+func (pod *Pod) queryStatuses(w http.ResponseWriter, r *http.Request) {
+	var query struct {
+		Affinity []string `json:"affinity"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		pod.writeProxyMetrics(w, http.StatusBadRequest)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var result struct {
+		Statuses []requestStatus `json:"statuses"`
+	}
+
+	for _, token := range query.Affinity {
+		status := requestStatus{Affinity: token}
+
+		parts := strings.SplitN(token, ".", 2)
+		ordinal, err := strconv.Atoi(parts[0])
+		holder := pod.server.Pod(ordinal)
+
+		switch {
+		case err != nil || len(parts) != 2:
+			status.State = "unknown"
+		case holder == nil:
+			status.State = "lost"
+		default:
+			holder.outcomesMu.Lock()
+			holder.pruneOutcomes()
+			o, ok := holder.jobs[parts[1]]
+			holder.outcomesMu.Unlock()
+
+			if !ok {
+				status.State = "expired"
+				break
+			}
+
+			select {
+			case <-o.done:
+				if o.result.err != nil {
+					status.State = "failed"
+					status.Error = o.result.err.Error()
+				} else {
+					status.State = "delivered"
+					status.Status = o.result.resp.StatusCode
+				}
+			default:
+				status.State = "forwarding"
+			}
+		}
+
+		result.Statuses = append(result.Statuses, status)
+	}
+
+	body, _ := json.Marshal(result)
+
+	w.Header().Set("Content-Type", "application/json")
+	pod.writeProxyMetrics(w, http.StatusOK)
+	w.Write(body)
+}
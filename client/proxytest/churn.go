@@ -0,0 +1,200 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btbd/proxy/client"
+)
+
+// ChurnOptions configures RunChurn
+type ChurnOptions struct {
+	// Steps is the number of times the StatefulSet changes, default 100
+	Steps int
+
+	// RequestsPerStep is the number of requests sent between changes, default 10
+	RequestsPerStep int
+
+	// MaxPods is the maximum number of pods at once, default 8
+	MaxPods int
+
+	// Seed seeds the changes, so a failing run can be replayed
+	Seed int64
+}
+
+// RunChurn simulates rapid StatefulSet churn against a client, returning the violated invariants
+// Between requests, pods are added and removed, their IPs reused by other ordinals, versions skipped and pods killed
+// The invariants are that the client does not panic, only routes requests to the pods of the version it knows, whose
+// pods it knows exactly, and that its version never decreases
+func RunChurn(options ChurnOptions) []error {
+	if options.Steps == 0 {
+		options.Steps = 100
+	}
+
+	if options.RequestsPerStep == 0 {
+		options.RequestsPerStep = 10
+	}
+
+	if options.MaxPods == 0 {
+		options.MaxPods = 8
+	}
+
+	random := rand.New(rand.NewSource(options.Seed))
+	f := NewFixture(1, 10)
+
+	// The pod lists by version, as served to the client
+	history := map[int64]map[int]string{1: f.list()}
+
+	// The clock is never advanced, so pings do not update the client between requests
+	clock := NewClock(time.Now())
+	p, err := client.NewWithConfig(f.URL, client.Config{
+		PingClient: f.Client(),
+		Clock:      clock,
+		Attempts:   uint(options.MaxPods) + 2,
+	})
+
+	if err != nil {
+		return []error{err}
+	}
+
+	// Wake the pings once destroyed so they stop
+	defer clock.Advance(time.Hour)
+	defer p.Destroy()
+
+	// Start the pings and wait for the first ones to be done
+	if err := p.WaitReady(context.Background()); err != nil {
+		return []error{err}
+	}
+
+	clock.BlockUntil(1)
+
+	// Guards the history and violations
+	var mu sync.Mutex
+	var violations []error
+	violate := func(format string, args ...interface{}) {
+		mu.Lock()
+		violations = append(violations, fmt.Errorf(format, args...))
+		mu.Unlock()
+	}
+
+	// Checks that requests to pods only go to the pods of the versions the client knew since the request was made, as
+	// the pings may update it in between
+	var requestVersion int64
+	httpClient := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		p.RLock()
+		version := p.Version
+		p.RUnlock()
+
+		if req.URL.Hostname() != "proxy.proxytest" {
+			found := false
+
+			mu.Lock()
+			for known := atomic.LoadInt64(&requestVersion); known <= version; known++ {
+				for _, ip := range history[known] {
+					found = found || ip == req.URL.Hostname()
+				}
+			}
+			mu.Unlock()
+
+			if !found {
+				violate("request routed to %v, which is not a pod of the known version %v", req.URL.Host, version)
+			}
+		}
+
+		return f.RoundTrip(req)
+	})}
+
+	version := int64(1)
+	lastVersion := int64(0)
+	for step := 0; step < options.Steps; step++ {
+		// Change the StatefulSet, drawing IPs from a small pool so they get reused by other ordinals
+		count := random.Intn(options.MaxPods) + 1
+		pool := random.Perm(options.MaxPods * 2)
+
+		ips := map[int]string{}
+		for ordinal := 0; ordinal < count; ordinal++ {
+			ips[ordinal] = fmt.Sprintf("10.0.1.%v", pool[ordinal]+1)
+		}
+
+		version += int64(random.Intn(3) + 1)
+
+		mu.Lock()
+		history[version] = ips
+		mu.Unlock()
+
+		f.SetPods(ips, version, int64(random.Intn(20)))
+
+		if random.Intn(4) == 0 {
+			f.Kill(random.Intn(count))
+		}
+
+		for i := 0; i < options.RequestsPerStep; i++ {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						violate("client panicked at step %v: %v", step, r)
+					}
+				}()
+
+				p.RLock()
+				atomic.StoreInt64(&requestVersion, p.Version)
+				p.RUnlock()
+
+				req, err := http.NewRequest(http.MethodPost, "http://recipient/", nil)
+				if err != nil {
+					violate("%v", err)
+					return
+				}
+
+				// Failures are expected while pods die
+				if resp, err := p.Do(httpClient, req); err == nil {
+					resp.Body.Close()
+				}
+			}()
+
+			p.RLock()
+			if p.Version < lastVersion {
+				violate("client version went from %v back to %v at step %v", lastVersion, p.Version, step)
+			}
+
+			lastVersion = p.Version
+
+			if len(p.Pods) != 0 {
+				mu.Lock()
+				known := history[p.Version]
+				mu.Unlock()
+
+				count := 0
+				for ordinal, pod := range p.Pods {
+					if pod == nil {
+						continue
+					}
+
+					count++
+					if known[ordinal] != pod.IP {
+						violate("client has pod %v at %v, which is %q in its version %v", ordinal, pod.IP, known[ordinal], p.Version)
+					}
+				}
+
+				if count != len(known) {
+					violate("client has %v pods, but its version %v has %v", count, p.Version, len(known))
+				}
+			}
+			p.RUnlock()
+		}
+	}
+
+	return violations
+}
+
+// Adapts a function to an http.RoundTripper
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
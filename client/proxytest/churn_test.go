@@ -0,0 +1,22 @@
+package proxytest
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRunChurn(t *testing.T) {
+	for seed := int64(0); seed < 5; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			for _, err := range RunChurn(ChurnOptions{Seed: seed}) {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRunChurnManyPods(t *testing.T) {
+	for _, err := range RunChurn(ChurnOptions{Steps: 50, RequestsPerStep: 20, MaxPods: 32, Seed: 42}) {
+		t.Error(err)
+	}
+}
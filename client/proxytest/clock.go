@@ -0,0 +1,105 @@
+package proxytest
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a manual clock for the client's Config.Clock, whose time only moves when advanced
+// Sleeping goroutines wake once the clock is advanced past their deadline
+type Clock struct {
+	sync.Mutex
+
+	now      time.Time
+	sleepers []*sleeper
+
+	// changed is closed and replaced whenever a goroutine starts sleeping
+	changed chan struct{}
+}
+
+// Goroutine sleeping until a deadline
+type sleeper struct {
+	deadline time.Time
+	wake     chan struct{}
+}
+
+// NewClock returns a clock starting at the time
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now, changed: make(chan struct{})}
+}
+
+// Now returns the clock's time
+func (c *Clock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.now
+}
+
+// Sleep blocks until the clock is advanced by the duration
+func (c *Clock) Sleep(d time.Duration) {
+	c.Lock()
+	if d <= 0 {
+		c.Unlock()
+		return
+	}
+
+	s := &sleeper{deadline: c.now.Add(d), wake: make(chan struct{})}
+	c.sleepers = append(c.sleepers, s)
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.Unlock()
+
+	<-s.wake
+}
+
+// Advance moves the clock forward by the duration, waking the goroutines whose sleep is over in deadline order
+func (c *Clock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.now = c.now.Add(d)
+
+	sort.SliceStable(c.sleepers, func(i, j int) bool {
+		return c.sleepers[i].deadline.Before(c.sleepers[j].deadline)
+	})
+
+	remaining := c.sleepers[:0]
+	for _, s := range c.sleepers {
+		if s.deadline.After(c.now) {
+			remaining = append(remaining, s)
+			continue
+		}
+
+		close(s.wake)
+	}
+
+	c.sleepers = remaining
+}
+
+// Sleepers returns the number of goroutines sleeping on the clock
+func (c *Clock) Sleepers() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return len(c.sleepers)
+}
+
+// BlockUntil blocks until the number of goroutines sleeping on the clock is at least n, e.g. to wait for the client
+// to finish a round of pings before advancing the clock
+func (c *Clock) BlockUntil(n int) {
+	for {
+		c.Lock()
+		if len(c.sleepers) >= n {
+			c.Unlock()
+			return
+		}
+
+		changed := c.changed
+		c.Unlock()
+
+		<-changed
+	}
+}
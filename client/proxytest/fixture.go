@@ -0,0 +1,435 @@
+package proxytest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/btbd/proxy/client"
+)
+
+// Headers are the Proxy-* response headers describing a pod and the StatefulSet
+type Headers struct {
+	Ordinal int
+	Counter int64
+	Free    int64
+	Status  int
+	Version int64
+
+	// List maps the ordinals of the ready pods to their IPs
+	List map[int]string
+
+	// Leader is the pod name of the leader, omitted if empty
+	Leader string
+
+	// ProtocolVersion is the Proxy-Protocol-Version, omitted if 0 like by pods predating it
+	ProtocolVersion int
+
+	// Epoch is the Proxy-Epoch, omitted if 0 like by pods predating it
+	Epoch int64
+
+	// Senders is the Proxy-Senders, omitted if 0 like by pods predating it
+	Senders int64
+
+	// CompressList compresses the Proxy-List with gzip and base64, like proxies do for large lists
+	CompressList bool
+}
+
+// ListHeader formats a Proxy-List header of the pod IPs by ordinal
+func ListHeader(ips map[int]string) string {
+	list, _ := json.Marshal(ips)
+	return string(list)
+}
+
+// CompressedListHeader formats a Proxy-List header of the pod IPs by ordinal, compressed with gzip and base64 for a
+// Proxy-List-Encoding of gzip
+func CompressedListHeader(ips map[int]string) string {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write([]byte(ListHeader(ips)))
+	writer.Close()
+
+	return base64.StdEncoding.EncodeToString(buffer.Bytes())
+}
+
+// Write sets the headers on the header
+func (h Headers) Write(header http.Header) {
+	status := h.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	header.Set("Proxy-Counter", strconv.FormatInt(h.Counter, 10))
+	header.Set("Proxy-Free", strconv.FormatInt(h.Free, 10))
+	header.Set("Proxy-Ordinal", strconv.Itoa(h.Ordinal))
+	header.Set("Proxy-Status", strconv.Itoa(status))
+	header.Set("Proxy-Version", strconv.FormatInt(h.Version, 10))
+	if h.CompressList {
+		header.Set("Proxy-List", CompressedListHeader(h.List))
+		header.Set("Proxy-List-Encoding", "gzip")
+	} else {
+		header.Set("Proxy-List", ListHeader(h.List))
+	}
+
+	if h.Leader != "" {
+		header.Set("Proxy-Leader", h.Leader)
+	}
+
+	if h.ProtocolVersion != 0 {
+		header.Set("Proxy-Protocol-Version", strconv.Itoa(h.ProtocolVersion))
+	}
+
+	if h.Epoch != 0 {
+		header.Set("Proxy-Epoch", strconv.FormatInt(h.Epoch, 10))
+	}
+
+	if h.Senders != 0 {
+		header.Set("Proxy-Senders", strconv.FormatInt(h.Senders, 10))
+	}
+}
+
+// Header returns the headers as a new header
+func (h Headers) Header() http.Header {
+	header := http.Header{}
+	h.Write(header)
+	return header
+}
+
+// Behavior answers a request to a fixture pod, scripted per pod
+type Behavior func(pod *FixturePod, req *http.Request) (*http.Response, error)
+
+// Respond answers with the status and body, as forwarded from the recipient
+func Respond(status int, body string) Behavior {
+	return func(pod *FixturePod, req *http.Request) (*http.Response, error) {
+		return pod.response(req, http.StatusOK, status, body), nil
+	}
+}
+
+// Accept answers with a 202, as if the recipient outlived the proxy timeout
+func Accept() Behavior {
+	return func(pod *FixturePod, req *http.Request) (*http.Response, error) {
+		return pod.response(req, http.StatusAccepted, http.StatusAccepted, ""), nil
+	}
+}
+
+// Deny answers with a 429, as if the pod was full
+func Deny() Behavior {
+	return func(pod *FixturePod, req *http.Request) (*http.Response, error) {
+		return pod.response(req, http.StatusTooManyRequests, http.StatusTooManyRequests, ""), nil
+	}
+}
+
+// Fail fails the request without a response, as if the connection was refused
+func Fail() Behavior {
+	return func(pod *FixturePod, req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("proxytest: connection to pod %v refused: %w", pod.Ordinal, syscall.ECONNREFUSED)
+	}
+}
+
+// WithFree sets the free requests the pod reports before answering with the behavior
+func WithFree(free int64, behavior Behavior) Behavior {
+	return func(pod *FixturePod, req *http.Request) (*http.Response, error) {
+		pod.Free = free
+		return behavior(pod, req)
+	}
+}
+
+// FixturePod is a scripted pod of a fixture
+type FixturePod struct {
+	Ordinal int
+	IP      string
+
+	// Free and Counter are reported in the pod's Proxy-* headers, the counter increments on every response
+	Free    int64
+	Counter int64
+
+	// Requests are the forwarded and ensure requests the pod received, in order
+	// The fields are guarded by the fixture
+	Requests []*http.Request
+
+	fixture *Fixture
+	script  []Behavior
+	dead    bool
+
+	// protocolVersion is the Proxy-Protocol-Version the pod reports, 0 to omit it like older pods
+	protocolVersion int
+
+	// epoch is the Proxy-Epoch the pod reports, 0 to omit it like older pods
+	epoch int64
+}
+
+// Script queues behaviors answering the pod's next forwarded and ensure requests in order, after which they are
+// answered with an empty 200 (pings always are)
+func (pod *FixturePod) Script(behaviors ...Behavior) {
+	pod.fixture.Lock()
+	defer pod.fixture.Unlock()
+
+	pod.script = append(pod.script, behaviors...)
+}
+
+// Sequence scripts the statuses of the pod's next forwarded requests in order: 429s deny them, 202s accept them and
+// other statuses respond with an empty body, e.g. Sequence(429, 202, 200)
+func (pod *FixturePod) Sequence(statuses ...int) {
+	behaviors := make([]Behavior, len(statuses))
+	for i, status := range statuses {
+		switch status {
+		case http.StatusTooManyRequests:
+			behaviors[i] = Deny()
+		case http.StatusAccepted:
+			behaviors[i] = Accept()
+		default:
+			behaviors[i] = Respond(status, "")
+		}
+	}
+
+	pod.Script(behaviors...)
+}
+
+// SetProtocolVersion sets the Proxy-Protocol-Version the pod reports, 0 to omit it like pods predating it
+func (pod *FixturePod) SetProtocolVersion(version int) {
+	pod.fixture.Lock()
+	defer pod.fixture.Unlock()
+
+	pod.protocolVersion = version
+}
+
+// Restart restarts the pod's process, resetting its counter and reporting a new epoch
+func (pod *FixturePod) Restart() {
+	pod.fixture.Lock()
+	defer pod.fixture.Unlock()
+
+	pod.Counter = 0
+	pod.epoch++
+	pod.dead = false
+}
+
+// Returns a response of the pod with its Proxy-* headers, must be called with the fixture locked
+func (pod *FixturePod) response(req *http.Request, proxyStatus int, status int, body string) *http.Response {
+	pod.Counter++
+
+	header := Headers{
+		Ordinal: pod.Ordinal,
+		Counter: pod.Counter,
+		Free:    pod.Free,
+		Status:  proxyStatus,
+		Version: pod.fixture.version,
+		List:    pod.fixture.list(),
+		Leader:  "proxy-0",
+
+		ProtocolVersion: pod.protocolVersion,
+		Epoch:           pod.epoch,
+	}.Header()
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%v %v", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// Fixture is a StatefulSet of scripted pods answering the client through an http.RoundTripper, without a network,
+// so tests of code built on the client can simulate scale-ups, pod death and version churn deterministically
+// Unscripted, the pods speak the protocol: pings and OPTIONS report the pods, ensure requests scale them up and
+// forwarded requests are answered with an empty 200
+type Fixture struct {
+	sync.Mutex
+
+	// URL is the proxy service URL to construct the client with
+	URL string
+
+	pods    map[int]*FixturePod
+	version int64
+
+	// free is the free requests reported by new pods, and the requests each pod takes for ensure requests
+	free int64
+}
+
+// NewFixture returns a fixture of the number of pods, each reporting the free requests
+func NewFixture(pods int, free int64) *Fixture {
+	f := &Fixture{
+		URL:  "http://proxy.proxytest:8080/",
+		pods: map[int]*FixturePod{},
+		free: free,
+	}
+
+	for ordinal := 0; ordinal < pods; ordinal++ {
+		f.addPod(ordinal, free)
+	}
+
+	f.version = 1
+	return f
+}
+
+// Client returns an HTTP client reaching the fixture, to pass to the client's Do and Ensure and as its PingClient
+func (f *Fixture) Client() *http.Client {
+	return &http.Client{Transport: f}
+}
+
+// Pod returns the pod with the ordinal, nil if there is none
+func (f *Fixture) Pod(ordinal int) *FixturePod {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.pods[ordinal]
+}
+
+// ScaleTo adds or removes the last pods to reach the count, bumping the version
+// Added pods report the free requests
+func (f *Fixture) ScaleTo(count int, free int64) {
+	f.Lock()
+	defer f.Unlock()
+
+	for ordinal := len(f.pods); ordinal < count; ordinal++ {
+		f.addPod(ordinal, free)
+	}
+
+	for ordinal := len(f.pods) - 1; ordinal >= count; ordinal-- {
+		delete(f.pods, ordinal)
+	}
+
+	f.version++
+}
+
+// SetPods replaces the pods with the IPs by ordinal at the version, e.g. to reuse IPs or skip versions
+// Pods keeping their ordinal and IP keep their state, added pods report the free requests
+func (f *Fixture) SetPods(ips map[int]string, version int64, free int64) {
+	f.Lock()
+	defer f.Unlock()
+
+	pods := map[int]*FixturePod{}
+	for ordinal, ip := range ips {
+		if pod, ok := f.pods[ordinal]; ok && pod.IP == ip {
+			pods[ordinal] = pod
+			continue
+		}
+
+		pods[ordinal] = &FixturePod{Ordinal: ordinal, IP: ip, Free: free, fixture: f}
+	}
+
+	f.pods = pods
+	f.version = version
+}
+
+// Kill makes requests to the pod fail without removing it from the proxy list, like a crashed pod
+func (f *Fixture) Kill(ordinal int) {
+	f.Lock()
+	defer f.Unlock()
+
+	if pod, ok := f.pods[ordinal]; ok {
+		pod.dead = true
+	}
+}
+
+// BumpVersion bumps the version without changing the pods, like an unrelated update of the StatefulSet
+func (f *Fixture) BumpVersion() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.version++
+}
+
+// RoundTrip answers a request to the service or a pod with the pod's next scripted behavior
+// Requests to the service are answered by the first pod, like the headless service's DNS would
+func (f *Fixture) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	var pod *FixturePod
+	if req.URL.Hostname() == "proxy.proxytest" {
+		pod = f.pods[0]
+	} else {
+		for _, other := range f.pods {
+			if other.IP == req.URL.Hostname() {
+				pod = other
+			}
+		}
+	}
+
+	if pod == nil || pod.dead {
+		return nil, fmt.Errorf("proxytest: no pod at %v: %w", req.URL.Host, syscall.ECONNREFUSED)
+	}
+
+	ensure := req.Header.Get("Proxy-Ensure-Requests")
+
+	// Pings are sent on a timer, so they never take scripted behaviors
+	if req.Header.Get("Forward-To") == "" && ensure == "" {
+		resp := pod.response(req, http.StatusOK, http.StatusOK, "")
+		if req.Method == http.MethodOptions {
+			resp.Header.Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, TRACE")
+			resp.Header.Set("Proxy-Recipients", "grpc, grpc-transcode, http")
+			resp.Header.Set("Proxy-Priorities", "high, normal, low")
+		}
+
+		return resp, nil
+	}
+
+	pod.Requests = append(pod.Requests, req)
+
+	if len(pod.script) != 0 {
+		behavior := pod.script[0]
+		pod.script = pod.script[1:]
+		return behavior(pod, req)
+	}
+
+	// Ensure requests scale the pods up to take the requests
+	if ensure != "" {
+		requests, err := strconv.ParseInt(ensure, 10, 64)
+		if err != nil {
+			return pod.response(req, http.StatusInternalServerError, http.StatusInternalServerError, ""), nil
+		}
+
+		count := len(f.pods)
+		if f.free > 0 {
+			count = int((requests + f.free - 1) / f.free)
+		}
+
+		if count > len(f.pods) {
+			for ordinal := len(f.pods); ordinal < count; ordinal++ {
+				f.addPod(ordinal, f.free)
+			}
+
+			f.version++
+		}
+	}
+
+	return pod.response(req, http.StatusOK, http.StatusOK, ""), nil
+}
+
+// Returns the IPs of the pods by ordinal, must be called with the fixture locked
+func (f *Fixture) list() map[int]string {
+	list := map[int]string{}
+	for ordinal, pod := range f.pods {
+		list[ordinal] = pod.IP
+	}
+
+	return list
+}
+
+// Adds a pod, must be called with the fixture locked
+func (f *Fixture) addPod(ordinal int, free int64) {
+	f.pods[ordinal] = &FixturePod{
+		Ordinal: ordinal,
+		IP:      fmt.Sprintf("10.0.0.%v", ordinal+1),
+		Free:    free,
+		fixture: f,
+
+		protocolVersion: client.ProtocolVersion,
+	}
+}
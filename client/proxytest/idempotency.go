@@ -0,0 +1,78 @@
+package proxytest
+
+import (
+	"net/http"
+	"time"
+)
+
+// Recipient's response to a forwarded request
+type result struct {
+	resp *http.Response
+	body []byte
+	err  error
+}
+
+// Outcome of a forwarded request, done once the recipient responded
+type outcome struct {
+	done   chan struct{}
+	result result
+
+	// expires is when the done outcome is forgotten, zero while pending, guarded by the pod's outcomesMu
+	expires time.Time
+}
+
+// Registers a request with the key, returning the original outcome if the key was already submitted to the pod
+func (pod *Pod) beginIdempotent(key string) (*outcome, bool) {
+	pod.outcomesMu.Lock()
+	defer pod.outcomesMu.Unlock()
+
+	pod.pruneOutcomes()
+	if o, ok := pod.outcomes[key]; ok {
+		return o, true
+	}
+
+	o := &outcome{done: make(chan struct{})}
+	pod.outcomes[key] = o
+	return o, false
+}
+
+// Stores the result of the request with the key, forgetting failed requests so they can be retried
+func (pod *Pod) finishIdempotent(key string, o *outcome, res result) {
+	if res.err != nil {
+		pod.outcomesMu.Lock()
+		if pod.outcomes[key] == o {
+			delete(pod.outcomes, key)
+		}
+		pod.outcomesMu.Unlock()
+	}
+
+	pod.finish(o, res)
+}
+
+// Stores the result of the outcome, which is kept for the OutcomeTTL from then
+func (pod *Pod) finish(o *outcome, res result) {
+	o.result = res
+
+	pod.outcomesMu.Lock()
+	o.expires = time.Now().Add(pod.server.Config.OutcomeTTL)
+	pod.outcomesMu.Unlock()
+
+	close(o.done)
+}
+
+// Forgets the outcomes and jobs past their expiry, must be called with outcomesMu locked
+func (pod *Pod) pruneOutcomes() {
+	now := time.Now()
+
+	for key, o := range pod.outcomes {
+		if !o.expires.IsZero() && now.After(o.expires) {
+			delete(pod.outcomes, key)
+		}
+	}
+
+	for id, o := range pod.jobs {
+		if !o.expires.IsZero() && now.After(o.expires) {
+			delete(pod.jobs, id)
+		}
+	}
+}
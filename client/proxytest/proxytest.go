@@ -0,0 +1,630 @@
+// Package proxytest runs in-process proxies speaking the proxy protocol, for end-to-end tests of senders
+// without a cluster. Each pod listens on its own port of 127.0.0.1 and is listed at a reserved IP (198.18.0.1,
+// 198.18.0.2, ...), which the server's Transport dials at the pod's port, as the client reaches pods by IP on the
+// service's port. Senders send their pings and requests with the server's HTTPClient or Transport.
+package proxytest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/btbd/proxy/client"
+)
+
+// Config configures the in-process proxies
+type Config struct {
+	// Pods is the initial number of pods, default 1
+	Pods int
+
+	// MaxPods is the maximum number of pods ensure requests scale up to, default 10
+	MaxPods int
+
+	// MaxRequests is the number of concurrent requests each pod takes before returning a 429, default 20
+	MaxRequests int
+
+	// ProxyTimeout is the time to wait for the recipient before returning a 202, default 100 milliseconds
+	ProxyTimeout time.Duration
+
+	// OutcomeTTL is the time the outcomes of requests with a Proxy-Idempotency-Key or answered with a 202 are kept
+	// once done, default 5 minutes like the proxies' affinityTTL
+	OutcomeTTL time.Duration
+}
+
+// Pod is an in-process proxy pod
+type Pod struct {
+	Ordinal int
+	IP      string
+
+	// Addr is the address of 127.0.0.1 the pod listens on, which its IP is dialed at by the server's Transport
+	Addr string
+
+	server *Server
+	http   *http.Server
+
+	active   int64
+	counter  uint64
+	requests uint64
+
+	// epoch is the pod's Proxy-Epoch, the time it started
+	epoch int64
+
+	// senders maps the Proxy-Sender of the senders to when they were last seen, reported in Proxy-Senders
+	sendersMu sync.Mutex
+	senders   map[string]time.Time
+
+	// outcomes are the outcomes of the requests with a Proxy-Idempotency-Key by key, and jobs those of the requests
+	// answered with a 202 by their Proxy-Affinity id, both kept for the OutcomeTTL once done
+	outcomesMu sync.Mutex
+	outcomes   map[string]*outcome
+	jobs       map[string]*outcome
+	lastJob    uint64
+
+	// delay is the time the pod waits before answering, failStatus the status it answers forwarded requests with
+	// instead of forwarding them, and resetting whether it drops their connections instead, see Slow, Fail and Reset
+	delay      int64
+	failStatus int32
+	resetting  int32
+}
+
+// allowedMethods are the methods forwarded to recipients, all but CONNECT
+const allowedMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, TRACE"
+
+// SenderTTL is the time a sender is counted in Proxy-Senders after its last request, like the proxies' default
+const SenderTTL = 10 * time.Second
+
+// Records the request's sender, returns the number of senders seen within the SenderTTL
+func (pod *Pod) recordSender(sender string) int {
+	pod.sendersMu.Lock()
+	defer pod.sendersMu.Unlock()
+
+	now := time.Now()
+	if sender != "" {
+		pod.senders[sender] = now
+	}
+
+	for other, lastSeen := range pod.senders {
+		if now.Sub(lastSeen) > SenderTTL {
+			delete(pod.senders, other)
+		}
+	}
+
+	return len(pod.senders)
+}
+
+// Active returns the number of requests the pod is currently forwarding
+func (pod *Pod) Active() int64 {
+	return atomic.LoadInt64(&pod.active)
+}
+
+// Requests returns the number of requests the pod has forwarded
+func (pod *Pod) Requests() uint64 {
+	return atomic.LoadUint64(&pod.requests)
+}
+
+// Server is a set of in-process proxy pods behind a service
+type Server struct {
+	sync.RWMutex
+
+	// URL is the proxy service URL to construct the client with
+	URL string
+
+	// Config is the config of the proxies
+	Config Config
+
+	port    int
+	service *http.Server
+	pods    map[int]*Pod
+	version int64
+
+	// Client is the HTTP client the pods forward requests to recipients with
+	Client *http.Client
+
+	// denying makes every pod deny requests with a 429 as if saturated
+	denying int32
+}
+
+// NewServer starts a single in-process proxy pod with the default config
+func NewServer() *Server {
+	return NewServerWithConfig(Config{})
+}
+
+// NewServerWithConfig starts in-process proxy pods with the config
+func NewServerWithConfig(config Config) *Server {
+	if config.Pods == 0 {
+		config.Pods = 1
+	}
+
+	if config.MaxPods == 0 {
+		config.MaxPods = 10
+	}
+
+	if config.MaxPods < config.Pods {
+		config.MaxPods = config.Pods
+	}
+
+	if config.MaxRequests == 0 {
+		config.MaxRequests = 20
+	}
+
+	if config.ProxyTimeout == 0 {
+		config.ProxyTimeout = 100 * time.Millisecond
+	}
+
+	if config.OutcomeTTL == 0 {
+		config.OutcomeTTL = 5 * time.Minute
+	}
+
+	s := &Server{
+		Config: config,
+		pods:   map[int]*Pod{},
+		Client: &http.Client{},
+	}
+
+	// The service takes any free port, which the pods' IPs are then dialed on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("proxytest: failed to listen: %v", err))
+	}
+
+	s.port = listener.Addr().(*net.TCPAddr).Port
+	s.URL = fmt.Sprintf("http://127.0.0.1:%v/", s.port)
+	s.service = &http.Server{Handler: http.HandlerFunc(s.serviceHandler)}
+	go s.service.Serve(listener)
+
+	s.Scale(config.Pods)
+	return s
+}
+
+// Close stops every pod and the service
+func (s *Server) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	for ordinal, pod := range s.pods {
+		pod.http.Close()
+		delete(s.pods, ordinal)
+	}
+
+	s.service.Close()
+}
+
+// Pod returns the pod with the ordinal, nil if there is none
+func (s *Server) Pod(ordinal int) *Pod {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.pods[ordinal]
+}
+
+// PodCount returns the current number of pods
+func (s *Server) PodCount() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.pods)
+}
+
+// Scale adds or removes the last pods to reach the count, like scaling the StatefulSet
+func (s *Server) Scale(count int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.scale(count)
+}
+
+// Must be called with s locked
+func (s *Server) scale(count int) {
+	for ordinal := len(s.pods); ordinal < count; ordinal++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			panic(fmt.Sprintf("proxytest: failed to listen: %v", err))
+		}
+
+		pod := &Pod{Ordinal: ordinal, IP: podIP(ordinal), Addr: listener.Addr().String(), server: s, epoch: time.Now().UnixNano(), senders: map[string]time.Time{}, outcomes: map[string]*outcome{}, jobs: map[string]*outcome{}}
+		pod.http = &http.Server{Handler: http.HandlerFunc(pod.handler)}
+		go pod.http.Serve(listener)
+
+		s.pods[ordinal] = pod
+	}
+
+	for ordinal := len(s.pods) - 1; ordinal >= count; ordinal-- {
+		s.pods[ordinal].http.Close()
+		delete(s.pods, ordinal)
+	}
+
+	s.version++
+}
+
+// Returns the IP the pod with the ordinal is listed at, in 198.18.0.0/15, which is reserved for benchmarking and
+// never routed to a real host
+func podIP(ordinal int) string {
+	n := ordinal + 1
+	return net.IPv4(198, byte(18+n>>16), byte(n>>8), byte(n)).String()
+}
+
+// Transport returns a new transport reaching the pods at their IPs on the service's port, and other addresses (e.g.
+// recipients) directly. Dials of the IPs of pods no longer listed are refused
+func (s *Server) Transport() *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil || port != strconv.Itoa(s.port) || host == "127.0.0.1" {
+				return dialer.DialContext(ctx, network, addr)
+			}
+
+			s.RLock()
+			var podAddr string
+			for _, pod := range s.pods {
+				if pod.IP == host {
+					podAddr = pod.Addr
+				}
+			}
+			s.RUnlock()
+
+			if podAddr == "" {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+			}
+
+			return dialer.DialContext(ctx, network, podAddr)
+		},
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// HTTPClient returns a new HTTP client with a Transport reaching the pods, for the PingClient of senders and their
+// requests
+func (s *Server) HTTPClient() *http.Client {
+	return &http.Client{Transport: s.Transport()}
+}
+
+// Kill makes the pod refuse connections without removing it from the proxy list, like a crashed pod
+func (s *Server) Kill(ordinal int) {
+	if pod := s.Pod(ordinal); pod != nil {
+		pod.http.Close()
+	}
+}
+
+// Deny makes every pod deny requests with a 429 as if saturated, until called with false
+func (s *Server) Deny(deny bool) {
+	var value int32
+	if deny {
+		value = 1
+	}
+
+	atomic.StoreInt32(&s.denying, value)
+}
+
+// Slow makes the pod wait for the delay before answering every request, pings included, like an overloaded pod or
+// network, until called with 0
+func (s *Server) Slow(ordinal int, delay time.Duration) {
+	if pod := s.Pod(ordinal); pod != nil {
+		atomic.StoreInt64(&pod.delay, int64(delay))
+	}
+}
+
+// Fail makes the pod answer forwarded requests with the status (e.g. 500 or 503) as its Proxy-Status without
+// forwarding them, like a failing pod, until called with 0
+func (s *Server) Fail(ordinal int, status int) {
+	if pod := s.Pod(ordinal); pod != nil {
+		atomic.StoreInt32(&pod.failStatus, int32(status))
+	}
+}
+
+// Reset makes the pod close the connections of forwarded requests without answering or forwarding them, like a pod
+// crashing mid-request, until called with false
+func (s *Server) Reset(ordinal int, reset bool) {
+	if pod := s.Pod(ordinal); pod != nil {
+		var value int32
+		if reset {
+			value = 1
+		}
+
+		atomic.StoreInt32(&pod.resetting, value)
+	}
+}
+
+// Routes requests to the service to the first pod, like the headless service's DNS would
+func (s *Server) serviceHandler(w http.ResponseWriter, r *http.Request) {
+	pod := s.Pod(0)
+	if pod == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	pod.handler(w, r)
+}
+
+// Sets the Proxy-* headers describing the pod
+func (pod *Pod) writeProxyMetrics(w http.ResponseWriter, proxyStatus int) {
+	s := pod.server
+
+	if senders := pod.recordSender(""); senders > 0 {
+		w.Header().Set("Proxy-Senders", strconv.Itoa(senders))
+	}
+
+	s.RLock()
+	list := map[int]string{}
+	for ordinal, other := range s.pods {
+		list[ordinal] = other.IP
+	}
+
+	version := s.version
+	headroom := s.Config.MaxPods - len(s.pods)
+	s.RUnlock()
+
+	if headroom < 0 {
+		headroom = 0
+	}
+
+	listJSON, _ := json.Marshal(list)
+
+	w.Header().Set("Proxy-Counter", strconv.FormatUint(atomic.AddUint64(&pod.counter, 1), 10))
+	w.Header().Set("Proxy-Free", strconv.FormatInt(int64(s.Config.MaxRequests)-atomic.LoadInt64(&pod.active), 10))
+	w.Header().Set("Proxy-Ordinal", strconv.Itoa(pod.Ordinal))
+	w.Header().Set("Proxy-Status", strconv.Itoa(proxyStatus))
+	w.Header().Set("Proxy-Version", strconv.FormatInt(version, 10))
+	w.Header().Set("Proxy-List", string(listJSON))
+	w.Header().Set("Proxy-Protocol-Version", strconv.Itoa(client.ProtocolVersion))
+	w.Header().Set("Proxy-Epoch", strconv.FormatInt(pod.epoch, 10))
+	w.Header().Set("Proxy-Max-Proxies", strconv.Itoa(s.Config.MaxPods))
+	w.Header().Set("Proxy-Headroom", strconv.Itoa(headroom))
+}
+
+// Handles a request to the pod following the proxy protocol
+func (pod *Pod) handler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	s := pod.server
+	pod.recordSender(strings.TrimSpace(r.Header.Get("Proxy-Sender")))
+
+	if delay := time.Duration(atomic.LoadInt64(&pod.delay)); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// Tunnels would bypass the queueing, so CONNECT is rejected like the proxies do
+	if r.Method == http.MethodConnect {
+		w.Header().Set("Allow", allowedMethods)
+		pod.writeProxyMetrics(w, http.StatusMethodNotAllowed)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Ensure requests scale the pods up to handle the requests
+	ensure := strings.TrimSpace(r.Header.Get("Proxy-Ensure-Requests"))
+	if ensure == "" {
+		ensure = strings.TrimSpace(r.Header.Get("Ensure-Requests"))
+	}
+
+	if ensure != "" {
+		requests, err := strconv.ParseUint(ensure, 10, 64)
+		if err != nil {
+			pod.writeProxyMetrics(w, http.StatusInternalServerError)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Senders bound the pods they ask for, and the pods added at once
+		senderMax, _ := strconv.Atoi(r.Header.Get("Proxy-Ensure-Max-Proxies"))
+		senderStep, _ := strconv.Atoi(r.Header.Get("Proxy-Ensure-Step"))
+
+		pods := int(math.Ceil(float64(requests) / float64(s.Config.MaxRequests)))
+		if senderMax > 0 && pods > senderMax {
+			pods = senderMax
+		}
+
+		if pods > s.Config.MaxPods {
+			pods = s.Config.MaxPods
+			w.Header().Set("Proxy-Max-Scale", "true")
+		}
+
+		s.Lock()
+		if senderStep > 0 && pods > len(s.pods)+senderStep {
+			pods = len(s.pods) + senderStep
+		}
+
+		if pods > len(s.pods) {
+			s.scale(pods)
+		}
+		s.Unlock()
+
+		pod.writeProxyMetrics(w, http.StatusOK)
+		return
+	}
+
+	// Follow up on a request answered with a 202
+	if token := strings.TrimSpace(r.Header.Get("Proxy-Affinity")); token != "" {
+		pod.followUp(w, token)
+		return
+	}
+
+	forwardTo := strings.TrimSpace(r.Header.Get("Forward-To"))
+	if forwardTo == "" && r.Method == http.MethodPost && r.Header.Get("Content-Type") == client.StatusQueryContentType {
+		pod.queryStatuses(w, r)
+		return
+	}
+
+	if forwardTo == "" {
+		// Ping, or the capabilities of the proxy to OPTIONS
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", allowedMethods)
+		}
+
+		pod.writeProxyMetrics(w, http.StatusOK)
+		return
+	}
+
+	// Deny the request if saturated
+	if atomic.LoadInt32(&s.denying) != 0 {
+		pod.writeProxyMetrics(w, http.StatusTooManyRequests)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	if status := int(atomic.LoadInt32(&pod.failStatus)); status != 0 {
+		pod.writeProxyMetrics(w, status)
+		w.WriteHeader(status)
+		return
+	}
+
+	if atomic.LoadInt32(&pod.resetting) != 0 {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+
+		panic(http.ErrAbortHandler)
+	}
+
+	if atomic.AddInt64(&pod.active, 1) > int64(s.Config.MaxRequests) {
+		atomic.AddInt64(&pod.active, -1)
+		pod.writeProxyMetrics(w, http.StatusTooManyRequests)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	// Answer duplicates of a request with a Proxy-Idempotency-Key with its original outcome, like the proxies, which
+	// scope the keys to the request's tenant, sender, method and target
+	key := strings.TrimSpace(r.Header.Get("Proxy-Idempotency-Key"))
+	var idempotent *outcome
+	if key != "" {
+		key = strings.Join([]string{r.Header.Get("Proxy-Tenant"), r.Header.Get("Proxy-Sender"), r.Method, forwardTo, key}, "\n")
+
+		var duplicate bool
+		if idempotent, duplicate = pod.beginIdempotent(key); duplicate {
+			atomic.AddInt64(&pod.active, -1)
+			if !pod.await(idempotent) {
+				pod.writeAccepted(w)
+				return
+			}
+
+			pod.writeOutcome(w, idempotent, true)
+			return
+		}
+	}
+
+	atomic.AddUint64(&pod.requests, 1)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		atomic.AddInt64(&pod.active, -1)
+		pod.writeProxyMetrics(w, http.StatusInternalServerError)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	req, err := http.NewRequest(r.Method, forwardTo, bytes.NewReader(body))
+	if err != nil {
+		atomic.AddInt64(&pod.active, -1)
+		if idempotent != nil {
+			pod.finishIdempotent(key, idempotent, result{err: err})
+		}
+
+		pod.writeProxyMetrics(w, http.StatusInternalServerError)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	req.Header = r.Header.Clone()
+	req.Header.Del("Forward-To")
+	req.Header.Del("Proxy-Protocol-Version")
+
+	res := &outcome{done: make(chan struct{})}
+	if idempotent != nil {
+		res = idempotent
+	}
+
+	go func() {
+		defer atomic.AddInt64(&pod.active, -1)
+
+		forwarded := forward(s.Client, req)
+		if idempotent != nil {
+			pod.finishIdempotent(key, idempotent, forwarded)
+		} else {
+			pod.finish(res, forwarded)
+		}
+	}()
+
+	if !pod.await(res) {
+		// The recipient keeps processing the request
+		w.Header().Set("Proxy-Affinity", pod.registerJob(res))
+		pod.writeAccepted(w)
+		return
+	}
+
+	pod.writeOutcome(w, res, false)
+}
+
+// Forwards the request to the recipient with the client, reading the response's body
+func forward(client *http.Client, req *http.Request) result {
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{err: err}
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return result{resp: resp, body: body, err: err}
+}
+
+// Waits up to the proxy timeout for the outcome, returning whether it is done
+func (pod *Pod) await(o *outcome) bool {
+	select {
+	case <-o.done:
+		return true
+	case <-time.After(pod.server.Config.ProxyTimeout):
+		return false
+	}
+}
+
+// Answers with a 202, as the recipient did not respond within the proxy timeout
+func (pod *Pod) writeAccepted(w http.ResponseWriter) {
+	pod.writeProxyMetrics(w, http.StatusAccepted)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Writes the done outcome of a forwarded request, duplicates of an idempotent request marked with
+// Proxy-Idempotent-Replay
+func (pod *Pod) writeOutcome(w http.ResponseWriter, o *outcome, replay bool) {
+	if replay {
+		w.Header().Set("Proxy-Idempotent-Replay", "true")
+	}
+
+	if o.result.err != nil {
+		pod.writeProxyMetrics(w, http.StatusInternalServerError)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(o.result.err.Error()))
+		return
+	}
+
+	for k, values := range o.result.resp.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+
+	pod.writeProxyMetrics(w, http.StatusOK)
+	w.WriteHeader(o.result.resp.StatusCode)
+	w.Write(o.result.body)
+}
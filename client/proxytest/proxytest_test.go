@@ -0,0 +1,149 @@
+package proxytest
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Sends a request forwarded to the target through the pod with the ordinal, at its IP on the service's port
+func forwardThrough(s *Server, ordinal int, target string, key string) (*http.Response, error) {
+	u := "http://" + net.JoinHostPort(s.Pod(ordinal).IP, strconv.Itoa(s.port)) + "/"
+
+	req, _ := http.NewRequest(http.MethodPost, u, nil)
+	req.Header.Set("Forward-To", target)
+	if key != "" {
+		req.Header.Set("Proxy-Idempotency-Key", key)
+	}
+
+	return s.HTTPClient().Do(req)
+}
+
+func newRecipient(t *testing.T) *httptest.Server {
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(recipient.Close)
+	return recipient
+}
+
+// The pods listen on ports of 127.0.0.1, and are reached at their IPs on the service's port through the Transport
+func TestPodsOnLoopback(t *testing.T) {
+	s := NewServerWithConfig(Config{Pods: 3})
+	defer s.Close()
+
+	ports := map[string]bool{}
+	for ordinal := 0; ordinal < 3; ordinal++ {
+		pod := s.Pod(ordinal)
+
+		host, port, err := net.SplitHostPort(pod.Addr)
+		if err != nil || host != "127.0.0.1" || ports[port] {
+			t.Errorf("pod %v listens on %v, expected its own port of 127.0.0.1", ordinal, pod.Addr)
+		}
+
+		ports[port] = true
+
+		resp, err := s.HTTPClient().Get("http://" + net.JoinHostPort(pod.IP, strconv.Itoa(s.port)) + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		if got := resp.Header.Get("Proxy-Ordinal"); got != strconv.Itoa(ordinal) {
+			t.Errorf("pod %v at %v answered with Proxy-Ordinal %v", ordinal, pod.IP, got)
+		}
+	}
+
+	// Removed pods' IPs are refused rather than dialed
+	ip := s.Pod(2).IP
+	s.Scale(2)
+
+	if _, err := s.HTTPClient().Get("http://" + net.JoinHostPort(ip, strconv.Itoa(s.port)) + "/"); err == nil {
+		t.Errorf("reached the IP %v of a removed pod", ip)
+	}
+}
+
+func TestFailureModes(t *testing.T) {
+	s := NewServerWithConfig(Config{Pods: 2})
+	defer s.Close()
+
+	recipient := newRecipient(t)
+
+	s.Fail(0, http.StatusServiceUnavailable)
+	resp, err := forwardThrough(s, 0, recipient.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Proxy-Status") != "503" {
+		t.Errorf("failing pod answered with %v and Proxy-Status %v", resp.StatusCode, resp.Header.Get("Proxy-Status"))
+	}
+
+	if requests := s.Pod(0).Requests(); requests != 0 {
+		t.Errorf("failing pod forwarded %v requests", requests)
+	}
+
+	s.Fail(0, 0)
+	s.Reset(0, true)
+	if resp, err := forwardThrough(s, 0, recipient.URL, ""); err == nil {
+		resp.Body.Close()
+		t.Errorf("resetting pod answered with %v", resp.StatusCode)
+	}
+
+	s.Reset(0, false)
+	s.Slow(1, 100*time.Millisecond)
+	start := time.Now()
+	resp, err = forwardThrough(s, 1, recipient.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || resp.StatusCode != http.StatusOK {
+		t.Errorf("slow pod answered with %v after %v", resp.StatusCode, elapsed)
+	}
+
+	// The other pods are unaffected
+	resp, err = forwardThrough(s, 0, recipient.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("pod 0 answered with %v once restored", resp.StatusCode)
+	}
+}
+
+// Done outcomes are forgotten after the OutcomeTTL rather than kept for the pod's lifetime
+func TestOutcomesExpire(t *testing.T) {
+	s := NewServerWithConfig(Config{OutcomeTTL: 50 * time.Millisecond})
+	defer s.Close()
+
+	recipient := newRecipient(t)
+
+	for i, key := range []string{"a", "b"} {
+		if i > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		resp, err := forwardThrough(s, 0, recipient.URL, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+	}
+
+	pod := s.Pod(0)
+	pod.outcomesMu.Lock()
+	outcomes := len(pod.outcomes)
+	pod.outcomesMu.Unlock()
+
+	if outcomes != 1 {
+		t.Errorf("the pod keeps %v outcomes, expected the unexpired one", outcomes)
+	}
+}
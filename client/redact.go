@@ -0,0 +1,100 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// DefaultSensitiveHeaders are the headers whose values are redacted from the tracing and logging output, besides
+// Config.SensitiveHeaders
+var DefaultSensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+	"X-Amz-Security-Token",
+}
+
+// RedactedValue replaces the values of the sensitive headers
+const RedactedValue = "[REDACTED]"
+
+// Returns the sensitive header patterns, lower cased, failing on malformed ones
+func parseSensitiveHeaders(patterns []string) ([]string, error) {
+	var sensitive []string
+	for _, pattern := range append(append([]string(nil), DefaultSensitiveHeaders...), patterns...) {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("error parsing SensitiveHeaders %q: %w", pattern, err)
+		}
+
+		sensitive = append(sensitive, pattern)
+	}
+
+	return sensitive, nil
+}
+
+// IsSensitiveHeader returns whether the values of the header are redacted, matching DefaultSensitiveHeaders or
+// Config.SensitiveHeaders
+func (p *Proxy) IsSensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range p.sensitiveHeaders {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RedactHeader returns a copy of the header whose sensitive values are replaced by RedactedValue, to log or trace it
+func (p *Proxy) RedactHeader(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		if p.IsSensitiveHeader(name) {
+			values = []string{RedactedValue}
+		}
+
+		redacted[name] = append([]string(nil), values...)
+	}
+
+	return redacted
+}
+
+// Starts tracing an attempt with the tracer, showing it the request and response with their sensitive headers
+// redacted. The headers the tracer sets on the request, but sensitive ones, are sent with it
+func (p *Proxy) traceAttempt(tracer Tracer, req *http.Request, ordinal int, attempt uint) func(resp *http.Response, err error) {
+	traced := req.Clone(req.Context())
+	traced.Header = p.RedactHeader(req.Header)
+
+	finish := tracer.StartAttempt(traced, ordinal, attempt)
+
+	for name := range req.Header {
+		if _, ok := traced.Header[name]; !ok && !p.IsSensitiveHeader(name) {
+			req.Header.Del(name)
+		}
+	}
+
+	for name, values := range traced.Header {
+		if !p.IsSensitiveHeader(name) {
+			req.Header[name] = values
+		}
+	}
+
+	if finish == nil {
+		return nil
+	}
+
+	return func(resp *http.Response, err error) {
+		if resp != nil {
+			redacted := *resp
+			redacted.Header = p.RedactHeader(resp.Header)
+			resp = &redacted
+		}
+
+		finish(resp, err)
+	}
+}
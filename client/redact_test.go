@@ -0,0 +1,98 @@
+package client_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Tracer keeping the headers of the attempts it is shown, setting a traceparent and trying to change a credential
+type headerTracer struct {
+	requests  chan http.Header
+	responses chan http.Header
+}
+
+func (tracer headerTracer) StartAttempt(req *http.Request, ordinal int, attempt uint) func(resp *http.Response, err error) {
+	tracer.requests <- req.Header.Clone()
+
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	req.Header.Set("Authorization", "Bearer tracer")
+
+	return func(resp *http.Response, err error) {
+		if resp != nil {
+			tracer.responses <- resp.Header.Clone()
+		}
+	}
+}
+
+// Tracers see the sensitive headers redacted, while the recipient and caller get them as they are
+func TestTracerRedacted(t *testing.T) {
+	server := proxytest.NewServer()
+	defer server.Close()
+
+	received := make(chan http.Header, 1)
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+	}))
+
+	defer recipient.Close()
+
+	p := newReadySender(t, server, client.Config{SensitiveHeaders: []string{"X-*-Signature"}})
+
+	tracer := headerTracer{requests: make(chan http.Header, 1), responses: make(chan http.Header, 1)}
+	p.SetTracer(tracer)
+
+	req, _ := http.NewRequest(http.MethodGet, recipient.URL, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Webhook-Signature", "signature")
+	req.Header.Set("X-Request-Id", "request")
+
+	resp, err := p.Do(server.HTTPClient(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	traced := <-tracer.requests
+	if traced.Get("Authorization") != client.RedactedValue || traced.Get("X-Webhook-Signature") != client.RedactedValue || traced.Get("X-Request-Id") != "request" {
+		t.Errorf("the tracer was shown %v, expected the credentials redacted", traced)
+	}
+
+	if traced := <-tracer.responses; traced.Get("Set-Cookie") != client.RedactedValue {
+		t.Errorf("the tracer was shown the response's Set-Cookie %q", traced.Get("Set-Cookie"))
+	}
+
+	// The tracer's traceparent is sent, but not its credential
+	sent := <-received
+	if sent.Get("Authorization") != "Bearer secret" || sent.Get("X-Webhook-Signature") != "signature" || sent.Get("Traceparent") == "" {
+		t.Errorf("the recipient received %v, expected the caller's credentials and the tracer's traceparent", sent)
+	}
+
+	if resp.Header.Get("Set-Cookie") == client.RedactedValue || resp.Header.Get("Set-Cookie") == "" {
+		t.Errorf("got Set-Cookie %q, expected the recipient's", resp.Header.Get("Set-Cookie"))
+	}
+}
+
+func TestSensitiveHeaders(t *testing.T) {
+	p, err := client.NewWithConfig("http://proxy.test:8080/", client.Config{SensitiveHeaders: []string{"X-*-Token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Destroy()
+
+	for name, sensitive := range map[string]bool{"authorization": true, "X-Refresh-Token": true, "X-Token": false, "Accept": false} {
+		if p.IsSensitiveHeader(name) != sensitive {
+			t.Errorf("got %v for %v, expected %v", !sensitive, name, sensitive)
+		}
+	}
+
+	if _, err := client.NewWithConfig("http://proxy.test:8080/", client.Config{SensitiveHeaders: []string{"X-[-Token"}}); err == nil {
+		t.Errorf("a malformed pattern was accepted")
+	}
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Get sends a GET request to the URL through the proxies, like http.Get
+func (p *Proxy) Get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Do(p.client(), req)
+}
+
+// Post sends a POST request of the content type to the URL through the proxies, like http.Post
+// The body is buffered, so the request can be retried on another pod
+func (p *Proxy) Post(ctx context.Context, url string, contentType string, body io.Reader) (*http.Response, error) {
+	buffer, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.post(ctx, url, contentType, buffer)
+}
+
+// PostJSON sends a POST request of the value encoded as JSON to the URL through the proxies
+func (p *Proxy) PostJSON(ctx context.Context, url string, v interface{}) (*http.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.post(ctx, url, "application/json", body)
+}
+
+// PostForm sends a POST request of the URL encoded values to the URL through the proxies, like http.PostForm
+func (p *Proxy) PostForm(ctx context.Context, url string, values url.Values) (*http.Response, error) {
+	return p.post(ctx, url, "application/x-www-form-urlencoded", []byte(values.Encode()))
+}
+
+// Sends a POST request of the body, whose reader is recreated by the request on retries
+func (p *Proxy) post(ctx context.Context, url string, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	return p.Do(p.client(), req)
+}
+
+// Returns the configured client, or else a new one
+func (p *Proxy) client() *http.Client {
+	if p.Config.Client == nil {
+		return &http.Client{Transport: p.transport}
+	}
+
+	return p.Config.Client
+}
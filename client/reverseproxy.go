@@ -0,0 +1,81 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// Transport is an http.RoundTripper sending requests through the proxies, balanced by their free requests like Do,
+// e.g. as the Transport of an httputil.ReverseProxy or an http.Client
+// Requests the recipient does not answer within the proxies' timeout are answered with a 202, like with Do
+type Transport struct {
+	// Proxy routes the requests
+	Proxy *Proxy
+
+	// Client sends the requests to the proxies, default one with the default transport, or following the proxy's
+	// TLS policy
+	Client *http.Client
+}
+
+// RoundTrip sends the request through the proxies to its URL, without modifying it
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	client := t.Client
+	if client == nil {
+		client = t.Proxy.defaultClient()
+	}
+
+	// Do sends clones of the request, leaving it as is
+	resp, err := t.Proxy.Do(client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Request = req
+	return resp, nil
+}
+
+// HTTPClient returns a copy of the base client (default a new one) whose requests go through the proxies, so code
+// using Get, Post or PostForm does not change
+// The base client's transport reaches the proxies, while its redirects, cookies and timeout apply to the requests
+func (p *Proxy) HTTPClient(base *http.Client) *http.Client {
+	if base == nil {
+		base = &http.Client{Transport: p.transport}
+	}
+
+	// The proxies' responses are the recipient's, so redirects are followed by sending new requests through them
+	proxyClient := &http.Client{
+		Transport: base.Transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	client := *base
+	client.Transport = &Transport{Proxy: p, Client: proxyClient}
+	return &client
+}
+
+// Director returns an httputil.ReverseProxy Director rewriting requests to the target like NewSingleHostReverseProxy's,
+// which also removes the headers the proxies act on instead of forwarding, so downstream callers can not use them
+func Director(target *url.URL) func(req *http.Request) {
+	director := httputil.NewSingleHostReverseProxy(target).Director
+
+	return func(req *http.Request) {
+		director(req)
+
+		req.Header.Del("Forward-To")
+		deleteProxyHeader(req.Header, "Proxy-Ensure-Requests")
+		req.Header.Del("Proxy-Ensure-Max-Proxies")
+		req.Header.Del("Proxy-Ensure-Step")
+	}
+}
+
+// NewReverseProxy returns an httputil.ReverseProxy to the target routing its requests through the proxies, pairing
+// the Director and a Transport, so an existing gateway can use the proxies without being rewritten around Do
+func (p *Proxy) NewReverseProxy(target *url.URL, client *http.Client) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director:  Director(target),
+		Transport: &Transport{Proxy: p, Client: client},
+	}
+}
@@ -0,0 +1,297 @@
+package client
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Route dispatches the requests matching its host and path prefix to a recipient
+type Route struct {
+	// Host matches the host of the request's URL, e.g. a logical name like "billing", any host if empty
+	// A leading "*." matches the subdomains of the rest
+	Host string
+
+	// PathPrefix matches the start of the request's path, any path if empty
+	PathPrefix string
+
+	// Recipient is the base URL the matching requests are sent to, with the rest of their path after the PathPrefix
+	// appended to its path, and their query kept
+	Recipient string
+
+	// Variants split the matching requests between several recipients by weight (e.g. 95 and 5 for a canary) instead
+	// of sending them to the Recipient
+	Variants []Variant
+
+	// Priority is the Proxy-Priority of the route's requests, which keep their own if empty
+	Priority string
+
+	// Header is set on the route's requests, e.g. a Proxy-Recipient or Proxy-Timeout
+	Header http.Header
+}
+
+// Variant is a recipient of a route, receiving a share of its requests by weight
+type Variant struct {
+	// Recipient is the base URL of the variant, like Route.Recipient
+	Recipient string
+
+	// Weight is the variant's share of the route's requests, relative to the other variants' weights
+	Weight int
+}
+
+// RouteStats are the counts of the requests dispatched by a route
+type RouteStats struct {
+	Route Route
+
+	// Requests is the number of requests dispatched by the route
+	Requests uint64
+
+	// Failures is the number of requests that failed without a response
+	Failures uint64
+
+	// Accepted and Denied are the numbers of requests the proxies answered with a 202 and a 429
+	Accepted uint64
+	Denied   uint64
+
+	// Variants are the counts of each recipient of the route, in the order of its Variants, or of its Recipient
+	Variants []VariantStats
+}
+
+// VariantStats are the counts of the requests sent to a recipient of a route
+type VariantStats struct {
+	Recipient string
+
+	// Weight is the variant's current weight
+	Weight int
+
+	Requests uint64
+	Failures uint64
+	Accepted uint64
+	Denied   uint64
+}
+
+// A recipient of a route with its counts
+type variant struct {
+	recipient *url.URL
+
+	// weight is accessed atomically, so it can be changed while requests are dispatched
+	weight int64
+
+	requests uint64
+	failures uint64
+	accepted uint64
+	denied   uint64
+}
+
+// A route with its parsed recipients
+type route struct {
+	Route
+	variants []*variant
+}
+
+// Router dispatches requests through a proxy to several recipients by their host and path, so call sites do not
+// build the recipients' absolute URLs, and counts the requests of each route
+// Its routes are matched in order, the first matching one dispatches the request
+type Router struct {
+	// Proxy sends the requests
+	Proxy *Proxy
+
+	// Client sends the requests to the proxies, default the proxy's Config.Client
+	Client *http.Client
+
+	routes []*route
+}
+
+// NewRouter returns a router of the routes through the proxy
+func NewRouter(p *Proxy, routes ...Route) (*Router, error) {
+	router := &Router{Proxy: p}
+	for i, r := range routes {
+		variants := r.Variants
+		if len(variants) == 0 {
+			variants = []Variant{{Recipient: r.Recipient, Weight: 1}}
+		}
+
+		compiled := &route{Route: r}
+		for _, v := range variants {
+			recipient, err := url.Parse(v.Recipient)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing the recipient of route %v: %w", i, err)
+			}
+
+			if recipient.Scheme == "" || recipient.Host == "" {
+				return nil, fmt.Errorf("recipient of route %v is not an absolute URL: %q", i, v.Recipient)
+			}
+
+			if v.Weight < 0 {
+				return nil, fmt.Errorf("weight of a variant of route %v is negative: %v", i, v.Weight)
+			}
+
+			compiled.variants = append(compiled.variants, &variant{recipient: recipient, weight: int64(v.Weight)})
+		}
+
+		router.routes = append(router.routes, compiled)
+	}
+
+	return router, nil
+}
+
+// SetWeights changes the weights of the variants of the route at the index, e.g. to shift a canary's share of the
+// requests, while requests are dispatched
+func (router *Router) SetWeights(index int, weights ...int) error {
+	if index < 0 || index >= len(router.routes) {
+		return fmt.Errorf("route %v does not exist", index)
+	}
+
+	r := router.routes[index]
+	if len(weights) != len(r.variants) {
+		return fmt.Errorf("route %v has %v variants, not %v", index, len(r.variants), len(weights))
+	}
+
+	for _, weight := range weights {
+		if weight < 0 {
+			return fmt.Errorf("weight is negative: %v", weight)
+		}
+	}
+
+	for i, weight := range weights {
+		atomic.StoreInt64(&r.variants[i].weight, int64(weight))
+	}
+
+	return nil
+}
+
+// Returns whether the route matches the URL
+func (r *route) matches(u *url.URL) bool {
+	host := u.Hostname()
+	switch {
+	case r.Host == "":
+	case strings.HasPrefix(r.Host, "*."):
+		if !strings.HasSuffix(host, r.Host[1:]) {
+			return false
+		}
+	case !strings.EqualFold(host, r.Host):
+		return false
+	}
+
+	return strings.HasPrefix(u.Path, r.PathPrefix)
+}
+
+// Picks a variant by weight, the first if all weights are 0
+func (r *route) pick() *variant {
+	if len(r.variants) == 1 {
+		return r.variants[0]
+	}
+
+	var total int64
+	for _, v := range r.variants {
+		total += atomic.LoadInt64(&v.weight)
+	}
+
+	if total <= 0 {
+		return r.variants[0]
+	}
+
+	n := rand.Int63n(total)
+	for _, v := range r.variants {
+		if n -= atomic.LoadInt64(&v.weight); n < 0 {
+			return v
+		}
+	}
+
+	// The weights changed while picking
+	return r.variants[len(r.variants)-1]
+}
+
+// Returns the URL at the variant's recipient the URL is dispatched to
+func (r *route) target(v *variant, u *url.URL) *url.URL {
+	target := *v.recipient
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, r.PathPrefix), "/")
+	target.RawPath = ""
+	target.RawQuery = u.RawQuery
+	return &target
+}
+
+// Do sends the request through the proxy to the recipient of its first matching route, like Proxy.Do
+// The request's URL may be relative to the route (e.g. "/charges" or "http://billing/charges"), and is left as is
+func (router *Router) Do(req *http.Request) (*http.Response, error) {
+	var matched *route
+	for _, r := range router.routes {
+		if r.matches(req.URL) {
+			matched = r
+			break
+		}
+	}
+
+	if matched == nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoRoute, req.URL)
+	}
+
+	v := matched.pick()
+
+	routed := req.Clone(req.Context())
+	routed.URL = matched.target(v, req.URL)
+	routed.Host = ""
+	if routed.Header == nil {
+		routed.Header = http.Header{}
+	}
+
+	for name, values := range matched.Header {
+		routed.Header[name] = append([]string(nil), values...)
+	}
+
+	if matched.Priority != "" {
+		routed.Header.Set("Proxy-Priority", matched.Priority)
+	}
+
+	client := router.Client
+	if client == nil {
+		client = router.Proxy.client()
+	}
+
+	atomic.AddUint64(&v.requests, 1)
+
+	resp, err := router.Proxy.Do(client, routed)
+	if err != nil {
+		atomic.AddUint64(&v.failures, 1)
+		return nil, err
+	}
+
+	switch proxyStatus, _ := strconv.Atoi(resp.Header.Get("Proxy-Status")); proxyStatus {
+	case http.StatusAccepted:
+		atomic.AddUint64(&v.accepted, 1)
+	case http.StatusTooManyRequests:
+		atomic.AddUint64(&v.denied, 1)
+	}
+
+	return resp, nil
+}
+
+// Stats returns the counts of each route's requests, in the order of the routes
+func (router *Router) Stats() []RouteStats {
+	stats := make([]RouteStats, len(router.routes))
+	for i, r := range router.routes {
+		stats[i].Route = r.Route
+		for _, v := range r.variants {
+			variantStats := VariantStats{
+				Recipient: v.recipient.String(),
+				Weight:    int(atomic.LoadInt64(&v.weight)),
+				Requests:  atomic.LoadUint64(&v.requests),
+				Failures:  atomic.LoadUint64(&v.failures),
+				Accepted:  atomic.LoadUint64(&v.accepted),
+				Denied:    atomic.LoadUint64(&v.denied),
+			}
+
+			stats[i].Requests += variantStats.Requests
+			stats[i].Failures += variantStats.Failures
+			stats[i].Accepted += variantStats.Accepted
+			stats[i].Denied += variantStats.Denied
+			stats[i].Variants = append(stats[i].Variants, variantStats)
+		}
+	}
+
+	return stats
+}
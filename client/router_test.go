@@ -0,0 +1,150 @@
+package client_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Recipient answering with the name, the URI and X-Route of the requests
+func newNamedRecipient(t *testing.T, name string) *httptest.Server {
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name + " " + r.URL.RequestURI() + " " + r.Header.Get("X-Route")))
+	}))
+
+	t.Cleanup(recipient.Close)
+	return recipient
+}
+
+// Sends the request with the router, returning the body of its response
+func routeBody(t *testing.T, router *client.Router, target string) (string, error) {
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+
+	resp, err := router.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body), nil
+}
+
+// Requests are dispatched to the recipient of their first matching route, with the rest of their path and query
+func TestRouter(t *testing.T) {
+	server := proxytest.NewServer()
+	defer server.Close()
+
+	billing := newNamedRecipient(t, "billing")
+	users := newNamedRecipient(t, "users")
+
+	p := newReadySender(t, server, client.Config{})
+	router, err := client.NewRouter(p,
+		client.Route{Host: "billing", PathPrefix: "/v1", Recipient: billing.URL + "/api", Header: http.Header{"X-Route": {"billing"}}},
+		client.Route{Host: "*.example", Recipient: users.URL},
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router.Client = server.HTTPClient()
+
+	for _, c := range []struct {
+		target string
+		body   string
+	}{
+		{"http://billing/v1/charges?id=1", "billing /api/charges?id=1 billing"},
+		{"http://users.example/profile", "users /profile "},
+	} {
+		if body, err := routeBody(t, router, c.target); err != nil || body != c.body {
+			t.Errorf("got %q (%v) for %v, expected %q", body, err, c.target, c.body)
+		}
+	}
+
+	// Neither the host of the first route without its prefix, nor another host match
+	for _, target := range []string{"http://billing/v2/charges", "http://example/profile"} {
+		if _, err := routeBody(t, router, target); !errors.Is(err, client.ErrNoRoute) {
+			t.Errorf("got %v for %v, expected ErrNoRoute", err, target)
+		}
+	}
+
+	stats := router.Stats()
+	if len(stats) != 2 || stats[0].Requests != 1 || stats[1].Requests != 1 || stats[0].Failures != 0 {
+		t.Errorf("got stats %+v, expected a request per route", stats)
+	}
+}
+
+func TestRouterInvalidRecipient(t *testing.T) {
+	for _, recipient := range []string{"billing", "/api", "http://%zz"} {
+		if _, err := client.NewRouter(nil, client.Route{Recipient: recipient}); err == nil {
+			t.Errorf("recipient %q was accepted", recipient)
+		}
+	}
+}
+
+// Variants split the route's requests by weight, which can be changed while dispatching
+func TestRouterVariants(t *testing.T) {
+	server := proxytest.NewServer()
+	defer server.Close()
+
+	stable := newNamedRecipient(t, "stable")
+	canary := newNamedRecipient(t, "canary")
+
+	p := newReadySender(t, server, client.Config{})
+	router, err := client.NewRouter(p, client.Route{Variants: []client.Variant{
+		{Recipient: stable.URL, Weight: 1},
+		{Recipient: canary.URL, Weight: 0},
+	}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router.Client = server.HTTPClient()
+
+	// Returns the number of requests of the count dispatched to each recipient
+	dispatch := func(count int) map[string]int {
+		received := map[string]int{}
+		for i := 0; i < count; i++ {
+			body, err := routeBody(t, router, "http://service/")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			received[body[:6]]++
+		}
+
+		return received
+	}
+
+	if received := dispatch(20); received["stable"] != 20 {
+		t.Errorf("got %v, expected every request to the only weighted variant", received)
+	}
+
+	if err := router.SetWeights(0, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Even shares, fewer than 50 of 200 being a negligible chance
+	if received := dispatch(200); received["stable"] < 50 || received["canary"] < 50 {
+		t.Errorf("got %v, expected even shares", received)
+	}
+
+	stats := router.Stats()[0]
+	if stats.Requests != 220 || stats.Variants[0].Requests+stats.Variants[1].Requests != 220 || stats.Variants[1].Weight != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	for _, weights := range [][]int{{1}, {1, -1}} {
+		if err := router.SetWeights(0, weights...); err == nil {
+			t.Errorf("weights %v were accepted", weights)
+		}
+	}
+}
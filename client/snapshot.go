@@ -0,0 +1,160 @@
+package client
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/url"
+	"sync/atomic"
+)
+
+// podSnapshot is an immutable view of the pod list, so selecting and updating pods takes no locks
+// A new snapshot is published whenever the pod list changes, the pods' metrics are updated atomically in place
+type podSnapshot struct {
+	version int64
+
+	// pods are the pods by ordinal, nil for the ordinals without a pod
+	pods []*Pod
+
+	// lastOrdinal is the last known pod ordinal
+	lastOrdinal int
+
+	// list is the raw Proxy-List the pods were parsed from
+	list string
+
+	// count is the number of pods
+	count int
+}
+
+// Returns the current snapshot of the pods
+func (p *Proxy) snapshot() *podSnapshot {
+	return p.table().pods.Load().(*podSnapshot)
+}
+
+// Publishes a snapshot of the pod list (must be called with p locked)
+// The pod slice is shared, as it is replaced rather than modified on changes
+func (p *Proxy) publish() {
+	s := &podSnapshot{
+		version:     p.Version,
+		pods:        p.Pods,
+		lastOrdinal: p.LastPodOrdinal,
+		list:        p.list,
+	}
+
+	for _, pod := range p.Pods {
+		if pod != nil {
+			s.count++
+		}
+	}
+
+	p.pods.Store(s)
+	p.signalChange()
+
+	// Wake the pings to ping the new pods
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Notifies the waiters of a change (must be called with p locked)
+func (p *Proxy) signalChange() {
+	if p.changed != nil {
+		close(p.changed)
+	}
+
+	p.changed = make(chan struct{})
+}
+
+// Returns a channel closed once the next snapshot is published, or the next round of pings is done
+func (p *Proxy) nextChange() <-chan struct{} {
+	p = p.table()
+
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.changed
+}
+
+// Returns the pod with the ordinal, nil if there is none
+func (s *podSnapshot) pod(ordinal int) *Pod {
+	if ordinal < 0 || ordinal >= len(s.pods) {
+		return nil
+	}
+
+	return s.pods[ordinal]
+}
+
+// Determines the best proxy based on current metrics, -1 if there is none
+func (s *podSnapshot) bestOrdinal() int {
+	bestOrdinal := -1
+	bestFree := int64(-math.MaxInt64)
+
+	// Pick the most free pod that isn't the last one
+	for ordinal, pod := range s.pods {
+		if pod == nil || atomic.LoadInt64(&pod.Counter) < 0 {
+			continue
+		}
+
+		if ordinal == s.lastOrdinal && bestFree > 0 {
+			break
+		}
+
+		if free := atomic.LoadInt64(&pod.Free); free > bestFree {
+			bestOrdinal = ordinal
+			bestFree = free
+		}
+	}
+
+	return bestOrdinal
+}
+
+// Determines the pod the key hashes to, -1 if there is none
+// Rendezvous hashing keeps the key on its pod as other pods come and go. Pods marked dead are kept, as a timeout
+// marks a pod dead while it still holds the key's outcome, until they leave the list
+func (s *podSnapshot) keyOrdinal(key string) int {
+	keyOrdinal := -1
+	var bestHash uint64
+
+	for ordinal, pod := range s.pods {
+		if pod == nil {
+			continue
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(pod.IP))
+
+		if hash := h.Sum64(); keyOrdinal < 0 || hash > bestHash {
+			keyOrdinal = ordinal
+			bestHash = hash
+		}
+	}
+
+	return keyOrdinal
+}
+
+// Returns a new pod at the IP, reached on the service's port and path
+func newPod(service *url.URL, ip string) *Pod {
+	pod := &Pod{IP: ip}
+
+	// Format the URL into scheme://ip:port/path
+	pod.url, pod.urlErr = url.Parse(fmt.Sprintf("%v://%v%v", service.Scheme, net.JoinHostPort(ip, service.Port()), service.Path))
+	if pod.urlErr == nil {
+		pod.urlString = pod.url.String()
+	}
+
+	return pod
+}
+
+// Returns a copy of the pod's URL, which is cheaper than formatting and parsing it, and which callers may modify
+func (pod *Pod) proxyURL() (*url.URL, error) {
+	if pod.urlErr != nil {
+		return nil, pod.urlErr
+	}
+
+	u := *pod.url
+	return &u, nil
+}
@@ -0,0 +1,374 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Spool durably records the requests of Do until the proxies respond to them, so a sender restarting sends the ones
+// left again, e.g. in a file with NewFileSpool or in a store of the sender's
+// Its methods are called concurrently
+type Spool interface {
+	// Add records the request, under its idempotency key
+	Add(req *SpooledRequest) error
+
+	// Remove removes the request with the key, once the proxies responded to it
+	Remove(key string) error
+
+	// Load returns the requests recorded, in the order they were added
+	Load() ([]*SpooledRequest, error)
+}
+
+// SpooledRequest is a request recorded in a Spool
+type SpooledRequest struct {
+	// Key is the request's Proxy-Idempotency-Key, which the proxies deduplicate its submissions by
+	Key string
+
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+
+	// Added is when the request was recorded
+	Added time.Time
+}
+
+// Returns a new request to send the spooled one again
+func (s *SpooledRequest) request() (*http.Request, error) {
+	req, err := http.NewRequest(s.Method, s.URL, bytes.NewReader(s.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = s.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+
+	req.Header.Set("Proxy-Idempotency-Key", s.Key)
+	return req, nil
+}
+
+// Line of a file spool, recording either an added or a removed request
+type spoolRecord struct {
+	Add    *SpooledRequest `json:",omitempty"`
+	Remove string          `json:",omitempty"`
+}
+
+// Spool in an append-only file of JSON lines, synced on each change and compacted as removals pile up
+type fileSpool struct {
+	sync.Mutex
+	path string
+	file *os.File
+
+	// requests are the requests recorded by key, and order their keys in the order added
+	requests map[string]*SpooledRequest
+	order    []string
+
+	// records is the number of lines of the file
+	records int
+}
+
+// NewFileSpool returns a Spool in the file at the path, created if missing, loading the requests it recorded
+// The file must only be used by a single proxy at a time
+func NewFileSpool(path string) (Spool, error) {
+	s := &fileSpool{path: path, requests: map[string]*SpooledRequest{}}
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if file != nil {
+		err = s.read(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reads the records of the file, ignoring a truncated last line left by a crash
+func (s *fileSpool) read(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var record spoolRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+
+		if record.Add != nil {
+			if _, ok := s.requests[record.Add.Key]; !ok {
+				s.order = append(s.order, record.Add.Key)
+			}
+
+			s.requests[record.Add.Key] = record.Add
+		} else if record.Remove != "" {
+			delete(s.requests, record.Remove)
+		}
+	}
+}
+
+// Rewrites the file with only the requests recorded (must be called with s locked, or before s is shared)
+func (s *fileSpool) compact() error {
+	var buf bytes.Buffer
+	order := s.order[:0]
+	for _, key := range s.order {
+		req, ok := s.requests[key]
+		if !ok {
+			continue
+		}
+
+		line, err := json.Marshal(spoolRecord{Add: req})
+		if err != nil {
+			return err
+		}
+
+		buf.Write(line)
+		buf.WriteByte('\n')
+		order = append(order, key)
+	}
+
+	// Replace the file atomically, so a crash leaves either the old or the new one
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	if err := syncFile(tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+
+	s.file = file
+	s.order = order
+	s.records = len(order)
+	return nil
+}
+
+// Appends the record to the file, synced before returning
+func (s *fileSpool) append(record spoolRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	s.records++
+	return s.file.Sync()
+}
+
+func (s *fileSpool) Add(req *SpooledRequest) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.append(spoolRecord{Add: req}); err != nil {
+		return err
+	}
+
+	if _, ok := s.requests[req.Key]; !ok {
+		s.order = append(s.order, req.Key)
+	}
+
+	s.requests[req.Key] = req
+	return nil
+}
+
+func (s *fileSpool) Remove(key string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.requests[key]; !ok {
+		return nil
+	}
+
+	if err := s.append(spoolRecord{Remove: key}); err != nil {
+		return err
+	}
+
+	delete(s.requests, key)
+
+	// Compact once most of the file is requests already removed
+	if s.records > 1024 && s.records > 4*len(s.requests) {
+		return s.compact()
+	}
+
+	return nil
+}
+
+func (s *fileSpool) Load() ([]*SpooledRequest, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	requests := make([]*SpooledRequest, 0, len(s.requests))
+	for _, key := range s.order {
+		if req, ok := s.requests[key]; ok {
+			requests = append(requests, req)
+		}
+	}
+
+	return requests, nil
+}
+
+// Syncs the file at the path to disk
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+	return file.Sync()
+}
+
+// Returns whether Do records the request in the Spool, the requests that are not safe, whose loss loses work
+func isSpoolable(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	default:
+		return true
+	}
+}
+
+// Records the request in the spool, returning a copy with its body buffered, a Proxy-Idempotency-Key and its
+// Proxy-Sender, so the proxies deduplicate it if it is sent again after a restart, and the key
+func (p *Proxy) spool(req *http.Request) (*http.Request, string, error) {
+	req, err := withGetBody(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var body []byte
+	if req.GetBody != nil {
+		reader, err := req.GetBody()
+		if err != nil {
+			return nil, "", err
+		}
+
+		body, err = ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	// The caller's request and headers are left as is, withGetBody returning requests that have a GetBody unchanged
+	req = req.WithContext(req.Context())
+	if req.Header == nil {
+		req.Header = http.Header{}
+	} else {
+		req.Header = req.Header.Clone()
+	}
+
+	key := req.Header.Get("Proxy-Idempotency-Key")
+	if key == "" {
+		id := make([]byte, 16)
+		rand.Read(id)
+		key = hex.EncodeToString(id)
+
+		req.Header.Set("Proxy-Idempotency-Key", key)
+	}
+
+	// The proxies scope the keys to the sender, so a restarted sender sends the request as the same one
+	if req.Header.Get("Proxy-Sender") == "" {
+		req.Header.Set("Proxy-Sender", p.Config.SenderID)
+	}
+
+	spooled := &SpooledRequest{
+		Key:    key,
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Header: req.Header.Clone(),
+		Body:   body,
+		Added:  p.clock().Now(),
+	}
+
+	if err := p.Config.Spool.Add(spooled); err != nil {
+		return nil, "", err
+	}
+
+	return req, key, nil
+}
+
+// Removes the request with the key from the spool, once the proxies responded to it or it can not be sent
+func (p *Proxy) unspool(key string) {
+	if err := p.Config.Spool.Remove(key); err != nil {
+		p.debugPrint(1, "Failed to remove request %v from the spool: %v", key, err)
+	}
+}
+
+// Sends the requests the spool recorded before the proxy was made again, once it is ready, with the client
+// Requests still failing to reach the proxies are kept for the next time
+func (p *Proxy) resubmitSpooled(client *http.Client, requests []*SpooledRequest) {
+	if err := p.WaitReady(p.ctx); err != nil {
+		return
+	}
+
+	for _, spooled := range requests {
+		if p.Closed() {
+			return
+		}
+
+		req, err := spooled.request()
+		if err != nil {
+			p.debugPrint(1, "Failed to resubmit spooled request %v: %v", spooled.Key, err)
+			p.unspool(spooled.Key)
+			continue
+		}
+
+		resp, err := p.dispatch(client, req.WithContext(p.ctx))
+		if err != nil {
+			if !p.canBuffer(req, err) {
+				p.debugPrint(1, "Failed to resubmit spooled request %v: %v", spooled.Key, err)
+				p.unspool(spooled.Key)
+			}
+
+			continue
+		}
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		p.unspool(spooled.Key)
+		p.debugPrint(2, "Resubmitted spooled request %v to %v", spooled.Key, spooled.URL)
+	}
+}
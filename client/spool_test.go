@@ -0,0 +1,151 @@
+package client_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// Returns the keys of the spool's requests, in order
+func spooledKeys(t *testing.T, spool client.Spool) string {
+	requests, err := spool.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, req := range requests {
+		keys = append(keys, req.Key)
+	}
+
+	return strings.Join(keys, ",")
+}
+
+// File spools keep their requests in order across reopenings, even after a crash mid-write
+func TestFileSpoolReopened(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+
+	spool, err := client.NewFileSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := spool.Add(&client.SpooledRequest{Key: key, Method: http.MethodPost, URL: "http://recipient.test/" + key, Body: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := spool.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash leaves a truncated last line
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.WriteString(`{"Add":{"Key":"d","Meth`)
+	file.Close()
+
+	reopened, err := client.NewFileSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := spooledKeys(t, reopened); keys != "a,c" {
+		t.Fatalf("got requests %v after reopening, expected a,c", keys)
+	}
+
+	requests, _ := reopened.Load()
+	if requests[1].URL != "http://recipient.test/c" || string(requests[1].Body) != "c" {
+		t.Errorf("got request %+v, expected it as added", requests[1])
+	}
+
+	// The reopened file is compacted, and appended to again
+	if err := reopened.Add(&client.SpooledRequest{Key: "e", Method: http.MethodPost, URL: "http://recipient.test/e"}); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := client.NewFileSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := spooledKeys(t, again); keys != "a,c,e" {
+		t.Errorf("got requests %v, expected a,c,e", keys)
+	}
+}
+
+// Spool of the requests added, keeping them once removed
+type recordingSpool struct {
+	client.Spool
+	added chan *client.SpooledRequest
+}
+
+func (s recordingSpool) Add(req *client.SpooledRequest) error {
+	s.added <- req
+	return s.Spool.Add(req)
+}
+
+// Unsafe requests are spooled with an idempotency key until the proxies respond, safe ones are not spooled
+func TestDoSpools(t *testing.T) {
+	server := proxytest.NewServer()
+	defer server.Close()
+
+	recipient := newCountingRecipient(t, 0)
+
+	spool, err := client.NewFileSpool(filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recording := recordingSpool{spool, make(chan *client.SpooledRequest, 2)}
+	p := newReadySender(t, server, client.Config{Spool: recording, SpoolClient: server.HTTPClient(), SenderID: "sender"})
+
+	req, _ := http.NewRequest(http.MethodPost, recipient.URL+"/spooled", strings.NewReader("body"))
+	resp, err := p.Do(server.HTTPClient(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	select {
+	case spooled := <-recording.added:
+		if spooled.Key == "" || spooled.Header.Get("Proxy-Idempotency-Key") != spooled.Key || string(spooled.Body) != "body" {
+			t.Errorf("got spooled request %+v, expected its key and body", spooled)
+		}
+
+		if spooled.Header.Get("Proxy-Sender") != "sender" {
+			t.Errorf("got Proxy-Sender %q, expected the sender's", spooled.Header.Get("Proxy-Sender"))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the request was not spooled")
+	}
+
+	// The caller's headers are left as is
+	if key := req.Header.Get("Proxy-Idempotency-Key"); key != "" {
+		t.Errorf("the caller's request got key %q", key)
+	}
+
+	awaitEmptySpool(t, spool)
+
+	req, _ = http.NewRequest(http.MethodGet, recipient.URL+"/unspooled", nil)
+	if resp, err = p.Do(server.HTTPClient(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if len(recording.added) != 0 {
+		t.Errorf("the GET was spooled")
+	}
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TLSPolicy restricts the TLS of the transports the client creates, for environments that can not accept Go's
+// defaults
+type TLSPolicy struct {
+	// MinVersion is the minimum TLS version, tls.VersionTLS12 (default) or tls.VersionTLS13
+	MinVersion uint16
+
+	// CipherSuites restricts the TLS 1.2 cipher suites to these, default Go's. crypto/tls does not allow restricting
+	// the TLS 1.3 ones
+	CipherSuites []uint16
+
+	// FIPS restricts the TLS to FIPS 140 approved algorithms: TLS 1.2 with ECDHE and AES-GCM suites, on the P-256 and
+	// P-384 curves, like Go's historical fipsonly mode. It is not a validated module, build with Go's FIPS 140 module
+	// for one
+	FIPS bool
+}
+
+// fipsCipherSuites are the TLS 1.2 cipher suites of the FIPS mode
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// Returns the TLS config of the policy, failing on invalid policies
+func (policy *TLSPolicy) config() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: policy.MinVersion}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	if config.MinVersion != tls.VersionTLS12 && config.MinVersion != tls.VersionTLS13 {
+		return nil, fmt.Errorf("TLS MinVersion %#x is neither TLS 1.2 nor TLS 1.3", config.MinVersion)
+	}
+
+	// Only the suites Go considers secure can be chosen
+	secure := map[uint16]bool{}
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.ID] = true
+	}
+
+	for _, suite := range policy.CipherSuites {
+		if !secure[suite] {
+			return nil, fmt.Errorf("TLS cipher suite %v is not secure", tls.CipherSuiteName(suite))
+		}
+	}
+
+	config.CipherSuites = policy.CipherSuites
+
+	if !policy.FIPS {
+		return config, nil
+	}
+
+	if config.MinVersion == tls.VersionTLS13 {
+		return nil, errors.New("TLS FIPS mode is limited to TLS 1.2, as the TLS 1.3 cipher suites can not be restricted")
+	}
+
+	config.MaxVersion = tls.VersionTLS12
+	config.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+
+	if len(policy.CipherSuites) == 0 {
+		config.CipherSuites = fipsCipherSuites
+		return config, nil
+	}
+
+	approved := map[uint16]bool{}
+	for _, suite := range fipsCipherSuites {
+		approved[suite] = true
+	}
+
+	for _, suite := range policy.CipherSuites {
+		if !approved[suite] {
+			return nil, fmt.Errorf("TLS cipher suite %v is not FIPS approved", tls.CipherSuiteName(suite))
+		}
+	}
+
+	return config, nil
+}
+
+// Returns a transport like http.DefaultTransport's, whose TLS follows the config
+func newPolicyTransport(config *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       config,
+	}
+}
+
+// Returns the client the proxy sends its requests with when given none, following the TLS policy if any
+func (p *Proxy) defaultClient() *http.Client {
+	if p.transport == nil {
+		return http.DefaultClient
+	}
+
+	return &http.Client{Transport: p.transport}
+}
@@ -0,0 +1,101 @@
+package client_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client"
+)
+
+// Returns the ClientHello of the pings of a proxy following the policy
+// The service's certificate is not trusted, so only the hello is sent
+func policyClientHello(t *testing.T, policy *client.TLSPolicy) *tls.ClientHelloInfo {
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+
+	service := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	service.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	service.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			select {
+			case hellos <- hello:
+			default:
+			}
+
+			return nil, nil
+		},
+	}
+
+	service.StartTLS()
+	defer service.Close()
+
+	p, err := client.NewWithConfig(service.URL, client.Config{TLS: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Destroy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	p.WaitReady(ctx)
+
+	select {
+	case hello := <-hellos:
+		return hello
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the service received no ClientHello")
+		return nil
+	}
+}
+
+// The clients the proxy creates offer only the versions, suites and curves of the policy
+func TestTLSPolicyClientHello(t *testing.T) {
+	hello := policyClientHello(t, &client.TLSPolicy{MinVersion: tls.VersionTLS13})
+	for _, version := range hello.SupportedVersions {
+		if version != tls.VersionTLS13 {
+			t.Errorf("got version %#x offered, expected only TLS 1.3", version)
+		}
+	}
+
+	hello = policyClientHello(t, &client.TLSPolicy{FIPS: true})
+	for _, version := range hello.SupportedVersions {
+		if version != tls.VersionTLS12 {
+			t.Errorf("got version %#x offered in FIPS mode, expected only TLS 1.2", version)
+		}
+	}
+
+	for _, suite := range hello.CipherSuites {
+		switch suite {
+		case tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:
+		default:
+			t.Errorf("got cipher suite %v offered in FIPS mode", tls.CipherSuiteName(suite))
+		}
+	}
+
+	for _, curve := range hello.SupportedCurves {
+		if curve != tls.CurveP256 && curve != tls.CurveP384 {
+			t.Errorf("got curve %v offered in FIPS mode", curve)
+		}
+	}
+}
+
+func TestTLSPolicyInvalid(t *testing.T) {
+	for _, policy := range []client.TLSPolicy{
+		{MinVersion: tls.VersionTLS11},
+		{CipherSuites: []uint16{tls.TLS_RSA_WITH_RC4_128_SHA}},
+		{FIPS: true, MinVersion: tls.VersionTLS13},
+		{FIPS: true, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305}},
+	} {
+		policy := policy
+		if _, err := client.NewWithConfig("https://proxy.test:8443/", client.Config{TLS: &policy}); err == nil {
+			t.Errorf("policy %+v was accepted", policy)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Command loadgen sends load through the proxies to measure the system end-to-end, e.g.
+//
+//	loadgen -proxy http://proxy.default.svc.cluster.local -target http://recipient.default.svc.cluster.local -rps 500 -duration 1m
+//
+// It reports the mix of statuses and the latency percentiles once done.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	proxy "github.com/btbd/proxy/client"
+)
+
+// Outcomes of the sent requests
+type report struct {
+	sync.Mutex
+
+	// Statuses counts the responses by status code and Proxy-Status
+	Statuses map[string]int64
+
+	// Errors counts the failed requests by error
+	Errors map[string]int64
+
+	// Latencies are the times taken by the requests that got a response
+	Latencies []time.Duration
+
+	// Skipped is the number of requests not sent as the concurrency limit was reached
+	Skipped int64
+}
+
+func main() {
+	proxyURL := flag.String("proxy", "http://proxy.default.svc.cluster.local", "service URL of the proxies")
+	target := flag.String("target", "http://recipient.default.svc.cluster.local", "URL to send the requests to")
+	method := flag.String("method", "GET", "method of the requests")
+	rps := flag.Float64("rps", 100, "requests per second to send, 0 to send as fast as the concurrency allows")
+	concurrency := flag.Int("concurrency", 100, "maximum number of requests in flight")
+	bodySize := flag.Int("body", 0, "size in bytes of the request bodies")
+	duration := flag.Duration("duration", 30*time.Second, "time to send requests for")
+	senders := flag.Uint("senders", 1, "number of senders sharing the proxies, including this one")
+	ensure := flag.Int("ensure", 0, "requests to ensure the proxies can take before starting, 0 to skip")
+	flag.Parse()
+
+	p, err := proxy.NewWithConfig(*proxyURL, proxy.Config{NumberOfSenders: *senders})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	defer p.Destroy()
+
+	client := &http.Client{}
+	body := bytes.Repeat([]byte("x"), *bodySize)
+
+	if *ensure > 0 {
+		if err := p.Ensure(client, *ensure); err != nil {
+			log.Fatalf("[!] Failed to ensure %v requests: %v", *ensure, err)
+		}
+	}
+
+	r := &report{Statuses: map[string]int64{}, Errors: map[string]int64{}}
+
+	var wg sync.WaitGroup
+	var inFlight int64
+	slots := make(chan struct{}, *concurrency)
+
+	// Sends a request and records its outcome
+	send := func() {
+		defer wg.Done()
+		defer func() { <-slots }()
+		defer atomic.AddInt64(&inFlight, -1)
+
+		req, err := http.NewRequest(*method, *target, bytes.NewReader(body))
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		start := time.Now()
+		resp, err := p.Do(client, req)
+		if err != nil {
+			r.Lock()
+			r.Errors[err.Error()]++
+			r.Unlock()
+			return
+		}
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		latency := time.Since(start)
+
+		r.Lock()
+		r.Statuses[fmt.Sprintf("%v (Proxy-Status %v)", resp.StatusCode, resp.Header.Get("Proxy-Status"))]++
+		r.Latencies = append(r.Latencies, latency)
+		r.Unlock()
+	}
+
+	start := time.Now()
+	deadline := start.Add(*duration)
+
+	if *rps > 0 {
+		// Send at the rate, skipping the requests over the concurrency limit rather than slowing down
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rps))
+		for now := range ticker.C {
+			if now.After(deadline) {
+				break
+			}
+
+			select {
+			case slots <- struct{}{}:
+				atomic.AddInt64(&inFlight, 1)
+				wg.Add(1)
+				go send()
+			default:
+				r.Skipped++
+			}
+		}
+
+		ticker.Stop()
+	} else {
+		// Keep the concurrency limit of requests in flight
+		for time.Now().Before(deadline) {
+			slots <- struct{}{}
+			atomic.AddInt64(&inFlight, 1)
+			wg.Add(1)
+			go send()
+		}
+	}
+
+	log.Printf("[+] Waiting for %v requests in flight", atomic.LoadInt64(&inFlight))
+	wg.Wait()
+
+	r.write(os.Stdout, time.Since(start))
+}
+
+// Writes the report
+func (r *report) write(w io.Writer, elapsed time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	var total int64
+	for _, count := range r.Statuses {
+		total += count
+	}
+
+	for _, count := range r.Errors {
+		total += count
+	}
+
+	fmt.Fprintf(w, "Requests: %v in %v (%.1f/s), %v skipped at the concurrency limit\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds(), r.Skipped)
+
+	fmt.Fprintf(w, "\nStatuses:\n")
+	writeCounts(w, r.Statuses, total)
+
+	if len(r.Errors) != 0 {
+		fmt.Fprintf(w, "\nErrors:\n")
+		writeCounts(w, r.Errors, total)
+	}
+
+	if len(r.Latencies) == 0 {
+		return
+	}
+
+	sort.Slice(r.Latencies, func(i, j int) bool {
+		return r.Latencies[i] < r.Latencies[j]
+	})
+
+	fmt.Fprintf(w, "\nLatencies:\n")
+	for _, percentile := range []float64{50, 90, 95, 99, 99.9} {
+		index := int(float64(len(r.Latencies)-1) * percentile / 100)
+		fmt.Fprintf(w, "  p%v\t%v\n", percentile, r.Latencies[index].Round(time.Microsecond))
+	}
+
+	fmt.Fprintf(w, "  max\t%v\n", r.Latencies[len(r.Latencies)-1].Round(time.Microsecond))
+}
+
+// Writes counts sorted by key with their share of the total
+func writeCounts(w io.Writer, counts map[string]int64, total int64) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %v\t%v (%.1f%%)\n", key, counts[key], float64(counts[key])*100/float64(total))
+	}
+}
@@ -0,0 +1,227 @@
+// Command soak runs clients against in-process proxies for hours while churning the pods, e.g.
+//
+//	soak -duration 4h -interval 1m
+//
+// It reports the goroutines, memory and file descriptors over time, and fails if they grew past the thresholds once
+// the clients are destroyed, to catch leaks like ping goroutines outliving Destroy.
+// The proxies listen on loopback IPs other than 127.0.0.1, which Linux provides by default.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	proxy "github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// A sample of the process's resources
+type sample struct {
+	Elapsed    time.Duration
+	Goroutines int
+	HeapAlloc  uint64
+	FDs        int
+	Requests   int64
+	Errors     int64
+}
+
+func main() {
+	duration := flag.Duration("duration", time.Hour, "time to soak for")
+	interval := flag.Duration("interval", time.Minute, "time between reports")
+	churn := flag.Duration("churn", 5*time.Second, "time between changes of the pod count")
+	maxPods := flag.Int("pods", 5, "maximum number of pods")
+	clients := flag.Int("clients", 4, "number of clients sending at once")
+	lifetime := flag.Duration("lifetime", 30*time.Second, "time each client lives before being destroyed and replaced")
+	rps := flag.Float64("rps", 50, "requests per second sent by each client")
+	maxGoroutines := flag.Int("max-goroutines", 20, "goroutines allowed above the baseline once the clients are destroyed")
+	maxFDs := flag.Int("max-fds", 20, "file descriptors allowed above the baseline once the clients are destroyed")
+	maxHeapGrowth := flag.Float64("max-heap-growth", 16, "MiB the heap may grow by above the baseline once the clients are destroyed")
+	flag.Parse()
+
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+
+	defer recipient.Close()
+
+	s := proxytest.NewServerWithConfig(proxytest.Config{Pods: 1, MaxPods: *maxPods})
+	defer s.Close()
+
+	baseline := takeSample(0, 0, 0)
+	log.Printf("[+] Baseline: %v", baseline)
+
+	start := time.Now()
+	deadline := start.Add(*duration)
+
+	var requests, errors int64
+	var wg sync.WaitGroup
+
+	// Each client sends until its lifetime is over, then is destroyed and replaced until the deadline
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for time.Now().Before(deadline) {
+				runClient(s, recipient.URL, *rps, *lifetime, deadline, &requests, &errors)
+			}
+		}()
+	}
+
+	// Churn the pods, scaling them randomly
+	stopChurn := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(*churn)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.Scale(rand.Intn(*maxPods) + 1)
+			case <-stopChurn:
+				return
+			}
+		}
+	}()
+
+	// Report until the clients are done
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(*interval)
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			log.Printf("[+] %v", takeSample(time.Since(start), atomic.LoadInt64(&requests), atomic.LoadInt64(&errors)))
+		case <-done:
+			running = false
+		}
+	}
+
+	ticker.Stop()
+	close(stopChurn)
+
+	// Let the destroyed clients' goroutines and idle connections wind down before the final sample
+	http.DefaultClient.CloseIdleConnections()
+	time.Sleep(3 * time.Second)
+	runtime.GC()
+
+	final := takeSample(time.Since(start), atomic.LoadInt64(&requests), atomic.LoadInt64(&errors))
+	log.Printf("[+] Final: %v", final)
+
+	leaked := false
+	if final.Goroutines > baseline.Goroutines+*maxGoroutines {
+		log.Printf("[!] Goroutines grew from %v to %v", baseline.Goroutines, final.Goroutines)
+		leaked = true
+	}
+
+	if float64(final.HeapAlloc) > float64(baseline.HeapAlloc)+*maxHeapGrowth*(1<<20) {
+		log.Printf("[!] Heap grew from %v to %v bytes", baseline.HeapAlloc, final.HeapAlloc)
+		leaked = true
+	}
+
+	if baseline.FDs >= 0 && final.FDs > baseline.FDs+*maxFDs {
+		log.Printf("[!] File descriptors grew from %v to %v", baseline.FDs, final.FDs)
+		leaked = true
+	}
+
+	if leaked {
+		os.Exit(1)
+	}
+}
+
+// Sends requests through a new client at the rate until its lifetime or the deadline is over, then destroys it
+func runClient(s *proxytest.Server, target string, rps float64, lifetime time.Duration, deadline time.Time, requests *int64, errors *int64) {
+	// Each client has its own transports, so their idle connections are closed with it
+	transport := s.Transport()
+	defer transport.CloseIdleConnections()
+
+	pingTransport := s.Transport()
+	defer pingTransport.CloseIdleConnections()
+
+	p, err := proxy.NewWithConfig(s.URL, proxy.Config{Attempts: 3, PingClient: &http.Client{Transport: pingTransport}})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	defer p.Destroy()
+
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	end := time.Now().Add(lifetime)
+	if end.After(deadline) {
+		end = deadline
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rps))
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if now.After(end) {
+			return
+		}
+
+		req, err := http.NewRequest(http.MethodPost, target, nil)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		atomic.AddInt64(requests, 1)
+
+		resp, err := p.Do(client, req)
+		if err != nil {
+			atomic.AddInt64(errors, 1)
+			continue
+		}
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// Samples the process's resources
+func takeSample(elapsed time.Duration, requests int64, errors int64) sample {
+	runtime.GC()
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	return sample{
+		Elapsed:    elapsed,
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  memStats.HeapAlloc,
+		FDs:        countFDs(),
+		Requests:   requests,
+		Errors:     errors,
+	}
+}
+
+func (s sample) String() string {
+	return fmt.Sprintf("elapsed %v, goroutines %v, heap %.1f MiB, fds %v, requests %v (%v errors)",
+		s.Elapsed.Round(time.Second), s.Goroutines, float64(s.HeapAlloc)/(1<<20), s.FDs, s.Requests, s.Errors)
+}
+
+// Returns the number of open file descriptors, -1 if unknown (outside of Linux)
+func countFDs() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+
+	return len(fds)
+}
@@ -0,0 +1,928 @@
+// Package conformance checks that a proxy server implements the Proxy-* protocol the client relies on, so
+// alternative implementations can run the same table of required behaviors against themselves, e.g. in a test:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Test(t, conformance.Config{URL: "http://127.0.0.1:8080/"})
+//	}
+//
+// The suite runs its own recipient, which the proxies under test must be able to reach.
+package conformance
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Config configures a run of the suite
+type Config struct {
+	// URL is the service URL of the proxies under test, whose port and path also reach each pod by IP
+	URL string
+
+	// Client is the HTTP client sending the requests, default one with a 10 second timeout
+	Client *http.Client
+
+	// RecipientListen is the address the suite's recipient listens on, default 127.0.0.1:0
+	RecipientListen string
+
+	// RecipientURL is the URL the proxies reach the recipient at, default http:// and the address it listens on
+	RecipientURL string
+
+	// ProxyTimeout is the time the proxies wait for the recipient before answering with a 202, default 100 milliseconds
+	ProxyTimeout time.Duration
+
+	// MaxConcurrency is the number of concurrent requests sent to a pod to saturate it, default 100
+	MaxConcurrency int
+}
+
+// Case is a behavior required by the protocol
+type Case struct {
+	// Name identifies the case
+	Name string
+
+	// Description states the required behavior
+	Description string
+
+	// Check returns an error if the proxies do not behave as required
+	Check func(env *Env) error
+}
+
+// Result is the outcome of a case
+type Result struct {
+	Case *Case
+
+	// Err is why the case failed, nil if it passed
+	Err error
+}
+
+// Env is what the cases run against
+type Env struct {
+	Config Config
+
+	service   *url.URL
+	recipient *recipient
+}
+
+// Cases are the behaviors required by the protocol, in the order they run
+var Cases = []*Case{
+	{
+		Name:        "headers",
+		Description: "every response carries valid Proxy-Counter, Proxy-Free, Proxy-Ordinal, Proxy-Status, Proxy-Version and Proxy-List headers, and a valid Proxy-Protocol-Version, Proxy-Epoch, Proxy-List-Encoding, Proxy-Senders, Proxy-Max-Proxies and Proxy-Headroom if any",
+		Check:       checkHeaders,
+	},
+	{
+		Name:        "pods",
+		Description: "every pod of the Proxy-List answers at its IP on the service's port, reporting its ordinal",
+		Check:       checkPods,
+	},
+	{
+		Name:        "counter",
+		Description: "the Proxy-Counter of a pod strictly increases",
+		Check:       checkCounter,
+	},
+	{
+		Name:        "version",
+		Description: "the Proxy-Version of a pod never decreases, and a version always has the same Proxy-List",
+		Check:       checkVersion,
+	},
+	{
+		Name:        "ping",
+		Description: "requests without Forward-To are answered by the proxy with Proxy-Status 200 and not forwarded",
+		Check:       checkPing,
+	},
+	{
+		Name:        "forward",
+		Description: "requests are forwarded to their Forward-To without it or Proxy-Protocol-Version, answered with the recipient's status and body and Proxy-Status 200",
+		Check:       checkForward,
+	},
+	{
+		Name:        "accepted",
+		Description: "requests outliving the proxy timeout are answered with a 202 and Proxy-Status 202, and still delivered",
+		Check:       checkAccepted,
+	},
+	{
+		Name:        "denied",
+		Description: "a saturated pod answers with a 429 and Proxy-Status 429 without forwarding the request",
+		Check:       checkDenied,
+	},
+	{
+		Name:        "ensure",
+		Description: "Proxy-Ensure-Requests is answered with Proxy-Status 200 without forwarding, and a malformed one with another Proxy-Status",
+		Check:       checkEnsure,
+	},
+	{
+		Name:        "methods",
+		Description: "HEAD is forwarded and answered without a body, OPTIONS without Forward-To is answered by the proxy with the forwarded methods in Allow, and CONNECT is rejected with a 405 and Proxy-Status 405",
+		Check:       checkMethods,
+	},
+	{
+		Name:        "idempotency",
+		Description: "a pod forwards the requests with a Proxy-Idempotency-Key once per sender, answering duplicates, even in flight, with the original response and Proxy-Idempotent-Replay",
+		Check:       checkIdempotency,
+	},
+}
+
+// Run runs every case against the proxies, returning their results in order
+func Run(config Config) ([]Result, error) {
+	env, err := newEnv(config)
+	if err != nil {
+		return nil, err
+	}
+
+	defer env.recipient.Close()
+
+	results := make([]Result, len(Cases))
+	for i, c := range Cases {
+		results[i] = Result{Case: c, Err: c.Check(env)}
+	}
+
+	return results, nil
+}
+
+// Test runs every case against the proxies as a subtest of t
+func Test(t *testing.T, config Config) {
+	env, err := newEnv(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer env.recipient.Close()
+
+	for _, c := range Cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			if err := c.Check(env); err != nil {
+				t.Errorf("%v: %v", c.Description, err)
+			}
+		})
+	}
+}
+
+// Fills the config's defaults and starts the recipient
+func newEnv(config Config) (*Env, error) {
+	service, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if config.RecipientListen == "" {
+		config.RecipientListen = "127.0.0.1:0"
+	}
+
+	if config.ProxyTimeout == 0 {
+		config.ProxyTimeout = 100 * time.Millisecond
+	}
+
+	if config.MaxConcurrency == 0 {
+		config.MaxConcurrency = 100
+	}
+
+	r, err := newRecipient(config.RecipientListen)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.RecipientURL == "" {
+		config.RecipientURL = "http://" + r.listener.Addr().String()
+	}
+
+	return &Env{Config: config, service: service, recipient: r}, nil
+}
+
+// A delivery received by the recipient
+type delivery struct {
+	Method string
+	Header http.Header
+	Body   []byte
+}
+
+// Recipient recording the requests forwarded to it by their id
+type recipient struct {
+	sync.Mutex
+
+	listener net.Listener
+	server   *http.Server
+
+	deliveries map[string][]delivery
+	next       int
+}
+
+func newRecipient(address string) (*recipient, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the recipient: %v", err)
+	}
+
+	r := &recipient{listener: listener, deliveries: map[string][]delivery{}}
+	r.server = &http.Server{Handler: r}
+	go r.server.Serve(listener)
+
+	return r, nil
+}
+
+// Close stops the recipient
+func (r *recipient) Close() {
+	r.server.Close()
+}
+
+// Answers with the status of the status query parameter after its delay in milliseconds, echoing the body
+func (r *recipient) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	query := req.URL.Query()
+
+	if delay, err := strconv.Atoi(query.Get("delay")); err == nil {
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+
+	r.Lock()
+	r.deliveries[query.Get("id")] = append(r.deliveries[query.Get("id")], delivery{Method: req.Method, Header: req.Header.Clone(), Body: body})
+	r.Unlock()
+
+	status, err := strconv.Atoi(query.Get("status"))
+	if err != nil {
+		status = http.StatusOK
+	}
+
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Returns a new id for requests to the recipient
+func (r *recipient) newID() string {
+	r.Lock()
+	defer r.Unlock()
+
+	r.next++
+	return strconv.Itoa(r.next)
+}
+
+// Returns the deliveries of the id
+func (r *recipient) received(id string) []delivery {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.deliveries[id]
+}
+
+// Proxy-* headers of a response
+type proxyHeaders struct {
+	Counter int64
+	Free    int64
+	Ordinal int
+	Status  int
+	Version int64
+	List    map[int]string
+
+	ProtocolVersion int
+
+	// Epoch is 0 for proxies predating Proxy-Epoch
+	Epoch int64
+
+	// Senders is 0 for proxies predating Proxy-Senders, or that have not seen a sender
+	Senders int64
+
+	// MaxProxies is 0 for proxies predating Proxy-Max-Proxies, or with an unbounded scale
+	MaxProxies int64
+	Headroom   int64
+}
+
+// Parses and validates the Proxy-* headers of a response
+func parseProxyHeaders(header http.Header) (*proxyHeaders, error) {
+	var h proxyHeaders
+
+	for _, field := range []struct {
+		name  string
+		value *int64
+	}{
+		{"Proxy-Counter", &h.Counter},
+		{"Proxy-Free", &h.Free},
+		{"Proxy-Version", &h.Version},
+	} {
+		value, err := strconv.ParseInt(header.Get(field.name), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v is not an integer: %q", field.name, header.Get(field.name))
+		}
+
+		*field.value = value
+	}
+
+	ordinal, err := strconv.Atoi(header.Get("Proxy-Ordinal"))
+	if err != nil || ordinal < 0 {
+		return nil, fmt.Errorf("Proxy-Ordinal is not an ordinal: %q", header.Get("Proxy-Ordinal"))
+	}
+
+	h.Ordinal = ordinal
+
+	status, err := strconv.Atoi(header.Get("Proxy-Status"))
+	if err != nil || status < 100 || status > 599 {
+		return nil, fmt.Errorf("Proxy-Status is not a status code: %q", header.Get("Proxy-Status"))
+	}
+
+	h.Status = status
+
+	// Proxies predating Proxy-Protocol-Version speak version 1
+	h.ProtocolVersion = 1
+	if value := header.Get("Proxy-Protocol-Version"); value != "" {
+		version, err := strconv.Atoi(value)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("Proxy-Protocol-Version is not a version: %q", value)
+		}
+
+		h.ProtocolVersion = version
+	}
+
+	if value := header.Get("Proxy-Epoch"); value != "" {
+		epoch, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || epoch < 0 {
+			return nil, fmt.Errorf("Proxy-Epoch is not an epoch: %q", value)
+		}
+
+		h.Epoch = epoch
+	}
+
+	if value := header.Get("Proxy-Senders"); value != "" {
+		senders, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || senders < 1 {
+			return nil, fmt.Errorf("Proxy-Senders is not a count: %q", value)
+		}
+
+		h.Senders = senders
+	}
+
+	if value := header.Get("Proxy-Max-Proxies"); value != "" {
+		maxProxies, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxProxies < 1 {
+			return nil, fmt.Errorf("Proxy-Max-Proxies is not a count: %q", value)
+		}
+
+		headroom, err := strconv.ParseInt(header.Get("Proxy-Headroom"), 10, 64)
+		if err != nil || headroom < 0 || headroom > maxProxies {
+			return nil, fmt.Errorf("Proxy-Headroom is not a count up to Proxy-Max-Proxies: %q", header.Get("Proxy-Headroom"))
+		}
+
+		h.MaxProxies = maxProxies
+		h.Headroom = headroom
+	}
+
+	list := []byte(header.Get("Proxy-List"))
+
+	// Large lists are compressed
+	switch encoding := header.Get("Proxy-List-Encoding"); encoding {
+	case "":
+	case "gzip":
+		compressed, err := base64.StdEncoding.DecodeString(string(list))
+		if err != nil {
+			return nil, fmt.Errorf("Proxy-List is not base64: %q", list)
+		}
+
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("Proxy-List is not gzip: %v", err)
+		}
+
+		if list, err = ioutil.ReadAll(reader); err != nil {
+			return nil, fmt.Errorf("Proxy-List is not gzip: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("Proxy-List-Encoding is not supported: %q", encoding)
+	}
+
+	if err := json.Unmarshal(list, &h.List); err != nil {
+		return nil, fmt.Errorf("Proxy-List is not a JSON object of IPs by ordinal: %q", list)
+	}
+
+	for ordinal, ip := range h.List {
+		if ordinal < 0 || net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("Proxy-List has an invalid pod %v at %q", ordinal, ip)
+		}
+	}
+
+	return &h, nil
+}
+
+// Sends the request, returning the response with its body read and its parsed Proxy-* headers
+func (env *Env) do(req *http.Request) (*http.Response, []byte, *proxyHeaders, error) {
+	resp, err := env.Config.Client.Do(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	h, err := parseProxyHeaders(resp.Header)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%v %v answered %v: %v", req.Method, req.URL, resp.StatusCode, err)
+	}
+
+	return resp, body, h, nil
+}
+
+// Pings the URL
+func (env *Env) ping(u string) (*proxyHeaders, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, h, err := env.do(req)
+	return h, err
+}
+
+// Returns the URL of the pod at the IP, on the service's port and path like the client
+func (env *Env) podURL(ip string) string {
+	return fmt.Sprintf("%v://%v%v", env.service.Scheme, net.JoinHostPort(ip, env.service.Port()), env.service.Path)
+}
+
+// Returns a request forwarded to the recipient with a new id, delayed by the milliseconds and answered with the status
+func (env *Env) forwardRequest(u string, delay int, status int, body string) (*http.Request, string, error) {
+	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+
+	id := env.recipient.newID()
+	req.Header.Set("Forward-To", fmt.Sprintf("%v/?id=%v&delay=%v&status=%v", env.Config.RecipientURL, id, delay, status))
+
+	return req, id, nil
+}
+
+// Waits for the id to be delivered the count of times, returning the deliveries
+func (env *Env) awaitDeliveries(id string, count int, timeout time.Duration) []delivery {
+	deadline := time.Now().Add(timeout)
+	for {
+		deliveries := env.recipient.received(id)
+		if len(deliveries) >= count || time.Now().After(deadline) {
+			return deliveries
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Returns the service's current pod list
+func (env *Env) pods() (map[int]string, error) {
+	h, err := env.ping(env.service.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(h.List) == 0 {
+		return nil, fmt.Errorf("Proxy-List has no pods")
+	}
+
+	return h.List, nil
+}
+
+func checkHeaders(env *Env) error {
+	h, err := env.ping(env.service.String())
+	if err != nil {
+		return err
+	}
+
+	if h.Status != http.StatusOK {
+		return fmt.Errorf("a ping answered Proxy-Status %v", h.Status)
+	}
+
+	return nil
+}
+
+func checkPods(env *Env) error {
+	list, err := env.pods()
+	if err != nil {
+		return err
+	}
+
+	for ordinal, ip := range list {
+		h, err := env.ping(env.podURL(ip))
+		if err != nil {
+			return fmt.Errorf("pod %v: %v", ordinal, err)
+		}
+
+		if h.Ordinal != ordinal {
+			return fmt.Errorf("pod %v at %v answered with Proxy-Ordinal %v", ordinal, ip, h.Ordinal)
+		}
+	}
+
+	return nil
+}
+
+func checkCounter(env *Env) error {
+	list, err := env.pods()
+	if err != nil {
+		return err
+	}
+
+	for ordinal, ip := range list {
+		last := int64(-1)
+		for i := 0; i < 5; i++ {
+			h, err := env.ping(env.podURL(ip))
+			if err != nil {
+				return fmt.Errorf("pod %v: %v", ordinal, err)
+			}
+
+			if h.Counter <= last {
+				return fmt.Errorf("pod %v answered Proxy-Counter %v after %v", ordinal, h.Counter, last)
+			}
+
+			last = h.Counter
+		}
+	}
+
+	return nil
+}
+
+func checkVersion(env *Env) error {
+	list, err := env.pods()
+	if err != nil {
+		return err
+	}
+
+	lists := map[int64]string{}
+	for ordinal, ip := range list {
+		last := int64(-1)
+		for i := 0; i < 5; i++ {
+			h, err := env.ping(env.podURL(ip))
+			if err != nil {
+				return fmt.Errorf("pod %v: %v", ordinal, err)
+			}
+
+			if h.Version < last {
+				return fmt.Errorf("pod %v answered Proxy-Version %v after %v", ordinal, h.Version, last)
+			}
+
+			last = h.Version
+
+			encoded, _ := json.Marshal(h.List)
+			if other, ok := lists[h.Version]; ok && other != string(encoded) {
+				return fmt.Errorf("version %v has the lists %v and %v", h.Version, other, string(encoded))
+			}
+
+			lists[h.Version] = string(encoded)
+		}
+	}
+
+	return nil
+}
+
+func checkPing(env *Env) error {
+	id := env.recipient.newID()
+
+	req, err := http.NewRequest(http.MethodGet, env.service.String()+"?id="+id, nil)
+	if err != nil {
+		return err
+	}
+
+	_, _, h, err := env.do(req)
+	if err != nil {
+		return err
+	}
+
+	if h.Status != http.StatusOK {
+		return fmt.Errorf("a ping answered Proxy-Status %v", h.Status)
+	}
+
+	if deliveries := env.awaitDeliveries(id, 1, env.Config.ProxyTimeout); len(deliveries) != 0 {
+		return fmt.Errorf("a ping was forwarded")
+	}
+
+	return nil
+}
+
+func checkForward(env *Env) error {
+	req, id, err := env.forwardRequest(env.service.String(), 0, http.StatusCreated, "conformance")
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Proxy-Protocol-Version", "1")
+
+	resp, body, h, err := env.do(req)
+	if err != nil {
+		return err
+	}
+
+	if h.Status != http.StatusOK {
+		return fmt.Errorf("answered Proxy-Status %v", h.Status)
+	}
+
+	if resp.StatusCode != http.StatusCreated || string(body) != "conformance" {
+		return fmt.Errorf("answered %v %q instead of the recipient's 201 \"conformance\"", resp.StatusCode, body)
+	}
+
+	deliveries := env.recipient.received(id)
+	if len(deliveries) != 1 {
+		return fmt.Errorf("the recipient received the request %v times", len(deliveries))
+	}
+
+	for _, name := range []string{"Forward-To", "Proxy-Protocol-Version"} {
+		if deliveries[0].Header.Get(name) != "" {
+			return fmt.Errorf("the recipient received the %v header", name)
+		}
+	}
+
+	if string(deliveries[0].Body) != "conformance" {
+		return fmt.Errorf("the recipient received the body %q", deliveries[0].Body)
+	}
+
+	return nil
+}
+
+func checkAccepted(env *Env) error {
+	delay := int(4 * env.Config.ProxyTimeout / time.Millisecond)
+
+	req, id, err := env.forwardRequest(env.service.String(), delay, http.StatusOK, "conformance")
+	if err != nil {
+		return err
+	}
+
+	resp, _, h, err := env.do(req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusAccepted || h.Status != http.StatusAccepted {
+		return fmt.Errorf("answered %v with Proxy-Status %v", resp.StatusCode, h.Status)
+	}
+
+	if deliveries := env.awaitDeliveries(id, 1, 10*env.Config.ProxyTimeout); len(deliveries) != 1 {
+		return fmt.Errorf("the recipient received the request %v times", len(deliveries))
+	}
+
+	return nil
+}
+
+func checkDenied(env *Env) error {
+	list, err := env.pods()
+	if err != nil {
+		return err
+	}
+
+	// Saturate a single pod with requests outliving the proxy timeout
+	var ip string
+	for _, ip = range list {
+		break
+	}
+
+	delay := int(4 * env.Config.ProxyTimeout / time.Millisecond)
+
+	type outcome struct {
+		id     string
+		status int
+		proxy  int
+		err    error
+	}
+
+	outcomes := make(chan outcome, env.Config.MaxConcurrency)
+	for i := 0; i < env.Config.MaxConcurrency; i++ {
+		go func() {
+			req, id, err := env.forwardRequest(env.podURL(ip), delay, http.StatusOK, "")
+			if err != nil {
+				outcomes <- outcome{err: err}
+				return
+			}
+
+			resp, _, h, err := env.do(req)
+			if err != nil {
+				outcomes <- outcome{err: err}
+				return
+			}
+
+			outcomes <- outcome{id: id, status: resp.StatusCode, proxy: h.Status}
+		}()
+	}
+
+	var denied []outcome
+	for i := 0; i < env.Config.MaxConcurrency; i++ {
+		o := <-outcomes
+		if o.err != nil {
+			return o.err
+		}
+
+		if o.status == http.StatusTooManyRequests || o.proxy == http.StatusTooManyRequests {
+			if o.status != o.proxy {
+				return fmt.Errorf("a denied request answered %v with Proxy-Status %v", o.status, o.proxy)
+			}
+
+			denied = append(denied, o)
+		}
+	}
+
+	if len(denied) == 0 {
+		return fmt.Errorf("%v concurrent requests did not saturate pod at %v, raise MaxConcurrency", env.Config.MaxConcurrency, ip)
+	}
+
+	// Give the accepted requests time to be delivered
+	time.Sleep(time.Duration(2*delay) * time.Millisecond)
+
+	for _, o := range denied {
+		if deliveries := env.recipient.received(o.id); len(deliveries) != 0 {
+			return fmt.Errorf("a denied request was forwarded")
+		}
+	}
+
+	return nil
+}
+
+func checkEnsure(env *Env) error {
+	id := env.recipient.newID()
+
+	req, err := http.NewRequest(http.MethodPost, env.service.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Proxy-Ensure-Requests", "1")
+	req.Header.Set("Forward-To", fmt.Sprintf("%v/?id=%v", env.Config.RecipientURL, id))
+
+	_, _, h, err := env.do(req)
+	if err != nil {
+		return err
+	}
+
+	if h.Status != http.StatusOK {
+		return fmt.Errorf("an ensure request answered Proxy-Status %v", h.Status)
+	}
+
+	if deliveries := env.awaitDeliveries(id, 1, env.Config.ProxyTimeout); len(deliveries) != 0 {
+		return fmt.Errorf("an ensure request was forwarded")
+	}
+
+	req, err = http.NewRequest(http.MethodPost, env.service.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Proxy-Ensure-Requests", "many")
+
+	_, _, h, err = env.do(req)
+	if err != nil {
+		return err
+	}
+
+	if h.Status == http.StatusOK {
+		return fmt.Errorf("a malformed ensure request answered Proxy-Status 200")
+	}
+
+	return nil
+}
+
+func checkMethods(env *Env) error {
+	req, id, err := env.forwardRequest(env.service.String(), 0, http.StatusOK, "conformance")
+	if err != nil {
+		return err
+	}
+
+	req.Method = http.MethodHead
+	req.Body = nil
+	req.ContentLength = 0
+
+	resp, body, h, err := env.do(req)
+	if err != nil {
+		return err
+	}
+
+	if h.Status != http.StatusOK || resp.StatusCode != http.StatusOK || len(body) != 0 {
+		return fmt.Errorf("answered HEAD %v %q with Proxy-Status %v", resp.StatusCode, body, h.Status)
+	}
+
+	if deliveries := env.recipient.received(id); len(deliveries) != 1 || deliveries[0].Method != http.MethodHead {
+		return fmt.Errorf("the recipient did not receive the HEAD request once")
+	}
+
+	req, err = http.NewRequest(http.MethodOptions, env.service.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, _, h, err = env.do(req)
+	if err != nil {
+		return err
+	}
+
+	if h.Status != http.StatusOK || !strings.Contains(resp.Header.Get("Allow"), http.MethodPost) {
+		return fmt.Errorf("answered OPTIONS with Proxy-Status %v and Allow %q", h.Status, resp.Header.Get("Allow"))
+	}
+
+	req, err = http.NewRequest(http.MethodConnect, env.service.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, _, h, err = env.do(req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusMethodNotAllowed || h.Status != http.StatusMethodNotAllowed {
+		return fmt.Errorf("answered CONNECT %v with Proxy-Status %v", resp.StatusCode, h.Status)
+	}
+
+	return nil
+}
+
+func checkIdempotency(env *Env) error {
+	list, err := env.pods()
+	if err != nil {
+		return err
+	}
+
+	// The outcomes are kept per pod, so the duplicates go to the same one
+	var ip string
+	for _, ip = range list {
+		break
+	}
+
+	u := env.podURL(ip)
+
+	// Sends the request twice with the same key, the duplicate once the original is delivered
+	submitTwice := func(delay int) error {
+		req, id, err := env.forwardRequest(u, delay, http.StatusCreated, "conformance")
+		if err != nil {
+			return err
+		}
+
+		key := "conformance-" + id
+		req.Header.Set("Proxy-Idempotency-Key", key)
+		req.Header.Set("Proxy-Sender", "conformance")
+
+		type outcome struct {
+			resp *http.Response
+			body []byte
+			err  error
+		}
+
+		original := make(chan outcome, 1)
+		go func() {
+			resp, body, _, err := env.do(req)
+			original <- outcome{resp, body, err}
+		}()
+
+		if deliveries := env.awaitDeliveries(id, 1, 10*env.Config.ProxyTimeout); len(deliveries) != 1 {
+			return fmt.Errorf("the recipient received the request %v times", len(deliveries))
+		}
+
+		duplicate, err := http.NewRequest(http.MethodPost, u, strings.NewReader("conformance"))
+		if err != nil {
+			return err
+		}
+
+		// The keys are scoped to the sender
+		duplicate.Header.Set("Forward-To", req.Header.Get("Forward-To"))
+		duplicate.Header.Set("Proxy-Idempotency-Key", key)
+		duplicate.Header.Set("Proxy-Sender", "conformance")
+
+		resp, body, h, err := env.do(duplicate)
+		if err != nil {
+			return err
+		}
+
+		if first := <-original; first.err != nil {
+			return first.err
+		} else if first.resp.StatusCode != http.StatusCreated || string(first.body) != "conformance" {
+			return fmt.Errorf("answered %v %q instead of the recipient's 201 \"conformance\"", first.resp.StatusCode, first.body)
+		}
+
+		if h.Status != http.StatusOK || resp.StatusCode != http.StatusCreated || string(body) != "conformance" {
+			return fmt.Errorf("answered the duplicate %v %q with Proxy-Status %v instead of the original response", resp.StatusCode, body, h.Status)
+		}
+
+		if resp.Header.Get("Proxy-Idempotent-Replay") != "true" {
+			return fmt.Errorf("answered the duplicate without Proxy-Idempotent-Replay")
+		}
+
+		// Give a forwarded duplicate time to arrive
+		time.Sleep(env.Config.ProxyTimeout)
+		if deliveries := env.recipient.received(id); len(deliveries) != 1 {
+			return fmt.Errorf("the recipient received the request %v times", len(deliveries))
+		}
+
+		return nil
+	}
+
+	// A duplicate of a request done, then of one still in flight
+	if err := submitTwice(0); err != nil {
+		return err
+	}
+
+	return submitTwice(int(env.Config.ProxyTimeout / 2 / time.Millisecond))
+}
@@ -0,0 +1,56 @@
+package conformance_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client/proxytest"
+	"github.com/btbd/proxy/conformance"
+)
+
+// The in-process proxies of proxytest are the reference the suite is checked against
+func TestProxytest(t *testing.T) {
+	s := proxytest.NewServerWithConfig(proxytest.Config{Pods: 2, MaxRequests: 5})
+	defer s.Close()
+
+	conformance.Test(t, conformance.Config{URL: s.URL, Client: &http.Client{Transport: s.Transport(), Timeout: 10 * time.Second}})
+}
+
+func TestRun(t *testing.T) {
+	s := proxytest.NewServer()
+	defer s.Close()
+
+	results, err := conformance.Run(conformance.Config{URL: s.URL, Client: &http.Client{Transport: s.Transport(), Timeout: 10 * time.Second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(conformance.Cases) {
+		t.Fatalf("got %v results for %v cases", len(results), len(conformance.Cases))
+	}
+
+	for i, result := range results {
+		if result.Case != conformance.Cases[i] {
+			t.Errorf("result %v is of case %v, expected %v", i, result.Case.Name, conformance.Cases[i].Name)
+		}
+
+		if result.Err != nil {
+			t.Errorf("%v: %v", result.Case.Name, result.Err)
+		}
+	}
+}
+
+// A server that is not a proxy fails the suite
+func TestNotAProxy(t *testing.T) {
+	results, err := conformance.Run(conformance.Config{URL: "http://127.0.0.1:1/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, result := range results {
+		if result.Err == nil {
+			t.Errorf("%v passed against no server", result.Case.Name)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogEntry is the structured access log line of a forwarded request
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Sender    string    `json:"sender,omitempty"`
+	Method    string    `json:"method"`
+	Target    string    `json:"target"`
+
+	// QueueWait is the time in milliseconds between receiving the request and forwarding it
+	QueueWait float64 `json:"queueWaitMs"`
+
+	// RecipientLatency is the time in milliseconds the recipient took to respond
+	RecipientLatency float64 `json:"recipientLatencyMs"`
+
+	// ProxyStatus is the Proxy-Status returned to the sender
+	ProxyStatus int `json:"proxyStatus"`
+
+	// RecipientStatus is the recipient's status code, 0 if the request failed
+	RecipientStatus int    `json:"recipientStatus,omitempty"`
+	Error           string `json:"error,omitempty"`
+
+	RequestBytes  int64 `json:"requestBytes"`
+	ResponseBytes int64 `json:"responseBytes"`
+
+	// TraceID is the W3C trace ID the request is part of
+	TraceID string `json:"traceId"`
+
+	// halves counts the finished halves of the entry, the response to the sender and the recipient's response
+	halves int32
+}
+
+// AccessLogSink writes access log entries somewhere
+type AccessLogSink interface {
+	Write(entry *AccessLogEntry)
+}
+
+// AccessLogSinks are the access log sinks selectable through the accessLog annotation
+var AccessLogSinks = map[string]AccessLogSink{
+	"none":   nil,
+	"stdout": &jsonAccessLogSink{Writer: os.Stdout},
+	"stderr": &jsonAccessLogSink{Writer: os.Stderr},
+}
+
+// Writes every entry as a line of JSON
+type jsonAccessLogSink struct {
+	sync.Mutex
+	Writer io.Writer
+}
+
+func (s *jsonAccessLogSink) Write(entry *AccessLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("[!] Failed to encode access log entry: %v", err)
+		return
+	}
+
+	s.Lock()
+	s.Writer.Write(append(line, '\n'))
+	s.Unlock()
+}
+
+// Generates a random request ID
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// Marks one half of the entry as finished, the entry is written once both are
+func (entry *AccessLogEntry) finishHalf() {
+	if atomic.AddInt32(&entry.halves, 1) != 2 {
+		return
+	}
+
+	if sink := currentConfig().AccessLogSink; sink != nil {
+		sink.Write(entry)
+	}
+}
+
+// Records the status returned to the sender
+func (entry *AccessLogEntry) finishResponse(proxyStatus int) {
+	entry.ProxyStatus = proxyStatus
+	entry.finishHalf()
+}
+
+// Records the outcome of the request to the recipient
+func (entry *AccessLogEntry) finishRecipient(recipientStatus int, responseBytes int, latency time.Duration, err error) {
+	entry.RecipientStatus = recipientStatus
+	entry.ResponseBytes = int64(responseBytes)
+	entry.RecipientLatency = float64(latency) / float64(time.Millisecond)
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	entry.finishHalf()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Sink passing on the entries it is written
+type channelAccessLogSink chan *AccessLogEntry
+
+func (s channelAccessLogSink) Write(entry *AccessLogEntry) {
+	s <- entry
+}
+
+// Returns the next entry written to the sink
+func nextAccessLogEntry(t *testing.T, sink channelAccessLogSink) *AccessLogEntry {
+	select {
+	case entry := <-sink:
+		return entry
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no access log entry was written")
+		return nil
+	}
+}
+
+// A single entry is written per forwarded request, once both the sender and recipient were answered
+func TestAccessLog(t *testing.T) {
+	sink := make(channelAccessLogSink, 2)
+	withConfig(t, func(next *proxyConfig) { next.AccessLogSink, next.ProxyTimeout = sink, 5000 })
+
+	release := make(chan struct{})
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+
+	defer recipient.Close()
+
+	r := newForwardRequest(http.MethodPost, recipient.URL, "order")
+	r.Header.Set("Proxy-Sender", "sender")
+	r.Header.Set("Proxy-Request-Id", "request")
+
+	if w := serveProxy(r); w.Code != http.StatusCreated {
+		t.Fatalf("got status %v, expected the recipient's 201", w.Code)
+	}
+
+	entry := nextAccessLogEntry(t, sink)
+	if entry.RequestID != "request" || entry.Sender != "sender" || entry.Method != http.MethodPost || entry.Target != recipient.URL || entry.TraceID == "" {
+		t.Errorf("got entry %+v, expected the request's", entry)
+	}
+
+	if entry.ProxyStatus != http.StatusOK || entry.RecipientStatus != http.StatusCreated || entry.RequestBytes != 5 || entry.ResponseBytes != 7 || entry.Error != "" {
+		t.Errorf("got entry %+v, expected the recipient's response", entry)
+	}
+
+	// Requests outliving the proxy timeout are logged once the recipient responds
+	updateConfig(func(next *proxyConfig) { next.ProxyTimeout = 100 })
+
+	if w := serveProxy(newForwardRequest(http.MethodGet, recipient.URL+"/slow", "")); w.Code != http.StatusAccepted {
+		t.Fatalf("got status %v, expected 202", w.Code)
+	}
+
+	select {
+	case entry := <-sink:
+		t.Errorf("got entry %+v before the recipient responded", entry)
+	default:
+	}
+
+	close(release)
+
+	if entry := nextAccessLogEntry(t, sink); entry.ProxyStatus != http.StatusAccepted || entry.RecipientStatus != http.StatusCreated || entry.RequestID == "" || entry.RequestID == "request" {
+		t.Errorf("got entry %+v, expected a 202 and the recipient's 201", entry)
+	}
+}
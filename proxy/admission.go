@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Request priorities, from the Proxy-Priority header
+const (
+	PriorityHigh = iota
+	PriorityNormal
+	PriorityLow
+)
+
+// PriorityNames are the Proxy-Priority header values of each priority
+var PriorityNames = []string{"high", "normal", "low"}
+
+// Order in which the priority queues are served, weighting high over normal over low 4:2:1
+var prioritySchedule = []int{PriorityHigh, PriorityHigh, PriorityHigh, PriorityHigh, PriorityNormal, PriorityNormal, PriorityLow}
+
+// Requests of a single sender waiting for a free slot, closed when admitted
+type senderQueue struct {
+	Sender  string
+	Tenant  string
+	Waiting []chan struct{}
+}
+
+// maxAdmittedSenders bounds the senders whose admitted requests are counted by name, as they are metric labels
+const maxAdmittedSenders = 100
+
+// OtherSenders is the sender the admitted requests of the senders past maxAdmittedSenders are counted as
+const OtherSenders = "other"
+
+// Requests waiting for a free slot, guarded by state.ActiveRequestsMu
+var admission struct {
+	// Queues are the per-sender queues of each priority, served round-robin
+	Queues [3][]*senderQueue
+
+	// Queued is the total number of waiting requests
+	Queued int64
+
+	// Turn is the position in the priority schedule
+	Turn int
+
+	// Admitted counts the admitted requests by sender, of at most maxAdmittedSenders then OtherSenders
+	Admitted map[string]uint64
+}
+
+func init() {
+	admission.Admitted = map[string]uint64{}
+}
+
+// Parses a Proxy-Priority header, defaulting to normal
+func parsePriority(value string) int {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	for priority, name := range PriorityNames {
+		if value == name {
+			return priority
+		}
+	}
+
+	return PriorityNormal
+}
+
+// Returns the sender identity of a request, the valid Proxy-Sender header or else the remote host
+func requestSender(r *http.Request) string {
+	if sender := proxySender(r.Header); sender != "" {
+		return sender
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// Adds a request to its sender's queue, must be called with state.ActiveRequestsMu locked
+func enqueueRequest(priority int, sender string, tenant string, admitted chan struct{}) {
+	admission.Queued++
+	tenantOf(tenant).Queued++
+
+	for _, queue := range admission.Queues[priority] {
+		if queue.Sender == sender && queue.Tenant == tenant {
+			queue.Waiting = append(queue.Waiting, admitted)
+			return
+		}
+	}
+
+	admission.Queues[priority] = append(admission.Queues[priority], &senderQueue{
+		Sender:  sender,
+		Tenant:  tenant,
+		Waiting: []chan struct{}{admitted},
+	})
+}
+
+// Removes a timed out request from its sender's queue, returns false if it was already admitted
+// Must be called with state.ActiveRequestsMu locked
+func removeQueuedRequest(priority int, sender string, tenant string, admitted chan struct{}) bool {
+	for i, queue := range admission.Queues[priority] {
+		if queue.Sender != sender || queue.Tenant != tenant {
+			continue
+		}
+
+		for j, waiting := range queue.Waiting {
+			if waiting != admitted {
+				continue
+			}
+
+			admission.Queued--
+			tenantOf(tenant).Queued--
+			queue.Waiting = append(queue.Waiting[:j:j], queue.Waiting[j+1:]...)
+			if len(queue.Waiting) == 0 {
+				admission.Queues[priority] = append(admission.Queues[priority][:i:i], admission.Queues[priority][i+1:]...)
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the index of the first sender queue whose tenant may have another active request, -1 if none
+// Must be called with state.ActiveRequestsMu locked
+func admissibleQueue(priority int) int {
+	for i, queue := range admission.Queues[priority] {
+		if tenantHasCapacity(queue.Tenant) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Marks a request as active, must be called with state.ActiveRequestsMu locked
+func markAdmitted(sender string, tenant string) {
+	// Bound the senders counted, so senders generating identities can not grow the map and metrics without limit
+	if _, ok := admission.Admitted[sender]; !ok && len(admission.Admitted) >= maxAdmittedSenders {
+		sender = OtherSenders
+	}
+
+	admission.Admitted[sender]++
+	tenantOf(tenant).Admitted++
+	tenantOf(tenant).Active++
+}
+
+// Removes the next request to admit from the queues, must be called with state.ActiveRequestsMu locked
+// Returns nil if no queued request may be admitted
+func dequeueRequest() chan struct{} {
+	if admission.Queued == 0 {
+		return nil
+	}
+
+	// Follow the schedule, skipping queues without admissible requests
+	for range prioritySchedule {
+		priority := prioritySchedule[admission.Turn]
+		admission.Turn = (admission.Turn + 1) % len(prioritySchedule)
+
+		i := admissibleQueue(priority)
+		if i < 0 {
+			continue
+		}
+
+		// Take the head of the sender's queue, then move that sender to the back
+		queues := admission.Queues[priority]
+		queue := queues[i]
+		next := queue.Waiting[0]
+		queue.Waiting = queue.Waiting[1:]
+		admission.Queued--
+		tenantOf(queue.Tenant).Queued--
+
+		admission.Queues[priority] = append(queues[:i:i], queues[i+1:]...)
+		if len(queue.Waiting) != 0 {
+			admission.Queues[priority] = append(admission.Queues[priority], queue)
+		}
+
+		markAdmitted(queue.Sender, queue.Tenant)
+		return next
+	}
+
+	return nil
+}
+
+// Admits a request as active, returns false if it should be denied
+// If the proxy or its tenant is full, the request waits in its sender's queue of its priority for up to queueTimeout,
+// or until its deadline if sooner
+func admitRequest(priority int, sender string, tenant string, deadline time.Time) (ok bool) {
+	defer func() {
+		recordSenderAdmission(sender, ok)
+	}()
+
+	current := currentConfig()
+	// Quickly deny without locking if there is no queue
+	if current.QueueTimeout == 0 && atomic.LoadInt64(&state.ActiveRequests) >= current.MaxRequests {
+		return false
+	}
+
+	state.ActiveRequestsMu.Lock()
+
+	if !takeTenantBudget(tenant) {
+		state.ActiveRequestsMu.Unlock()
+		return false
+	}
+
+	// Admissible queued requests go first
+	if state.ActiveRequests < current.MaxRequests && tenantHasCapacity(tenant) && !hasAdmissibleRequests() {
+		atomic.AddInt64(&state.ActiveRequests, 1)
+		markAdmitted(sender, tenant)
+		state.ActiveRequestsMu.Unlock()
+		return true
+	}
+
+	if current.QueueTimeout == 0 || admission.Queued >= current.MaxQueuedRequests || !tenantCanQueue(tenant) {
+		refundTenantBudget(tenant)
+		state.ActiveRequestsMu.Unlock()
+		return false
+	}
+
+	admitted := make(chan struct{})
+	enqueueRequest(priority, sender, tenant, admitted)
+	state.ActiveRequestsMu.Unlock()
+
+	// Stop waiting once the request expires
+	wait := time.Duration(current.QueueTimeout) * time.Millisecond
+	if !deadline.IsZero() && time.Until(deadline) < wait {
+		wait = time.Until(deadline)
+	}
+
+	select {
+	case <-admitted:
+		return true
+	case <-time.After(wait):
+	}
+
+	state.ActiveRequestsMu.Lock()
+	defer state.ActiveRequestsMu.Unlock()
+
+	// We may have been admitted while timing out
+	if removeQueuedRequest(priority, sender, tenant, admitted) {
+		refundTenantBudget(tenant)
+		return false
+	}
+
+	return true
+}
+
+// Returns whether any queued request may be admitted, must be called with state.ActiveRequestsMu locked
+func hasAdmissibleRequests() bool {
+	for priority := range admission.Queues {
+		if admissibleQueue(priority) >= 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Releases the slot of a finished request of the tenant, handing it to the next admissible queued request if any
+// Returns the resulting number of active requests
+func releaseRequest(tenant string) int64 {
+	state.ActiveRequestsMu.Lock()
+	defer state.ActiveRequestsMu.Unlock()
+
+	tenantOf(tenant).Active--
+
+	if next := dequeueRequest(); next != nil {
+		close(next)
+		return atomic.LoadInt64(&state.ActiveRequests)
+	}
+
+	return atomic.AddInt64(&state.ActiveRequests, -1)
+}
+
+// Writes the queue depths in the Prometheus text exposition format
+func writeQueueMetrics(w *strings.Builder) {
+	state.ActiveRequestsMu.Lock()
+	defer state.ActiveRequestsMu.Unlock()
+
+	fmt.Fprintf(w, "# HELP proxy_queued_requests Number of requests waiting for a free slot by priority.\n")
+	fmt.Fprintf(w, "# TYPE proxy_queued_requests gauge\n")
+	for priority, name := range PriorityNames {
+		var queued int
+		for _, queue := range admission.Queues[priority] {
+			queued += len(queue.Waiting)
+		}
+
+		fmt.Fprintf(w, "proxy_queued_requests{priority=%v} %v\n", labelValue(name), queued)
+	}
+
+	senders := make([]string, 0, len(admission.Admitted))
+	for sender := range admission.Admitted {
+		senders = append(senders, sender)
+	}
+	sort.Strings(senders)
+
+	fmt.Fprintf(w, "# HELP proxy_sender_admitted_requests_total Number of requests admitted by sender.\n")
+	fmt.Fprintf(w, "# TYPE proxy_sender_admitted_requests_total counter\n")
+	for _, sender := range senders {
+		fmt.Fprintf(w, "proxy_sender_admitted_requests_total{sender=%v} %v\n", labelValue(sender), admission.Admitted[sender])
+	}
+
+	writeTenantMetrics(w)
+}
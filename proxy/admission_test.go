@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Senders past maxAdmittedSenders are counted together, bounding the map and the metric labels
+func TestAdmittedSendersBounded(t *testing.T) {
+	state.ActiveRequestsMu.Lock()
+	admitted, usage := admission.Admitted, tenants
+	admission.Admitted, tenants = map[string]uint64{}, map[string]*tenantState{}
+
+	for i := 0; i < 2*maxAdmittedSenders; i++ {
+		markAdmitted(fmt.Sprintf("sender-%v", i), "")
+	}
+
+	markAdmitted("sender-0", "")
+	state.ActiveRequestsMu.Unlock()
+
+	defer func() {
+		state.ActiveRequestsMu.Lock()
+		admission.Admitted, tenants = admitted, usage
+		state.ActiveRequestsMu.Unlock()
+	}()
+
+	if len(admission.Admitted) != maxAdmittedSenders+1 {
+		t.Errorf("counted %v senders, expected %v and %v", len(admission.Admitted), maxAdmittedSenders, OtherSenders)
+	}
+
+	if admission.Admitted["sender-0"] != 2 || admission.Admitted[OtherSenders] != maxAdmittedSenders {
+		t.Errorf("counted %v requests of sender-0 and %v of %v", admission.Admitted["sender-0"], admission.Admitted[OtherSenders], OtherSenders)
+	}
+
+	var w strings.Builder
+	writeQueueMetrics(&w)
+	if labels := strings.Count(w.String(), "proxy_sender_admitted_requests_total{"); labels != maxAdmittedSenders+1 {
+		t.Errorf("wrote %v sender labels", labels)
+	}
+}
+
+// Sender identities are escaped in the metric labels as the exposition format does, rather than as Go strings
+func TestSenderLabelsEscaped(t *testing.T) {
+	state.ActiveRequestsMu.Lock()
+	admitted, usage := admission.Admitted, tenants
+	admission.Admitted, tenants = map[string]uint64{}, map[string]*tenantState{}
+
+	markAdmitted("a\\b\"c\nd\té", "")
+	state.ActiveRequestsMu.Unlock()
+
+	defer func() {
+		state.ActiveRequestsMu.Lock()
+		admission.Admitted, tenants = admitted, usage
+		state.ActiveRequestsMu.Unlock()
+	}()
+
+	var w strings.Builder
+	writeQueueMetrics(&w)
+	if expected := `proxy_sender_admitted_requests_total{sender="a\\b\"c\nd` + "\t" + `é"} 1`; !strings.Contains(w.String(), expected) {
+		t.Errorf("the metrics lack %v:\n%v", expected, w.String())
+	}
+}
+
+// Proxy-Sender identities too long or with other than printable ASCII characters are ignored for the remote host
+func TestProxySenderValidated(t *testing.T) {
+	for _, c := range []struct {
+		sender   string
+		expected string
+	}{
+		{"sender-1", "sender-1"},
+		{" sender 2 ", "sender 2"},
+		{strings.Repeat("s", maxSenderLength), strings.Repeat("s", maxSenderLength)},
+		{strings.Repeat("s", maxSenderLength+1), "192.0.2.1"},
+		{"sénder", "192.0.2.1"},
+		{"sender\x00", "192.0.2.1"},
+		{"", "192.0.2.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Proxy-Sender", c.sender)
+
+		if sender := requestSender(r); sender != c.expected {
+			t.Errorf("got sender %q for Proxy-Sender %q, expected %q", sender, c.sender, c.expected)
+		}
+	}
+}
+
+// Waits for the number of queued requests to reach the count
+func awaitQueued(t *testing.T, count int64) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		state.ActiveRequestsMu.Lock()
+		queued := admission.Queued
+		state.ActiveRequestsMu.Unlock()
+
+		if queued == count {
+			return
+		}
+	}
+
+	t.Fatalf("%v requests were never queued", count)
+}
+
+// While the proxy is full, queued high priority requests are admitted before the low priority ones queued earlier,
+// and requests past the queue are denied
+func TestPriorityAdmission(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) {
+		next.MaxRequests, next.QueueTimeout, next.MaxQueuedRequests, next.ProxyTimeout = 1, 5000, 2, 5000
+	})
+
+	held, release := make(chan struct{}), make(chan struct{})
+	forwarded := make(chan string, 2)
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			close(held)
+			<-release
+			return
+		}
+
+		forwarded <- r.URL.Path
+	}))
+
+	defer recipient.Close()
+
+	var wg sync.WaitGroup
+	serve := func(path string, priority string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r := newForwardRequest(http.MethodGet, recipient.URL+path, "")
+			r.Header.Set("Proxy-Priority", priority)
+
+			if w := serveProxy(r); w.Code != http.StatusOK {
+				t.Errorf("got status %v for %v, expected 200", w.Code, path)
+			}
+		}()
+	}
+
+	serve("/hold", "normal")
+	<-held
+
+	serve("/low", "low")
+	awaitQueued(t, 1)
+	serve("/high", "high")
+	awaitQueued(t, 2)
+
+	if w := serveProxy(newForwardRequest(http.MethodGet, recipient.URL, "")); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %v past the queue, expected 429", w.Code)
+	}
+
+	// Start the schedule over, at its high priority turns
+	state.ActiveRequestsMu.Lock()
+	admission.Turn = 0
+	state.ActiveRequestsMu.Unlock()
+
+	close(release)
+	wg.Wait()
+
+	if first, second := <-forwarded, <-forwarded; first != "/high" || second != "/low" {
+		t.Errorf("forwarded %v then %v, expected the high priority request first", first, second)
+	}
+}
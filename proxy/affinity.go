@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request that outlived the proxy timeout, followed up through its affinity token
+type affinityJob struct {
+	Outcome *idempotentOutcome
+
+	// Context is the context of the request to the recipient, cancelled by Cancel
+	Context context.Context
+	Cancel  context.CancelFunc
+
+	// Forwarding is 1 once the request is being forwarded to the recipient, and Accepted once it was answered with a
+	// 202, leaving the proxy alone to know its outcome, both accessed atomically
+	Forwarding int32
+	Accepted   int32
+
+	// Expired is set before the outcome is done if the request was dropped for its Proxy-TTL
+	Expired bool
+}
+
+// Jobs of the 202 responses issued by this proxy, by ID
+var affinityJobs struct {
+	sync.Mutex
+	Jobs map[string]*affinityJob
+}
+
+func init() {
+	affinityJobs.Jobs = map[string]*affinityJob{}
+
+	go expireAffinityJobs()
+}
+
+// Forgets the finished jobs past the affinity TTL every second
+func expireAffinityJobs() {
+	for {
+		time.Sleep(time.Second)
+
+		affinityJobs.Lock()
+		for id, job := range affinityJobs.Jobs {
+			select {
+			case <-job.Outcome.Done:
+				if time.Now().After(job.Outcome.Expires) {
+					delete(affinityJobs.Jobs, id)
+				}
+			default:
+			}
+		}
+		affinityJobs.Unlock()
+	}
+}
+
+// Returns a new job of a request to forward, which must be sent with the job's context, cancelled if draining times
+// out
+func newAffinityJob(ctx context.Context) *affinityJob {
+	ctx, cancel := withDrain(ctx)
+
+	return &affinityJob{
+		Outcome: &idempotentOutcome{Done: make(chan struct{})},
+		Context: ctx,
+		Cancel:  cancel,
+	}
+}
+
+// Stores the recipient's response as the outcome of the job
+func finishAffinityJob(job *affinityJob, resp *http.Response, body []byte, err error) {
+	if err != nil {
+		job.Outcome.Err = err
+	} else {
+		job.Outcome.StatusCode = resp.StatusCode
+		job.Outcome.Header = resp.Header
+		job.Outcome.Body = body
+	}
+
+	job.Outcome.Expires = time.Now().Add(time.Duration(currentConfig().AffinityTTL) * time.Second)
+	close(job.Outcome.Done)
+	job.Cancel()
+}
+
+// Registers the job of a 202 response, returns its affinity token ("<ordinal>.<id>") or "" if disabled
+func registerAffinityJob(job *affinityJob) string {
+	atomic.StoreInt32(&job.Accepted, 1)
+
+	if currentConfig().AffinityTTL == 0 {
+		return ""
+	}
+
+	id := newRequestID()
+
+	affinityJobs.Lock()
+	affinityJobs.Jobs[id] = job
+	affinityJobs.Unlock()
+
+	return fmt.Sprintf("%v.%v", ProxyOrdinal, id)
+}
+
+// Handles a follow-up request with a Proxy-Affinity token if it exists, returns false if none exists
+// GET returns the outcome of the job (202 while pending) and DELETE cancels it
+func handleAffinityRequest(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimSpace(r.Header.Get("Proxy-Affinity"))
+	if token == "" {
+		return false
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	ordinal, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		writeProxyMetrics(w, http.StatusBadRequest)
+		w.WriteHeader(http.StatusBadRequest)
+		return true
+	}
+
+	// Route the follow-up to the proxy holding the job
+	if ordinal != ProxyOrdinal {
+		forwardAffinityRequest(w, r, ordinal)
+		return true
+	}
+
+	affinityJobs.Lock()
+	job, ok := affinityJobs.Jobs[parts[1]]
+	affinityJobs.Unlock()
+
+	if !ok {
+		writeProxyMetrics(w, http.StatusNotFound)
+		w.WriteHeader(http.StatusNotFound)
+		return true
+	}
+
+	if r.Method != http.MethodDelete {
+		writeStoredOutcome(w, job.Outcome)
+		return true
+	}
+
+	select {
+	case <-job.Outcome.Done:
+		// Too late to cancel
+		writeProxyMetrics(w, http.StatusConflict)
+		w.WriteHeader(http.StatusConflict)
+	default:
+		job.Cancel()
+		writeProxyMetrics(w, http.StatusOK)
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return true
+}
+
+// Forwards a follow-up request to the proxy with the ordinal, returning its response as is
+func forwardAffinityRequest(w http.ResponseWriter, r *http.Request, ordinal int64) {
+	proxies.List.RLock()
+	ip, ok := proxies.List.PodIPs[fmt.Sprintf("%v-%v", ProxyStatefulSet, ordinal)]
+	proxies.List.RUnlock()
+
+	// The proxy holding the job is gone along with it
+	if !ok {
+		writeProxyMetrics(w, http.StatusGone)
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	scheme, client := peerClient()
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, fmt.Sprintf("%v://%v:%v%v", scheme, ip, currentConfig().HTTP.Port, currentConfig().HTTP.Path), nil)
+	if err != nil {
+		writeProxyMetrics(w, http.StatusInternalServerError)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	req.Header.Set("Proxy-Affinity", r.Header.Get("Proxy-Affinity"))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		debugPrint(1, "[!] Failed to forward follow-up request to proxy %v: %v", ordinal, err)
+		writeProxyMetrics(w, http.StatusBadGateway)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	for k, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+
+	// Stream the stored response rather than buffering it, as it may be as large as the recipient's
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		debugPrint(1, "[!] Failed to relay follow-up response of proxy %v: %v", ordinal, err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Returns a follow-up request of the affinity token
+func newAffinityRequest(method string, token string) *http.Request {
+	r := httptest.NewRequest(method, "/", nil)
+	r.Header.Set("Proxy-Affinity", token)
+	return r
+}
+
+// Requests outliving the proxy timeout are answered with a 202 and a token to follow up on their outcome
+func TestAffinityFollowUp(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) { next.ProxyTimeout, next.AffinityTTL = 50, 60 })
+
+	release := make(chan struct{})
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Location", "/orders/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+
+	defer recipient.Close()
+
+	w := serveProxy(newForwardRequest(http.MethodPost, recipient.URL, "order"))
+	token := w.Header().Get("Proxy-Affinity")
+	if w.Code != http.StatusAccepted || !strings.HasPrefix(token, "0.") {
+		close(release)
+		t.Fatalf("got status %v and Proxy-Affinity %q, expected a 202 with a token", w.Code, token)
+	}
+
+	// Still pending
+	if w := serveProxy(newAffinityRequest(http.MethodGet, token)); w.Code != http.StatusAccepted {
+		t.Errorf("got status %v while pending, expected 202", w.Code)
+	}
+
+	// Wait for the outcome rather than answering with a 202
+	close(release)
+	updateConfig(func(next *proxyConfig) { next.ProxyTimeout = 5000 })
+
+	w = serveProxy(newAffinityRequest(http.MethodGet, token))
+	if w.Code != http.StatusCreated || w.Body.String() != "created" || w.Header().Get("Location") != "/orders/1" {
+		t.Errorf("got status %v, %v and body %q, expected the recipient's response", w.Code, w.Header(), w.Body.String())
+	}
+
+	// Too late to cancel
+	if w := serveProxy(newAffinityRequest(http.MethodDelete, token)); w.Code != http.StatusConflict {
+		t.Errorf("got status %v cancelling a finished request, expected 409", w.Code)
+	}
+
+	for token, status := range map[string]int{"0.unknown": http.StatusNotFound, "zero.id": http.StatusBadRequest, "0": http.StatusBadRequest} {
+		if w := serveProxy(newAffinityRequest(http.MethodGet, token)); w.Code != status {
+			t.Errorf("got status %v for token %q, expected %v", w.Code, token, status)
+		}
+	}
+}
+
+// Pending requests are cancelled by a DELETE of their token
+func TestAffinityCancel(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) { next.ProxyTimeout, next.AffinityTTL = 50, 60 })
+
+	cancelled := make(chan struct{})
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body so that the closed connection is noticed
+		ioutil.ReadAll(r.Body)
+
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+
+	defer recipient.Close()
+
+	w := serveProxy(newForwardRequest(http.MethodPost, recipient.URL, "order"))
+	token := w.Header().Get("Proxy-Affinity")
+	if w.Code != http.StatusAccepted || token == "" {
+		t.Fatalf("got status %v and Proxy-Affinity %q, expected a 202 with a token", w.Code, token)
+	}
+
+	if w := serveProxy(newAffinityRequest(http.MethodDelete, token)); w.Code != http.StatusOK {
+		t.Fatalf("got status %v cancelling a pending request, expected 200", w.Code)
+	}
+
+	<-cancelled
+	updateConfig(func(next *proxyConfig) { next.ProxyTimeout = 5000 })
+
+	if w := serveProxy(newAffinityRequest(http.MethodGet, token)); w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %v following up on a cancelled request, expected 500", w.Code)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// BatchContentType is the content type of batches, one JSON request per line
+const BatchContentType = "application/x-ndjson"
+
+// Request of a batch
+type batchItem struct {
+	ForwardTo string      `json:"forwardTo"`
+	Method    string      `json:"method"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+}
+
+// Outcome of submitting a request of a batch
+type batchItemResult struct {
+	RequestID string `json:"requestId,omitempty"`
+	Status    int    `json:"status"`
+
+	// Affinity is the token to follow up on the request with, as with a 202 response
+	Affinity string `json:"affinity,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Returns whether the request is a batch, a POST of BatchContentType without Forward-To
+func isBatchRequest(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == BatchContentType
+}
+
+// Handles a batch, enqueueing each request individually and returning their request IDs and statuses in order
+// Admitted requests are forwarded in the background and answered with a 202, to follow up on with their affinity token
+func handleBatchRequest(w http.ResponseWriter, r *http.Request) {
+	// Is the batch too large to take?
+	if rejectOversizedRequest(w, r) {
+		return
+	}
+
+	// Read the whole batch before submitting any of it, so an invalid batch submits nothing
+	var items []batchItem
+	decoder := json.NewDecoder(r.Body)
+	for {
+		var item batchItem
+		err := decoder.Decode(&item)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			writeProxyMetrics(w, http.StatusBadRequest)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("batch item %v is invalid: %v", len(items), err)))
+			return
+		}
+
+		if int64(len(items)) == currentConfig().MaxBatchSize {
+			writeProxyMetrics(w, http.StatusRequestEntityTooLarge)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// Canonicalize the header names, as they are not when decoded
+		header := http.Header{}
+		for k, values := range item.Header {
+			for _, v := range values {
+				header.Add(k, v)
+			}
+		}
+
+		item.Header = header
+		items = append(items, item)
+	}
+
+	// Every request of the batch counts toward the batch's sender and tenant
+	sender := requestSender(r)
+	tenant := requestTenant(r)
+
+	// The whole batch waits for free slots for up to one queueTimeout, rather than each of its requests in turn
+	queueDeadline := time.Now().Add(time.Duration(currentConfig().QueueTimeout) * time.Millisecond)
+
+	var response bytes.Buffer
+	encoder := json.NewEncoder(&response)
+	for _, item := range items {
+		// Inherit the batch's priority unless the request has its own
+		priority := item.Header.Get("Proxy-Priority")
+		if priority == "" {
+			priority = r.Header.Get("Proxy-Priority")
+		}
+
+		encoder.Encode(submitBackgroundRequest(item, priority, sender, tenant, queueDeadline, nil))
+	}
+
+	w.Header().Set("Content-Type", BatchContentType)
+	writeProxyMetrics(w, http.StatusOK)
+	w.WriteHeader(http.StatusOK)
+	w.Write(response.Bytes())
+}
+
+// Admits a request answered before being forwarded (e.g. of a batch) and starts forwarding it in the background
+// It waits in the queue until the queue deadline at most, if not zero, and its outcome is stored in the job, or a new
+// job registered for follow-ups if nil
+func submitBackgroundRequest(item batchItem, priority string, sender string, tenant string, queueDeadline time.Time, job *affinityJob) batchItemResult {
+	receivedAt := time.Now()
+
+	header := item.Header
+	if header == nil {
+		header = http.Header{}
+	}
+
+	// Proxy-Request-Id identifies the request in the access log, generate one if the sender did not
+	requestID := strings.TrimSpace(header.Get("Proxy-Request-Id"))
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	result := batchItemResult{RequestID: requestID}
+
+	method := item.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	if item.ForwardTo == "" || method == http.MethodConnect {
+		result.Status = http.StatusBadRequest
+		result.Error = "forwardTo is required and method must not be CONNECT"
+		return result
+	}
+
+	// Proxy-TTL is the time in milliseconds the request can wait to be forwarded before being dropped
+	deadline, err := requestDeadline(header, receivedAt)
+	if err != nil {
+		result.Status = http.StatusBadRequest
+		result.Error = err.Error()
+		return result
+	}
+
+	span := startSpanFromRequest("proxy", header)
+
+	// Drops the request if it expired before being forwarded
+	expired := func() batchItemResult {
+		dropExpiredRequest(&DeadLetter{
+			Time:       time.Now(),
+			RequestID:  requestID,
+			Sender:     sender,
+			Tenant:     tenant,
+			Method:     method,
+			Target:     item.ForwardTo,
+			Header:     header,
+			Body:       item.Body,
+			ReceivedAt: receivedAt,
+			QueueWait:  float64(time.Since(receivedAt)) / float64(time.Millisecond),
+		})
+
+		result.Status = http.StatusGatewayTimeout
+		result.Error = "request expired before being forwarded"
+		return result
+	}
+
+	admissionDeadline := deadline
+	if !queueDeadline.IsZero() && (admissionDeadline.IsZero() || queueDeadline.Before(admissionDeadline)) {
+		admissionDeadline = queueDeadline
+	}
+
+	// Have we (or the tenant) fully maxed out even after queueing, or are we draining?
+	if atomic.LoadInt32(&state.Draining) != 0 || !admitRequest(parsePriority(priority), sender, tenant, admissionDeadline) {
+		if isExpired(deadline) {
+			return expired()
+		}
+
+		result.Status = http.StatusTooManyRequests
+		return result
+	}
+
+	// Was the request admitted too late?
+	if isExpired(deadline) {
+		releaseRequest(tenant)
+		return expired()
+	}
+
+	if atomic.LoadInt64(&state.ActiveRequests) > idleRequests() {
+		// No longer idle, restart the timer
+		resetIdleShutdown()
+	}
+
+	// Proxy-Timeout is the time in milliseconds to wait for the recipient before failing
+	recipientTimeout, err := requestTimeout(header)
+	if err != nil {
+		releaseRequest(tenant)
+		result.Status = http.StatusBadRequest
+		result.Error = err.Error()
+		return result
+	}
+
+	proxyRequest, err := http.NewRequest(method, item.ForwardTo, bytes.NewReader(item.Body))
+	if err != nil {
+		releaseRequest(tenant)
+		result.Status = http.StatusBadRequest
+		result.Error = err.Error()
+		return result
+	}
+
+	proxyRequest.Header = header
+	proxyRequest.Header.Del("Forward-To")
+	proxyRequest.Header.Del("Proxy-Timeout")
+	proxyRequest.Header.Del("Proxy-TTL")
+	proxyRequest.Header.Del("Proxy-Protocol-Version")
+
+	// Apply the policies of the platform, then adapt the request to the kind of recipient
+	recipient, ok := recipientAdapterOf(header.Get("Proxy-Recipient"))
+	proxyRequest.Header.Del("Proxy-Recipient")
+
+	// Load the config once, so the request sees one version of it throughout
+	current := currentConfig()
+
+	body := item.Body
+	if body, err = applyRequestTransforms(current, proxyRequest, body); err != nil || !ok || recipient.PrepareRequest(proxyRequest, body) != nil {
+		releaseRequest(tenant)
+		result.Status = http.StatusInternalServerError
+		return result
+	}
+
+	// Fast fail if the recipient is unhealthy
+	breaker := breakerFor(proxyRequest.URL.Host)
+	if !breaker.Allow() {
+		releaseRequest(tenant)
+		result.Status = http.StatusServiceUnavailable
+		result.Error = errBreakerOpen.Error()
+		return result
+	}
+
+	options := forwardOptions{
+		InsecureSkipVerify: strings.ToLower(strings.TrimSpace(header.Get("Insecure-Skip-Verify"))) == "true",
+		RecipientTimeout:   recipientTimeout,
+		Breaker:            breaker,
+		AccessLog: &AccessLogEntry{
+			Time:         receivedAt,
+			RequestID:    requestID,
+			Sender:       sender,
+			Method:       method,
+			Target:       item.ForwardTo,
+			QueueWait:    float64(time.Since(receivedAt)) / float64(time.Millisecond),
+			RequestBytes: int64(len(body)),
+			TraceID:      span.TraceID,
+		},
+		Span:      span,
+		Tenant:    tenant,
+		Recipient: recipient,
+		Config:    current,
+	}
+
+	// The request is answered right away, its outcome is kept for follow-ups
+	if job == nil {
+		job = newAffinityJob(context.Background())
+		result.Affinity = registerAffinityJob(job)
+	}
+
+	proxyRequest = proxyRequest.WithContext(job.Context)
+	result.Status = http.StatusAccepted
+
+	options.AccessLog.finishResponse(http.StatusAccepted)
+	span.end(map[string]string{"proxy.status": strconv.Itoa(http.StatusAccepted), "proxy.batch": "true"})
+
+	go forwardRequest(proxyRequest, options, job)
+
+	return result
+}
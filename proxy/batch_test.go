@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The requests of a batch wait for free slots for one queueTimeout in all, not one each
+func TestBatchQueueTimeout(t *testing.T) {
+	// The proxy is full, so the requests are queued until they time out
+	withConfig(t, func(next *proxyConfig) {
+		next.MaxRequests = 0
+		next.QueueTimeout = 100
+	})
+
+	const items = 10
+	batch := strings.Repeat(`{"forwardTo": "http://recipient.test/"}`+"\n", items)
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(batch))
+	r.Header.Set("Content-Type", BatchContentType)
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	handleBatchRequest(w, r)
+
+	if elapsed := time.Since(start); elapsed >= 3*time.Duration(currentConfig().QueueTimeout)*time.Millisecond {
+		t.Errorf("the batch took %v to be denied", elapsed)
+	}
+
+	var results int
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var result batchItemResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Status != http.StatusTooManyRequests {
+			t.Errorf("got status %v of a request of the batch, expected %v", result.Status, http.StatusTooManyRequests)
+		}
+
+		results++
+	}
+
+	if results != items {
+		t.Errorf("got %v results for %v requests", results, items)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// Error of requests fast failed by an open breaker
+var errBreakerOpen = errors.New("circuit breaker toward the recipient is open")
+
+// BreakerIdleTimeout is the time after which the closed breakers of hosts no request was forwarded to are forgotten
+const BreakerIdleTimeout = 5 * time.Minute
+
+// maxBreakers bounds the hosts with a breaker, so senders can not grow the map and metrics without limit
+const maxBreakers = 1000
+
+// Circuit breaker toward a single recipient host
+type circuitBreaker struct {
+	sync.Mutex
+
+	// Failures is the number of consecutive failed requests to the host
+	Failures int64
+
+	// OpenedAt is when the breaker last opened
+	OpenedAt time.Time
+
+	// Trial is set while a half-open breaker lets a single request through
+	Trial bool
+
+	// LastUsed is when a request to the host was last allowed
+	LastUsed time.Time
+}
+
+// Circuit breakers of every recipient host requests were forwarded to
+var breakers struct {
+	sync.Mutex
+	Hosts map[string]*circuitBreaker
+}
+
+func init() {
+	breakers.Hosts = map[string]*circuitBreaker{}
+
+	go expireBreakers()
+}
+
+// Forgets the closed breakers of the hosts not used within BreakerIdleTimeout every second, and every breaker while
+// they are disabled
+func expireBreakers() {
+	for {
+		time.Sleep(time.Second)
+
+		breakers.Lock()
+		for host, breaker := range breakers.Hosts {
+			breaker.Lock()
+			if currentConfig().BreakerFailures == 0 || (breaker.state() == BreakerClosed && time.Since(breaker.LastUsed) > BreakerIdleTimeout) {
+				delete(breakers.Hosts, host)
+			}
+			breaker.Unlock()
+		}
+		breakers.Unlock()
+	}
+}
+
+// Returns the circuit breaker of a recipient host, nil (always closed) if breakers are disabled or too many hosts
+// have one
+func breakerFor(host string) *circuitBreaker {
+	if currentConfig().BreakerFailures == 0 {
+		return nil
+	}
+
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	breaker, ok := breakers.Hosts[host]
+	if !ok {
+		if len(breakers.Hosts) >= maxBreakers {
+			return nil
+		}
+
+		breaker = &circuitBreaker{LastUsed: time.Now()}
+		breakers.Hosts[host] = breaker
+	}
+
+	return breaker
+}
+
+// Returns the breaker's state, must be called with the breaker locked
+func (b *circuitBreaker) state() string {
+	current := currentConfig()
+
+	if current.BreakerFailures == 0 || b.Failures < current.BreakerFailures {
+		return BreakerClosed
+	}
+
+	if time.Since(b.OpenedAt) < time.Duration(current.BreakerCooldown)*time.Second {
+		return BreakerOpen
+	}
+
+	return BreakerHalfOpen
+}
+
+// State returns the breaker's state
+func (b *circuitBreaker) State() string {
+	if b == nil {
+		return BreakerClosed
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return b.state()
+}
+
+// Allow returns whether a request may be forwarded to the host
+// A half-open breaker lets a single trial request through
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.LastUsed = time.Now()
+
+	switch b.state() {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.Trial {
+			return false
+		}
+
+		b.Trial = true
+	}
+
+	return true
+}
+
+// Record records the outcome of a request forwarded to the host
+func (b *circuitBreaker) Record(resp *http.Response, err error) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.Trial = false
+
+	if err == nil && resp.StatusCode < http.StatusInternalServerError {
+		b.Failures = 0
+		return
+	}
+
+	b.Failures++
+
+	current := currentConfig()
+	// Open the breaker, or reopen it if the trial request failed
+	if current.BreakerFailures > 0 && b.Failures >= current.BreakerFailures {
+		b.OpenedAt = time.Now()
+	}
+}
+
+// Writes the breaker states in the Prometheus text exposition format
+func writeBreakerMetrics(w *strings.Builder) {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	var hosts []string
+	for host := range breakers.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	fmt.Fprintf(w, "# HELP proxy_breaker_open Whether the circuit breaker toward a recipient host is open (1), half-open (0.5) or closed (0).\n")
+	fmt.Fprintf(w, "# TYPE proxy_breaker_open gauge\n")
+	for _, host := range hosts {
+		value := 0.0
+		switch breakers.Hosts[host].State() {
+		case BreakerOpen:
+			value = 1
+		case BreakerHalfOpen:
+			value = 0.5
+		}
+
+		fmt.Fprintf(w, "proxy_breaker_open{host=%v} %v\n", labelValue(host), value)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Runs the test with no breakers and the breaker failures
+func withBreakers(t *testing.T, failures int64) {
+	breakers.Lock()
+	hosts := breakers.Hosts
+	breakers.Hosts = map[string]*circuitBreaker{}
+	breakers.Unlock()
+
+	withConfig(t, func(next *proxyConfig) { next.BreakerFailures = failures })
+
+	t.Cleanup(func() {
+		breakers.Lock()
+		breakers.Hosts = hosts
+		breakers.Unlock()
+	})
+}
+
+// Disabled breakers are not created, and allow every request
+func TestBreakersDisabled(t *testing.T) {
+	withBreakers(t, 0)
+
+	breaker := breakerFor("recipient")
+	if !breaker.Allow() || breaker.State() != BreakerClosed {
+		t.Errorf("a disabled breaker denied a request")
+	}
+
+	breaker.Record(nil, errBreakerOpen)
+
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	if len(breakers.Hosts) != 0 {
+		t.Errorf("created %v breakers while disabled", len(breakers.Hosts))
+	}
+}
+
+// Closed breakers of idle hosts are forgotten, open ones are kept, and the breakers are bounded
+func TestBreakersExpire(t *testing.T) {
+	withBreakers(t, 1)
+
+	for i := 0; i < maxBreakers+10; i++ {
+		breakerFor(fmt.Sprintf("recipient-%v", i))
+	}
+
+	breakers.Lock()
+	tracked := len(breakers.Hosts)
+	breakers.Unlock()
+
+	if tracked != maxBreakers {
+		t.Errorf("tracked %v breakers, expected %v", tracked, maxBreakers)
+	}
+
+	idle := breakerFor("recipient-0")
+	open := breakerFor("recipient-1")
+	open.Record(&http.Response{StatusCode: http.StatusInternalServerError}, nil)
+
+	idle.Lock()
+	idle.LastUsed = time.Now().Add(-2 * BreakerIdleTimeout)
+	idle.Unlock()
+
+	open.Lock()
+	open.LastUsed = time.Now().Add(-2 * BreakerIdleTimeout)
+	open.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		breakers.Lock()
+		_, idleKept := breakers.Hosts["recipient-0"]
+		_, openKept := breakers.Hosts["recipient-1"]
+		breakers.Unlock()
+
+		if !idleKept {
+			if !openKept {
+				t.Errorf("forgot the open breaker")
+			}
+
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("the idle breaker was not forgotten")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recipient response cached for identical GET requests
+type cachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Expires    time.Time
+
+	// Public is whether the response may be served to requests with credentials
+	Public bool
+}
+
+// Cached recipient responses keyed by method, URL and the values of the request headers they vary by
+var cache struct {
+	sync.Mutex
+	Responses map[string]*cachedResponse
+
+	// Vary maps the method and URL to the request headers the latest response listed in its Vary header
+	Vary map[string][]string
+}
+
+func init() {
+	cache.Responses = map[string]*cachedResponse{}
+	cache.Vary = map[string][]string{}
+}
+
+// Returns the cache key of a request, with the values of the request headers the response varies by
+func cacheKey(urlKey string, vary []string, header http.Header) string {
+	if len(vary) == 0 {
+		return urlKey
+	}
+
+	var key strings.Builder
+	key.WriteString(urlKey)
+	for _, name := range vary {
+		key.WriteString("\n")
+		key.WriteString(name)
+		key.WriteString(": ")
+		key.WriteString(strings.Join(header.Values(name), ", "))
+	}
+
+	return key.String()
+}
+
+// Returns whether the request carries credentials, whose responses are only cached if public
+func hasCredentials(header http.Header) bool {
+	return header.Get("Authorization") != "" || header.Get("Cookie") != ""
+}
+
+// Parses a Cache-Control header into its directives
+func parseCacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "" {
+				continue
+			}
+
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				directives[directive[:i]] = strings.Trim(directive[i+1:], `"`)
+			} else {
+				directives[directive] = ""
+			}
+		}
+	}
+
+	return directives
+}
+
+// Returns the cached response of a request to the URL, if any
+func lookupCachedResponse(method string, rawURL string, header http.Header) *cachedResponse {
+	if currentConfig().CacheTTL == 0 || method != http.MethodGet {
+		return nil
+	}
+
+	// Normalize the URL the same way as the forwarded request's
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+
+	urlKey := method + " " + u.String()
+
+	// The sender asked for a fresh response
+	directives := parseCacheControl(header)
+	if _, ok := directives["no-cache"]; ok {
+		return nil
+	}
+
+	if _, ok := directives["no-store"]; ok {
+		return nil
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	key := cacheKey(urlKey, cache.Vary[urlKey], header)
+	cached, ok := cache.Responses[key]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(cached.Expires) {
+		delete(cache.Responses, key)
+		return nil
+	}
+
+	// Responses for one sender's credentials are not served to others
+	if !cached.Public && hasCredentials(header) {
+		return nil
+	}
+
+	return cached
+}
+
+// Returns how long a recipient response may be cached, 0 if it may not be
+func cacheDuration(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" {
+		return 0
+	}
+
+	directives := parseCacheControl(resp.Header)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return 0
+		}
+	}
+
+	// Prefer the recipient's own lifetime over the configured one
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return 0
+			}
+
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	return time.Duration(currentConfig().CacheTTL) * time.Second
+}
+
+// Caches a recipient response to a request to the URL (before any rewriting), if allowed
+func storeCachedResponse(req *http.Request, rawURL string, resp *http.Response, body []byte) {
+	if currentConfig().CacheTTL == 0 || req.Method != http.MethodGet {
+		return
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+
+	duration := cacheDuration(resp)
+	if duration <= 0 {
+		return
+	}
+
+	// Responses to requests with credentials are only shared if public
+	_, public := parseCacheControl(resp.Header)["public"]
+	if !public && hasCredentials(req.Header) {
+		return
+	}
+
+	cached := &cachedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		Expires:    time.Now().Add(duration),
+		Public:     public,
+	}
+
+	var vary []string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	sort.Strings(vary)
+	urlKey := req.Method + " " + u.String()
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	// Make room by evicting expired responses first, then any response
+	if int64(len(cache.Responses)) >= currentConfig().CacheMaxEntries {
+		for key, response := range cache.Responses {
+			if time.Now().After(response.Expires) {
+				delete(cache.Responses, key)
+			}
+		}
+
+		for key := range cache.Responses {
+			if int64(len(cache.Responses)) < currentConfig().CacheMaxEntries {
+				break
+			}
+
+			delete(cache.Responses, key)
+		}
+	}
+
+	// Forgetting the headers a URL varies by only makes its responses miss
+	if int64(len(cache.Vary)) >= currentConfig().CacheMaxEntries {
+		for urlKey := range cache.Vary {
+			delete(cache.Vary, urlKey)
+			if int64(len(cache.Vary)) < currentConfig().CacheMaxEntries {
+				break
+			}
+		}
+	}
+
+	if len(vary) != 0 {
+		cache.Vary[urlKey] = vary
+	} else {
+		delete(cache.Vary, urlKey)
+	}
+
+	cache.Responses[cacheKey(urlKey, vary, req.Header)] = cached
+}
+
+// Writes a cached response back to the sender
+func writeCachedResponse(w http.ResponseWriter, cached *cachedResponse) {
+	for k, values := range cached.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+
+	w.Header().Set("Proxy-Cache", "hit")
+	writeProxyMetrics(w, http.StatusOK)
+	w.WriteHeader(cached.StatusCode)
+
+	w.Write(cached.Body)
+}
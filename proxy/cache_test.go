@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Stores the recipient's response to the request, with the response's headers
+func cacheResponse(req *http.Request, header http.Header, body string) {
+	resp := &http.Response{StatusCode: http.StatusOK, Header: header}
+	storeCachedResponse(req, req.URL.String(), resp, []byte(body))
+}
+
+// Returns the body of the cached response to the request, "" if there is none
+func cachedBody(req *http.Request) string {
+	if cached := lookupCachedResponse(req.Method, req.URL.String(), req.Header); cached != nil {
+		return string(cached.Body)
+	}
+
+	return ""
+}
+
+func withCache(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) { next.CacheTTL = 60 })
+
+	t.Cleanup(func() {
+		cache.Lock()
+		cache.Responses = map[string]*cachedResponse{}
+		cache.Vary = map[string][]string{}
+		cache.Unlock()
+	})
+}
+
+func TestCacheVary(t *testing.T) {
+	withCache(t)
+
+	english := httptest.NewRequest(http.MethodGet, "http://recipient/greeting", nil)
+	english.Header.Set("Accept-Language", "en")
+	french := httptest.NewRequest(http.MethodGet, "http://recipient/greeting", nil)
+	french.Header.Set("Accept-Language", "fr")
+
+	cacheResponse(english, http.Header{"Vary": {"accept-language"}}, "hello")
+	cacheResponse(french, http.Header{"Vary": {"Accept-Language"}}, "bonjour")
+
+	if body := cachedBody(english); body != "hello" {
+		t.Errorf("got %q for English, expected hello", body)
+	}
+
+	if body := cachedBody(french); body != "bonjour" {
+		t.Errorf("got %q for French, expected bonjour", body)
+	}
+
+	german := httptest.NewRequest(http.MethodGet, "http://recipient/greeting", nil)
+	german.Header.Set("Accept-Language", "de")
+	if body := cachedBody(german); body != "" {
+		t.Errorf("got %q for German, expected a miss", body)
+	}
+}
+
+func TestCacheCredentials(t *testing.T) {
+	withCache(t)
+
+	alice := httptest.NewRequest(http.MethodGet, "http://recipient/account", nil)
+	alice.Header.Set("Authorization", "Bearer alice")
+	bob := httptest.NewRequest(http.MethodGet, "http://recipient/account", nil)
+	bob.Header.Set("Cookie", "session=bob")
+	anonymous := httptest.NewRequest(http.MethodGet, "http://recipient/account", nil)
+
+	// Responses to requests with credentials are not stored unless public
+	cacheResponse(alice, http.Header{}, "alice's account")
+	if body := cachedBody(alice); body != "" {
+		t.Errorf("stored the response to a request with credentials: %q", body)
+	}
+
+	// Nor are responses to others served to requests with credentials
+	cacheResponse(anonymous, http.Header{}, "account")
+	if body := cachedBody(bob); body != "" {
+		t.Errorf("served a private response to a request with credentials: %q", body)
+	}
+
+	if body := cachedBody(anonymous); body != "account" {
+		t.Errorf("got %q without credentials, expected account", body)
+	}
+
+	cacheResponse(alice, http.Header{"Cache-Control": {"public, max-age=60"}}, "public account")
+	if body := cachedBody(bob); body != "public account" {
+		t.Errorf("got %q for a public response, expected public account", body)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CapacityStrategy determines how many more requests a proxy should accept (Proxy-Free)
+// A result <= 0 means the proxy is at its target load and will try to scale up
+type CapacityStrategy interface {
+	Free() int
+}
+
+// CapacityStrategies are the capacity strategies selectable through the capacityStrategy annotation
+var CapacityStrategies = map[string]CapacityStrategy{
+	"fixed":   fixedCapacity{},
+	"memory":  &memoryCapacity{},
+	"latency": &latencyCapacity{},
+}
+
+// Returns the target number of active requests based on maxRequests and maxLoadFactor
+func targetRequests() int {
+	current := currentConfig()
+	return int(float64(current.MaxRequests) * current.MaxLoadFactor)
+}
+
+// Fixed concurrency, the target number of active requests is maxRequests * maxLoadFactor
+type fixedCapacity struct{}
+
+func (fixedCapacity) Free() int {
+	return targetRequests() - int(atomic.LoadInt64(&state.ActiveRequests))
+}
+
+// Memory based, additionally limits the active requests so the heap stays below maxMemory
+type memoryCapacity struct {
+	sampler  sync.Once
+	heapSize uint64
+}
+
+// Samples the heap size every second, as reading the memory stats stops the world
+func (m *memoryCapacity) sampleHeapSize() {
+	for {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		atomic.StoreUint64(&m.heapSize, stats.HeapInuse)
+
+		time.Sleep(time.Second)
+	}
+}
+
+func (m *memoryCapacity) Free() int {
+	free := fixedCapacity{}.Free()
+	current := currentConfig()
+	if current.MaxMemory <= 0 {
+		return free
+	}
+
+	m.sampler.Do(func() {
+		go m.sampleHeapSize()
+	})
+
+	heapSize := int64(atomic.LoadUint64(&m.heapSize))
+	active := atomic.LoadInt64(&state.ActiveRequests)
+	if heapSize == 0 || active == 0 {
+		return free
+	}
+
+	// Estimate how many more requests fit based on the average memory per active request, at least a byte
+	perRequest := heapSize / active
+	if perRequest == 0 {
+		perRequest = 1
+	}
+
+	memoryFree := int((current.MaxMemory*1024*1024 - heapSize) / perRequest)
+	if memoryFree < free {
+		return memoryFree
+	}
+
+	return free
+}
+
+// Recipient latency adaptive, shrinks the target number of active requests as recipients slow down past targetLatency
+type latencyCapacity struct{}
+
+func (latencyCapacity) Free() int {
+	free := fixedCapacity{}.Free()
+	current := currentConfig()
+	if current.TargetLatency <= 0 {
+		return free
+	}
+
+	latency := recentRecipientLatency()
+	target := float64(current.TargetLatency) * float64(time.Millisecond)
+	if latency <= target {
+		return free
+	}
+
+	// Scale the target down proportionally to how slow the recipients are
+	return int(math.Floor(float64(targetRequests())*target/latency)) - int(atomic.LoadInt64(&state.ActiveRequests))
+}
+
+// Exponentially weighted moving average of the recipient latency in nanoseconds
+var recipientLatencyAverage uint64
+
+// Updates the recipient latency moving average
+func updateRecipientLatencyAverage(latency time.Duration) {
+	for {
+		old := atomic.LoadUint64(&recipientLatencyAverage)
+
+		updated := uint64(latency)
+		if old != 0 {
+			updated = uint64(0.9*float64(old) + 0.1*float64(latency))
+		}
+
+		if atomic.CompareAndSwapUint64(&recipientLatencyAverage, old, updated) {
+			return
+		}
+	}
+}
+
+// Returns the recent recipient latency in nanoseconds
+func recentRecipientLatency() float64 {
+	return float64(atomic.LoadUint64(&recipientLatencyAverage))
+}
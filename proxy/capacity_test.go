@@ -0,0 +1,22 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// More active requests than bytes of heap do not divide by a zero memory per request
+func TestMemoryCapacitySmallHeap(t *testing.T) {
+	defer atomic.StoreInt64(&state.ActiveRequests, 0)
+
+	withConfig(t, func(next *proxyConfig) { next.MaxMemory = 1 })
+
+	m := &memoryCapacity{}
+	m.sampler.Do(func() {})
+	atomic.StoreUint64(&m.heapSize, 10)
+	atomic.StoreInt64(&state.ActiveRequests, 100)
+
+	if free, expected := m.Free(), (fixedCapacity{}).Free(); free != expected {
+		t.Errorf("got %v free requests, expected %v", free, expected)
+	}
+}
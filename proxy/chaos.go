@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults injected by the chaos mode
+const (
+	ChaosDelay   = "delay"
+	ChaosDrop    = "drop"
+	ChaosDeny    = "deny"
+	ChaosCorrupt = "corrupt"
+)
+
+// ChaosConfig injects faults into a percentage of forwarded requests, to validate senders' retries and alerting
+type ChaosConfig struct {
+	// DelayPercent of the requests are held for Delay milliseconds before being handled
+	DelayPercent float64 `json:"delayPercent"`
+	Delay        int64   `json:"delay"`
+
+	// DropPercent of the requests have their connection closed without a response
+	DropPercent float64 `json:"dropPercent"`
+
+	// DenyPercent of the requests are denied with a 429 as if the proxy was full
+	DenyPercent float64 `json:"denyPercent"`
+
+	// CorruptPercent of the requests are answered with invalid Proxy-* headers
+	CorruptPercent float64 `json:"corruptPercent"`
+}
+
+// Number of injected faults by kind
+var chaosFaults = struct {
+	sync.Mutex
+	Counts map[string]uint64
+}{Counts: map[string]uint64{}}
+
+// Parses the chaos annotation, a JSON object of the faults to inject, nil if disabled
+func parseChaosConfig(value string) (*ChaosConfig, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	chaos := &ChaosConfig{}
+	if err := json.Unmarshal([]byte(value), chaos); err != nil {
+		return nil, fmt.Errorf("chaos is not a valid JSON object: %v", err)
+	}
+
+	for name, percent := range map[string]float64{"delayPercent": chaos.DelayPercent, "dropPercent": chaos.DropPercent, "denyPercent": chaos.DenyPercent, "corruptPercent": chaos.CorruptPercent} {
+		if percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("chaos %v must be between 0 and 100: %v", name, percent)
+		}
+	}
+
+	// A request gets at most one of the faults besides the delay
+	if chaos.DropPercent+chaos.DenyPercent+chaos.CorruptPercent > 100 {
+		return nil, fmt.Errorf("chaos dropPercent + denyPercent + corruptPercent must be <= 100")
+	}
+
+	if chaos.Delay < 0 {
+		return nil, fmt.Errorf("chaos delay must be >= 0: %v", chaos.Delay)
+	}
+
+	return chaos, nil
+}
+
+// Records an injected fault
+func recordChaosFault(fault string) {
+	debugPrint(3, "[!] Injecting chaos fault: %v", fault)
+
+	chaosFaults.Lock()
+	chaosFaults.Counts[fault]++
+	chaosFaults.Unlock()
+}
+
+// Injects the faults of the chaos mode into a forwarded request, returns false if the request must not be handled
+// The returned writer must be used for the rest of the request
+func injectChaos(w http.ResponseWriter, chaos *ChaosConfig) (http.ResponseWriter, bool) {
+	if chaos == nil {
+		return w, true
+	}
+
+	if rand.Float64()*100 < chaos.DelayPercent {
+		recordChaosFault(ChaosDelay)
+		time.Sleep(time.Duration(chaos.Delay) * time.Millisecond)
+	}
+
+	roll := rand.Float64() * 100
+	switch {
+	case roll < chaos.DropPercent:
+		recordChaosFault(ChaosDrop)
+
+		// Abort the connection (or the stream on HTTP/2) without responding
+		panic(http.ErrAbortHandler)
+	case roll < chaos.DropPercent+chaos.DenyPercent:
+		recordChaosFault(ChaosDeny)
+		writeProxyMetrics(w, http.StatusTooManyRequests)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return w, false
+	case roll < chaos.DropPercent+chaos.DenyPercent+chaos.CorruptPercent:
+		recordChaosFault(ChaosCorrupt)
+		return &corruptResponseWriter{ResponseWriter: w}, true
+	}
+
+	return w, true
+}
+
+// Replaces the Proxy-* headers with invalid values before they are written
+type corruptResponseWriter struct {
+	http.ResponseWriter
+
+	wroteHeader bool
+}
+
+func (w *corruptResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+
+		header := w.Header()
+		for _, name := range []string{"Proxy-Counter", "Proxy-Free", "Proxy-Ordinal", "Proxy-Status", "Proxy-Version", "Proxy-List", "Proxy-Leader", "Proxy-Protocol-Version", "Proxy-Epoch", "Proxy-List-Encoding", "Proxy-Senders", "Proxy-Max-Proxies", "Proxy-Headroom"} {
+			if header.Get(name) != "" {
+				header.Set(name, corruptValue())
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *corruptResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *corruptResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Returns a value no Proxy-* header accepts
+func corruptValue() string {
+	values := []string{"", "-1", "NaN", "{", "[1,", "99999999999999999999"}
+	return values[rand.Intn(len(values))]
+}
+
+// Writes the injected faults in the Prometheus text exposition format
+func writeChaosMetrics(w *strings.Builder) {
+	chaosFaults.Lock()
+	defer chaosFaults.Unlock()
+
+	fmt.Fprintf(w, "# HELP proxy_chaos_faults_total Number of faults injected by the chaos mode by kind.\n")
+	fmt.Fprintf(w, "# TYPE proxy_chaos_faults_total counter\n")
+	for _, fault := range []string{ChaosDelay, ChaosDrop, ChaosDeny, ChaosCorrupt} {
+		fmt.Fprintf(w, "proxy_chaos_faults_total{fault=%v} %v\n", labelValue(fault), chaosFaults.Counts[fault])
+	}
+}
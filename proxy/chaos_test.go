@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Returns the number of faults of the kind injected so far
+func chaosFaultCount(fault string) uint64 {
+	chaosFaults.Lock()
+	defer chaosFaults.Unlock()
+
+	return chaosFaults.Counts[fault]
+}
+
+// Requests given a fault are delayed, dropped, denied or answered with corrupt Proxy-* headers
+func TestChaosFaults(t *testing.T) {
+	var received int64
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&received, 1)
+	}))
+
+	defer recipient.Close()
+
+	withChaos := func(chaos string) {
+		parsed, err := parseChaosConfig(chaos)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		withConfig(t, func(next *proxyConfig) { next.Chaos, next.ProxyTimeout = parsed, 5000 })
+	}
+
+	withChaos(`{"denyPercent": 100}`)
+	denied := chaosFaultCount(ChaosDeny)
+
+	if w := serveProxy(newForwardRequest(http.MethodGet, recipient.URL, "")); w.Code != http.StatusTooManyRequests || w.Header().Get("Proxy-Status") != "429" {
+		t.Errorf("got status %v, expected a 429", w.Code)
+	}
+
+	if atomic.LoadInt64(&received) != 0 || chaosFaultCount(ChaosDeny) != denied+1 {
+		t.Errorf("the denied request reached the recipient, or was not counted")
+	}
+
+	withChaos(`{"corruptPercent": 100}`)
+
+	w := serveProxy(newForwardRequest(http.MethodGet, recipient.URL, ""))
+	if w.Code != http.StatusOK || atomic.LoadInt64(&received) != 1 {
+		t.Errorf("got status %v, expected the recipient's response", w.Code)
+	}
+
+	if status := w.Header().Get("Proxy-Status"); status == "200" {
+		t.Errorf("got Proxy-Status %q, expected it corrupted", status)
+	}
+
+	withChaos(`{"delayPercent": 100, "delay": 50}`)
+	start := time.Now()
+
+	if w := serveProxy(newForwardRequest(http.MethodGet, recipient.URL, "")); w.Code != http.StatusOK || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("got status %v after %v, expected the response delayed by 50ms", w.Code, time.Since(start))
+	}
+
+	// Dropped requests have their connection closed
+	withChaos(`{"dropPercent": 100}`)
+
+	proxy := httptest.NewServer(http.HandlerFunc(httpHandler))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	req.Header.Set("Forward-To", recipient.URL)
+
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Errorf("got status %v, expected the connection closed", resp.StatusCode)
+	}
+
+	if n := atomic.LoadInt64(&received); n != 2 {
+		t.Errorf("the recipient received %v requests, expected 2", n)
+	}
+}
+
+func TestChaosConfigInvalid(t *testing.T) {
+	for _, chaos := range []string{
+		`{"dropPercent": 101}`,
+		`{"denyPercent": -1}`,
+		`{"dropPercent": 50, "denyPercent": 30, "corruptPercent": 30}`,
+		`{"delayPercent": 10, "delay": -1}`,
+		`[]`,
+	} {
+		if _, err := parseChaosConfig(chaos); err == nil {
+			t.Errorf("chaos %v was accepted", chaos)
+		}
+	}
+}
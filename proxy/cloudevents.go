@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// CloudEvents types of the dead letters and delivery receipts
+const (
+	deadLetterEventType = "com.github.btbd.proxy.deadletter"
+	receiptEventType    = "com.github.btbd.proxy.receipt"
+)
+
+// MessageFormat is how the dead letters and delivery receipts are encoded
+type MessageFormat struct {
+	// CloudEvents wraps them in CloudEvents 1.0 events
+	CloudEvents bool
+
+	// Binary puts the events' attributes in ce-* headers and the message alone in the body, rather than the whole
+	// event in the body, for sinks with headers
+	Binary bool
+}
+
+// MessageFormats are the formats selectable through the deadLetterFormat annotation
+var MessageFormats = map[string]MessageFormat{
+	"json":               {},
+	"cloudevents":        {CloudEvents: true},
+	"cloudevents-binary": {CloudEvents: true, Binary: true},
+}
+
+// Event in the CloudEvents 1.0 structured mode
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            time.Time       `json:"time"`
+	Subject         string          `json:"subject,omitempty"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// Returns the source of the proxy's events, its pod
+func eventSource() string {
+	return fmt.Sprintf("/namespaces/%v/pods/%v", ProxyNamespace, ProxyName)
+}
+
+// Encodes the dead letter or receipt in the format, returning the body and the headers to send it with
+// Sinks without headers encode the events of the binary format in the structured one
+func encodeMessage(format MessageFormat, eventType string, subject string, eventTime time.Time, value interface{}) ([]byte, http.Header, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := http.Header{}
+	if !format.CloudEvents {
+		header.Set("Content-Type", "application/json")
+		return data, header, nil
+	}
+
+	event := cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              newRequestID(),
+		Source:          eventSource(),
+		Type:            eventType,
+		Time:            eventTime.UTC(),
+		Subject:         subject,
+		DataContentType: "application/json",
+		Data:            data,
+	}
+
+	if format.Binary {
+		header.Set("Content-Type", event.DataContentType)
+		header.Set("Ce-Specversion", event.SpecVersion)
+		header.Set("Ce-Id", event.ID)
+		header.Set("Ce-Source", event.Source)
+		header.Set("Ce-Type", event.Type)
+		header.Set("Ce-Time", event.Time.Format(time.RFC3339Nano))
+		if subject != "" {
+			header.Set("Ce-Subject", subject)
+		}
+
+		return data, header, nil
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header.Set("Content-Type", "application/cloudevents+json")
+	return body, header, nil
+}
+
+// Encodes the dead letter in the configured format
+func encodeDeadLetter(letter *DeadLetter, headers bool) ([]byte, http.Header, error) {
+	format := currentConfig().DeadLetterFormat
+	format.Binary = format.Binary && headers
+
+	return encodeMessage(format, deadLetterEventType, letter.RequestID, letter.Time, letter)
+}
+
+// Encodes the delivery receipt in the configured format
+func encodeReceipt(receipt *DeliveryReceipt, headers bool) ([]byte, http.Header, error) {
+	format := currentConfig().DeadLetterFormat
+	format.Binary = format.Binary && headers
+
+	return encodeMessage(format, receiptEventType, receipt.RequestID, receipt.Time, receipt)
+}
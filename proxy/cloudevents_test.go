@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Request received by a webhook
+type webhookRequest struct {
+	Header http.Header
+	Body   []byte
+}
+
+// Dead letters reach webhooks as plain JSON, or CloudEvents in the structured or binary mode
+func TestWebhookCloudEvents(t *testing.T) {
+	requests := make(chan webhookRequest, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- webhookRequest{r.Header, body}
+	}))
+
+	defer webhook.Close()
+
+	letter := &DeadLetter{Time: time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC), Reason: "expired", RequestID: "request", Method: http.MethodPost, Target: "http://recipient/"}
+
+	for name, check := range map[string]func(t *testing.T, request webhookRequest){
+		"json": func(t *testing.T, request webhookRequest) {
+			var received DeadLetter
+			if request.Header.Get("Content-Type") != "application/json" || json.Unmarshal(request.Body, &received) != nil || received.RequestID != "request" {
+				t.Errorf("got %v %s, expected the dead letter", request.Header, request.Body)
+			}
+		},
+		"cloudevents": func(t *testing.T, request webhookRequest) {
+			var event struct {
+				cloudEvent
+				Data DeadLetter `json:"data"`
+			}
+
+			if request.Header.Get("Content-Type") != "application/cloudevents+json" || json.Unmarshal(request.Body, &event) != nil {
+				t.Fatalf("got %v %s, expected a structured event", request.Header, request.Body)
+			}
+
+			if event.SpecVersion != "1.0" || event.Type != deadLetterEventType || event.Subject != "request" || event.ID == "" || event.Source != eventSource() || !event.Time.Equal(letter.Time) {
+				t.Errorf("got event %+v", event.cloudEvent)
+			}
+
+			if event.Data.RequestID != "request" || event.Data.Reason != "expired" {
+				t.Errorf("got data %+v, expected the dead letter", event.Data)
+			}
+		},
+		"cloudevents-binary": func(t *testing.T, request webhookRequest) {
+			var received DeadLetter
+			if request.Header.Get("Content-Type") != "application/json" || json.Unmarshal(request.Body, &received) != nil || received.RequestID != "request" {
+				t.Errorf("got %v %s, expected the dead letter alone", request.Header, request.Body)
+			}
+
+			if request.Header.Get("Ce-Specversion") != "1.0" || request.Header.Get("Ce-Type") != deadLetterEventType || request.Header.Get("Ce-Subject") != "request" || request.Header.Get("Ce-Id") == "" || request.Header.Get("Ce-Time") != "2026-10-15T09:00:00Z" {
+				t.Errorf("got header %v, expected the event's attributes", request.Header)
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			withConfig(t, func(next *proxyConfig) {
+				next.DeadLetterFormat = MessageFormats[name]
+			})
+
+			sink := &webhookDeadLetterSink{URL: webhook.URL}
+			sink.Write(letter)
+
+			select {
+			case request := <-requests:
+				check(t, request)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("the webhook received no dead letter")
+			}
+		})
+	}
+}
+
+// Sinks without headers write the events of the binary mode in the structured one
+func TestCloudEventsBinaryWithoutHeaders(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) {
+		next.DeadLetterFormat = MessageFormats["cloudevents-binary"]
+	})
+
+	var buffer bytes.Buffer
+	sink := &jsonDeadLetterSink{Writer: &buffer}
+	sink.WriteReceipt(&DeliveryReceipt{Time: time.Now(), RequestID: "request", Status: http.StatusOK})
+
+	var event cloudEvent
+	if err := json.Unmarshal(buffer.Bytes(), &event); err != nil || event.Type != receiptEventType || event.Subject != "request" || len(event.Data) == 0 {
+		t.Errorf("got line %s, expected a structured receipt event", buffer.Bytes())
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DeadLetterVersion is the version of the dead letters' schema, raised on incompatible changes
+// Its fields are described by client/deadletter.schema.json, and decoded by client.DecodeDeadLetter
+const DeadLetterVersion = 1
+
+// DeadLetter is a request dropped by the proxy without being forwarded, e.g. for expiring before its Proxy-TTL
+type DeadLetter struct {
+	Version int `json:"version"`
+
+	Time      time.Time `json:"time"`
+	Reason    string    `json:"reason"`
+	RequestID string    `json:"requestId"`
+	Sender    string    `json:"sender,omitempty"`
+	Tenant    string    `json:"tenant"`
+
+	// The request as it would have been forwarded, to redeliver it
+	Method string      `json:"method"`
+	Target string      `json:"target"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+
+	// ReceivedAt is when the proxy received the request, and QueueWait the time in milliseconds between receiving
+	// and dropping it
+	ReceivedAt time.Time `json:"receivedAt"`
+	QueueWait  float64   `json:"queueWaitMs"`
+
+	// Attempts is the number of times the request was forwarded to the recipient
+	Attempts int `json:"attempts"`
+
+	// Response is the recipient's last response, nil if it did not respond
+	Response *DeadLetterResponse `json:"response,omitempty"`
+}
+
+// DeadLetterResponse is a snapshot of a recipient's response to a dead letter's request
+type DeadLetterResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// DeadLetterSink receives the dropped requests
+type DeadLetterSink interface {
+	Write(letter *DeadLetter)
+}
+
+// DeliveryReceipt is the outcome of a request forwarded to the recipient, sent to the dead letter sink when
+// deliveryReceipts is set
+type DeliveryReceipt struct {
+	Version int `json:"version"`
+
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Sender    string    `json:"sender,omitempty"`
+	Tenant    string    `json:"tenant"`
+	Method    string    `json:"method"`
+	Target    string    `json:"target"`
+
+	// Status is the recipient's status code, 0 if the request failed with Error
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	Attempts int     `json:"attempts"`
+	Latency  float64 `json:"latencyMs"`
+
+	// Accepted is true if the sender was answered with a 202, so only learns of the outcome from the proxy
+	Accepted bool `json:"accepted"`
+
+	// TraceParent is the W3C traceparent of the request's forward span, propagated to webhooks
+	TraceParent string `json:"-"`
+}
+
+// ReceiptSink is a dead letter sink also receiving delivery receipts, all but the custom ones
+type ReceiptSink interface {
+	WriteReceipt(receipt *DeliveryReceipt)
+}
+
+// DeadLetterSinks are the dead letter sinks selectable through the deadLetter annotation, besides webhook URLs
+var DeadLetterSinks = map[string]DeadLetterSink{
+	"none":   nil,
+	"stdout": &jsonDeadLetterSink{Writer: os.Stdout},
+	"stderr": &jsonDeadLetterSink{Writer: os.Stderr},
+}
+
+// Parses the deadLetter annotation, the name of a sink, the URL of a message queue or the http(s) URL of a webhook
+func parseDeadLetterSink(value string) (DeadLetterSink, error) {
+	if sink, ok := DeadLetterSinks[value]; ok {
+		return sink, nil
+	}
+
+	// Message queues, e.g. kafka+http://rest-proxy:8082/topics/failed or sqs+https://sqs.us-east-1.amazonaws.com/1/failed
+	if strings.HasPrefix(value, "kafka+") {
+		return queueSinkFor(value, func() (QueuePublisher, error) {
+			return &kafkaRESTPublisher{URL: strings.TrimPrefix(value, "kafka+"), Client: &http.Client{Timeout: 10 * time.Second}}, nil
+		})
+	}
+
+	if strings.HasPrefix(value, "sqs+") {
+		return queueSinkFor(value, func() (QueuePublisher, error) {
+			return newSQSPublisher(strings.TrimPrefix(value, "sqs+"))
+		})
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("deadLetter %v is neither a sink nor an http(s) URL", value)
+	}
+
+	return &webhookDeadLetterSink{URL: u.String()}, nil
+}
+
+// Writes every dead letter as a line of JSON
+type jsonDeadLetterSink struct {
+	sync.Mutex
+	Writer io.Writer
+}
+
+func (s *jsonDeadLetterSink) Write(letter *DeadLetter) {
+	line, _, err := encodeDeadLetter(letter, false)
+	s.writeLine(line, err)
+}
+
+func (s *jsonDeadLetterSink) WriteReceipt(receipt *DeliveryReceipt) {
+	line, _, err := encodeReceipt(receipt, false)
+	s.writeLine(line, err)
+}
+
+// Writes the encoded message as a line
+func (s *jsonDeadLetterSink) writeLine(line []byte, err error) {
+	if err != nil {
+		log.Printf("[!] Failed to encode dead letter: %v", err)
+		return
+	}
+
+	s.Lock()
+	s.Writer.Write(append(line, '\n'))
+	s.Unlock()
+}
+
+// POSTs every dead letter, and delivery receipt, to a webhook
+type webhookDeadLetterSink struct {
+	URL string
+}
+
+func (s *webhookDeadLetterSink) Write(letter *DeadLetter) {
+	body, header, err := encodeDeadLetter(letter, true)
+	s.post(letter.RequestID, body, header, letter.Header.Get("Traceparent"), err)
+}
+
+func (s *webhookDeadLetterSink) WriteReceipt(receipt *DeliveryReceipt) {
+	body, header, err := encodeReceipt(receipt, true)
+	s.post(receipt.RequestID, body, header, receipt.TraceParent, err)
+}
+
+// POSTs the encoded message in the background, in the request's trace if any
+func (s *webhookDeadLetterSink) post(requestID string, body []byte, header http.Header, traceParent string, err error) {
+	if err != nil {
+		log.Printf("[!] Failed to encode dead letter: %v", err)
+		return
+	}
+
+	go func() {
+		req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+		if err != nil {
+			recordWebhookDelivery("failed")
+			debugPrint(1, "[!] Failed to send dead letter %v to %v: %v", requestID, s.URL, err)
+			return
+		}
+
+		req.Header = header
+		if traceParent != "" {
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+
+			req.Header.Set("Traceparent", traceParent)
+		}
+
+		client := http.Client{Timeout: 10 * time.Second}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			recordWebhookDelivery("failed")
+			debugPrint(1, "[!] Failed to send dead letter %v to %v: %v", requestID, s.URL, err)
+			return
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			recordWebhookDelivery("rejected")
+			debugPrint(1, "[!] Webhook %v rejected dead letter %v: %v", s.URL, requestID, resp.StatusCode)
+			return
+		}
+
+		recordWebhookDelivery("delivered")
+	}()
+}
+
+// Returns the time the request expires at from its Proxy-TTL header (in milliseconds), the zero time if it has none
+func requestDeadline(header http.Header, receivedAt time.Time) (time.Time, error) {
+	ttl := strings.TrimSpace(header.Get("Proxy-TTL"))
+	if ttl == "" {
+		return time.Time{}, nil
+	}
+
+	value, err := strconv.ParseUint(ttl, 10, 64)
+	if err != nil || value == 0 {
+		return time.Time{}, fmt.Errorf("Proxy-TTL is not a positive number of milliseconds: %v", ttl)
+	}
+
+	return receivedAt.Add(time.Duration(value) * time.Millisecond), nil
+}
+
+// Returns whether the request expired before being forwarded
+func isExpired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// Drops a request that expired before being forwarded, sending it to the dead letter sink
+func dropExpiredRequest(letter *DeadLetter) {
+	atomic.AddUint64(&state.ExpiredCounter, 1)
+	debugPrint(3, "[!] Request %v to %v expired after %vms", letter.RequestID, letter.Target, letter.QueueWait)
+
+	letter.Reason = "expired"
+	writeDeadLetter(letter)
+}
+
+// Sends the dead letter to the dead letter sink, if any
+func writeDeadLetter(letter *DeadLetter) {
+	letter.Version = DeadLetterVersion
+	if sink := currentConfig().DeadLetterSink; sink != nil {
+		sink.Write(letter)
+	}
+}
+
+// Reports the outcome of a forwarded request, a dead letter if it failed after the sender was answered with a 202,
+// and a delivery receipt if enabled
+func reportDelivery(r *http.Request, options forwardOptions, job *affinityJob, attempts int64, latency time.Duration, resp *http.Response, body []byte, err error) {
+	accepted := atomic.LoadInt32(&job.Accepted) == 1
+	failed := err != nil || resp.StatusCode >= 500
+
+	if accepted && failed {
+		atomic.AddUint64(&state.FailedCounter, 1)
+		debugPrint(3, "[!] Request %v to %v failed after a 202", options.AccessLog.RequestID, options.AccessLog.Target)
+
+		letter := &DeadLetter{
+			Time:       time.Now(),
+			Reason:     "failed",
+			RequestID:  options.AccessLog.RequestID,
+			Sender:     options.AccessLog.Sender,
+			Tenant:     options.Tenant,
+			Method:     r.Method,
+			Target:     options.AccessLog.Target,
+			Header:     r.Header.Clone(),
+			ReceivedAt: options.AccessLog.Time,
+			QueueWait:  options.AccessLog.QueueWait,
+			Attempts:   int(attempts),
+		}
+
+		if r.GetBody != nil {
+			if requestBody, err := r.GetBody(); err == nil {
+				letter.Body, _ = ioutil.ReadAll(requestBody)
+				requestBody.Close()
+			}
+		}
+
+		if err == nil {
+			letter.Response = &DeadLetterResponse{Status: resp.StatusCode, Header: resp.Header.Clone(), Body: body}
+		}
+
+		writeDeadLetter(letter)
+	}
+
+	if !currentConfig().DeliveryReceipts {
+		return
+	}
+
+	sink, ok := currentConfig().DeadLetterSink.(ReceiptSink)
+	if !ok {
+		return
+	}
+
+	receipt := &DeliveryReceipt{
+		Version:   DeadLetterVersion,
+		Time:      time.Now(),
+		RequestID: options.AccessLog.RequestID,
+		Sender:    options.AccessLog.Sender,
+		Tenant:    options.Tenant,
+		Method:    r.Method,
+		Target:    options.AccessLog.Target,
+		Attempts:  int(attempts),
+		Latency:   float64(latency) / float64(time.Millisecond),
+		Accepted:  accepted,
+
+		TraceParent: r.Header.Get("Traceparent"),
+	}
+
+	if err != nil {
+		receipt.Error = err.Error()
+	} else {
+		receipt.Status = resp.StatusCode
+	}
+
+	sink.WriteReceipt(receipt)
+}
+
+// Drops a request received by the handler that expired before being forwarded, answering with a 504
+func writeExpiredRequest(w http.ResponseWriter, r *http.Request, forwardTo string, tenant string, receivedAt time.Time) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	header := r.Header.Clone()
+	header.Del("Forward-To")
+
+	// Proxy-Request-Id identifies the request in the dead letter, generate one if the sender did not
+	requestID := strings.TrimSpace(header.Get("Proxy-Request-Id"))
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	dropExpiredRequest(&DeadLetter{
+		Time:       time.Now(),
+		RequestID:  requestID,
+		Sender:     requestSender(r),
+		Tenant:     tenant,
+		Method:     r.Method,
+		Target:     forwardTo,
+		Header:     header,
+		Body:       body,
+		ReceivedAt: receivedAt,
+		QueueWait:  float64(time.Since(receivedAt)) / float64(time.Millisecond),
+	})
+
+	w.Header().Set("Proxy-Expired", "true")
+	w.Header().Set("Proxy-Request-Id", requestID)
+	writeProxyMetrics(w, http.StatusGatewayTimeout)
+	w.WriteHeader(http.StatusGatewayTimeout)
+}
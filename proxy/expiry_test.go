@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Sink passing on the dead letters it is written
+type channelDeadLetterSink chan *DeadLetter
+
+func (s channelDeadLetterSink) Write(letter *DeadLetter) {
+	s <- letter
+}
+
+// Requests queued past their Proxy-TTL are dropped to the dead letter sink instead of being forwarded
+func TestRequestTTL(t *testing.T) {
+	sink := make(channelDeadLetterSink, 1)
+	withConfig(t, func(next *proxyConfig) {
+		next.MaxRequests, next.QueueTimeout, next.ProxyTimeout, next.DeadLetterSink = 1, 5000, 5000, sink
+	})
+
+	held, release := make(chan struct{}), make(chan struct{})
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hold":
+			close(held)
+			<-release
+		case "/stale":
+			t.Errorf("the recipient received the expired request")
+		}
+	}))
+
+	defer recipient.Close()
+
+	for _, ttl := range []string{"0", "-1", "soon"} {
+		r := newForwardRequest(http.MethodGet, recipient.URL, "")
+		r.Header.Set("Proxy-TTL", ttl)
+
+		if w := serveProxy(r); w.Code != http.StatusBadRequest {
+			t.Errorf("got status %v for Proxy-TTL %q, expected 400", w.Code, ttl)
+		}
+	}
+
+	// Fill the proxy
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serveProxy(newForwardRequest(http.MethodGet, recipient.URL+"/hold", ""))
+	}()
+
+	<-held
+
+	r := newForwardRequest(http.MethodPost, recipient.URL+"/stale", "order")
+	r.Header.Set("Proxy-TTL", "50")
+	r.Header.Set("Proxy-Request-Id", "stale")
+
+	w := serveProxy(r)
+	close(release)
+	wg.Wait()
+
+	if w.Code != http.StatusGatewayTimeout || w.Header().Get("Proxy-Expired") != "true" || w.Header().Get("Proxy-Request-Id") != "stale" {
+		t.Errorf("got status %v and headers %v, expected an expired 504", w.Code, w.Header())
+	}
+
+	select {
+	case letter := <-sink:
+		if letter.Reason != "expired" || letter.RequestID != "stale" || letter.Target != recipient.URL+"/stale" || string(letter.Body) != "order" || letter.QueueWait < 50 {
+			t.Errorf("got dead letter %+v, expected the expired request", letter)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the expired request was not sent to the dead letter sink")
+	}
+
+	r = newForwardRequest(http.MethodGet, recipient.URL, "")
+	r.Header.Set("Proxy-TTL", "5000")
+
+	if w := serveProxy(r); w.Code != http.StatusOK {
+		t.Errorf("got status %v within the Proxy-TTL, expected 200", w.Code)
+	}
+}
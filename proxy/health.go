@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LivenessPath is the path of the Kubernetes liveness endpoint
+const LivenessPath = "/healthz"
+
+// ReadinessPath is the path of the Kubernetes readiness endpoint
+const ReadinessPath = "/readyz"
+
+// Records the outcome of a request to a recipient for the recipient health
+func recordRecipientResult(err error) {
+	if err != nil {
+		atomic.AddInt64(&state.RecipientFailures, 1)
+		atomic.StoreInt64(&state.LastRecipientFailure, time.Now().UnixNano())
+	} else {
+		atomic.StoreInt64(&state.RecipientFailures, 0)
+	}
+}
+
+// Returns whether the proxy can serve requests
+// Unready pods leave the Proxy-List and the Service, so besides draining proxies, only proxies past the unready
+// saturation or recipient failures are unready, taking them out until their requests finish or recipients recover
+func isReady() bool {
+	if atomic.LoadInt32(&state.Draining) != 0 {
+		return false
+	}
+
+	current := currentConfig()
+	if current.UnreadySaturation > 0 && float64(atomic.LoadInt64(&state.ActiveRequests)) >= float64(current.MaxRequests)*current.UnreadySaturation {
+		return false
+	}
+
+	// Unready proxies get no requests to find the recipients recovered with, so like an open breaker they are ready again
+	// for trial requests once the breakerCooldown passed since the last failure
+	if current.UnreadyRecipientFailures > 0 && atomic.LoadInt64(&state.RecipientFailures) >= current.UnreadyRecipientFailures {
+		return time.Since(time.Unix(0, atomic.LoadInt64(&state.LastRecipientFailure))) >= time.Duration(current.BreakerCooldown)*time.Second
+	}
+
+	return true
+}
+
+// Returns whether the proxy is forwarding its maximum of requests
+func isSaturated() bool {
+	return atomic.LoadInt64(&state.ActiveRequests) >= currentConfig().MaxRequests
+}
+
+// Returns whether the recipients are reachable, false after MaxRecipientFailures consecutive failures
+func recipientsHealthy() bool {
+	current := currentConfig()
+	return current.MaxRecipientFailures <= 0 || atomic.LoadInt64(&state.RecipientFailures) < current.MaxRecipientFailures
+}
+
+// Liveness HTTP handler, only reflects that the process is serving
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Readiness HTTP handler, reflects whether the proxy can serve requests
+// The saturation and the recipients' health are reported in headers, and in the metrics
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	w.Header().Set("Proxy-Saturated", strconv.FormatBool(isSaturated()))
+	w.Header().Set("Proxy-Recipients-Healthy", strconv.FormatBool(recipientsHealthy()))
+
+	if !isReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Writes the saturation and recipient health metrics in the Prometheus text exposition format
+func writeHealthMetrics(w *strings.Builder) {
+	fmt.Fprintf(w, "# HELP proxy_saturated Whether the proxy is forwarding its maximum of requests.\n")
+	fmt.Fprintf(w, "# TYPE proxy_saturated gauge\n")
+	fmt.Fprintf(w, "proxy_saturated %v\n", boolMetric(isSaturated()))
+
+	fmt.Fprintf(w, "# HELP proxy_recipient_consecutive_failures Number of consecutive failed requests to recipients.\n")
+	fmt.Fprintf(w, "# TYPE proxy_recipient_consecutive_failures gauge\n")
+	fmt.Fprintf(w, "proxy_recipient_consecutive_failures %v\n", atomic.LoadInt64(&state.RecipientFailures))
+
+	fmt.Fprintf(w, "# HELP proxy_recipients_healthy Whether the recipients are reachable, per maxRecipientFailures.\n")
+	fmt.Fprintf(w, "# TYPE proxy_recipients_healthy gauge\n")
+	fmt.Fprintf(w, "proxy_recipients_healthy %v\n", boolMetric(recipientsHealthy()))
+}
+
+// Returns the value of a boolean gauge
+func boolMetric(value bool) int {
+	if value {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// By default, saturated proxies and proxies failing to reach recipients stay ready, as unready pods leave the Proxy-List
+func TestReadiness(t *testing.T) {
+	defer func() {
+		atomic.StoreInt64(&state.ActiveRequests, 0)
+		atomic.StoreInt64(&state.RecipientFailures, 0)
+		atomic.StoreInt32(&state.Draining, 0)
+	}()
+
+	withConfig(t, func(next *proxyConfig) { next.MaxRecipientFailures = 3 })
+
+	for _, c := range []struct {
+		name      string
+		active    int64
+		failures  int64
+		draining  int32
+		status    int
+		saturated string
+		healthy   string
+	}{
+		{"idle", 0, 0, 0, http.StatusOK, "false", "true"},
+		{"saturated", currentConfig().MaxRequests, 0, 0, http.StatusOK, "true", "true"},
+		{"failing recipients", 0, 3, 0, http.StatusOK, "false", "false"},
+		{"draining", 0, 0, 1, http.StatusServiceUnavailable, "false", "true"},
+	} {
+		atomic.StoreInt64(&state.ActiveRequests, c.active)
+		atomic.StoreInt64(&state.RecipientFailures, c.failures)
+		atomic.StoreInt32(&state.Draining, c.draining)
+
+		w := httptest.NewRecorder()
+		readinessHandler(w, httptest.NewRequest(http.MethodGet, ReadinessPath, nil))
+
+		if w.Code != c.status {
+			t.Errorf("%v: got status %v, expected %v", c.name, w.Code, c.status)
+		}
+
+		if saturated := w.Header().Get("Proxy-Saturated"); saturated != c.saturated {
+			t.Errorf("%v: got Proxy-Saturated %q, expected %q", c.name, saturated, c.saturated)
+		}
+
+		if healthy := w.Header().Get("Proxy-Recipients-Healthy"); healthy != c.healthy {
+			t.Errorf("%v: got Proxy-Recipients-Healthy %q, expected %q", c.name, healthy, c.healthy)
+		}
+
+		var metrics strings.Builder
+		writeHealthMetrics(&metrics)
+		if expected := "proxy_recipients_healthy " + map[string]string{"true": "1", "false": "0"}[c.healthy]; !strings.Contains(metrics.String(), expected) {
+			t.Errorf("%v: the metrics lack %q:\n%v", c.name, expected, metrics.String())
+		}
+	}
+}
+
+// Past the unready thresholds, saturated proxies and proxies failing to reach recipients are unready
+func TestReadinessThresholds(t *testing.T) {
+	defer func() {
+		atomic.StoreInt64(&state.ActiveRequests, 0)
+		atomic.StoreInt64(&state.RecipientFailures, 0)
+		atomic.StoreInt64(&state.LastRecipientFailure, 0)
+	}()
+
+	withConfig(t, func(next *proxyConfig) {
+		next.MaxRequests = 10
+		next.UnreadySaturation = 0.8
+		next.UnreadyRecipientFailures = 3
+		next.BreakerCooldown = 60
+	})
+
+	for _, c := range []struct {
+		name        string
+		active      int64
+		failures    int64
+		lastFailure time.Time
+		status      int
+	}{
+		{"idle", 0, 0, time.Time{}, http.StatusOK},
+		{"below the saturation", 7, 0, time.Time{}, http.StatusOK},
+		{"saturated", 8, 0, time.Time{}, http.StatusServiceUnavailable},
+		{"below the recipient failures", 0, 2, time.Now(), http.StatusOK},
+		{"failing recipients", 0, 3, time.Now(), http.StatusServiceUnavailable},
+		{"failing recipients after the cooldown", 0, 3, time.Now().Add(-time.Minute), http.StatusOK},
+	} {
+		atomic.StoreInt64(&state.ActiveRequests, c.active)
+		atomic.StoreInt64(&state.RecipientFailures, c.failures)
+		atomic.StoreInt64(&state.LastRecipientFailure, c.lastFailure.UnixNano())
+
+		w := httptest.NewRecorder()
+		readinessHandler(w, httptest.NewRequest(http.MethodGet, ReadinessPath, nil))
+
+		if w.Code != c.status {
+			t.Errorf("%v: got status %v, expected %v", c.name, w.Code, c.status)
+		}
+	}
+
+	// A request reaching a recipient makes the proxy ready again
+	atomic.StoreInt64(&state.ActiveRequests, 0)
+	atomic.StoreInt64(&state.RecipientFailures, 3)
+	recordRecipientResult(nil)
+
+	if !isReady() {
+		t.Errorf("the proxy is unready after reaching a recipient")
+	}
+}
+
+// Requests still active once draining times out are cancelled, and the ones after resuming are not
+func TestDrainTimeout(t *testing.T) {
+	defer atomic.StoreInt64(&state.ActiveRequests, 0)
+
+	withConfig(t, func(next *proxyConfig) { next.DrainTimeout = 0 })
+	atomic.StoreInt64(&state.ActiveRequests, 1)
+
+	job := newAffinityJob(context.Background())
+	drain()
+
+	select {
+	case <-job.Context.Done():
+	case <-time.After(time.Second):
+		t.Errorf("the active request was not cancelled once draining timed out")
+	}
+
+	undrain()
+
+	if atomic.LoadInt32(&state.Draining) != 0 {
+		t.Errorf("the proxy is still draining after resuming")
+	}
+
+	job = newAffinityJob(context.Background())
+	defer job.Cancel()
+
+	select {
+	case <-job.Context.Done():
+		t.Errorf("a request after resuming was cancelled")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcome of a request submitted with a Proxy-Idempotency-Key
+type idempotentOutcome struct {
+	// Done is closed once the recipient responded
+	Done chan struct{}
+
+	// Expires is when the outcome is forgotten, set once Done is closed
+	Expires time.Time
+
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Err        error
+}
+
+// Request being forwarded with a Proxy-Idempotency-Key
+type idempotentRequest struct {
+	Key     string
+	Outcome *idempotentOutcome
+}
+
+// Outcomes of the idempotent requests seen within the idempotency TTL, by scoped key
+var idempotency struct {
+	sync.Mutex
+	Outcomes map[string]*idempotentOutcome
+
+	// Bytes is the size of the outcomes' bodies and headers
+	Bytes int64
+}
+
+func init() {
+	idempotency.Outcomes = map[string]*idempotentOutcome{}
+
+	go expireIdempotentOutcomes()
+}
+
+// Forgets the expired outcomes every second
+func expireIdempotentOutcomes() {
+	for {
+		time.Sleep(time.Second)
+
+		idempotency.Lock()
+		expireIdempotentOutcomesLocked()
+		idempotency.Unlock()
+	}
+}
+
+// Forgets the expired outcomes, must be called with idempotency locked
+func expireIdempotentOutcomesLocked() {
+	now := time.Now()
+	for key, outcome := range idempotency.Outcomes {
+		if outcome.expired(now) {
+			forgetIdempotentOutcomeLocked(key, outcome)
+		}
+	}
+}
+
+// Returns whether the outcome is past its TTL, counted from when the recipient responded so requests slower than the
+// TTL are still deduplicated while in flight
+func (outcome *idempotentOutcome) expired(now time.Time) bool {
+	select {
+	case <-outcome.Done:
+		return now.After(outcome.Expires)
+	default:
+		return false
+	}
+}
+
+// Forgets the outcome of the key, must be called with idempotency locked
+func forgetIdempotentOutcomeLocked(key string, outcome *idempotentOutcome) {
+	if idempotency.Outcomes[key] != outcome {
+		return
+	}
+
+	delete(idempotency.Outcomes, key)
+
+	select {
+	case <-outcome.Done:
+		idempotency.Bytes -= outcome.size()
+	default:
+	}
+}
+
+// Returns the approximate size of the stored outcome
+func (outcome *idempotentOutcome) size() int64 {
+	size := int64(len(outcome.Body))
+	for k, values := range outcome.Header {
+		for _, v := range values {
+			size += int64(len(k) + len(v))
+		}
+	}
+
+	return size
+}
+
+// Returns the key of an idempotent request, scoped to its tenant, sender and target, so senders can not read or
+// block each other's outcomes by reusing their keys
+func idempotencyScope(tenant string, sender string, method string, target string, key string) string {
+	return strings.Join([]string{tenant, sender, method, target, key}, "\n")
+}
+
+// Registers an idempotent request, returns the original outcome if the key was already submitted
+// full is true if the outcomes take idempotencyMaxEntries or idempotencyMaxBytes, and the request can not be
+// deduplicated
+func beginIdempotentRequest(key string) (outcome *idempotentOutcome, duplicate bool, full bool) {
+	idempotency.Lock()
+	defer idempotency.Unlock()
+
+	if outcome, ok := idempotency.Outcomes[key]; ok && !outcome.expired(time.Now()) {
+		return outcome, true, false
+	}
+
+	if idempotencyFull() {
+		expireIdempotentOutcomesLocked()
+		if idempotencyFull() {
+			return nil, false, true
+		}
+	}
+
+	outcome = &idempotentOutcome{Done: make(chan struct{})}
+
+	idempotency.Outcomes[key] = outcome
+	return outcome, false, false
+}
+
+// Returns whether the outcomes take their maximum entries or bytes, must be called with idempotency locked
+func idempotencyFull() bool {
+	current := currentConfig()
+	return int64(len(idempotency.Outcomes)) >= current.IdempotencyMaxEntries ||
+		current.IdempotencyMaxBytes > 0 && idempotency.Bytes >= current.IdempotencyMaxBytes
+}
+
+// Stores the recipient's response as the outcome of an idempotent request
+// Failed requests are forgotten so they can be retried
+func finishIdempotentRequest(key string, outcome *idempotentOutcome, resp *http.Response, body []byte, err error) {
+	idempotency.Lock()
+	defer idempotency.Unlock()
+
+	if err != nil {
+		outcome.Err = err
+		forgetIdempotentOutcomeLocked(key, outcome)
+	} else {
+		outcome.StatusCode = resp.StatusCode
+		outcome.Header = resp.Header
+		outcome.Body = body
+
+		if idempotency.Outcomes[key] == outcome {
+			idempotency.Bytes += outcome.size()
+		}
+	}
+
+	outcome.Expires = time.Now().Add(time.Duration(currentConfig().IdempotencyTTL) * time.Second)
+	close(outcome.Done)
+}
+
+// Writes the original outcome of a duplicate idempotent request
+func writeIdempotentOutcome(w http.ResponseWriter, outcome *idempotentOutcome) {
+	w.Header().Set("Proxy-Idempotent-Replay", "true")
+	writeStoredOutcome(w, outcome)
+}
+
+// Writes the stored outcome of a request
+// If the request is still being processed, waits up to the proxy timeout before returning a 202
+func writeStoredOutcome(w http.ResponseWriter, outcome *idempotentOutcome) {
+	select {
+	case <-outcome.Done:
+	case <-time.After(time.Duration(currentConfig().ProxyTimeout) * time.Millisecond):
+	}
+
+	select {
+	case <-outcome.Done:
+		if outcome.Err != nil {
+			// The original request failed, report the same failure
+			writeProxyMetrics(w, http.StatusInternalServerError)
+			w.WriteHeader(http.StatusInternalServerError)
+
+			w.Write([]byte(outcome.Err.Error()))
+			return
+		}
+
+		for k, values := range outcome.Header {
+			for _, v := range values {
+				w.Header().Add(k, v)
+			}
+		}
+
+		writeProxyMetrics(w, http.StatusOK)
+		w.WriteHeader(outcome.StatusCode)
+
+		w.Write(outcome.Body)
+	default:
+		writeProxyMetrics(w, http.StatusAccepted)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
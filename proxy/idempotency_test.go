@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func withIdempotency(t *testing.T, maxEntries int64, maxBytes int64) {
+	withConfig(t, func(next *proxyConfig) {
+		next.IdempotencyTTL, next.IdempotencyMaxEntries, next.IdempotencyMaxBytes = 60, maxEntries, maxBytes
+	})
+
+	t.Cleanup(func() {
+		idempotency.Lock()
+		idempotency.Outcomes = map[string]*idempotentOutcome{}
+		idempotency.Bytes = 0
+		idempotency.Unlock()
+	})
+}
+
+func TestIdempotencyDisabledByDefault(t *testing.T) {
+	if ttl := currentConfig().IdempotencyTTL; ttl != 0 {
+		t.Errorf("got idempotencyTTL %v by default, expected 0", ttl)
+	}
+}
+
+// Keys are scoped, so the same key of another tenant, sender or target is another request
+func TestIdempotencyScope(t *testing.T) {
+	withIdempotency(t, 100, 0)
+
+	key := idempotencyScope("tenant", "sender", http.MethodPost, "http://recipient/", "key")
+	outcome, duplicate, _ := beginIdempotentRequest(key)
+	if duplicate {
+		t.Fatalf("the first request is a duplicate")
+	}
+
+	finishIdempotentRequest(key, outcome, &http.Response{StatusCode: http.StatusCreated}, []byte("body"), nil)
+
+	if _, duplicate, _ := beginIdempotentRequest(key); !duplicate {
+		t.Errorf("the second request is not a duplicate")
+	}
+
+	for _, other := range []string{
+		idempotencyScope("other", "sender", http.MethodPost, "http://recipient/", "key"),
+		idempotencyScope("tenant", "other", http.MethodPost, "http://recipient/", "key"),
+		idempotencyScope("tenant", "sender", http.MethodPost, "http://other/", "key"),
+	} {
+		if _, duplicate, _ := beginIdempotentRequest(other); duplicate {
+			t.Errorf("%q is a duplicate of %q", other, key)
+		}
+	}
+}
+
+func TestIdempotencyBounds(t *testing.T) {
+	withIdempotency(t, 2, 10)
+
+	for i, key := range []string{"a", "b"} {
+		outcome, _, full := beginIdempotentRequest(key)
+		if full {
+			t.Fatalf("full after %v outcomes", i)
+		}
+
+		finishIdempotentRequest(key, outcome, &http.Response{StatusCode: http.StatusOK}, []byte("body"), nil)
+	}
+
+	if _, _, full := beginIdempotentRequest("c"); !full {
+		t.Errorf("took a third outcome past idempotencyMaxEntries")
+	}
+
+	// The bytes bound applies with entries to spare
+	updateConfig(func(next *proxyConfig) { next.IdempotencyMaxEntries = 100 })
+	outcome, _, _ := beginIdempotentRequest("c")
+	finishIdempotentRequest("c", outcome, &http.Response{StatusCode: http.StatusOK}, []byte("body"), nil)
+
+	if _, _, full := beginIdempotentRequest("d"); !full {
+		t.Errorf("took a fourth outcome past idempotencyMaxBytes, with %v bytes", idempotency.Bytes)
+	}
+
+	// Forgotten outcomes release their bytes
+	idempotency.Lock()
+	for key, outcome := range idempotency.Outcomes {
+		forgetIdempotentOutcomeLocked(key, outcome)
+	}
+	idempotency.Unlock()
+
+	if idempotency.Bytes != 0 {
+		t.Errorf("got %v bytes without outcomes", idempotency.Bytes)
+	}
+}
+
+// Requests in flight for longer than the idempotency TTL are still deduplicated, their TTL starting once answered
+func TestIdempotencySlowRecipient(t *testing.T) {
+	withIdempotency(t, 100, 0)
+	updateConfig(func(next *proxyConfig) { next.IdempotencyTTL, next.ProxyTimeout = 1, 100 })
+
+	var received int64
+	release := make(chan struct{})
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&received, 1)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	defer recipient.Close()
+
+	// Returns the response to a request with the idempotency key
+	send := func() *httptest.ResponseRecorder {
+		r := newForwardRequest(http.MethodPost, recipient.URL, "order")
+		r.Header.Set("Proxy-Idempotency-Key", "key")
+		return serveProxy(r)
+	}
+
+	if w := send(); w.Code != http.StatusAccepted {
+		close(release)
+		t.Fatalf("got status %v, expected a 202 past the proxy timeout", w.Code)
+	}
+
+	// Past the TTL, as swept every second
+	time.Sleep(1100 * time.Millisecond)
+
+	idempotency.Lock()
+	expireIdempotentOutcomesLocked()
+	idempotency.Unlock()
+
+	if w := send(); w.Code != http.StatusAccepted || w.Header().Get("Proxy-Idempotent-Replay") != "true" {
+		t.Errorf("got status %v and headers %v while in flight, expected a replayed 202", w.Code, w.Header())
+	}
+
+	// Wait for the outcome rather than answering with a 202
+	close(release)
+	updateConfig(func(next *proxyConfig) { next.ProxyTimeout = 5000 })
+
+	if w := send(); w.Code != http.StatusCreated || w.Header().Get("Proxy-Idempotent-Replay") != "true" {
+		t.Errorf("got status %v and headers %v once answered, expected the replayed 201", w.Code, w.Header())
+	}
+
+	if n := atomic.LoadInt64(&received); n != 1 {
+		t.Errorf("the recipient received %v requests, expected 1", n)
+	}
+}
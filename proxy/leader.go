@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Leader of the StatefulSet, the only proxy making scaling decisions for ensure requests
+var leader struct {
+	sync.RWMutex
+	Identity string
+}
+
+// Returns the name of the current leader's pod, empty if unknown
+func currentLeader() string {
+	leader.RLock()
+	defer leader.RUnlock()
+
+	return leader.Identity
+}
+
+// Starts campaigning for leadership through a Lease named after the StatefulSet
+func startLeaderElection() {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      ProxyStatefulSet,
+			Namespace: ProxyNamespace,
+		},
+		Client: kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: ProxyName,
+		},
+	}
+
+	go func() {
+		// RunOrDie returns when leadership is lost, so campaign again
+		for {
+			leaderelection.RunOrDie(context.Background(), leaderelection.LeaderElectionConfig{
+				Lock:            lock,
+				LeaseDuration:   15 * time.Second,
+				RenewDeadline:   10 * time.Second,
+				RetryPeriod:     2 * time.Second,
+				ReleaseOnCancel: true,
+				Callbacks: leaderelection.LeaderCallbacks{
+					OnStartedLeading: func(ctx context.Context) {
+						debugPrint(1, "[+] Became the leader")
+					},
+					OnStoppedLeading: func() {
+						debugPrint(1, "[+] Stopped being the leader")
+					},
+					OnNewLeader: func(identity string) {
+						leader.Lock()
+						leader.Identity = identity
+						leader.Unlock()
+
+						debugPrint(2, "[+] New leader: %v", identity)
+					},
+				},
+			})
+		}
+	}()
+}
+
+// Forwards an ensure request to the leader, returns false if this proxy should handle it instead
+func forwardEnsureRequest(w http.ResponseWriter, r *http.Request, ensure string) bool {
+	identity := currentLeader()
+	if identity == "" || identity == ProxyName {
+		return false
+	}
+
+	proxies.List.RLock()
+	leaderIP, ok := proxies.List.PodIPs[identity]
+	proxies.List.RUnlock()
+
+	if !ok {
+		debugPrint(2, "[!] Leader %v is not ready, handling ensure request locally", identity)
+		return false
+	}
+
+	scheme, client := peerClient()
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%v://%v:%v%v", scheme, leaderIP, currentConfig().HTTP.Port, currentConfig().HTTP.Path), nil)
+	if err != nil {
+		return false
+	}
+
+	req.Header.Set("Proxy-Ensure-Requests", ensure)
+	for _, header := range []string{"Proxy-Ensure-Max-Proxies", "Proxy-Ensure-Step"} {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	req.Header.Set("Proxy-Leader", identity)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		debugPrint(1, "[!] Failed to forward ensure request to leader %v, handling it locally: %v", identity, err)
+		return false
+	}
+
+	defer resp.Body.Close()
+
+	// Report the leader's outcome with the leader's view of the proxy list, omitting the headers it did not send
+	for _, header := range []string{"Proxy-Counter", "Proxy-Free", "Proxy-Ordinal", "Proxy-Status", "Proxy-Version", "Proxy-List", "Proxy-Leader", "Proxy-Protocol-Version", "Proxy-Epoch", "Proxy-List-Encoding", "Proxy-Senders", "Proxy-Max-Proxies", "Proxy-Headroom", "Proxy-Max-Scale"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+
+	return true
+}
+
+// PeerTimeout bounds the requests to the other proxies, so an unresponsive peer does not hold up the requests
+const PeerTimeout = 5 * time.Second
+
+// MaxPeerResponseBytes bounds the responses read from the other proxies, e.g. of status queries
+const MaxPeerResponseBytes = 8 << 20
+
+// MaxPeerQueries bounds the queries to the other proxies one request makes at once
+const MaxPeerQueries = 8
+
+// Dialer of the connections to the other proxies
+var peerDialer = &net.Dialer{Timeout: 2 * time.Second, KeepAlive: 30 * time.Second}
+
+// Clients reaching the other proxies over HTTP and HTTPS, shared so their connections are reused
+var peerHTTPClient = &http.Client{
+	Timeout: PeerTimeout,
+	Transport: &http.Transport{
+		DialContext:         peerDialer.DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+var peerHTTPSClient = &http.Client{
+	Timeout: PeerTimeout,
+	Transport: &http.Transport{
+		DialTLSContext:      dialPeerTLS,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// Returns the scheme and client to reach another proxy with
+func peerClient() (string, *http.Client) {
+	if currentConfig().TLS.CertFile != "" {
+		return "https", peerHTTPSClient
+	}
+
+	return "http", peerHTTPClient
+}
+
+// Returns the name the certificate of the proxy at the IP must cover, its pod's DNS name in the headless Service
+func peerServerName(ip string) (string, error) {
+	proxies.List.RLock()
+	defer proxies.List.RUnlock()
+
+	for pod, podIP := range proxies.List.RunningPodIPs {
+		if podIP == ip {
+			return fmt.Sprintf("%v.%v.%v.svc", pod, ProxyStatefulSet, ProxyNamespace), nil
+		}
+	}
+
+	return "", fmt.Errorf("%v is not a running proxy", ip)
+}
+
+// Dials another proxy over TLS, presenting this proxy's certificate, and verifying the peer's against the peer CAs
+// for its pod's DNS name, as proxies are reached by pod IP
+func dialPeerTLS(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	serverName, err := peerServerName(host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := peerDialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	serverTLS.RLock()
+	peerCAs := serverTLS.PeerCAs
+	serverTLS.RUnlock()
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    peerCAs,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			serverTLS.RLock()
+			defer serverTLS.RUnlock()
+
+			return serverTLS.Certificate, nil
+		},
+	})
+
+	// Bound the handshake by the context, like the dial
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Returns whether the request comes from another proxy forwarding it to this one as the leader it knows
+// Proxy-Leader is stripped from other requests, so senders can not bypass the leader
+func isForwardedToLeader(r *http.Request) bool {
+	if r.Header.Get("Proxy-Leader") != ProxyName {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	proxies.List.RLock()
+	defer proxies.List.RUnlock()
+
+	for _, ip := range proxies.List.RunningPodIPs {
+		if ip == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scaling is 1 while this proxy's scale request is in flight, so its saturated responses do not send one each
+var scaling int32
+
+// Scales the StatefulSet from the count this proxy knows to the new scale through the leader, or locally if it is the
+// leader or the leader can not be reached, returns whether it scaled
+func scaleThroughLeader(from int64, newScale int) bool {
+	if !atomic.CompareAndSwapInt32(&scaling, 0, 1) {
+		return false
+	}
+
+	defer atomic.StoreInt32(&scaling, 0)
+
+	if scaled, forwarded := forwardScaleRequest(from, newScale); forwarded {
+		return scaled
+	}
+
+	return scaleFrom(from, newScale)
+}
+
+// Scales the StatefulSet to the new scale if its count is still the one given, so the stale requests of several
+// proxies do not compound
+func scaleFrom(from int64, newScale int) bool {
+	proxies.CountMu.Lock()
+	defer proxies.CountMu.Unlock()
+
+	if proxies.Count != from {
+		return false
+	}
+
+	return scaleStatefulSet(newScale)
+}
+
+// Asks the leader to scale the StatefulSet from the count to the new scale, returns whether it scaled, and false for
+// forwarded if this proxy should scale instead
+func forwardScaleRequest(from int64, newScale int) (scaled bool, forwarded bool) {
+	identity := currentLeader()
+	if identity == "" || identity == ProxyName {
+		return false, false
+	}
+
+	proxies.List.RLock()
+	leaderIP, ok := proxies.List.PodIPs[identity]
+	proxies.List.RUnlock()
+
+	if !ok {
+		debugPrint(2, "[!] Leader %v is not ready, scaling locally", identity)
+		return false, false
+	}
+
+	scheme, client := peerClient()
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%v://%v:%v%v", scheme, leaderIP, currentConfig().HTTP.Port, currentConfig().HTTP.Path), nil)
+	if err != nil {
+		return false, false
+	}
+
+	req.Header.Set("Proxy-Leader", identity)
+	req.Header.Set("Proxy-Scale-From", strconv.FormatInt(from, 10))
+	req.Header.Set("Proxy-Scale-To", strconv.Itoa(newScale))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		debugPrint(1, "[!] Failed to forward scale request to leader %v, scaling locally: %v", identity, err)
+		return false, false
+	}
+
+	defer resp.Body.Close()
+
+	return resp.Header.Get("Proxy-Status") == strconv.Itoa(http.StatusOK), true
+}
+
+// Handles a scale request of the last proxy forwarded to this one as the leader, returns false if none exists
+// Only the last proxy scales up or down by one, so others are denied
+func handleScaleRequest(w http.ResponseWriter, r *http.Request) bool {
+	to := strings.TrimSpace(r.Header.Get("Proxy-Scale-To"))
+	if to == "" || r.Header.Get("Proxy-Leader") == "" {
+		return false
+	}
+
+	from, err := strconv.ParseInt(strings.TrimSpace(r.Header.Get("Proxy-Scale-From")), 10, 64)
+	newScale, err2 := strconv.ParseInt(to, 10, 64)
+	if err != nil || err2 != nil || (newScale != from+1 && newScale != from-1) {
+		writeProxyMetrics(w, http.StatusBadRequest)
+		w.WriteHeader(http.StatusBadRequest)
+		return true
+	}
+
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	// The last proxy is unready while it drains to scale down
+	proxies.List.RLock()
+	lastIP := proxies.List.RunningPodIPs[fmt.Sprintf("%v-%v", ProxyStatefulSet, from-1)]
+	proxies.List.RUnlock()
+
+	if host == "" || host != lastIP {
+		writeProxyMetrics(w, http.StatusForbidden)
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+
+	// A count changed since the request was sent is a conflict
+	status := http.StatusConflict
+	if scaleFrom(from, int(newScale)) {
+		status = http.StatusOK
+	}
+
+	writeProxyMetrics(w, status)
+	w.WriteHeader(status)
+	return true
+}
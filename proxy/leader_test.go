@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Runs the test as the pod proxy-0 of the StatefulSet proxy, with the running pods' IPs
+func withPeers(t *testing.T, ips map[string]string) {
+	name, namespace, statefulSet := ProxyName, ProxyNamespace, ProxyStatefulSet
+	ProxyName, ProxyNamespace, ProxyStatefulSet = "proxy-0", "default", "proxy"
+
+	proxies.List.Lock()
+	podIPs, runningPodIPs := proxies.List.PodIPs, proxies.List.RunningPodIPs
+	proxies.List.PodIPs, proxies.List.RunningPodIPs = ips, ips
+	proxies.List.Unlock()
+
+	t.Cleanup(func() {
+		ProxyName, ProxyNamespace, ProxyStatefulSet = name, namespace, statefulSet
+
+		proxies.List.Lock()
+		proxies.List.PodIPs, proxies.List.RunningPodIPs = podIPs, runningPodIPs
+		proxies.List.Unlock()
+	})
+}
+
+func TestIsForwardedToLeader(t *testing.T) {
+	withPeers(t, map[string]string{"proxy-0": "10.0.0.1", "proxy-1": "10.0.0.2"})
+
+	for _, c := range []struct {
+		leader     string
+		remoteAddr string
+		forwarded  bool
+	}{
+		{"proxy-0", "10.0.0.2:1234", true},
+		{"proxy-1", "10.0.0.2:1234", false},
+		{"proxy-0", "192.168.0.1:1234", false},
+		{"", "10.0.0.2:1234", false},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.leader != "" {
+			r.Header.Set("Proxy-Leader", c.leader)
+		}
+
+		if forwarded := isForwardedToLeader(r); forwarded != c.forwarded {
+			t.Errorf("Proxy-Leader %q from %v: forwarded %v, expected %v", c.leader, c.remoteAddr, forwarded, c.forwarded)
+		}
+	}
+}
+
+// Only the last proxy scales, by one, from the count the leader still has
+func TestHandleScaleRequest(t *testing.T) {
+	withPeers(t, map[string]string{"proxy-0": "10.0.0.1", "proxy-1": "10.0.0.2"})
+
+	// Full proxies of other tests may still be scaling up in the background
+	count := atomic.SwapInt64(&proxies.Count, 3)
+	defer atomic.StoreInt64(&proxies.Count, count)
+
+	for _, c := range []struct {
+		name       string
+		from       string
+		to         string
+		remoteAddr string
+		status     int
+	}{
+		{"not the last proxy", "3", "4", "10.0.0.1:1234", http.StatusForbidden},
+		{"by more than one", "2", "4", "10.0.0.2:1234", http.StatusBadRequest},
+		{"stale count", "2", "3", "10.0.0.2:1234", http.StatusConflict},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		r.Header.Set("Proxy-Leader", "proxy-0")
+		r.Header.Set("Proxy-Scale-From", c.from)
+		r.Header.Set("Proxy-Scale-To", c.to)
+
+		w := httptest.NewRecorder()
+		if !handleScaleRequest(w, r) {
+			t.Fatalf("%v: the scale request was not handled", c.name)
+		}
+
+		if w.Code != c.status {
+			t.Errorf("%v: got status %v, expected %v", c.name, w.Code, c.status)
+		}
+	}
+
+	// Requests without Proxy-Leader, stripped from the senders', are not scale requests
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Proxy-Scale-To", "4")
+	if handleScaleRequest(httptest.NewRecorder(), r) {
+		t.Errorf("handled a scale request without Proxy-Leader")
+	}
+}
+
+// Returns a TLS server at 127.0.0.1 with a certificate for the DNS name, and the pool of its CA
+func newPeerServer(t *testing.T, dnsName string) (*httptest.Server, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server, pool
+}
+
+// Peers are verified against the peer CAs for their pod's DNS name, not skipped
+func TestDialPeerTLS(t *testing.T) {
+	withPeers(t, map[string]string{"proxy-1": "127.0.0.1"})
+
+	for _, c := range []struct {
+		dnsName string
+		trusted bool
+		valid   bool
+	}{
+		{"proxy-1.proxy.default.svc", true, true},
+		{"proxy-2.proxy.default.svc", true, false},
+		{"proxy-1.proxy.default.svc", false, false},
+	} {
+		server, pool := newPeerServer(t, c.dnsName)
+
+		serverTLS.Lock()
+		serverTLS.Certificate = &tls.Certificate{}
+		serverTLS.PeerCAs = x509.NewCertPool()
+		if c.trusted {
+			serverTLS.PeerCAs = pool
+		}
+		serverTLS.Unlock()
+
+		conn, err := dialPeerTLS(context.Background(), "tcp", server.Listener.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+
+		if (err == nil) != c.valid {
+			t.Errorf("certificate for %v trusted %v: got error %v, expected valid %v", c.dnsName, c.trusted, err, c.valid)
+		}
+	}
+
+	serverTLS.Lock()
+	serverTLS.Certificate = nil
+	serverTLS.PeerCAs = nil
+	serverTLS.Unlock()
+
+	// Addresses of no proxy are not dialed
+	if _, err := dialPeerTLS(context.Background(), "tcp", net.JoinHostPort("127.0.0.2", "443")); err == nil {
+		t.Errorf("dialed an address of no proxy")
+	}
+}
+
+func TestPeerClientShared(t *testing.T) {
+	_, first := peerClient()
+	_, second := peerClient()
+
+	if first != second || first == http.DefaultClient || first.Timeout == 0 {
+		t.Errorf("the peer clients are not one shared client with a timeout")
+	}
+}
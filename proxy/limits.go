@@ -0,0 +1,40 @@
+package main
+
+import "net/http"
+
+// Returns the size in bytes of a request's headers
+func headerSize(header http.Header) int64 {
+	var size int64
+	for k, values := range header {
+		for _, v := range values {
+			// Account for the ": " and "\r\n" around every header line
+			size += int64(len(k) + len(v) + 4)
+		}
+	}
+
+	return size
+}
+
+// Rejects a request that exceeds the configured size limits, returns true if it was rejected
+// The body is only limited when reading, as its length is not known upfront for chunked requests
+func rejectOversizedRequest(w http.ResponseWriter, r *http.Request) bool {
+	current := currentConfig()
+
+	if current.MaxHeaderBytes > 0 && headerSize(r.Header) > current.MaxHeaderBytes {
+		writeProxyMetrics(w, http.StatusRequestHeaderFieldsTooLarge)
+		w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+		return true
+	}
+
+	if current.MaxBodyBytes > 0 {
+		if r.ContentLength > current.MaxBodyBytes {
+			writeProxyMetrics(w, http.StatusRequestEntityTooLarge)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return true
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, current.MaxBodyBytes)
+	}
+
+	return false
+}
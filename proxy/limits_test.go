@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Requests over the size limits are rejected without reaching the recipient, even if their length is not known
+func TestRequestSizeLimits(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) { next.MaxHeaderBytes, next.MaxBodyBytes, next.ProxyTimeout = 200, 10, 5000 })
+
+	var received int64
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&received, 1)
+	}))
+
+	defer recipient.Close()
+
+	r := newForwardRequest(http.MethodPost, recipient.URL, "")
+	r.Header.Set("X-Padding", strings.Repeat("a", 200))
+
+	if w := serveProxy(r); w.Code != http.StatusRequestHeaderFieldsTooLarge || w.Header().Get("Proxy-Status") != "431" {
+		t.Errorf("got status %v for oversized headers, expected 431", w.Code)
+	}
+
+	if w := serveProxy(newForwardRequest(http.MethodPost, recipient.URL, strings.Repeat("a", 11))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %v for an oversized Content-Length, expected 413", w.Code)
+	}
+
+	// Chunked
+	r = newForwardRequest(http.MethodPost, recipient.URL, strings.Repeat("a", 20))
+	r.ContentLength = -1
+
+	if w := serveProxy(r); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %v for an oversized chunked body, expected 413", w.Code)
+	}
+
+	if n := atomic.LoadInt64(&received); n != 0 {
+		t.Errorf("the recipient received %v oversized requests", n)
+	}
+
+	if active := atomic.LoadInt64(&state.ActiveRequests); active != 0 {
+		t.Errorf("the rejected requests left %v active requests", active)
+	}
+
+	if w := serveProxy(newForwardRequest(http.MethodPost, recipient.URL, strings.Repeat("a", 10))); w.Code != http.StatusOK || atomic.LoadInt64(&received) != 1 {
+		t.Errorf("got status %v for a request within the limits, expected 200", w.Code)
+	}
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
-	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
@@ -20,6 +22,7 @@ import (
 	v1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -34,8 +37,16 @@ var ProxyNamespace = os.Getenv("POD_NAMESPACE")
 // ProxyStatefulSet is the StatefulSet the proxy's pod resides in
 var ProxyStatefulSet = os.Getenv("POD_STATEFULSET")
 
-// ProxyOrdinal is the proxy's pod's ordinal in the StatefulSet
-var ProxyOrdinal = getProxyOrdinal(ProxyName)
+// ProxyOrdinal is the proxy's pod's ordinal in the StatefulSet, parsed from ProxyName on start
+var ProxyOrdinal int64
+
+// ProtocolVersion is the version of the Proxy-* protocol the proxy speaks, advertised in Proxy-Protocol-Version
+// Proxies predating the header speak version 1
+const ProtocolVersion = 2
+
+// Epoch identifies the proxy's process, advertised in Proxy-Epoch, so clients can tell a restarted pod's counter
+// apart from stale responses
+var Epoch = time.Now().UnixNano()
 
 var kubeClient *kubernetes.Clientset
 
@@ -47,6 +58,14 @@ var proxies struct {
 		sync.RWMutex
 		IPs     string
 		Version string
+
+		// Encoding is the Proxy-List-Encoding of IPs, empty if it is not encoded
+		Encoding string
+
+		// PodIPs maps the names of the ready pods to their IPs, and RunningPodIPs those of the running pods, including
+		// the draining ones, which the other proxies accept peer requests from
+		PodIPs        map[string]string
+		RunningPodIPs map[string]string
 	}
 }
 
@@ -58,12 +77,43 @@ var state struct {
 	DenyCounter      uint64
 	IdleShutdown     struct {
 		sync.RWMutex
-		LastTime time.Time
+
+		// Time of the last activity in Unix nanoseconds, accessed atomically
+		LastTime int64
 	}
+
+	// RecipientFailures is the number of consecutive failed requests to recipients
+	RecipientFailures int64
+
+	// LastRecipientFailure is the time of the last failed request to a recipient in Unix nanoseconds
+	LastRecipientFailure int64
+
+	// Draining is set while the proxy finishes its active requests before scaling down
+	Draining int32
+
+	// ScheduledRequests is the number of requests held until their Proxy-Delay or Proxy-Not-Before
+	ScheduledRequests int64
+
+	// ExpiredCounter is the number of requests dropped for expiring before being forwarded
+	ExpiredCounter uint64
+
+	// FailedCounter is the number of requests answered with a 202 that then failed to be delivered
+	FailedCounter uint64
+
+	// DroppedMessagesCounter is the number of dead letters and receipts a queue sink dropped for not keeping up
+	DroppedMessagesCounter uint64
+
+	// FailedMessagesCounter is the number of dead letters and receipts a queue sink dropped after failing to publish
+	// them
+	FailedMessagesCounter uint64
+
+	// DroppedSpansCounter is the number of spans an OTLP sink dropped for not keeping up, or failing to export them
+	DroppedSpansCounter uint64
 }
 
-// Config from annotations (+ readiness probe)
-var config struct {
+// Config from annotations (+ readiness probe), published as a whole as an immutable snapshot on every update, so
+// readers load one consistent version of it without locking
+type proxyConfig struct {
 	MinProxies    int64
 	MaxProxies    int64
 	MaxRequests   int64
@@ -72,85 +122,218 @@ var config struct {
 	IdleTimeout   int64
 	DebugLevel    int64
 
+	// DrainTimeout is the time in seconds the last proxy waits for its active requests before scaling down, after
+	// which the remaining ones are cancelled, below the pods' terminationGracePeriodSeconds
+	DrainTimeout int64
+
+	// MaxRecipientFailures is the number of consecutive recipient failures before reporting the recipients unhealthy
+	MaxRecipientFailures int64
+
+	// UnreadySaturation is the fraction of MaxRequests active at which the proxy reports itself unready (0 disables)
+	UnreadySaturation float64
+
+	// UnreadyRecipientFailures is the number of consecutive recipient failures at which the proxy reports itself
+	// unready (0 disables)
+	UnreadyRecipientFailures int64
+
+	// IdempotencyTTL is the time in seconds outcomes of requests with a Proxy-Idempotency-Key are kept, and
+	// IdempotencyMaxEntries and IdempotencyMaxBytes bound them
+	IdempotencyTTL        int64
+	IdempotencyMaxEntries int64
+	IdempotencyMaxBytes   int64
+
+	// AffinityTTL is the time in seconds outcomes of requests answered with a 202 are kept for follow-ups
+	AffinityTTL int64
+
+	// SenderTTL is the time in seconds a sender is counted in Proxy-Senders after its last request
+	SenderTTL int64
+
+	// Retry policy for requests to recipients
+	RecipientRetries    int64
+	RecipientRetryDelay int64
+	RetryAllMethods     bool
+
+	// StreamingMode streams requests while the proxy has capacity to spare instead of buffering them
+	StreamingMode bool
+
+	// Circuit breaker toward recipient hosts
+	BreakerFailures int64
+	BreakerCooldown int64
+
+	// Cache of recipient responses to GET requests
+	CacheTTL        int64
+	CacheMaxEntries int64
+
+	// Queueing of requests while the proxy is full
+	QueueTimeout      int64
+	MaxQueuedRequests int64
+
+	// Connection pooling and DNS caching toward recipients
+	MaxConnsPerHost     int64
+	MaxIdleConnsPerHost int64
+	IdleConnTimeout     int64
+	DNSCacheTTL         int64
+
+	// Value of the recipientTLS annotation the RecipientTLS were parsed from
+	RecipientTLSValue string
+
+	// RecipientTLS are the TLS configs toward recipients by host pattern
+	RecipientTLS []*recipientTLS
+
+	// TenantLimits are the limits of each tenant sharing the proxies
+	TenantLimits map[string]TenantLimits
+
+	// Transforms applied to forwarded requests and responses, then the filter of responses
+	Transforms     []Transform
+	ResponseFilter *ResponseFilter
+
+	// Chaos injects faults into forwarded requests, nil to disable
+	Chaos *ChaosConfig
+
+	// MaxBatchSize is the maximum number of requests in a batch
+	MaxBatchSize int64
+
+	// Limits of the requests scheduled with Proxy-Delay or Proxy-Not-Before
+	MaxDelay             int64
+	MaxScheduledRequests int64
+
+	// Size limits of incoming requests
+	MaxHeaderBytes int64
+	MaxBodyBytes   int64
+
+	// MaxProxyListBytes is the size of the Proxy-List above which it is compressed (0 disables)
+	MaxProxyListBytes int64
+
+	// AccessLogSink receives an entry per forwarded request, nil to disable
+	AccessLogSink AccessLogSink
+
+	// DeadLetterSink receives the requests dropped without being forwarded, or failing after a 202, nil to disable
+	DeadLetterSink DeadLetterSink
+
+	// DeadLetterFormat is how the dead letters and delivery receipts are encoded
+	DeadLetterFormat MessageFormat
+
+	// DeliveryReceipts sends a receipt of every request forwarded to the recipient to the DeadLetterSink, if it is a
+	// ReceiptSink
+	DeliveryReceipts bool
+
+	// SpanSink receives the spans of forwarded requests, nil to disable
+	SpanSink SpanSink
+
+	// CapacityStrategy computes the free requests reported to clients
+	CapacityStrategy CapacityStrategy
+	MaxMemory        int64
+	TargetLatency    int64
+
+	// IdleLoadFactor is the fraction of the target requests under which the last proxy counts as idle
+	IdleLoadFactor float64
+
 	// HTTP config comes from readiness probe
 	HTTP struct {
 		Path string
 		Port int
 	}
+
+	// TLS config of the proxy's listener, only read on startup to choose between HTTP and HTTPS
+	TLS struct {
+		CertFile     string
+		KeyFile      string
+		ClientCAFile string
+
+		// PeerCAFile verifies the other proxies, default the cluster's CA bundle
+		PeerCAFile string
+	}
+}
+
+// Current *proxyConfig, replaced rather than modified by updateConfig
+var configs atomic.Value
+
+// Serializes the updates of the config
+var configsMu sync.Mutex
+
+// Returns the current config, which must not be modified
+// Requests load it once, so they see one version of it throughout
+func currentConfig() *proxyConfig {
+	if current, ok := configs.Load().(*proxyConfig); ok {
+		return current
+	}
+
+	return &proxyConfig{}
+}
+
+// Publishes a copy of the current config changed by the update
+// The maps and slices of the config are shared between the copies, so they must be replaced rather than modified
+func updateConfig(update func(next *proxyConfig)) *proxyConfig {
+	configsMu.Lock()
+	defer configsMu.Unlock()
+
+	next := *currentConfig()
+	update(&next)
+	configs.Store(&next)
+
+	return &next
 }
 
 func debugPrint(level int, format string, args ...interface{}) {
-	if int64(level) > config.DebugLevel {
+	if int64(level) > currentConfig().DebugLevel {
 		return
 	}
 
 	log.Printf(format, args...)
 }
 
-// Changes the StatefulSet replica count
-func scaleStatefulSet(newScale int) {
+// Changes the StatefulSet replica count, returns whether the scale changed
+func scaleStatefulSet(newScale int) bool {
 	debugPrint(2, "[+] Attempting to scale to %v proxies", newScale)
 
 	// Cap it at max proxies
-	if int64(newScale) > config.MaxProxies {
-		newScale = int(config.MaxProxies)
+	if int64(newScale) > currentConfig().MaxProxies {
+		newScale = int(currentConfig().MaxProxies)
 	}
 
 	// Skip useless scalings
-	if int64(newScale) == proxies.Count || int64(newScale) < config.MinProxies {
-		return
+	if int64(newScale) == proxies.Count || int64(newScale) < currentConfig().MinProxies {
+		return false
 	}
 
+	// Only the replicas of the scale subresource are patched, so the proxy needs no update rights on the StatefulSet itself
+	patch := []byte(fmt.Sprintf(`{"spec":{"replicas":%v}}`, newScale))
+
 	retries := 5
 	for retry := 0; retry < retries; retry++ {
 		statefulSets := kubeClient.AppsV1().StatefulSets(ProxyNamespace)
 
-		scale, err := statefulSets.GetScale(context.Background(), ProxyStatefulSet, metav1.GetOptions{})
-		if err != nil {
-			log.Fatalf("[!] Error getting StatefulSet's scale: %s", err)
-		}
-
-		scale.Spec.Replicas = int32(newScale)
-		scale.Status.Replicas = int32(newScale)
-
-		scale, err = statefulSets.UpdateScale(context.Background(), ProxyStatefulSet, scale, metav1.UpdateOptions{})
+		_, err := statefulSets.Patch(context.Background(), ProxyStatefulSet, types.MergePatchType, patch, metav1.PatchOptions{}, "scale")
 		if err != nil {
-			debugPrint(1, "[!] Error updating StatefulSet's scale (try %v): %s", retry, err)
+			debugPrint(1, "[!] Error patching StatefulSet's scale (try %v): %s", retry, err)
 			continue
 		}
 
+		recordScaleEvent(int(proxies.Count), newScale)
+
 		proxies.Count = int64(newScale)
-		return
+		return true
 	}
 
 	log.Fatalf("[!] Failed to scale up after %v tries", retries)
+	return false
 }
 
-// Scales up if we are the last proxy and have not hit the max proxies
+// Scales up if we are the last proxy and have not hit the max proxies, through the leader
 func scaleUp() bool {
-	if proxies.Count+1 <= config.MaxProxies && ProxyOrdinal+1 == proxies.Count {
-		proxies.CountMu.Lock()
-		defer proxies.CountMu.Unlock()
-
-		if proxies.Count+1 <= config.MaxProxies && ProxyOrdinal+1 == proxies.Count {
-			scaleStatefulSet(int(ProxyOrdinal) + 2)
-			return true
-		}
+	count := atomic.LoadInt64(&proxies.Count)
+	if count+1 <= currentConfig().MaxProxies && ProxyOrdinal+1 == count {
+		return scaleThroughLeader(count, int(ProxyOrdinal)+2)
 	}
 
 	return false
 }
 
-// Scales down if we are the last proxy and have not hit the min proxies
+// Scales down if we are the last proxy and have not hit the min proxies, through the leader
 func scaleDown() bool {
-	if proxies.Count-1 >= config.MinProxies && ProxyOrdinal+1 == proxies.Count {
-		proxies.CountMu.Lock()
-		defer proxies.CountMu.Unlock()
-
-		if proxies.Count-1 >= config.MinProxies && ProxyOrdinal+1 == proxies.Count {
-			scaleStatefulSet(int(ProxyOrdinal))
-			return true
-		}
+	count := atomic.LoadInt64(&proxies.Count)
+	if count-1 >= currentConfig().MinProxies && ProxyOrdinal+1 == count {
+		return scaleThroughLeader(count, int(ProxyOrdinal))
 	}
 
 	return false
@@ -162,10 +345,15 @@ func writeProxyMetrics(w http.ResponseWriter, proxyStatus int) {
 		atomic.AddUint64(&state.DenyCounter, 1)
 	}
 
-	free := int(float64(config.MaxRequests)*config.MaxLoadFactor) - int(state.ActiveRequests)
+	recordResponse(proxyStatus)
+
+	free := currentConfig().CapacityStrategy.Free()
 
-	// If we have no more free requests based on load factor, try to scale up
-	if free <= 0 {
+	// A draining proxy takes no more requests and must not scale up
+	if atomic.LoadInt32(&state.Draining) != 0 {
+		free = 0
+	} else if free <= 0 {
+		// If we have no more free requests based on load factor, try to scale up
 		go scaleUp()
 	}
 
@@ -173,10 +361,30 @@ func writeProxyMetrics(w http.ResponseWriter, proxyStatus int) {
 	w.Header().Set("Proxy-Free", strconv.Itoa(free))
 	w.Header().Set("Proxy-Ordinal", strconv.Itoa(int(ProxyOrdinal)))
 	w.Header().Set("Proxy-Status", strconv.Itoa(proxyStatus))
+	w.Header().Set("Proxy-Leader", currentLeader())
+	w.Header().Set("Proxy-Protocol-Version", strconv.Itoa(ProtocolVersion))
+	w.Header().Set("Proxy-Epoch", strconv.FormatInt(Epoch, 10))
+	if count := activeSenders(); count > 0 {
+		w.Header().Set("Proxy-Senders", strconv.Itoa(count))
+	}
+
+	// A bounded scale is reported with the pods left to scale up, so senders stop ensuring past it
+	if currentConfig().MaxProxies != math.MaxInt64 {
+		headroom := currentConfig().MaxProxies - proxies.Count
+		if headroom < 0 {
+			headroom = 0
+		}
+
+		w.Header().Set("Proxy-Max-Proxies", strconv.FormatInt(currentConfig().MaxProxies, 10))
+		w.Header().Set("Proxy-Headroom", strconv.FormatInt(headroom, 10))
+	}
 
 	proxies.List.RLock()
 	w.Header().Set("Proxy-Version", proxies.List.Version)
 	w.Header().Set("Proxy-List", proxies.List.IPs)
+	if proxies.List.Encoding != "" {
+		w.Header().Set("Proxy-List-Encoding", proxies.List.Encoding)
+	}
 	proxies.List.RUnlock()
 }
 
@@ -184,51 +392,161 @@ func writeProxyMetrics(w http.ResponseWriter, proxyStatus int) {
 func httpHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	// Handle ensure requests
+	// Count the sender before responding, so even its first ping reports it
+	recordSender(proxySender(r.Header))
+
+	// Proxy-Leader is only trusted from the proxies forwarding requests to this one as the leader
+	if !isForwardedToLeader(r) {
+		r.Header.Del("Proxy-Leader")
+	}
+
+	// Handle the scale requests of the last proxy, then ensure requests
+	if handleScaleRequest(w, r) {
+		return
+	}
+
 	if handleEnsureRequest(w, r) {
 		return
 	}
 
+	// Handle follow-up requests of earlier 202 responses
+	if handleAffinityRequest(w, r) {
+		return
+	}
+
 	// Forward-To is the host to forward the request to
 	forwardTo := strings.TrimSpace(r.Header.Get("Forward-To"))
 
 	// Is there no Forward-To header?
 	if forwardTo == "" {
-		// If so, return metrics.
+		// If so, submit batches of requests
+		if isBatchRequest(r) {
+			handleBatchRequest(w, r)
+			return
+		}
+
+		// If so, answer the statuses of the requests of earlier 202 responses
+		if isStatusQuery(r) {
+			handleStatusQuery(w, r)
+			return
+		}
+
+		// If so, return the capabilities to OPTIONS requests and metrics to pings
+		if r.Method == http.MethodOptions {
+			writeProxyCapabilities(w)
+			return
+		}
+
 		writeProxyMetrics(w, http.StatusOK)
 		return
 	}
 
-	// Have we fully maxed out?
-	if state.ActiveRequests >= int64(config.MaxRequests) {
+	// Load the config once, so the request sees one version of it throughout
+	current := currentConfig()
+
+	// Inject the faults of the chaos mode
+	w, ok := injectChaos(w, current.Chaos)
+	if !ok {
+		return
+	}
+
+	receivedAt := time.Now()
+
+	// Continue the sender's trace, the queue span lasts until the request is forwarded
+	span := startSpanFromRequest("proxy", r.Header)
+	queueSpan := span.startChild("queue")
+
+	// Is the request too large to take?
+	if rejectOversizedRequest(w, r) {
+		return
+	}
+
+	// Is the request scheduled for later?
+	if handleScheduledRequest(w, r, forwardTo) {
+		return
+	}
+
+	// Proxy-TTL is the time in milliseconds the request can wait to be forwarded before being dropped
+	deadline, err := requestDeadline(r.Header, receivedAt)
+	if err != nil {
+		writeProxyMetrics(w, http.StatusBadRequest)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	recipientTimeout, err := requestTimeout(r.Header)
+	if err != nil {
+		writeProxyMetrics(w, http.StatusBadRequest)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Have we (or the tenant) fully maxed out even after queueing, or are we draining?
+	tenant := requestTenant(r)
+	if atomic.LoadInt32(&state.Draining) != 0 || !admitRequest(parsePriority(r.Header.Get("Proxy-Priority")), requestSender(r), tenant, deadline) {
+		// Did the request expire while queued?
+		if isExpired(deadline) {
+			writeExpiredRequest(w, r, forwardTo, tenant, receivedAt)
+			return
+		}
+
 		// If so, deny the request and return metrics
 		writeProxyMetrics(w, http.StatusTooManyRequests)
 		w.WriteHeader(http.StatusTooManyRequests)
 		return
 	}
 
-	// Perform a double check after locking
-	state.ActiveRequestsMu.Lock()
-	if state.ActiveRequests >= int64(config.MaxRequests) {
-		state.ActiveRequestsMu.Unlock()
-		writeProxyMetrics(w, http.StatusTooManyRequests)
-		w.WriteHeader(http.StatusTooManyRequests)
+	// Was the request admitted too late?
+	if isExpired(deadline) {
+		releaseRequest(tenant)
+		writeExpiredRequest(w, r, forwardTo, tenant, receivedAt)
 		return
 	}
 
-	// Increase the active request count
-	atomic.AddInt64(&state.ActiveRequests, 1)
-	debugPrint(3, "[>] Active Requests: %v", state.ActiveRequests)
+	// Can the request be served from the cache? Hits are admitted like other requests, so they count toward the
+	// sender's and tenant's limits
+	if cached := lookupCachedResponse(r.Method, forwardTo, r.Header); cached != nil {
+		releaseRequest(tenant)
+		writeCachedResponse(w, cached)
+		return
+	}
+
+	if atomic.LoadInt64(&state.ActiveRequests) > idleRequests() {
+		// No longer idle, restart the timer
+		resetIdleShutdown()
+	}
 
-	state.ActiveRequestsMu.Unlock()
+	debugPrint(3, "[>] Active Requests: %v", atomic.LoadInt64(&state.ActiveRequests))
 
-	// Delete the Forward-To header for when we copy the request to proxy it
+	// Stream the request like a reverse proxy while there is capacity to spare
+	if recipient, ok := recipientAdapterOf(r.Header.Get("Proxy-Recipient")); ok && shouldStreamRequest(r, recipient, current) {
+		if target, err := url.Parse(forwardTo); err == nil && target.Host != "" {
+			queueSpan.end(nil)
+			streamRequest(w, r, target, recipient, recipientTimeout, tenant, span, current)
+			return
+		}
+	}
+
+	// Delete the proxy headers for when we copy the request to proxy it
 	r.Header.Del("Forward-To")
+	r.Header.Del("Proxy-Timeout")
+	r.Header.Del("Proxy-TTL")
+	r.Header.Del("Proxy-Protocol-Version")
 
 	// Read the body to copy it
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		atomic.AddInt64(&state.ActiveRequests, -1)
+		releaseRequest(tenant)
+
+		// Did the body exceed maxBodyBytes?
+		if current.MaxBodyBytes > 0 && int64(len(body)) >= current.MaxBodyBytes {
+			writeProxyMetrics(w, http.StatusRequestEntityTooLarge)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
 		writeProxyMetrics(w, http.StatusInternalServerError)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -237,7 +555,7 @@ func httpHandler(w http.ResponseWriter, r *http.Request) {
 	// Create the proxy request
 	proxyRequest, err := http.NewRequest(r.Method, forwardTo, bytes.NewReader(body))
 	if err != nil {
-		atomic.AddInt64(&state.ActiveRequests, -1)
+		releaseRequest(tenant)
 		writeProxyMetrics(w, http.StatusInternalServerError)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -246,87 +564,273 @@ func httpHandler(w http.ResponseWriter, r *http.Request) {
 	// Copy the headers
 	proxyRequest.Header = r.Header
 
+	// Apply the policies of the platform, then adapt the request to the kind of recipient
+	recipient, ok := recipientAdapterOf(r.Header.Get("Proxy-Recipient"))
+	r.Header.Del("Proxy-Recipient")
+	if body, err = applyRequestTransforms(current, proxyRequest, body); err != nil || !ok || recipient.PrepareRequest(proxyRequest, body) != nil {
+		releaseRequest(tenant)
+		writeProxyMetrics(w, http.StatusInternalServerError)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Has this request already been submitted?
+	var idempotentReq *idempotentRequest
+	if key := strings.TrimSpace(r.Header.Get("Proxy-Idempotency-Key")); key != "" && current.IdempotencyTTL > 0 {
+		key = idempotencyScope(tenantName(r), requestSender(r), r.Method, forwardTo, key)
+		outcome, duplicate, full := beginIdempotentRequest(key)
+		if duplicate {
+			releaseRequest(tenant)
+			writeIdempotentOutcome(w, outcome)
+			return
+		}
+
+		// Deny rather than forward requests that could not be deduplicated
+		if full {
+			releaseRequest(tenant)
+			writeProxyMetrics(w, http.StatusTooManyRequests)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		idempotentReq = &idempotentRequest{Key: key, Outcome: outcome}
+	}
+
+	// Fast fail if the recipient is unhealthy
+	breaker := breakerFor(proxyRequest.URL.Host)
+	if !breaker.Allow() {
+		releaseRequest(tenant)
+		w.Header().Set("Proxy-Breaker", BreakerOpen)
+		writeProxyMetrics(w, http.StatusServiceUnavailable)
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		if idempotentReq != nil {
+			finishIdempotentRequest(idempotentReq.Key, idempotentReq.Outcome, nil, nil, errBreakerOpen)
+		}
+
+		return
+	}
+
+	// Proxy-Request-Id identifies the request in the access log, generate one if the sender did not
+	requestID := strings.TrimSpace(r.Header.Get("Proxy-Request-Id"))
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	accessLog := &AccessLogEntry{
+		Time:         receivedAt,
+		RequestID:    requestID,
+		Sender:       r.Header.Get("Proxy-Sender"),
+		Method:       r.Method,
+		Target:       forwardTo,
+		QueueWait:    float64(time.Since(receivedAt)) / float64(time.Millisecond),
+		RequestBytes: int64(len(body)),
+		TraceID:      span.TraceID,
+	}
+
+	queueSpan.end(nil)
+
 	// Do the actual request
-	doAsyncProxyRequest(w, proxyRequest, strings.ToLower(strings.TrimSpace(r.Header.Get("Insecure-Skip-Verify"))) == "true")
+	doAsyncProxyRequest(w, proxyRequest, forwardOptions{
+		InsecureSkipVerify: strings.ToLower(strings.TrimSpace(r.Header.Get("Insecure-Skip-Verify"))) == "true",
+		RecipientTimeout:   recipientTimeout,
+		Breaker:            breaker,
+		Idempotency:        idempotentReq,
+		AccessLog:          accessLog,
+		Span:               span,
+		Tenant:             tenant,
+		Recipient:          recipient,
+		Config:             current,
+	})
+}
+
+// Per request options of a forwarded request
+type forwardOptions struct {
+	// InsecureSkipVerify skips verifying the recipient's certificate
+	InsecureSkipVerify bool
+
+	// RecipientTimeout is the time to wait for the recipient before failing, 0 for no timeout
+	RecipientTimeout time.Duration
+
+	// Breaker is the circuit breaker toward the recipient's host
+	Breaker *circuitBreaker
+
+	// Idempotency is set if the request has a Proxy-Idempotency-Key
+	Idempotency *idempotentRequest
+
+	// AccessLog is the access log entry of the request
+	AccessLog *AccessLogEntry
+
+	// Span is the span of the request on the proxy
+	Span *Span
+
+	// Tenant is the tenant whose limits the request counts toward
+	Tenant string
+
+	// Recipient is the adapter to the kind of recipient
+	Recipient RecipientAdapter
+
+	// Config is the config loaded when the request was received
+	Config *proxyConfig
+}
+
+// Writes the headers describing a forwarded request
+func writeForwardHeaders(w http.ResponseWriter, options forwardOptions) {
+	w.Header().Set("Proxy-Breaker", options.Breaker.State())
+	w.Header().Set("Proxy-Request-Id", options.AccessLog.RequestID)
+}
+
+// Returns the time to wait for the recipient before failing, from the Proxy-Timeout in milliseconds, 0 to wait
+// indefinitely
+func requestTimeout(header http.Header) (time.Duration, error) {
+	timeout := strings.TrimSpace(header.Get("Proxy-Timeout"))
+	if timeout == "" {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseUint(timeout, 10, 64)
+	if err != nil || value > uint64(math.MaxInt64/time.Millisecond) {
+		return 0, fmt.Errorf("Proxy-Timeout is not a number of milliseconds: %v", timeout)
+	}
+
+	return time.Duration(value) * time.Millisecond, nil
 }
 
+// MaxEnsureRequests is the most requests an ensure request can expect, and the most proxies its constraints can name,
+// bounding the scaling arithmetic well below overflows
+const MaxEnsureRequests = math.MaxUint32
+
 // Handles an ensure request if it exists, returns false if none exists
 func handleEnsureRequest(w http.ResponseWriter, r *http.Request) bool {
-	ensure := strings.TrimSpace(r.Header.Get("Ensure-Requests"))
+	ensure := strings.TrimSpace(r.Header.Get("Proxy-Ensure-Requests"))
+	if ensure == "" {
+		// Older clients send the header without the prefix
+		ensure = strings.TrimSpace(r.Header.Get("Ensure-Requests"))
+	}
+
 	if ensure == "" {
 		return false
 	}
 
-	// Ensure-Requests are the number of requests to expect
+	// Proxy-Ensure-Requests are the number of requests to expect
 	ensureRequests, err := strconv.ParseUint(ensure, 10, 64)
-	if err != nil {
-		writeProxyMetrics(w, http.StatusInternalServerError)
+	if err != nil || ensureRequests > MaxEnsureRequests {
+		writeProxyMetrics(w, http.StatusBadRequest)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Proxy-Ensure-Requests must be a number of requests up to %v", uint64(MaxEnsureRequests))))
 		return true
 	}
 
-	// Determine how many proxies are needed based on the ideal load amount for each proxy
-	// Why does Go not have a min that works with ints?
-	desiredProxyCount := int64(math.Min(float64(config.MaxProxies), float64(int64(ensureRequests)/int64(float64(config.MaxRequests)*config.MaxLoadFactor))))
+	// Senders may bound the proxies they ask for, and the proxies added at once, to bound their cost
+	var senderMax, senderStep uint64
+	for _, constraint := range []struct {
+		name  string
+		value *uint64
+	}{
+		{"Proxy-Ensure-Max-Proxies", &senderMax},
+		{"Proxy-Ensure-Step", &senderStep},
+	} {
+		if value := strings.TrimSpace(r.Header.Get(constraint.name)); value != "" {
+			*constraint.value, err = strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				writeProxyMetrics(w, http.StatusBadRequest)
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("%v must be a number of proxies", constraint.name)))
+				return true
+			}
+
+			// Larger constraints bound nothing more
+			if *constraint.value > MaxEnsureRequests {
+				*constraint.value = MaxEnsureRequests
+			}
+		}
+	}
+
+	// Only the leader makes scaling decisions, unless the request was already forwarded by another proxy
+	if r.Header.Get("Proxy-Leader") == "" && forwardEnsureRequest(w, r, ensure) {
+		return true
+	}
+
+	desiredProxyCount, capped := desiredProxyCount(int64(ensureRequests))
+
+	// The sender's own maximum being lower, it is the one reached
+	if senderMax > 0 && desiredProxyCount > int64(senderMax) {
+		desiredProxyCount = int64(senderMax)
+		capped = false
+	}
+
+	if senderStep > 0 && desiredProxyCount > proxies.Count+int64(senderStep) {
+		desiredProxyCount = proxies.Count + int64(senderStep)
+	}
 
 	// Scale up, if necessary
+	scaled := false
 	if proxies.Count < desiredProxyCount {
 		proxies.CountMu.Lock()
 
 		if proxies.Count < desiredProxyCount {
-			scaleStatefulSet(int(desiredProxyCount))
+			scaled = scaleStatefulSet(int(desiredProxyCount))
 		}
 
 		proxies.CountMu.Unlock()
 	}
 
+	// Refresh the proxy list so the response reports the new version
+	if scaled {
+		statefulSet, err := kubeClient.AppsV1().StatefulSets(ProxyNamespace).Get(context.Background(), ProxyStatefulSet, metav1.GetOptions{})
+		if err == nil {
+			err = updateProxyList(statefulSet)
+		}
+
+		if err != nil {
+			debugPrint(1, "[!] Failed to refresh proxy list after scaling: %v", err)
+		}
+	}
+
+	// The requests need more proxies than the maximum, ensuring more is futile until it is raised
+	if capped {
+		w.Header().Set("Proxy-Max-Scale", "true")
+	}
+
 	writeProxyMetrics(w, http.StatusOK)
 	return true
 }
 
+// Determines how many proxies are needed for the expected requests on top of the current load, capped to the
+// maximum, and whether they were
+func desiredProxyCount(ensureRequests int64) (int64, bool) {
+	target := int64(targetRequests())
+	if target <= 0 {
+		target = 1
+	}
+
+	// The load of this proxy is taken as representative of every proxy
+	demand := ensureRequests + atomic.LoadInt64(&state.ActiveRequests)*proxies.Count
+
+	// Round up, as a partially loaded proxy still has to exist
+	desired := (demand + target - 1) / target
+	if desired > currentConfig().MaxProxies {
+		return currentConfig().MaxProxies, true
+	}
+
+	return desired, false
+}
+
 // Does an async proxy request and returns the status code if returned before the timeout
-func doAsyncProxyRequest(w http.ResponseWriter, proxyRequest *http.Request, insecureSkipVerify bool) {
+func doAsyncProxyRequest(w http.ResponseWriter, proxyRequest *http.Request, options forwardOptions) {
 	timeoutChan := make(chan bool, 2)
 
+	// Keep the outcome for follow-ups in case the request outlives the proxy timeout
+	job := newAffinityJob(proxyRequest.Context())
+	proxyRequest = proxyRequest.WithContext(job.Context)
+
 	var requestResponse *http.Response
 	var requestResponseBody []byte
 	var requestError error
 
 	// Start the request
 	go func() {
-		defer func() {
-			// Restart the timer
-			resetIdleShutdown()
-
-			// Decrement the current number of active requests
-			atomic.AddInt64(&state.ActiveRequests, -1)
-			debugPrint(3, "[<] Active requests: %v", state.ActiveRequests)
-		}()
-
-		// Do the request
-		var httpClient http.Client
-		if insecureSkipVerify {
-			httpClient.Transport = &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}
-		}
-
-		requestResponse, requestError = httpClient.Do(proxyRequest)
-
-		// Was there no error?
-		if requestError == nil {
-			defer requestResponse.Body.Close()
-
-			// Read the body
-			if body, err := ioutil.ReadAll(requestResponse.Body); err == nil {
-				requestResponseBody = body
-			} else {
-				requestError = err
-
-				debugPrint(2, "[!] Failed to read request to %v response body from: %v", proxyRequest.URL.String(), requestError)
-			}
-		} else {
-			debugPrint(2, "[!] Request to %v failed: %v", proxyRequest.URL.String(), requestError)
-		}
+		requestResponse, requestResponseBody, requestError = forwardRequest(proxyRequest, options, job)
 
 		// We did not timeout, request finished
 		timeoutChan <- false
@@ -335,13 +839,20 @@ func doAsyncProxyRequest(w http.ResponseWriter, proxyRequest *http.Request, inse
 	// Start the timeout
 	go func() {
 		// Sleep for the timeout then notify the timeout channel
-		time.Sleep(time.Duration(config.ProxyTimeout) * time.Millisecond)
+		time.Sleep(time.Duration(currentConfig().ProxyTimeout) * time.Millisecond)
 		timeoutChan <- true
 	}()
 
 	if <-timeoutChan {
 		// We did timeout, request still being processed
+		if token := registerAffinityJob(job); token != "" {
+			w.Header().Set("Proxy-Affinity", token)
+		}
+
+		writeForwardHeaders(w, options)
 		writeProxyMetrics(w, http.StatusAccepted)
+		options.AccessLog.finishResponse(http.StatusAccepted)
+		options.Span.end(map[string]string{"proxy.status": strconv.Itoa(http.StatusAccepted)})
 		w.WriteHeader(http.StatusAccepted)
 	} else {
 		// We did not timeout, try to copy the response back
@@ -358,13 +869,28 @@ func doAsyncProxyRequest(w http.ResponseWriter, proxyRequest *http.Request, inse
 				}
 			}
 
+			writeForwardHeaders(w, options)
 			writeProxyMetrics(w, http.StatusOK)
+			options.AccessLog.finishResponse(http.StatusOK)
+			options.Span.end(map[string]string{"proxy.status": strconv.Itoa(http.StatusOK)})
 			w.WriteHeader(requestResponse.StatusCode)
 
-			w.Write(requestResponseBody)
+			if responseHasBody(proxyRequest.Method, requestResponse.StatusCode) {
+				w.Write(requestResponseBody)
+			}
+
+			// Copy trailers (e.g. the status of gRPC responses)
+			for k, values := range requestResponse.Trailer {
+				for _, v := range values {
+					w.Header().Add(http.TrailerPrefix+k, v)
+				}
+			}
 		} else {
 			// The request entirely failed
+			writeForwardHeaders(w, options)
 			writeProxyMetrics(w, http.StatusInternalServerError)
+			options.AccessLog.finishResponse(http.StatusInternalServerError)
+			options.Span.end(map[string]string{"proxy.status": strconv.Itoa(http.StatusInternalServerError)})
 			w.WriteHeader(http.StatusInternalServerError)
 
 			// Send error in body
@@ -373,12 +899,122 @@ func doAsyncProxyRequest(w http.ResponseWriter, proxyRequest *http.Request, inse
 	}
 }
 
+// Forwards an admitted request to the recipient and releases it, storing the outcome in the job
+func forwardRequest(proxyRequest *http.Request, options forwardOptions, job *affinityJob) (*http.Response, []byte, error) {
+	var requestResponse *http.Response
+	var requestResponseBody []byte
+	var requestError error
+
+	atomic.StoreInt32(&job.Forwarding, 1)
+
+	defer func() {
+		// Decrement the current number of active requests
+		activeRequests := releaseRequest(options.Tenant)
+		debugPrint(3, "[<] Active requests: %v", activeRequests)
+
+		// Restart the timer if we were not idle until now
+		if activeRequests >= idleRequests() {
+			resetIdleShutdown()
+		}
+	}()
+
+	// Do the request
+	httpClient := http.Client{
+		Timeout:   options.RecipientTimeout,
+		Transport: options.Recipient.Transport(proxyRequest.URL, options.Config.recipientTLSConfig(proxyRequest.URL.Host, options.InsecureSkipVerify)),
+	}
+
+	// Propagate the trace to the recipient
+	forwardSpan := options.Span.startChild("forward")
+	proxyRequest.Header.Set("Traceparent", forwardSpan.traceParent())
+
+	requestStart := time.Now()
+	var attempts int64
+	requestResponse, attempts, requestError = doRecipientRequest(&httpClient, traceRecipientConnections(proxyRequest))
+
+	// Was there no error?
+	if requestError == nil {
+		defer requestResponse.Body.Close()
+
+		// Read the body, adapted back for the sender
+		if body, err := ioutil.ReadAll(requestResponse.Body); err == nil {
+			requestResponseBody, requestError = options.Recipient.AdaptResponse(requestResponse, body)
+			if requestError == nil {
+				requestResponseBody, requestError = applyResponseTransforms(options.Config, requestResponse, requestResponseBody)
+			}
+		} else {
+			requestError = err
+
+			debugPrint(2, "[!] Failed to read request to %v response body from: %v", proxyRequest.URL.String(), requestError)
+		}
+
+		recordRecipientLatency(time.Since(requestStart))
+		updateRecipientLatencyAverage(time.Since(requestStart))
+	} else {
+		debugPrint(2, "[!] Request to %v failed: %v", proxyRequest.URL.String(), requestError)
+	}
+
+	recordRecipientResult(requestError)
+	options.Breaker.Record(requestResponse, requestError)
+
+	recipientStatus := 0
+	if requestError == nil {
+		recipientStatus = requestResponse.StatusCode
+	}
+
+	options.AccessLog.finishRecipient(recipientStatus, len(requestResponseBody), time.Since(requestStart), requestError)
+
+	forwardAttributes := map[string]string{"http.url": proxyRequest.URL.String(), "http.method": proxyRequest.Method}
+	if requestError != nil {
+		forwardAttributes["error"] = requestError.Error()
+	} else {
+		forwardAttributes["http.status_code"] = strconv.Itoa(recipientStatus)
+	}
+
+	forwardSpan.end(forwardAttributes)
+
+	if options.Idempotency != nil {
+		finishIdempotentRequest(options.Idempotency.Key, options.Idempotency.Outcome, requestResponse, requestResponseBody, requestError)
+	}
+
+	finishAffinityJob(job, requestResponse, requestResponseBody, requestError)
+	reportDelivery(proxyRequest, options, job, attempts, time.Since(requestStart), requestResponse, requestResponseBody, requestError)
+
+	if requestError == nil {
+		storeCachedResponse(proxyRequest, options.AccessLog.Target, requestResponse, requestResponseBody)
+	}
+
+	return requestResponse, requestResponseBody, requestError
+}
+
 // Starts the HTTP server
 func startServer() {
-	http.HandleFunc(config.HTTP.Path, httpHandler)
+	http.HandleFunc(currentConfig().HTTP.Path, httpHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc(SendersPath, sendersHandler)
+	http.HandleFunc(LivenessPath, livenessHandler)
+	http.HandleFunc(ReadinessPath, readinessHandler)
+
+	// Serve over TLS if a certificate is configured
+	if currentConfig().TLS.CertFile != "" {
+		if err := loadTLS(); err != nil {
+			log.Fatalf("[!] Failed to load TLS: %v", err)
+		}
+
+		go watchTLS()
+
+		server := &http.Server{
+			Addr:      fmt.Sprintf(":%v", currentConfig().HTTP.Port),
+			Handler:   requireClientCert(rejectConnect(http.DefaultServeMux)),
+			TLSConfig: newServerTLSConfig(),
+		}
+
+		debugPrint(1, "[+] Listening with TLS on port %v (path \"%v\")", currentConfig().HTTP.Port, currentConfig().HTTP.Path)
+		log.Fatalln(server.ListenAndServeTLS("", ""))
+	}
 
-	debugPrint(1, "[+] Listening on port %v (path \"%v\")", config.HTTP.Port, config.HTTP.Path)
-	log.Fatalln(http.ListenAndServe(fmt.Sprintf(":%v", config.HTTP.Port), nil))
+	debugPrint(1, "[+] Listening on port %v (path \"%v\")", currentConfig().HTTP.Port, currentConfig().HTTP.Path)
+	log.Fatalln(http.ListenAndServe(fmt.Sprintf(":%v", currentConfig().HTTP.Port), rejectConnect(http.DefaultServeMux)))
 }
 
 // Returns the proxy's ordinal, which represents the proxy's current index in the StatefulSet
@@ -393,12 +1029,78 @@ func getProxyOrdinal(podName string) int64 {
 
 // Resets the idle shutdown timer if applicable
 func resetIdleShutdown() {
-	state.IdleShutdown.LastTime = time.Now()
+	atomic.StoreInt64(&state.IdleShutdown.LastTime, time.Now().UnixNano())
+}
+
+// Returns the number of active requests at or under which the proxy counts as idle
+func idleRequests() int64 {
+	return int64(float64(targetRequests()) * currentConfig().IdleLoadFactor)
 }
 
 // Should we do an idle shutdown?
 func shouldDoIdleShutdown() bool {
-	return ProxyOrdinal != 0 && ProxyOrdinal >= config.MinProxies && state.ActiveRequests == 0 && time.Since(state.IdleShutdown.LastTime) >= time.Duration(config.IdleTimeout)*time.Second
+	return ProxyOrdinal != 0 && ProxyOrdinal >= currentConfig().MinProxies && atomic.LoadInt64(&state.ActiveRequests) <= idleRequests() && atomic.LoadInt64(&state.ScheduledRequests) == 0 && time.Since(time.Unix(0, atomic.LoadInt64(&state.IdleShutdown.LastTime))) >= time.Duration(currentConfig().IdleTimeout)*time.Second
+}
+
+// Stops taking new requests and waits for the active requests to finish
+func drain() {
+	atomic.StoreInt32(&state.Draining, 1)
+	debugPrint(2, "[+] Draining %v active requests", atomic.LoadInt64(&state.ActiveRequests))
+
+	deadline := time.Now().Add(time.Duration(currentConfig().DrainTimeout) * time.Second)
+	for atomic.LoadInt64(&state.ActiveRequests) > 0 {
+		if time.Now().After(deadline) {
+			debugPrint(1, "[!] Cancelling %v active requests left after draining for %vs", atomic.LoadInt64(&state.ActiveRequests), currentConfig().DrainTimeout)
+
+			draining.Lock()
+			draining.Cancel()
+			draining.Unlock()
+
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Resumes taking requests after draining, with a new drain context for them
+func undrain() {
+	draining.Lock()
+	draining.Cancel()
+	draining.Context, draining.Cancel = context.WithCancel(context.Background())
+	draining.Unlock()
+
+	atomic.StoreInt32(&state.Draining, 0)
+}
+
+// Context cancelled once draining times out, which the forwarded requests are cancelled with
+var draining struct {
+	sync.Mutex
+	Context context.Context
+	Cancel  context.CancelFunc
+}
+
+func init() {
+	draining.Context, draining.Cancel = context.WithCancel(context.Background())
+}
+
+// Returns a context of the parent also cancelled once draining times out, which must be cancelled when done
+func withDrain(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	draining.Lock()
+	drained := draining.Context.Done()
+	draining.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-drained:
+			cancel()
+		}
+	}()
+
+	return ctx, cancel
 }
 
 // Sets up the idle shutdown timer
@@ -413,7 +1115,10 @@ func setupIdleShutdown() {
 	// Waits for the idle shutdown timer to finish
 	go func() {
 		for {
-			if shouldDoIdleShutdown() {
+			if shouldDoIdleShutdown() && ProxyOrdinal+1 == proxies.Count {
+				// Only the highest ordinal proxy is removed, so finish its requests first
+				drain()
+
 				state.IdleShutdown.Lock()
 
 				if shouldDoIdleShutdown() && scaleDown() {
@@ -422,6 +1127,9 @@ func setupIdleShutdown() {
 				}
 
 				state.IdleShutdown.Unlock()
+
+				// We are no longer the last proxy or scaling down failed, resume taking requests
+				undrain()
 			}
 
 			time.Sleep(time.Second)
@@ -430,33 +1138,61 @@ func setupIdleShutdown() {
 }
 
 // Updates the HTTP config from any containers valid readiness probe
+// If the probe targets one of the health endpoints, the proxy is served on "/"
 func updateHTTPConfig(containers []corev1.Container) error {
 	// Don't update if already valid
-	if config.HTTP.Port != 0 {
+	if currentConfig().HTTP.Port != 0 {
 		return nil
 	}
 
+	var port int
+	var path string
 	for _, c := range containers {
 		if readinessProbe := c.ReadinessProbe; readinessProbe != nil {
 			if httpGet := readinessProbe.HTTPGet; httpGet != nil {
-				config.HTTP.Path = httpGet.Path
-				config.HTTP.Port = httpGet.Port.IntValue()
+				port = httpGet.Port.IntValue()
+
+				if httpGet.Path != LivenessPath && httpGet.Path != ReadinessPath {
+					path = httpGet.Path
+				}
 				break
 			}
 		}
 	}
 
-	if config.HTTP.Port == 0 {
+	if port == 0 {
 		return fmt.Errorf("found no valid HTTP get readiness probe in container spec")
 	}
 
-	if config.HTTP.Path == "" {
-		config.HTTP.Path = "/"
+	if path == "" {
+		path = "/"
 	}
 
+	updateConfig(func(next *proxyConfig) {
+		next.HTTP.Port = port
+		next.HTTP.Path = path
+	})
+
 	return nil
 }
 
+// Compresses the proxy list with gzip and base64 when it is larger than config.MaxProxyListBytes, so large deployments
+// fit in the header size limits of ingresses, returning the list and its Proxy-List-Encoding
+func encodeProxyList(list string) (string, string) {
+	current := currentConfig()
+
+	if current.MaxProxyListBytes == 0 || int64(len(list)) <= current.MaxProxyListBytes {
+		return list, ""
+	}
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write([]byte(list))
+	writer.Close()
+
+	return base64.StdEncoding.EncodeToString(buffer.Bytes()), "gzip"
+}
+
 // Updates the proxy list from the StatefulSet
 func updateProxyList(set *v1.StatefulSet) error {
 	// Get the pods that are part of the current StatefulSet
@@ -488,6 +1224,9 @@ func updateProxyList(set *v1.StatefulSet) error {
 	var newProxyList strings.Builder
 	newProxyList.WriteRune('{')
 
+	newPodIPs := map[string]string{}
+	newRunningPodIPs := map[string]string{}
+
 	// Construct the list of pods that are running and pass the readiness check
 	for ordinal, pod := range podList.Items {
 		readinessCheck := false
@@ -499,21 +1238,31 @@ func updateProxyList(set *v1.StatefulSet) error {
 			}
 		}
 
+		if pod.Status.Phase == corev1.PodRunning && pod.Status.PodIP != "" {
+			newRunningPodIPs[pod.Name] = pod.Status.PodIP
+		}
+
 		if readinessCheck && pod.Status.Phase == corev1.PodRunning {
 			if newProxyList.Len() != 1 {
 				newProxyList.WriteRune(',')
 			}
 
 			newProxyList.WriteString(fmt.Sprintf(`"%v":"%v"`, ordinal, pod.Status.PodIP))
+			newPodIPs[pod.Name] = pod.Status.PodIP
 		}
 	}
 
 	newProxyList.WriteRune('}')
 
+	ips, encoding := encodeProxyList(newProxyList.String())
+
 	// Update the active proxies list
 	proxies.List.Lock()
-	proxies.List.IPs = newProxyList.String()
+	proxies.List.IPs = ips
+	proxies.List.Encoding = encoding
 	proxies.List.Version = set.ObjectMeta.ResourceVersion
+	proxies.List.PodIPs = newPodIPs
+	proxies.List.RunningPodIPs = newRunningPodIPs
 	proxies.List.Unlock()
 
 	// Update the number of intended proxies
@@ -568,6 +1317,18 @@ func getOptionalConfigValueFloat(annotations map[string]string, configName strin
 	return value, nil
 }
 
+func getOptionalConfigValueString(annotations map[string]string, configName string, defaultValue string) string {
+	stringValue, ok := annotations[configName]
+	stringValue = strings.TrimSpace(stringValue)
+
+	if !ok || stringValue == "" {
+		debugPrint(1, "[+] Defaulting %v to %v", configName, defaultValue)
+		return defaultValue
+	}
+
+	return stringValue
+}
+
 // Updates the proxy config from the annotations
 func updateProxyConfig(annotations map[string]string) error {
 	// config.MinProxies is the minimum number of proxy pods
@@ -616,29 +1377,359 @@ func updateProxyConfig(annotations map[string]string) error {
 		return err
 	}
 
+	// config.DrainTimeout is the time in seconds the proxy waits for its active requests before scaling down
+	newDrainTimeout, err := getOptionalConfigValue(annotations, "drainTimeout", 25)
+	if err != nil {
+		return err
+	}
+
 	// config.DebugLevel is the debug verbosity
 	newDebugLevel, err := getOptionalConfigValue(annotations, "debugLevel", 0)
 	if err != nil {
 		return err
 	}
 
+	// config.MaxRecipientFailures is the number of consecutive recipient failures before reporting them unhealthy (0 disables)
+	newMaxRecipientFailures, err := getOptionalConfigValue(annotations, "maxRecipientFailures", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.UnreadySaturation is the fraction of maxRequests active at which the proxy is unready (0 disables)
+	newUnreadySaturation, err := getOptionalConfigValueFloat(annotations, "unreadySaturation", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.UnreadyRecipientFailures is the number of consecutive recipient failures at which the proxy is unready (0 disables)
+	newUnreadyRecipientFailures, err := getOptionalConfigValue(annotations, "unreadyRecipientFailures", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.CapacityStrategy is how the free requests of the proxy are computed
+	newCapacityStrategyName := getOptionalConfigValueString(annotations, "capacityStrategy", "fixed")
+	newCapacityStrategy, ok := CapacityStrategies[newCapacityStrategyName]
+	if !ok {
+		return fmt.Errorf("capacityStrategy %v does not exist", newCapacityStrategyName)
+	}
+
+	// config.MaxMemory is the heap size in megabytes the memory capacity strategy stays below (0 disables)
+	newMaxMemory, err := getOptionalConfigValue(annotations, "maxMemory", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.TargetLatency is the recipient latency in milliseconds the latency capacity strategy aims for (0 disables)
+	newTargetLatency, err := getOptionalConfigValue(annotations, "targetLatency", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.IdleLoadFactor is the fraction of the target requests under which the last proxy counts as idle
+	newIdleLoadFactor, err := getOptionalConfigValueFloat(annotations, "idleLoadFactor", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.IdempotencyTTL is the time in seconds outcomes of idempotent requests are kept for deduplication (0 disables)
+	newIdempotencyTTL, err := getOptionalConfigValue(annotations, "idempotencyTTL", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.IdempotencyMaxEntries is the maximum number of outcomes of idempotent requests kept
+	newIdempotencyMaxEntries, err := getOptionalConfigValue(annotations, "idempotencyMaxEntries", 10000)
+	if err != nil {
+		return err
+	}
+
+	// config.IdempotencyMaxBytes is the maximum size in bytes of the outcomes of idempotent requests kept (0 disables)
+	newIdempotencyMaxBytes, err := getOptionalConfigValue(annotations, "idempotencyMaxBytes", 64<<20)
+	if err != nil {
+		return err
+	}
+
+	// config.AffinityTTL is the time in seconds outcomes of requests answered with a 202 are kept (0 disables affinity tokens)
+	newAffinityTTL, err := getOptionalConfigValue(annotations, "affinityTTL", 300)
+	if err != nil {
+		return err
+	}
+
+	// config.SenderTTL is the time in seconds a sender is counted after its last request (0 disables Proxy-Senders)
+	newSenderTTL, err := getOptionalConfigValue(annotations, "senderTTL", 10)
+	if err != nil {
+		return err
+	}
+
+	// config.RecipientRetries is the number of times a failed request to a recipient is retried
+	newRecipientRetries, err := getOptionalConfigValue(annotations, "recipientRetries", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.RecipientRetryDelay is the time in milliseconds between retries, multiplied by the attempt
+	newRecipientRetryDelay, err := getOptionalConfigValue(annotations, "recipientRetryDelay", 100)
+	if err != nil {
+		return err
+	}
+
+	// config.RetryAllMethods allows retrying non idempotent methods (e.g. POST) when != 0
+	newRetryAllMethods, err := getOptionalConfigValue(annotations, "retryAllMethods", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.StreamingMode streams requests like a reverse proxy while below the load target when != 0
+	newStreamingMode, err := getOptionalConfigValue(annotations, "streamingMode", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.BreakerFailures is the number of consecutive failures after which requests to a recipient host fast fail (0 disables)
+	newBreakerFailures, err := getOptionalConfigValue(annotations, "breakerFailures", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.BreakerCooldown is the time in seconds an open breaker waits before letting a trial request through
+	newBreakerCooldown, err := getOptionalConfigValue(annotations, "breakerCooldown", 10)
+	if err != nil {
+		return err
+	}
+
+	// config.CacheTTL is the time in seconds responses to GET requests are cached for when they do not set a max-age (0 disables)
+	newCacheTTL, err := getOptionalConfigValue(annotations, "cacheTTL", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.CacheMaxEntries is the maximum number of cached responses
+	newCacheMaxEntries, err := getOptionalConfigValue(annotations, "cacheMaxEntries", 1000)
+	if err != nil {
+		return err
+	}
+
+	// config.MaxProxyListBytes is the size in bytes of the Proxy-List above which it is compressed (0 disables)
+	newMaxProxyListBytes, err := getOptionalConfigValue(annotations, "maxProxyListBytes", 4096)
+	if err != nil {
+		return err
+	}
+
+	// config.MaxHeaderBytes is the maximum size in bytes of a request's headers (0 disables)
+	newMaxHeaderBytes, err := getOptionalConfigValue(annotations, "maxHeaderBytes", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.MaxBodyBytes is the maximum size in bytes of a request's body (0 disables)
+	newMaxBodyBytes, err := getOptionalConfigValue(annotations, "maxBodyBytes", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.TLS are the files of the proxy's TLS certificate, key, optional client CAs to verify senders with and peer
+	// CAs to verify the other proxies with
+	newTLSCertFile := getOptionalConfigValueString(annotations, "tlsCertFile", "")
+	newTLSKeyFile := getOptionalConfigValueString(annotations, "tlsKeyFile", "")
+	newTLSClientCAFile := getOptionalConfigValueString(annotations, "tlsClientCAFile", "")
+	newTLSPeerCAFile := getOptionalConfigValueString(annotations, "tlsPeerCAFile", "")
+
+	if (newTLSCertFile == "") != (newTLSKeyFile == "") {
+		return fmt.Errorf("tlsCertFile and tlsKeyFile must be defined together")
+	}
+
+	// config.AccessLogSink is where the access log of forwarded requests is written
+	newAccessLogSinkName := getOptionalConfigValueString(annotations, "accessLog", "none")
+	newAccessLogSink, ok := AccessLogSinks[newAccessLogSinkName]
+	if !ok {
+		return fmt.Errorf("accessLog %v does not exist", newAccessLogSinkName)
+	}
+
+	// config.DeadLetterSink is where requests dropped for expiring before being forwarded, or failing after a 202,
+	// are sent
+	newDeadLetterSink, err := parseDeadLetterSink(getOptionalConfigValueString(annotations, "deadLetter", "none"))
+	if err != nil {
+		return err
+	}
+
+	// config.DeadLetterFormat is how the dead letters and receipts are encoded, plain JSON or CloudEvents
+	newDeadLetterFormatName := getOptionalConfigValueString(annotations, "deadLetterFormat", "json")
+	newDeadLetterFormat, ok := MessageFormats[newDeadLetterFormatName]
+	if !ok {
+		return fmt.Errorf("deadLetterFormat %v does not exist", newDeadLetterFormatName)
+	}
+
+	// config.DeliveryReceipts sends a receipt of every forwarded request to the dead letter sink when != 0
+	newDeliveryReceipts, err := getOptionalConfigValue(annotations, "deliveryReceipts", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.SpanSink is where the spans of forwarded requests are exported
+	newSpanSink, err := parseSpanSink(getOptionalConfigValueString(annotations, "traceSink", "none"))
+	if err != nil {
+		return err
+	}
+
+	// config.QueueTimeout is the time in milliseconds a request waits for a free slot before being denied (0 disables queueing)
+	newQueueTimeout, err := getOptionalConfigValue(annotations, "queueTimeout", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.MaxQueuedRequests is the maximum number of requests waiting for a free slot
+	newMaxQueuedRequests, err := getOptionalConfigValue(annotations, "maxQueuedRequests", 100)
+	if err != nil {
+		return err
+	}
+
+	// TenantLimits are the concurrency, queue depth and rate limits of each tenant
+	newTenantLimits, err := parseTenantLimits(getOptionalConfigValueString(annotations, "tenantLimits", ""))
+	if err != nil {
+		return err
+	}
+
+	// config.MaxConnsPerHost is the maximum number of connections to each recipient host (0 for unlimited)
+	newMaxConnsPerHost, err := getOptionalConfigValue(annotations, "maxConnsPerHost", 0)
+	if err != nil {
+		return err
+	}
+
+	// config.MaxIdleConnsPerHost is the maximum number of idle connections kept open to each recipient host
+	newMaxIdleConnsPerHost, err := getOptionalConfigValue(annotations, "maxIdleConnsPerHost", 100)
+	if err != nil {
+		return err
+	}
+
+	// config.IdleConnTimeout is the time in seconds an idle connection to a recipient is kept open
+	newIdleConnTimeout, err := getOptionalConfigValue(annotations, "idleConnTimeout", 90)
+	if err != nil {
+		return err
+	}
+
+	// config.DNSCacheTTL is the time in seconds resolved recipient addresses are cached (0 disables caching)
+	newDNSCacheTTL, err := getOptionalConfigValue(annotations, "dnsCacheTTL", 30)
+	if err != nil {
+		return err
+	}
+
+	// Transforms are the transforms applied to every forwarded request and its response, in order
+	newTransforms, err := parseTransforms(getOptionalConfigValueString(annotations, "transforms", ""))
+	if err != nil {
+		return err
+	}
+
+	// ResponseFilter scrubs every response before it is returned to the sender
+	newResponseFilter, err := parseResponseFilter(getOptionalConfigValueString(annotations, "responseFilter", ""))
+	if err != nil {
+		return err
+	}
+
+	// config.MaxBatchSize is the maximum number of requests in a batch
+	newMaxBatchSize, err := getOptionalConfigValue(annotations, "maxBatchSize", 1000)
+	if err != nil {
+		return err
+	}
+
+	// config.MaxDelay is the maximum time in seconds a request can be scheduled ahead
+	newMaxDelay, err := getOptionalConfigValue(annotations, "maxDelay", 3600)
+	if err != nil {
+		return err
+	}
+
+	// config.MaxScheduledRequests is the maximum number of scheduled requests a proxy holds
+	newMaxScheduledRequests, err := getOptionalConfigValue(annotations, "maxScheduledRequests", 1000)
+	if err != nil {
+		return err
+	}
+
+	// Chaos injects faults into a percentage of forwarded requests, disabled if empty
+	newChaos, err := parseChaosConfig(getOptionalConfigValueString(annotations, "chaos", ""))
+	if err != nil {
+		return err
+	}
+
+	// RecipientTLS are the client certificates and CAs toward recipients by host pattern, only reparsed on change
+	previous := currentConfig()
+	newRecipientTLSValue := getOptionalConfigValueString(annotations, "recipientTLS", "")
+	newRecipientTLS := previous.RecipientTLS
+	if newRecipientTLSValue != previous.RecipientTLSValue {
+		newRecipientTLS, err = parseRecipientTLS(newRecipientTLSValue)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Begin shared lock for idle shutdown
 	state.IdleShutdown.RLock()
 	defer state.IdleShutdown.RUnlock()
 
 	// Determine if we should restart the idle timer
-	if int64(newIdleTimeout) != config.IdleTimeout || (ProxyOrdinal > int64(newMinProxies) && ProxyOrdinal <= config.MinProxies) {
+	if int64(newIdleTimeout) != previous.IdleTimeout || (ProxyOrdinal > int64(newMinProxies) && ProxyOrdinal <= previous.MinProxies) {
 		resetIdleShutdown()
 	}
 
-	// Update the config globals
-	config.MinProxies = int64(newMinProxies)
-	config.MaxProxies = int64(newMaxProxies)
-	config.MaxRequests = int64(newMaxRequests)
-	config.MaxLoadFactor = newMaxLoadFactor
-	config.ProxyTimeout = int64(newProxyTimeout)
-	config.IdleTimeout = int64(newIdleTimeout)
-	config.DebugLevel = int64(newDebugLevel)
+	// Publish the new config at once, so requests never see it half updated
+	current := updateConfig(func(next *proxyConfig) {
+		next.MinProxies = int64(newMinProxies)
+		next.MaxProxies = int64(newMaxProxies)
+		next.MaxRequests = int64(newMaxRequests)
+		next.MaxLoadFactor = newMaxLoadFactor
+		next.ProxyTimeout = int64(newProxyTimeout)
+		next.IdleTimeout = int64(newIdleTimeout)
+		next.DrainTimeout = int64(newDrainTimeout)
+		next.DebugLevel = int64(newDebugLevel)
+		next.MaxRecipientFailures = int64(newMaxRecipientFailures)
+		next.UnreadySaturation = newUnreadySaturation
+		next.UnreadyRecipientFailures = int64(newUnreadyRecipientFailures)
+		next.CapacityStrategy = newCapacityStrategy
+		next.MaxMemory = int64(newMaxMemory)
+		next.TargetLatency = int64(newTargetLatency)
+		next.IdleLoadFactor = newIdleLoadFactor
+		next.IdempotencyTTL = int64(newIdempotencyTTL)
+		next.IdempotencyMaxEntries = int64(newIdempotencyMaxEntries)
+		next.IdempotencyMaxBytes = int64(newIdempotencyMaxBytes)
+		next.AffinityTTL = int64(newAffinityTTL)
+		next.SenderTTL = int64(newSenderTTL)
+		next.RecipientRetries = int64(newRecipientRetries)
+		next.RecipientRetryDelay = int64(newRecipientRetryDelay)
+		next.RetryAllMethods = newRetryAllMethods != 0
+		next.StreamingMode = newStreamingMode != 0
+		next.BreakerFailures = int64(newBreakerFailures)
+		next.BreakerCooldown = int64(newBreakerCooldown)
+		next.CacheTTL = int64(newCacheTTL)
+		next.CacheMaxEntries = int64(newCacheMaxEntries)
+		next.QueueTimeout = int64(newQueueTimeout)
+		next.MaxQueuedRequests = int64(newMaxQueuedRequests)
+		next.MaxConnsPerHost = int64(newMaxConnsPerHost)
+		next.MaxIdleConnsPerHost = int64(newMaxIdleConnsPerHost)
+		next.IdleConnTimeout = int64(newIdleConnTimeout)
+		next.DNSCacheTTL = int64(newDNSCacheTTL)
+		next.MaxBatchSize = int64(newMaxBatchSize)
+		next.MaxDelay = int64(newMaxDelay)
+		next.MaxScheduledRequests = int64(newMaxScheduledRequests)
+		next.TenantLimits = newTenantLimits
+		next.Transforms = newTransforms
+		next.ResponseFilter = newResponseFilter
+		next.Chaos = newChaos
+		next.RecipientTLS = newRecipientTLS
+		next.RecipientTLSValue = newRecipientTLSValue
+		next.MaxHeaderBytes = int64(newMaxHeaderBytes)
+		next.MaxBodyBytes = int64(newMaxBodyBytes)
+		next.MaxProxyListBytes = int64(newMaxProxyListBytes)
+		next.TLS.CertFile = newTLSCertFile
+		next.TLS.KeyFile = newTLSKeyFile
+		next.TLS.ClientCAFile = newTLSClientCAFile
+		next.TLS.PeerCAFile = newTLSPeerCAFile
+		next.AccessLogSink = newAccessLogSink
+		next.SpanSink = newSpanSink
+		next.DeadLetterSink = newDeadLetterSink
+		next.DeadLetterFormat = newDeadLetterFormat
+		next.DeliveryReceipts = newDeliveryReceipts != 0
+	})
+
+	pruneRecipientTransports()
 
 	// If we are the last proxy, ensure the min/max number of proxies
 	if ProxyOrdinal+1 == proxies.Count {
@@ -646,17 +1737,17 @@ func updateProxyConfig(annotations map[string]string) error {
 
 		// Double check after locking
 		if ProxyOrdinal+1 == proxies.Count {
-			if proxies.Count < config.MinProxies {
-				scaleStatefulSet(int(config.MinProxies))
-			} else if proxies.Count > config.MaxProxies {
-				scaleStatefulSet(int(config.MaxProxies))
+			if proxies.Count < current.MinProxies {
+				scaleStatefulSet(int(current.MinProxies))
+			} else if proxies.Count > current.MaxProxies {
+				scaleStatefulSet(int(current.MaxProxies))
 			}
 		}
 
 		proxies.CountMu.Unlock()
 	}
 
-	debugPrint(2, "[+] Updated config: %v", config)
+	debugPrint(2, "[+] Updated config: %v", *current)
 
 	return nil
 }
@@ -668,8 +1759,8 @@ func updateStatefulSet(set *v1.StatefulSet) {
 		log.Fatalf("[!] Failed to update proxy list: %v", err)
 	}
 
-	// Update configs
-	if err := updateProxyConfig(set.GetObjectMeta().GetAnnotations()); err != nil {
+	// Update configs, keeping the overrides of the config directory
+	if err := updateAnnotations(set.GetObjectMeta().GetAnnotations()); err != nil {
 		log.Fatalf("[!] Failed to update proxy config: %v", err)
 	}
 }
@@ -734,8 +1825,8 @@ func printStats() {
 
 			debugPrint(1, "[+] P:%-3v Max:%-4v Target:%-4v Deny:%-7v Active:%v",
 				proxies.Count,
-				config.MaxRequests,
-				int(float64(config.MaxRequests)*config.MaxLoadFactor),
+				currentConfig().MaxRequests,
+				int(float64(currentConfig().MaxRequests)*currentConfig().MaxLoadFactor),
 				state.DenyCounter,
 				state.ActiveRequests)
 		}
@@ -743,7 +1834,11 @@ func printStats() {
 }
 
 func main() {
+	ProxyOrdinal = getProxyOrdinal(ProxyName)
+
+	startConfigDirWatcher()
 	startWatcher()
+	startLeaderElection()
 	setupIdleShutdown()
 
 	printStats()
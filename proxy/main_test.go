@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The tests run against the default config, as a proxy without annotations
+func TestMain(m *testing.M) {
+	if err := updateProxyConfig(map[string]string{}); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load the default config: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
+
+// Changes the config for the test, restoring the previous one once it is done
+func withConfig(t *testing.T, update func(next *proxyConfig)) {
+	previous := currentConfig()
+	updateConfig(update)
+
+	t.Cleanup(func() {
+		updateConfig(func(next *proxyConfig) { *next = *previous })
+	})
+}
+
+// Ensure requests past MaxEnsureRequests are rejected before overflowing the scaling arithmetic
+func TestEnsureRequestBounds(t *testing.T) {
+	// Every proxy the ensure requests need is beyond the maximum, so none scale
+	withConfig(t, func(next *proxyConfig) { next.MaxProxies = proxies.Count })
+
+	for _, c := range []struct {
+		ensure   string
+		maxPods  string
+		status   int
+		maxScale string
+	}{
+		{"0", "", http.StatusOK, ""},
+		{"1", "", http.StatusOK, "true"},
+		{strconv.FormatUint(MaxEnsureRequests, 10), "", http.StatusOK, "true"},
+		{strconv.FormatUint(MaxEnsureRequests+1, 10), "", http.StatusBadRequest, ""},
+		{strconv.FormatUint(math.MaxInt64, 10), "", http.StatusBadRequest, ""},
+		{strconv.FormatUint(math.MaxUint64, 10), "", http.StatusBadRequest, ""},
+		{"-1", "", http.StatusBadRequest, ""},
+		{"many", "", http.StatusBadRequest, ""},
+		{"1", strconv.FormatUint(math.MaxUint64, 10), http.StatusOK, "true"},
+		{"1", "many", http.StatusBadRequest, ""},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("Proxy-Ensure-Requests", c.ensure)
+		if c.maxPods != "" {
+			r.Header.Set("Proxy-Ensure-Max-Proxies", c.maxPods)
+		}
+
+		w := httptest.NewRecorder()
+		if !handleEnsureRequest(w, r) {
+			t.Fatalf("%v: the ensure request was not handled", c.ensure)
+		}
+
+		if w.Code != c.status || w.Header().Get("Proxy-Status") != strconv.Itoa(c.status) {
+			t.Errorf("%v (max %q): got status %v and Proxy-Status %v, expected %v", c.ensure, c.maxPods, w.Code, w.Header().Get("Proxy-Status"), c.status)
+		}
+
+		if maxScale := w.Header().Get("Proxy-Max-Scale"); maxScale != c.maxScale {
+			t.Errorf("%v (max %q): got Proxy-Max-Scale %q, expected %q", c.ensure, c.maxPods, maxScale, c.maxScale)
+		}
+	}
+
+	// The most requests an ensure request can expect need at most the maximum proxies, even an unbounded maximum
+	withConfig(t, func(next *proxyConfig) { next.MaxProxies = math.MaxInt64 })
+
+	if desired, capped := desiredProxyCount(MaxEnsureRequests); desired <= 0 || capped {
+		t.Errorf("got %v proxies (capped %v) for %v requests", desired, capped, uint64(MaxEnsureRequests))
+	}
+}
+
+// Returns a request forwarded to the target by the proxy
+func newForwardRequest(method string, target string, body string) *http.Request {
+	r := httptest.NewRequest(method, "/", strings.NewReader(body))
+	r.Header.Set("Forward-To", target)
+	return r
+}
+
+// Serves the request with the proxy's handler, returning its response
+func serveProxy(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	httpHandler(w, r)
+	return w
+}
+
+// Malformed Proxy-Timeouts are rejected as bad requests, and recipients slower than the others fail the request
+func TestProxyTimeout(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) { next.ProxyTimeout = 5000 })
+
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+
+	defer recipient.Close()
+
+	for _, timeout := range []string{"soon", "-1", "1.5", strconv.FormatUint(math.MaxUint64, 10)} {
+		r := newForwardRequest(http.MethodGet, recipient.URL, "")
+		r.Header.Set("Proxy-Timeout", timeout)
+
+		if w := serveProxy(r); w.Code != http.StatusBadRequest || w.Header().Get("Proxy-Status") != "400" {
+			t.Errorf("Proxy-Timeout %v: got status %v and Proxy-Status %v, expected 400", timeout, w.Code, w.Header().Get("Proxy-Status"))
+		}
+	}
+
+	if active := atomic.LoadInt64(&state.ActiveRequests); active != 0 {
+		t.Errorf("the rejected requests left %v active requests", active)
+	}
+
+	r := newForwardRequest(http.MethodGet, recipient.URL, "")
+	r.Header.Set("Proxy-Timeout", "20")
+
+	if w := serveProxy(r); w.Code != http.StatusInternalServerError || w.Header().Get("Proxy-Status") != "500" {
+		t.Errorf("got status %v and Proxy-Status %v past the Proxy-Timeout, expected 500", w.Code, w.Header().Get("Proxy-Status"))
+	}
+
+	r = newForwardRequest(http.MethodGet, recipient.URL, "")
+	r.Header.Set("Proxy-Timeout", "5000")
+
+	if w := serveProxy(r); w.Code != http.StatusOK || w.Header().Get("Proxy-Status") != "200" {
+		t.Errorf("got status %v and Proxy-Status %v within the Proxy-Timeout, expected 200", w.Code, w.Header().Get("Proxy-Status"))
+	}
+}
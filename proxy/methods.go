@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ForwardedMethods are the methods forwarded to recipients, CONNECT is rejected as tunnels bypass the queueing
+var ForwardedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+	http.MethodTrace,
+}
+
+// Rejects CONNECT requests before routing, as their target is an authority rather than a path
+func rejectConnect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Allow", strings.Join(ForwardedMethods, ", "))
+		writeProxyMetrics(w, http.StatusMethodNotAllowed)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+}
+
+// Writes the capabilities of the proxy in response to an OPTIONS request without Forward-To
+func writeProxyCapabilities(w http.ResponseWriter) {
+	recipients := make([]string, 0, len(RecipientAdapters))
+	for name := range RecipientAdapters {
+		recipients = append(recipients, name)
+	}
+	sort.Strings(recipients)
+
+	w.Header().Set("Allow", strings.Join(ForwardedMethods, ", "))
+	w.Header().Set("Proxy-Recipients", strings.Join(recipients, ", "))
+	w.Header().Set("Proxy-Priorities", strings.Join(PriorityNames, ", "))
+	writeProxyMetrics(w, http.StatusOK)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Returns whether a response to the request can have a body
+func responseHasBody(method string, statusCode int) bool {
+	return method != http.MethodHead && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
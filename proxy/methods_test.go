@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRejectConnect(t *testing.T) {
+	var forwarded []string
+	handler := rejectConnect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Method)
+	}))
+
+	for _, method := range append(ForwardedMethods, http.MethodConnect) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/", nil))
+
+		if method != http.MethodConnect {
+			continue
+		}
+
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Proxy-Status") != "405" {
+			t.Errorf("CONNECT answered %v with Proxy-Status %q", w.Code, w.Header().Get("Proxy-Status"))
+		}
+
+		if allow := w.Header().Get("Allow"); strings.Contains(allow, http.MethodConnect) || !strings.Contains(allow, http.MethodGet) {
+			t.Errorf("CONNECT answered Allow %q", allow)
+		}
+	}
+
+	if strings.Join(forwarded, ",") != strings.Join(ForwardedMethods, ",") {
+		t.Errorf("forwarded %v, expected %v", forwarded, ForwardedMethods)
+	}
+}
+
+func TestProxyCapabilities(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeProxyCapabilities(w)
+
+	if w.Code != http.StatusOK || w.Header().Get("Proxy-Status") != "200" {
+		t.Errorf("answered %v with Proxy-Status %q", w.Code, w.Header().Get("Proxy-Status"))
+	}
+
+	if allow := w.Header().Get("Allow"); allow != strings.Join(ForwardedMethods, ", ") {
+		t.Errorf("answered Allow %q", allow)
+	}
+
+	for _, name := range []string{"Proxy-Recipients", "Proxy-Priorities"} {
+		if w.Header().Get(name) == "" {
+			t.Errorf("answered without %v", name)
+		}
+	}
+}
+
+func TestResponseHasBody(t *testing.T) {
+	for _, c := range []struct {
+		method string
+		status int
+		body   bool
+	}{
+		{http.MethodGet, http.StatusOK, true},
+		{http.MethodHead, http.StatusOK, false},
+		{http.MethodPost, http.StatusNoContent, false},
+		{http.MethodGet, http.StatusNotModified, false},
+		{http.MethodOptions, http.StatusOK, true},
+	} {
+		if body := responseHasBody(c.method, c.status); body != c.body {
+			t.Errorf("%v %v has a body: %v, expected %v", c.method, c.status, body, c.body)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds (in seconds) of the recipient latency histogram buckets, the same as the client's
+// PrometheusLatencyBuckets
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Prometheus metrics of the current proxy
+var metrics struct {
+	sync.Mutex
+
+	// Responses counts the responses sent back to senders by status code
+	Responses map[int]uint64
+
+	// ScaleEvents counts the successful scalings by direction ("up" or "down")
+	ScaleEvents map[string]uint64
+
+	// WebhookDeliveries counts the dead letters and receipts POSTed to a webhook by result ("delivered", "rejected"
+	// or "failed")
+	WebhookDeliveries map[string]uint64
+
+	// RecipientLatency tracks how long the recipients took to respond
+	RecipientLatency struct {
+		Buckets []uint64
+		Count   uint64
+		Sum     float64
+	}
+}
+
+// Escapes the label values of the metrics, which may come from senders (e.g. their Proxy-Sender), as the Prometheus
+// text exposition format does: only backslashes, double quotes and line feeds
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Returns the label value quoted for the Prometheus text exposition format
+func labelValue(value string) string {
+	return `"` + labelValueEscaper.Replace(value) + `"`
+}
+
+func init() {
+	metrics.Responses = map[int]uint64{}
+	metrics.ScaleEvents = map[string]uint64{}
+	metrics.WebhookDeliveries = map[string]uint64{}
+	metrics.RecipientLatency.Buckets = make([]uint64, len(latencyBuckets))
+}
+
+// Records a response sent back to a sender
+func recordResponse(statusCode int) {
+	metrics.Lock()
+	metrics.Responses[statusCode]++
+	metrics.Unlock()
+}
+
+// Records a successful scaling of the StatefulSet
+func recordScaleEvent(oldScale int, newScale int) {
+	direction := "up"
+	if newScale < oldScale {
+		direction = "down"
+	}
+
+	metrics.Lock()
+	metrics.ScaleEvents[direction]++
+	metrics.Unlock()
+}
+
+// Records the result of POSTing a dead letter or receipt to a webhook
+func recordWebhookDelivery(result string) {
+	metrics.Lock()
+	metrics.WebhookDeliveries[result]++
+	metrics.Unlock()
+}
+
+// Records the time a recipient took to respond
+func recordRecipientLatency(latency time.Duration) {
+	seconds := latency.Seconds()
+
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			metrics.RecipientLatency.Buckets[i]++
+		}
+	}
+
+	metrics.RecipientLatency.Count++
+	metrics.RecipientLatency.Sum += seconds
+}
+
+// Writes the metrics in the Prometheus text exposition format
+func writePrometheusMetrics(w *strings.Builder) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	// The ordinal labels the client's metrics of the pod too, e.g. proxy_client_attempts_total
+	fmt.Fprintf(w, "# HELP proxy_info Pod and ordinal of the proxy in the StatefulSet.\n")
+	fmt.Fprintf(w, "# TYPE proxy_info gauge\n")
+	fmt.Fprintf(w, "proxy_info{pod=%v,ordinal=\"%v\"} 1\n", labelValue(ProxyName), ProxyOrdinal)
+
+	fmt.Fprintf(w, "# HELP proxy_active_requests Number of requests currently being forwarded to recipients.\n")
+	fmt.Fprintf(w, "# TYPE proxy_active_requests gauge\n")
+	fmt.Fprintf(w, "proxy_active_requests %v\n", atomic.LoadInt64(&state.ActiveRequests))
+
+	fmt.Fprintf(w, "# HELP proxy_scheduled_requests Number of requests held until their scheduled time.\n")
+	fmt.Fprintf(w, "# TYPE proxy_scheduled_requests gauge\n")
+	fmt.Fprintf(w, "proxy_scheduled_requests %v\n", atomic.LoadInt64(&state.ScheduledRequests))
+
+	fmt.Fprintf(w, "# HELP proxy_max_requests Maximum number of requests the proxy can be forwarding at once.\n")
+	fmt.Fprintf(w, "# TYPE proxy_max_requests gauge\n")
+	fmt.Fprintf(w, "proxy_max_requests %v\n", currentConfig().MaxRequests)
+
+	fmt.Fprintf(w, "# HELP proxy_proxies Number of proxies intended to be running in the StatefulSet.\n")
+	fmt.Fprintf(w, "# TYPE proxy_proxies gauge\n")
+	fmt.Fprintf(w, "proxy_proxies %v\n", atomic.LoadInt64(&proxies.Count))
+
+	fmt.Fprintf(w, "# HELP proxy_requests_total Number of requests received by the proxy.\n")
+	fmt.Fprintf(w, "# TYPE proxy_requests_total counter\n")
+	fmt.Fprintf(w, "proxy_requests_total %v\n", atomic.LoadUint64(&state.RequestCounter))
+
+	fmt.Fprintf(w, "# HELP proxy_expired_requests_total Number of requests dropped for expiring before being forwarded.\n")
+	fmt.Fprintf(w, "# TYPE proxy_expired_requests_total counter\n")
+	fmt.Fprintf(w, "proxy_expired_requests_total %v\n", atomic.LoadUint64(&state.ExpiredCounter))
+
+	fmt.Fprintf(w, "# HELP proxy_failed_deliveries_total Number of requests answered with a 202 that then failed to be delivered.\n")
+	fmt.Fprintf(w, "# TYPE proxy_failed_deliveries_total counter\n")
+	fmt.Fprintf(w, "proxy_failed_deliveries_total %v\n", atomic.LoadUint64(&state.FailedCounter))
+
+	fmt.Fprintf(w, "# HELP proxy_dropped_messages_total Number of dead letters and receipts dropped by a queue sink not keeping up, or failing to publish them.\n")
+	fmt.Fprintf(w, "# TYPE proxy_dropped_messages_total counter\n")
+	fmt.Fprintf(w, "proxy_dropped_messages_total{reason=\"full\"} %v\n", atomic.LoadUint64(&state.DroppedMessagesCounter))
+	fmt.Fprintf(w, "proxy_dropped_messages_total{reason=\"failed\"} %v\n", atomic.LoadUint64(&state.FailedMessagesCounter))
+
+	fmt.Fprintf(w, "# HELP proxy_dropped_spans_total Number of spans dropped by an OTLP sink not keeping up, or failing to export them.\n")
+	fmt.Fprintf(w, "# TYPE proxy_dropped_spans_total counter\n")
+	fmt.Fprintf(w, "proxy_dropped_spans_total %v\n", atomic.LoadUint64(&state.DroppedSpansCounter))
+
+	// Sort the status codes so the output is stable between scrapes
+	var statusCodes []int
+	for statusCode := range metrics.Responses {
+		statusCodes = append(statusCodes, statusCode)
+	}
+	sort.Ints(statusCodes)
+
+	fmt.Fprintf(w, "# HELP proxy_responses_total Number of responses sent back to senders by status code.\n")
+	fmt.Fprintf(w, "# TYPE proxy_responses_total counter\n")
+	for _, statusCode := range statusCodes {
+		fmt.Fprintf(w, "proxy_responses_total{code=\"%v\"} %v\n", statusCode, metrics.Responses[statusCode])
+	}
+
+	fmt.Fprintf(w, "# HELP proxy_scale_events_total Number of times this proxy scaled the StatefulSet.\n")
+	fmt.Fprintf(w, "# TYPE proxy_scale_events_total counter\n")
+	for _, direction := range []string{"up", "down"} {
+		fmt.Fprintf(w, "proxy_scale_events_total{direction=\"%v\"} %v\n", direction, metrics.ScaleEvents[direction])
+	}
+
+	fmt.Fprintf(w, "# HELP proxy_webhook_deliveries_total Number of dead letters and receipts POSTed to a webhook by result.\n")
+	fmt.Fprintf(w, "# TYPE proxy_webhook_deliveries_total counter\n")
+	for _, result := range []string{"delivered", "rejected", "failed"} {
+		fmt.Fprintf(w, "proxy_webhook_deliveries_total{result=%v} %v\n", labelValue(result), metrics.WebhookDeliveries[result])
+	}
+
+	fmt.Fprintf(w, "# HELP proxy_recipient_latency_seconds Time taken by recipients to respond.\n")
+	fmt.Fprintf(w, "# TYPE proxy_recipient_latency_seconds histogram\n")
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "proxy_recipient_latency_seconds_bucket{le=\"%v\"} %v\n", bound, metrics.RecipientLatency.Buckets[i])
+	}
+	fmt.Fprintf(w, "proxy_recipient_latency_seconds_bucket{le=\"+Inf\"} %v\n", metrics.RecipientLatency.Count)
+	fmt.Fprintf(w, "proxy_recipient_latency_seconds_sum %v\n", metrics.RecipientLatency.Sum)
+	fmt.Fprintf(w, "proxy_recipient_latency_seconds_count %v\n", metrics.RecipientLatency.Count)
+}
+
+// Metrics HTTP handler
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var body strings.Builder
+	writePrometheusMetrics(&body)
+	writeHealthMetrics(&body)
+	writeBreakerMetrics(&body)
+	writeQueueMetrics(&body)
+	writePoolMetrics(&body)
+	writeChaosMetrics(&body)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(body.String()))
+}
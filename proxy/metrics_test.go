@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btbd/proxy/client"
+)
+
+// Returns the value of the series in the metrics, "" if there is none
+func metricValue(series string) string {
+	var body strings.Builder
+	writePrometheusMetrics(&body)
+
+	for _, line := range strings.Split(body.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			return strings.TrimPrefix(line, series+" ")
+		}
+	}
+
+	return ""
+}
+
+// Webhook deliveries are counted by result
+func TestWebhookDeliveryMetrics(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	defer webhook.Close()
+
+	series := `proxy_webhook_deliveries_total{result="rejected"}`
+	before := metricValue(series)
+
+	sink := &webhookDeadLetterSink{URL: webhook.URL}
+	sink.Write(&DeadLetter{Time: time.Now(), Reason: "expired", RequestID: "request"})
+
+	for deadline := time.Now().Add(5 * time.Second); metricValue(series) == before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the rejected delivery was not counted, %v is %v", series, metricValue(series))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A sample of the Prometheus text exposition format
+type sample struct {
+	Name   string
+	Labels map[string]string
+	Value  string
+}
+
+// Parses the samples of the Prometheus text exposition format, unescaping their label values
+func parseExposition(t *testing.T, exposition string) []sample {
+	var samples []sample
+	for _, line := range strings.Split(exposition, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		s := sample{Labels: map[string]string{}}
+		end := strings.IndexAny(line, "{ ")
+		if end < 0 {
+			t.Fatalf("malformed sample %q", line)
+		}
+
+		s.Name, line = line[:end], line[end:]
+		if strings.HasPrefix(line, "{") {
+			line = line[1:]
+			for !strings.HasPrefix(line, "}") {
+				equals := strings.Index(line, "=\"")
+				if equals < 0 {
+					t.Fatalf("malformed labels of %v: %q", s.Name, line)
+				}
+
+				name := line[:equals]
+				line = line[equals+2:]
+
+				var value strings.Builder
+				for {
+					if line == "" {
+						t.Fatalf("unterminated label %v of %v", name, s.Name)
+					}
+
+					c := line[0]
+					line = line[1:]
+					if c == '"' {
+						break
+					}
+
+					if c == '\\' && line != "" {
+						switch line[0] {
+						case 'n':
+							c = '\n'
+						case '\\', '"':
+							c = line[0]
+						default:
+							t.Fatalf("invalid escape in label %v of %v", name, s.Name)
+						}
+
+						line = line[1:]
+					}
+
+					value.WriteByte(c)
+				}
+
+				s.Labels[name] = value.String()
+				line = strings.TrimPrefix(line, ",")
+			}
+
+			line = line[1:]
+		}
+
+		s.Value = strings.TrimSpace(line)
+		samples = append(samples, s)
+	}
+
+	return samples
+}
+
+// The proxy's proxy_info and the client's metrics parse as the exposition format, and join on the pod ordinal
+func TestMetricsJoinOnOrdinal(t *testing.T) {
+	defer func(name string, ordinal int64) { ProxyName, ProxyOrdinal = name, ordinal }(ProxyName, ProxyOrdinal)
+	ProxyName, ProxyOrdinal = "proxy-2", 2
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	clientMetrics := client.NewPrometheusMetrics()
+	clientMetrics.Attempt(2, http.StatusOK, nil, time.Millisecond)
+	clientMetrics.Attempt(0, http.StatusTooManyRequests, nil, time.Millisecond)
+
+	var exposition strings.Builder
+	clientMetrics.WriteTo(&exposition)
+
+	// The pods of the proxies' proxy_info by ordinal
+	pods := map[string]string{}
+	for _, s := range parseExposition(t, w.Body.String()) {
+		if s.Name == "proxy_info" {
+			pods[s.Labels["ordinal"]] = s.Labels["pod"]
+		}
+	}
+
+	if pods["2"] != "proxy-2" {
+		t.Fatalf("got proxy_info pods %v, expected proxy-2 at ordinal 2", pods)
+	}
+
+	joined := 0
+	for _, s := range parseExposition(t, exposition.String()) {
+		if s.Name != "proxy_client_attempts_total" {
+			continue
+		}
+
+		if pod, ok := pods[s.Labels["ordinal"]]; ok {
+			if pod != "proxy-2" || s.Labels["code"] != strconv.Itoa(http.StatusOK) || s.Value != "1" {
+				t.Errorf("joined %+v with pod %v", s, pod)
+			}
+
+			joined++
+		}
+	}
+
+	if joined != 1 {
+		t.Errorf("joined %v client series with the proxy's", joined)
+	}
+}
+
+// Label values are escaped as the exposition format does, and parse back to themselves
+func TestLabelValueEscaped(t *testing.T) {
+	for _, value := range []string{"proxy-0", `a\b`, `"quoted"`, "multi\nline", "tab\tand é"} {
+		samples := parseExposition(t, fmt.Sprintf("proxy_info{pod=%v} 1\n", labelValue(value)))
+		if len(samples) != 1 || samples[0].Labels["pod"] != value {
+			t.Errorf("got %+v for %q", samples, value)
+		}
+	}
+
+	if escaped := labelValue("tab\tand é"); escaped != "\"tab\tand é\"" {
+		t.Errorf("got %v, expected the tab and é unescaped", escaped)
+	}
+}
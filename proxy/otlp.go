@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of spans an OTLP sink holds before dropping new ones, and exports at once
+const (
+	otlpSpanBuffer = 4096
+	otlpSpanBatch  = 512
+)
+
+// OTLPScope is the instrumentation scope of the exported spans
+const OTLPScope = "github.com/btbd/proxy"
+
+// Returns the span sink of the traceSink annotation: a predefined sink, or an OpenTelemetry collector's OTLP/HTTP
+// traces endpoint prefixed with otlp+, e.g. otlp+http://otel-collector:4318/v1/traces
+func parseSpanSink(value string) (SpanSink, error) {
+	if sink, ok := SpanSinks[value]; ok {
+		return sink, nil
+	}
+
+	if !strings.HasPrefix(value, "otlp+") {
+		return nil, fmt.Errorf("traceSink %v does not exist", value)
+	}
+
+	u, err := url.Parse(strings.TrimPrefix(value, "otlp+"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("traceSink %v is not an otlp+http(s) URL", value)
+	}
+
+	return otlpSpanSinkFor(u.String()), nil
+}
+
+// Exports the spans to an OpenTelemetry collector with OTLP over HTTP, in its JSON encoding, in the background
+// Spans are dropped rather than blocking the requests when the collector can not keep up or fails
+type otlpSpanSink struct {
+	URL    string
+	Client *http.Client
+
+	spans chan *Span
+}
+
+// OTLP sinks by URL, reused across config updates so their exporters are not leaked
+var otlpSpanSinks struct {
+	sync.Mutex
+	Sinks map[string]*otlpSpanSink
+}
+
+// Returns the OTLP sink of the URL, starting its exporter on first use
+func otlpSpanSinkFor(u string) *otlpSpanSink {
+	otlpSpanSinks.Lock()
+	defer otlpSpanSinks.Unlock()
+
+	if sink, ok := otlpSpanSinks.Sinks[u]; ok {
+		return sink
+	}
+
+	sink := &otlpSpanSink{URL: u, Client: &http.Client{Timeout: 10 * time.Second}, spans: make(chan *Span, otlpSpanBuffer)}
+	go sink.export()
+
+	if otlpSpanSinks.Sinks == nil {
+		otlpSpanSinks.Sinks = map[string]*otlpSpanSink{}
+	}
+
+	otlpSpanSinks.Sinks[u] = sink
+	return sink
+}
+
+func (s *otlpSpanSink) Export(span *Span) {
+	select {
+	case s.spans <- span:
+	default:
+		atomic.AddUint64(&state.DroppedSpansCounter, 1)
+	}
+}
+
+// Exports the spans in batches as they come
+func (s *otlpSpanSink) export() {
+	for span := range s.spans {
+		batch := []*Span{span}
+		for len(batch) < otlpSpanBatch {
+			select {
+			case span := <-s.spans:
+				batch = append(batch, span)
+				continue
+			default:
+			}
+
+			break
+		}
+
+		if err := s.exportBatch(batch); err != nil {
+			atomic.AddUint64(&state.DroppedSpansCounter, uint64(len(batch)))
+			debugPrint(1, "[!] Failed to export %v spans to %v: %v", len(batch), s.URL, err)
+		}
+	}
+}
+
+// POSTs the batch as an ExportTraceServiceRequest
+func (s *otlpSpanSink) exportBatch(batch []*Span) error {
+	body, err := json.Marshal(encodeOTLPSpans(batch))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// OTLP JSON encoding of the spans, see opentelemetry-proto's ExportTraceServiceRequest
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// OTLP span kinds and status codes
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpSpanKindClient   = 3
+
+	otlpStatusError = 2
+)
+
+// Returns the OTLP attributes of the attributes, sorted by key
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	var result []otlpAttribute
+	for key, value := range attributes {
+		attribute := otlpAttribute{Key: key}
+		attribute.Value.StringValue = value
+		result = append(result, attribute)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// Encodes the spans as an ExportTraceServiceRequest of the proxy's pod
+func encodeOTLPSpans(spans []*Span) *otlpTraces {
+	scopeSpans := otlpScopeSpans{}
+	scopeSpans.Scope.Name = OTLPScope
+
+	for _, span := range spans {
+		// The proxy span serves the sender's request, and the forward span is the request to the recipient
+		kind := otlpSpanKindInternal
+		switch span.Name {
+		case "proxy":
+			kind = otlpSpanKindServer
+		case "forward":
+			kind = otlpSpanKindClient
+		}
+
+		encoded := otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentSpanID,
+			Name:              span.Name,
+			Kind:              kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+
+		if message := span.Attributes["error"]; message != "" {
+			encoded.Status = &otlpStatus{Code: otlpStatusError, Message: message}
+		} else if status, _ := strconv.Atoi(span.Attributes["proxy.status"]); status >= 500 {
+			encoded.Status = &otlpStatus{Code: otlpStatusError}
+		}
+
+		scopeSpans.Spans = append(scopeSpans.Spans, encoded)
+	}
+
+	resourceSpans := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scopeSpans}}
+	resourceSpans.Resource.Attributes = otlpAttributes(map[string]string{
+		"service.name":        "proxy",
+		"service.instance.id": ProxyName,
+		"k8s.namespace.name":  ProxyNamespace,
+		"k8s.pod.name":        ProxyName,
+	})
+
+	return &otlpTraces{ResourceSpans: []otlpResourceSpans{resourceSpans}}
+}
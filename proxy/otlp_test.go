@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Spans reach the collector as an OTLP ExportTraceServiceRequest
+func TestOTLPSpanSink(t *testing.T) {
+	requests := make(chan *otlpTraces, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces otlpTraces
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&traces) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		requests <- &traces
+	}))
+
+	defer collector.Close()
+
+	sink, err := parseSpanSink("otlp+" + collector.URL + "/v1/traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{}
+	header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	span := startSpanFromRequest("proxy", header)
+	span.End = span.Start.Add(time.Millisecond)
+	span.Attributes = map[string]string{"proxy.status": "500"}
+	sink.Export(span)
+
+	var traces *otlpTraces
+	select {
+	case traces = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the collector received no spans")
+	}
+
+	if len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("got %+v, expected one span", traces)
+	}
+
+	exported := traces.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if exported.TraceID != "0af7651916cd43dd8448eb211c80319c" || exported.ParentSpanID != "b7ad6b7169203331" || exported.SpanID != span.SpanID {
+		t.Errorf("got span %+v, expected it to continue the trace", exported)
+	}
+
+	if exported.Kind != otlpSpanKindServer || exported.Status == nil || exported.Status.Code != otlpStatusError {
+		t.Errorf("got kind %v and status %+v, expected a failed server span", exported.Kind, exported.Status)
+	}
+
+	if exported.StartTimeUnixNano == "" || exported.EndTimeUnixNano == "" {
+		t.Errorf("got span %+v without its times", exported)
+	}
+
+	// The sink is reused across config updates
+	if again, _ := parseSpanSink("otlp+" + collector.URL + "/v1/traces"); again != sink {
+		t.Errorf("got a new sink for the same collector")
+	}
+
+	for _, value := range []string{"otlp", "otlp+ftp://collector/", "jaeger"} {
+		if _, err := parseSpanSink(value); err == nil {
+			t.Errorf("traceSink %v was accepted", value)
+		}
+	}
+}
+
+// Webhooks of dead letters are sent in the request's trace
+func TestWebhookTraceParent(t *testing.T) {
+	traceParents := make(chan string, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParents <- r.Header.Get("Traceparent")
+	}))
+
+	defer webhook.Close()
+
+	header := http.Header{}
+	header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	sink := &webhookDeadLetterSink{URL: webhook.URL}
+	sink.Write(&DeadLetter{Time: time.Now(), Reason: "expired", RequestID: "request", Header: header})
+
+	select {
+	case traceParent := <-traceParents:
+		if traceParent != header.Get("Traceparent") {
+			t.Errorf("got traceparent %q, expected the request's", traceParent)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the webhook received no dead letter")
+	}
+}
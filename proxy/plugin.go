@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"plugin"
+	"sync"
+)
+
+// PluginSymbol is the function a Go plugin exports to create its transforms, NewTransform(options []byte)
+// (interface{}, error), whose transforms implement the methods of Transform. The plugin can not import this package,
+// so the transforms are only checked once created
+const PluginSymbol = "NewTransform"
+
+// Transform of a Go plugin, e.g. for auth token exchange or per-tenant routing, loaded from its path with the options
+// passed to its NewTransform
+type pluginTransform struct {
+	Path    string          `json:"path"`
+	Options json.RawMessage `json:"options"`
+}
+
+// Transforms created by plugins, by path and options, so reloading the config does not create them again
+var pluginTransforms struct {
+	sync.Mutex
+	Transforms map[string]Transform
+}
+
+func init() {
+	pluginTransforms.Transforms = map[string]Transform{}
+}
+
+func newPluginTransform(options []byte) (Transform, error) {
+	transform := &pluginTransform{}
+	if err := json.Unmarshal(options, transform); err != nil {
+		return nil, err
+	}
+
+	if transform.Path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+
+	// Key the transforms by their options without insignificant whitespace
+	var compacted bytes.Buffer
+	if len(transform.Options) != 0 {
+		if err := json.Compact(&compacted, transform.Options); err != nil {
+			return nil, err
+		}
+	}
+
+	key := transform.Path + "\n" + compacted.String()
+
+	pluginTransforms.Lock()
+	defer pluginTransforms.Unlock()
+
+	if cached, ok := pluginTransforms.Transforms[key]; ok {
+		return cached, nil
+	}
+
+	created, err := loadPluginTransform(transform)
+	if err != nil {
+		return nil, err
+	}
+
+	pluginTransforms.Transforms[key] = created
+	return created, nil
+}
+
+// Loads the plugin of the transform and creates its transform
+func loadPluginTransform(transform *pluginTransform) (Transform, error) {
+	// Opening the same path again returns the plugin already loaded, as plugins can not be unloaded
+	p, err := plugin.Open(transform.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	symbol, err := p.Lookup(PluginSymbol)
+	if err != nil {
+		return nil, err
+	}
+
+	newTransform, ok := symbol.(func(options []byte) (interface{}, error))
+	if !ok {
+		return nil, fmt.Errorf("%v of %v is a %T, not a func(options []byte) (interface{}, error)", PluginSymbol, transform.Path, symbol)
+	}
+
+	created, err := newTransform(transform.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	pluginTransform, ok := created.(Transform)
+	if !ok {
+		return nil, fmt.Errorf("%v of %v created a %T, which does not implement TransformRequest and TransformResponse", PluginSymbol, transform.Path, created)
+	}
+
+	debugPrint(2, "[+] Loaded plugin %v", transform.Path)
+
+	return pluginTransform, nil
+}
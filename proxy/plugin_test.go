@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"plugin"
+	"testing"
+)
+
+// Source of a plugin counting the transforms it created
+const testPluginSource = `package main
+
+import "net/http"
+
+var Created int
+
+type transform struct{}
+
+func (transform) TransformRequest(req *http.Request, body []byte) ([]byte, error) { return body, nil }
+
+func (transform) TransformResponse(resp *http.Response, body []byte) ([]byte, error) { return body, nil }
+
+func NewTransform(options []byte) (interface{}, error) {
+	Created++
+	return transform{}, nil
+}
+`
+
+// Builds the test plugin, skipping the test if plugins can not be built here
+func buildTestPlugin(t *testing.T) string {
+	if testing.Short() {
+		t.Skip("building a plugin is slow")
+	}
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module testplugin\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte(testPluginSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "plugin.so")
+	cmd := exec.Command("go", "build", "-buildmode=plugin", "-o", path, ".")
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("can not build plugins: %v\n%s", err, output)
+	}
+
+	return path
+}
+
+// Reloading the same plugin transforms reuses them rather than creating them again
+func TestPluginTransformsCached(t *testing.T) {
+	path := buildTestPlugin(t)
+
+	transforms := func(options string) string {
+		return fmt.Sprintf(`[{"type": "plugin", "path": %q, "options": %v}]`, path, options)
+	}
+
+	for _, value := range []string{
+		transforms(`{"tenant": "a"}`),
+		transforms(`{ "tenant" : "a" }`),
+		transforms(`{"tenant": "b"}`),
+	} {
+		if _, err := parseTransforms(value); err != nil {
+			t.Skipf("can not load plugins: %v", err)
+		}
+	}
+
+	p, err := plugin.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := p.Lookup("Created")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := *created.(*int); count != 2 {
+		t.Errorf("the plugin created %v transforms, expected one for each options", count)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RecipientPoolIdleTimeout is the time after which the transports and cached addresses of recipient hosts no request
+// was forwarded to are forgotten
+const RecipientPoolIdleTimeout = 5 * time.Minute
+
+// maxRecipientTransports bounds the cached transports, evicting the least recently used, and maxDNSCacheEntries the
+// cached hosts, so senders can not grow them without limit
+const (
+	maxRecipientTransports = 1000
+	maxDNSCacheEntries     = 1000
+)
+
+// Connection pool settings of the transports to recipients
+type poolSettings struct {
+	MaxConnsPerHost     int64
+	MaxIdleConnsPerHost int64
+	IdleConnTimeout     int64
+}
+
+// Returns the currently configured pool settings
+func currentPoolSettings() poolSettings {
+	return poolSettings{
+		MaxConnsPerHost:     currentConfig().MaxConnsPerHost,
+		MaxIdleConnsPerHost: currentConfig().MaxIdleConnsPerHost,
+		IdleConnTimeout:     currentConfig().IdleConnTimeout,
+	}
+}
+
+// Transports to recipients cached per host, as each holds its own connection pool
+var recipientTransports struct {
+	sync.Mutex
+	Transports map[recipientTransportKey]*cachedTransport
+}
+
+type cachedTransport struct {
+	Transport http.RoundTripper
+	LastUsed  time.Time
+}
+
+type recipientTransportKey struct {
+	Adapter  string
+	Host     string
+	TLS      *tls.Config
+	Settings poolSettings
+}
+
+// Connection stats of the recipients, not by host as senders choose the hosts
+var poolStats struct {
+	Open   int64
+	Dials  uint64
+	Reused uint64
+}
+
+// Resolved recipient addresses, cached for dnsCacheTTL
+var dnsCache struct {
+	sync.Mutex
+	Entries map[string]*dnsEntry
+	Hits    uint64
+	Misses  uint64
+}
+
+type dnsEntry struct {
+	Addrs   []string
+	Expires time.Time
+
+	// Next is the address to try first, rotated to spread connections
+	Next int
+}
+
+func init() {
+	recipientTransports.Transports = map[recipientTransportKey]*cachedTransport{}
+	dnsCache.Entries = map[string]*dnsEntry{}
+
+	go expireRecipientPools()
+}
+
+// Forgets the transports unused within RecipientPoolIdleTimeout, closing their idle connections, and the expired
+// cached addresses every second
+func expireRecipientPools() {
+	for {
+		time.Sleep(time.Second)
+
+		recipientTransports.Lock()
+		for key, cached := range recipientTransports.Transports {
+			if time.Since(cached.LastUsed) > RecipientPoolIdleTimeout {
+				closeIdleConnections(cached.Transport)
+				delete(recipientTransports.Transports, key)
+			}
+		}
+		recipientTransports.Unlock()
+
+		dnsCache.Lock()
+		for host, entry := range dnsCache.Entries {
+			if time.Now().After(entry.Expires) {
+				delete(dnsCache.Entries, host)
+			}
+		}
+		dnsCache.Unlock()
+	}
+}
+
+// Closes the idle connections of a transport being dropped, its active ones close once done
+func closeIdleConnections(transport http.RoundTripper) {
+	if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// Returns the cached transport of the adapter toward the host, creating it if needed
+func cachedRecipientTransport(adapter string, host string, tlsConfig *tls.Config, newTransport func(*tls.Config, poolSettings) http.RoundTripper) http.RoundTripper {
+	recipientTransports.Lock()
+	defer recipientTransports.Unlock()
+
+	key := recipientTransportKey{Adapter: adapter, Host: host, TLS: tlsConfig, Settings: currentPoolSettings()}
+	cached, ok := recipientTransports.Transports[key]
+	if !ok {
+		if len(recipientTransports.Transports) >= maxRecipientTransports {
+			evictRecipientTransportLocked()
+		}
+
+		cached = &cachedTransport{Transport: newTransport(tlsConfig, key.Settings)}
+		recipientTransports.Transports[key] = cached
+	}
+
+	cached.LastUsed = time.Now()
+	return cached.Transport
+}
+
+// Drops the least recently used transport, must be called with recipientTransports locked
+func evictRecipientTransportLocked() {
+	var oldest recipientTransportKey
+	var oldestUse time.Time
+	for key, cached := range recipientTransports.Transports {
+		if oldestUse.IsZero() || cached.LastUsed.Before(oldestUse) {
+			oldest, oldestUse = key, cached.LastUsed
+		}
+	}
+
+	if cached, ok := recipientTransports.Transports[oldest]; ok {
+		closeIdleConnections(cached.Transport)
+		delete(recipientTransports.Transports, oldest)
+	}
+}
+
+// Drops the cached transports of replaced TLS configs or pool settings, closing their idle connections
+func pruneRecipientTransports() {
+	recipientTransports.Lock()
+	defer recipientTransports.Unlock()
+
+	current := map[*tls.Config]bool{nil: true, insecureRecipientTLS: true}
+	for _, recipient := range currentConfig().RecipientTLS {
+		current[recipient.Config] = true
+		current[recipient.InsecureConfig] = true
+	}
+
+	settings := currentPoolSettings()
+	for key, cached := range recipientTransports.Transports {
+		if current[key.TLS] && key.Settings == settings {
+			continue
+		}
+
+		closeIdleConnections(cached.Transport)
+		delete(recipientTransports.Transports, key)
+	}
+}
+
+// Returns the addresses of the host, from the cache if still fresh
+func lookupRecipientHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil || currentConfig().DNSCacheTTL == 0 {
+		return []string{host}, nil
+	}
+
+	dnsCache.Lock()
+	entry, ok := dnsCache.Entries[host]
+	if ok && time.Now().Before(entry.Expires) {
+		dnsCache.Hits++
+
+		// Rotate the addresses to spread connections across them
+		addrs := append(entry.Addrs[entry.Next:len(entry.Addrs):len(entry.Addrs)], entry.Addrs[:entry.Next]...)
+		entry.Next = (entry.Next + 1) % len(entry.Addrs)
+		dnsCache.Unlock()
+
+		return addrs, nil
+	}
+
+	dnsCache.Misses++
+	dnsCache.Unlock()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve the hosts past the bound on every new connection rather than caching them
+	dnsCache.Lock()
+	if _, ok := dnsCache.Entries[host]; ok || len(dnsCache.Entries) < maxDNSCacheEntries {
+		dnsCache.Entries[host] = &dnsEntry{Addrs: addrs, Expires: time.Now().Add(time.Duration(currentConfig().DNSCacheTTL) * time.Second)}
+	}
+	dnsCache.Unlock()
+
+	return addrs, nil
+}
+
+// Connection to a recipient, tracked in the pool stats until closed
+type recipientConn struct {
+	net.Conn
+	closeOnce sync.Once
+}
+
+func (c *recipientConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(&poolStats.Open, -1)
+	})
+
+	return c.Conn.Close()
+}
+
+// Dials a recipient through the DNS cache, trying each of its addresses
+func dialRecipient(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := lookupRecipientHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	var conn net.Conn
+	for _, ip := range addrs {
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&poolStats.Open, 1)
+	atomic.AddUint64(&poolStats.Dials, 1)
+
+	return &recipientConn{Conn: conn}, nil
+}
+
+// Returns a new transport to plain HTTP(S) recipients
+func newHTTPTransport(tlsConfig *tls.Config, settings poolSettings) http.RoundTripper {
+	return &http.Transport{
+		DialContext:         dialRecipient,
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxConnsPerHost:     int(settings.MaxConnsPerHost),
+		MaxIdleConnsPerHost: int(settings.MaxIdleConnsPerHost),
+		IdleConnTimeout:     time.Duration(settings.IdleConnTimeout) * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// Counts the requests reusing a pooled connection to the recipient
+func traceRecipientConnections(req *http.Request) *http.Request {
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&poolStats.Reused, 1)
+			}
+		},
+	}))
+}
+
+// Writes the connection pool and DNS cache stats in the Prometheus text exposition format
+func writePoolMetrics(w *strings.Builder) {
+	recipientTransports.Lock()
+	transports := len(recipientTransports.Transports)
+	recipientTransports.Unlock()
+
+	fmt.Fprintf(w, "# HELP proxy_recipient_transports Number of cached transports to recipient hosts.\n")
+	fmt.Fprintf(w, "# TYPE proxy_recipient_transports gauge\n")
+	fmt.Fprintf(w, "proxy_recipient_transports %v\n", transports)
+
+	fmt.Fprintf(w, "# HELP proxy_recipient_open_connections Number of open connections to recipients.\n")
+	fmt.Fprintf(w, "# TYPE proxy_recipient_open_connections gauge\n")
+	fmt.Fprintf(w, "proxy_recipient_open_connections %v\n", atomic.LoadInt64(&poolStats.Open))
+
+	fmt.Fprintf(w, "# HELP proxy_recipient_dials_total Number of new connections to recipients.\n")
+	fmt.Fprintf(w, "# TYPE proxy_recipient_dials_total counter\n")
+	fmt.Fprintf(w, "proxy_recipient_dials_total %v\n", atomic.LoadUint64(&poolStats.Dials))
+
+	fmt.Fprintf(w, "# HELP proxy_recipient_reused_connections_total Number of requests to recipients reusing a pooled connection.\n")
+	fmt.Fprintf(w, "# TYPE proxy_recipient_reused_connections_total counter\n")
+	fmt.Fprintf(w, "proxy_recipient_reused_connections_total %v\n", atomic.LoadUint64(&poolStats.Reused))
+
+	dnsCache.Lock()
+	defer dnsCache.Unlock()
+
+	fmt.Fprintf(w, "# HELP proxy_dns_cache_lookups_total Number of recipient DNS lookups by result.\n")
+	fmt.Fprintf(w, "# TYPE proxy_dns_cache_lookups_total counter\n")
+	fmt.Fprintf(w, "proxy_dns_cache_lookups_total{result=\"hit\"} %v\n", dnsCache.Hits)
+	fmt.Fprintf(w, "proxy_dns_cache_lookups_total{result=\"miss\"} %v\n", dnsCache.Misses)
+}
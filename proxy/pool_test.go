@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Transport counting its closed idle connections
+type closingTransport struct {
+	http.RoundTripper
+	closed int
+}
+
+func (t *closingTransport) CloseIdleConnections() {
+	t.closed++
+}
+
+// The cached transports are bounded, evicting the least recently used, and forgotten once idle
+func TestRecipientTransportsBounded(t *testing.T) {
+	recipientTransports.Lock()
+	transports := recipientTransports.Transports
+	recipientTransports.Transports = map[recipientTransportKey]*cachedTransport{}
+	recipientTransports.Unlock()
+
+	defer func() {
+		recipientTransports.Lock()
+		recipientTransports.Transports = transports
+		recipientTransports.Unlock()
+	}()
+
+	var created []*closingTransport
+	newTransport := func(*tls.Config, poolSettings) http.RoundTripper {
+		transport := &closingTransport{}
+		created = append(created, transport)
+		return transport
+	}
+
+	for i := 0; i < maxRecipientTransports; i++ {
+		cachedRecipientTransport("http", fmt.Sprintf("recipient-%v:80", i), nil, newTransport)
+	}
+
+	// Use the first transport again, so the second is the least recently used
+	cachedRecipientTransport("http", "recipient-0:80", nil, newTransport)
+	cachedRecipientTransport("http", "new:80", nil, newTransport)
+
+	if len(created) != maxRecipientTransports+1 || created[0].closed != 0 || created[1].closed != 1 {
+		t.Fatalf("did not evict the least recently used transport")
+	}
+
+	recipientTransports.Lock()
+	cached := len(recipientTransports.Transports)
+	for key, transport := range recipientTransports.Transports {
+		if key.Host != "new:80" {
+			transport.LastUsed = time.Now().Add(-2 * RecipientPoolIdleTimeout)
+		}
+	}
+	recipientTransports.Unlock()
+
+	if cached != maxRecipientTransports {
+		t.Errorf("cached %v transports, expected %v", cached, maxRecipientTransports)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		recipientTransports.Lock()
+		cached = len(recipientTransports.Transports)
+		recipientTransports.Unlock()
+
+		if cached == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%v idle transports are still cached", cached)
+		}
+	}
+
+	if created[0].closed != 1 {
+		t.Errorf("the idle connections of a forgotten transport were not closed")
+	}
+}
+
+// The pool metrics have no labels of the hosts senders choose
+func TestPoolMetricsUnlabeled(t *testing.T) {
+	var w strings.Builder
+	writePoolMetrics(&w)
+
+	if strings.Contains(w.String(), "host=") {
+		t.Errorf("the pool metrics are labeled by host:\n%v", w.String())
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of messages a queue sink holds before dropping new ones, and publishes at once
+const (
+	queueSinkBuffer = 4096
+	queueSinkBatch  = 100
+)
+
+// Number of times a queue sink publishes a batch before dropping its messages
+const queueSinkAttempts = 5
+
+// Time a queue sink waits after failing to publish, twice as long after each failure up to queueSinkMaxBackoff
+var (
+	queueSinkBackoff    = 200 * time.Millisecond
+	queueSinkMaxBackoff = 5 * time.Second
+)
+
+// QueueMessage is a message published to a message queue, keyed by request ID
+type QueueMessage struct {
+	Key   string
+	Value []byte
+}
+
+// QueuePublisher publishes messages to a message queue
+// Publishers publishing some of the messages return a *PartialPublishError, so only the others are published again
+type QueuePublisher interface {
+	Publish(messages []QueueMessage) error
+}
+
+// PartialPublishError is the error of a publish in which only some messages failed
+type PartialPublishError struct {
+	Failed []QueueMessage
+	Err    error
+}
+
+func (e *PartialPublishError) Error() string {
+	return fmt.Sprintf("%v messages failed to be published: %v", len(e.Failed), e.Err)
+}
+
+func (e *PartialPublishError) Unwrap() error {
+	return e.Err
+}
+
+// Publishes the dead letters, and delivery receipts, as messages to a message queue in the background
+// Messages are dropped rather than blocking the requests when the queue can not keep up
+type queueSink struct {
+	Name      string
+	Publisher QueuePublisher
+
+	messages chan QueueMessage
+}
+
+// Queue sinks by the deadLetter annotation, reused across config updates so their publishers are not leaked
+var queueSinks struct {
+	sync.Mutex
+	Sinks map[string]*queueSink
+}
+
+// Returns the queue sink of the annotation, starting its publisher on first use
+func queueSinkFor(value string, publisher func() (QueuePublisher, error)) (*queueSink, error) {
+	queueSinks.Lock()
+	defer queueSinks.Unlock()
+
+	if sink, ok := queueSinks.Sinks[value]; ok {
+		return sink, nil
+	}
+
+	p, err := publisher()
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &queueSink{Name: value, Publisher: p, messages: make(chan QueueMessage, queueSinkBuffer)}
+	go sink.publish()
+
+	if queueSinks.Sinks == nil {
+		queueSinks.Sinks = map[string]*queueSink{}
+	}
+
+	queueSinks.Sinks[value] = sink
+	return sink, nil
+}
+
+// Publishes the messages in batches as they come
+func (s *queueSink) publish() {
+	for message := range s.messages {
+		batch := []QueueMessage{message}
+		for len(batch) < queueSinkBatch {
+			select {
+			case message := <-s.messages:
+				batch = append(batch, message)
+				continue
+			default:
+			}
+
+			break
+		}
+
+		s.publishBatch(batch)
+	}
+}
+
+// Publishes a batch, publishing the messages that failed again with backoff, and dropping them once out of attempts
+func (s *queueSink) publishBatch(batch []QueueMessage) {
+	backoff := queueSinkBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.Publisher.Publish(batch)
+		if err == nil {
+			return
+		}
+
+		var partial *PartialPublishError
+		if errors.As(err, &partial) {
+			batch = partial.Failed
+		}
+
+		if attempt == queueSinkAttempts {
+			atomic.AddUint64(&state.FailedMessagesCounter, uint64(len(batch)))
+			debugPrint(1, "[!] Dropped %v messages after failing to publish them to %v %v times: %v", len(batch), s.Name, attempt, err)
+			return
+		}
+
+		debugPrint(2, "[!] Failed to publish %v messages to %v, retrying in %v: %v", len(batch), s.Name, backoff, err)
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > queueSinkMaxBackoff {
+			backoff = queueSinkMaxBackoff
+		}
+	}
+}
+
+// Queues the encoded message, the queues having no headers for the binary format
+func (s *queueSink) enqueue(key string, body []byte, err error) {
+	if err != nil {
+		log.Printf("[!] Failed to encode message %v: %v", key, err)
+		return
+	}
+
+	select {
+	case s.messages <- QueueMessage{Key: key, Value: body}:
+	default:
+		atomic.AddUint64(&state.DroppedMessagesCounter, 1)
+		debugPrint(1, "[!] Dropped message %v, %v is not keeping up", key, s.Name)
+	}
+}
+
+func (s *queueSink) Write(letter *DeadLetter) {
+	body, _, err := encodeDeadLetter(letter, false)
+	s.enqueue(letter.RequestID, body, err)
+}
+
+func (s *queueSink) WriteReceipt(receipt *DeliveryReceipt) {
+	body, _, err := encodeReceipt(receipt, false)
+	s.enqueue(receipt.RequestID, body, err)
+}
+
+// Produces messages to a Kafka topic through a Kafka REST proxy (v2 API), at the topic's URL, e.g.
+// http://rest-proxy:8082/topics/failed
+type kafkaRESTPublisher struct {
+	URL    string
+	Client *http.Client
+}
+
+func (p *kafkaRESTPublisher) Publish(messages []QueueMessage) error {
+	type record struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+
+	var records struct {
+		Records []record `json:"records"`
+	}
+
+	for _, message := range messages {
+		records.Records = append(records.Records, record{Key: message.Key, Value: message.Value})
+	}
+
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.Client.Post(p.URL, "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the Kafka REST proxy answered %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Sends messages to an Amazon SQS queue at its URL, e.g. https://sqs.us-east-1.amazonaws.com/123456789012/failed,
+// signing the requests with the credentials of the environment (see awsCredentialsOf). The messages of FIFO queues
+// are grouped and deduplicated by their key
+type sqsPublisher struct {
+	URL    *url.URL
+	Region string
+	Client *http.Client
+
+	// STSEndpoint is the URL of the AWS STS the credentials of a web identity are exchanged at
+	STSEndpoint string
+
+	// Credentials of the web identity, until they are about to expire
+	mu          sync.Mutex
+	credentials *awsCredentials
+}
+
+// Returns a publisher to the SQS queue at the URL, whose region is taken from its host or else AWS_REGION
+func newSQSPublisher(queueURL string) (*sqsPublisher, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("SQS queue URL %v is invalid", queueURL)
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if parts := strings.Split(u.Hostname(), "."); len(parts) >= 4 && parts[0] == "sqs" {
+		region = parts[1]
+	}
+
+	if region == "" {
+		return nil, fmt.Errorf("the region of SQS queue %v is unknown, set AWS_REGION", queueURL)
+	}
+
+	return &sqsPublisher{
+		URL:         u,
+		Region:      region,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		STSEndpoint: fmt.Sprintf("https://sts.%v.amazonaws.com/", region),
+	}, nil
+}
+
+// Sends the messages one by one, going on past the ones that fail
+func (p *sqsPublisher) Publish(messages []QueueMessage) error {
+	credentials, err := p.awsCredentials()
+	if err != nil {
+		return err
+	}
+
+	var failed []QueueMessage
+	var lastErr error
+	for _, message := range messages {
+		if err := p.send(message, credentials); err != nil {
+			failed = append(failed, message)
+			lastErr = err
+		}
+	}
+
+	if len(failed) != 0 {
+		return &PartialPublishError{Failed: failed, Err: lastErr}
+	}
+
+	return nil
+}
+
+// Sends a single message to the queue
+func (p *sqsPublisher) send(message QueueMessage, credentials *awsCredentials) error {
+	form := url.Values{
+		"Action":      {"SendMessage"},
+		"Version":     {"2012-11-05"},
+		"MessageBody": {string(message.Value)},
+	}
+
+	if strings.HasSuffix(p.URL.Path, ".fifo") {
+		form.Set("MessageGroupId", message.Key)
+		form.Set("MessageDeduplicationId", message.Key)
+	}
+
+	body := []byte(form.Encode())
+
+	req, err := http.NewRequest(http.MethodPost, p.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signAWSRequest(req, body, p.Region, "sqs", time.Now(), credentials)
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("SQS answered %v to message %v", resp.StatusCode, message.Key)
+	}
+
+	return nil
+}
+
+// AWS credentials, temporary ones expiring
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// Returns the credentials of the environment: those of the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables, or else of the web identity of AWS_WEB_IDENTITY_TOKEN_FILE assuming
+// AWS_ROLE_ARN, as set up by IAM roles for service accounts (IRSA) on EKS
+func (p *sqsPublisher) awsCredentials() (*awsCredentials, error) {
+	if accessKey := os.Getenv("AWS_ACCESS_KEY_ID"); accessKey != "" {
+		return &awsCredentials{
+			AccessKeyID:     accessKey,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return nil, fmt.Errorf("no AWS credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Renew the credentials ahead of their expiry, so requests are not signed with credentials expiring in flight
+	if p.credentials != nil && time.Until(p.credentials.Expires) > 5*time.Minute {
+		return p.credentials, nil
+	}
+
+	credentials, err := assumeRoleWithWebIdentity(p.Client, p.STSEndpoint, tokenFile, roleARN)
+	if err != nil {
+		return nil, err
+	}
+
+	p.credentials = credentials
+	return credentials, nil
+}
+
+// Exchanges the web identity token of the file, read again each time as it is rotated, for temporary credentials of
+// the role at the STS endpoint
+func assumeRoleWithWebIdentity(client *http.Client, endpoint string, tokenFile string, roleARN string) (*awsCredentials, error) {
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "proxy-" + ProxyName
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("STS answered %v to assuming role %v", resp.StatusCode, roleARN)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("STS answered invalid credentials for role %v: %v", roleARN, err)
+	}
+
+	return &awsCredentials{
+		AccessKeyID:     result.Credentials.AccessKeyID,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+		Expires:         result.Credentials.Expiration,
+	}, nil
+}
+
+// Signs the request with AWS Signature Version 4, with the credentials
+func signAWSRequest(req *http.Request, body []byte, region string, service string, now time.Time, credentials *awsCredentials) {
+	accessKey := credentials.AccessKeyID
+	secretKey := credentials.SecretAccessKey
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if token := credentials.SessionToken; token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	// Every header set so far is signed
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	payloadHash := sha256.Sum256(body)
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := fmt.Sprintf("%v/%v/%v/aws4_request", date, region, service)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Fake SQS queue recording the messages it received, failing the ones with the bodies to fail
+type fakeSQS struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received []string
+	headers  []http.Header
+	fail     map[string]bool
+}
+
+func newFakeSQS(t *testing.T, fail ...string) *fakeSQS {
+	q := &fakeSQS{fail: map[string]bool{}}
+	for _, body := range fail {
+		q.fail[body] = true
+	}
+
+	q.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		body := r.Form.Get("MessageBody")
+		if q.fail[body] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		q.received = append(q.received, body)
+		q.headers = append(q.headers, r.Header)
+	}))
+
+	t.Cleanup(q.Close)
+	return q
+}
+
+func (q *fakeSQS) publisher(t *testing.T) *sqsPublisher {
+	u, _ := url.Parse(q.URL + "/123456789012/queue")
+	return &sqsPublisher{URL: u, Region: "us-east-1", Client: q.Client()}
+}
+
+// Messages failing to be sent do not stop the others, and are returned to be published again
+func TestSQSPublishPartial(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	q := newFakeSQS(t, "b")
+
+	err := q.publisher(t).Publish([]QueueMessage{{Key: "a", Value: []byte("a")}, {Key: "b", Value: []byte("b")}, {Key: "c", Value: []byte("c")}})
+
+	var partial *PartialPublishError
+	if !errors.As(err, &partial) || len(partial.Failed) != 1 || partial.Failed[0].Key != "b" {
+		t.Fatalf("got error %v, expected only message b to fail", err)
+	}
+
+	if strings.Join(q.received, ",") != "a,c" {
+		t.Errorf("the queue received %v, expected a and c", q.received)
+	}
+}
+
+// Publisher failing the messages other than a until its failures run out
+type flakyPublisher struct {
+	failures  int
+	published []string
+}
+
+func (p *flakyPublisher) Publish(messages []QueueMessage) error {
+	var failed []QueueMessage
+	for _, message := range messages {
+		if p.failures > 0 && message.Key != "a" {
+			failed = append(failed, message)
+			continue
+		}
+
+		p.published = append(p.published, message.Key)
+	}
+
+	if len(failed) != 0 {
+		p.failures--
+		return &PartialPublishError{Failed: failed, Err: fmt.Errorf("unavailable")}
+	}
+
+	return nil
+}
+
+// Failed messages are published again with backoff, and counted once dropped
+func TestQueueSinkRetries(t *testing.T) {
+	defer func(backoff time.Duration) { queueSinkBackoff = backoff }(queueSinkBackoff)
+	queueSinkBackoff = time.Millisecond
+
+	batch := []QueueMessage{{Key: "a"}, {Key: "b"}}
+
+	publisher := &flakyPublisher{failures: queueSinkAttempts - 1}
+	(&queueSink{Name: "flaky", Publisher: publisher}).publishBatch(batch)
+
+	if strings.Join(publisher.published, ",") != "a,b" {
+		t.Errorf("published %v, expected a then the failed message b", publisher.published)
+	}
+
+	failed := atomic.LoadUint64(&state.FailedMessagesCounter)
+
+	publisher = &flakyPublisher{failures: queueSinkAttempts}
+	(&queueSink{Name: "failing", Publisher: publisher}).publishBatch(batch)
+
+	if strings.Join(publisher.published, ",") != "a" || atomic.LoadUint64(&state.FailedMessagesCounter) != failed+1 {
+		t.Errorf("published %v and counted %v dropped messages, expected message b dropped", publisher.published, atomic.LoadUint64(&state.FailedMessagesCounter)-failed)
+	}
+}
+
+// Without static credentials, the web identity of IRSA is exchanged for credentials, which are reused until expiring
+func TestSQSWebIdentity(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("web-identity-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/proxy")
+
+	var exchanges int32
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "web-identity-token" || r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/proxy" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		atomic.AddInt32(&exchanges, 1)
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIATEST</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session-token</SessionToken>
+      <Expiration>%v</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer sts.Close()
+
+	q := newFakeSQS(t)
+	publisher := q.publisher(t)
+	publisher.STSEndpoint = sts.URL
+
+	for _, key := range []string{"a", "b"} {
+		if err := publisher.Publish([]QueueMessage{{Key: key, Value: []byte(key)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if exchanges != 1 {
+		t.Errorf("exchanged the web identity %v times, expected once", exchanges)
+	}
+
+	for _, header := range q.headers {
+		if header.Get("X-Amz-Security-Token") != "session-token" || !strings.Contains(header.Get("Authorization"), "Credential=ASIATEST/") {
+			t.Errorf("the message was not signed with the credentials of the web identity: %v", header)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// RecipientAdapter forwards requests to a kind of recipient, selected through the Proxy-Recipient header
+type RecipientAdapter interface {
+	// Transport returns the transport to reach the recipient at the URL with, over TLS with the config
+	Transport(u *url.URL, tlsConfig *tls.Config) http.RoundTripper
+
+	// PrepareRequest adapts the sender's request to the recipient
+	PrepareRequest(req *http.Request, body []byte) error
+
+	// AdaptResponse adapts the recipient's response back to the sender, returning the body to send
+	AdaptResponse(resp *http.Response, body []byte) ([]byte, error)
+}
+
+// RecipientAdapters are the adapters selectable through the Proxy-Recipient header
+var RecipientAdapters = map[string]RecipientAdapter{
+	"http":           &httpRecipient{},
+	"grpc":           &grpcRecipient{},
+	"grpc-transcode": &grpcRecipient{Transcode: true},
+}
+
+// Returns the adapter of the Proxy-Recipient header, defaulting to plain HTTP
+func recipientAdapterOf(value string) (RecipientAdapter, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		value = "http"
+	}
+
+	adapter, ok := RecipientAdapters[value]
+	return adapter, ok
+}
+
+// Forwards requests as they are to plain HTTP(S) recipients
+type httpRecipient struct{}
+
+func (*httpRecipient) Transport(u *url.URL, tlsConfig *tls.Config) http.RoundTripper {
+	return cachedRecipientTransport("http", u.Host, tlsConfig, newHTTPTransport)
+}
+
+func (*httpRecipient) PrepareRequest(req *http.Request, body []byte) error {
+	return nil
+}
+
+func (*httpRecipient) AdaptResponse(resp *http.Response, body []byte) ([]byte, error) {
+	return body, nil
+}
+
+// Forwards requests to gRPC recipients over HTTP/2
+type grpcRecipient struct {
+	// Transcode sends the request body as the single message of a unary call and returns the response message,
+	// otherwise requests already in the gRPC wire format are tunneled as they are
+	Transcode bool
+}
+
+// Returns a new transport to gRPC recipients over TLS
+func newGRPCTransport(tlsConfig *tls.Config, settings poolSettings) http.RoundTripper {
+	return &http2.Transport{
+		TLSClientConfig: tlsConfig,
+		IdleConnTimeout: time.Duration(settings.IdleConnTimeout) * time.Second,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := dialRecipient(context.Background(), network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConn := tls.Client(conn, cfg)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+
+			return tlsConn, nil
+		},
+	}
+}
+
+// Returns a new transport to gRPC recipients over plaintext HTTP/2 (h2c)
+func newGRPCPlaintextTransport(tlsConfig *tls.Config, settings poolSettings) http.RoundTripper {
+	return &http2.Transport{
+		AllowHTTP:       true,
+		IdleConnTimeout: time.Duration(settings.IdleConnTimeout) * time.Second,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return dialRecipient(context.Background(), network, addr)
+		},
+	}
+}
+
+// Maps gRPC status codes to the HTTP status codes of transcoded responses
+var grpcHTTPStatus = map[int]int{
+	0:  http.StatusOK,
+	1:  499,
+	2:  http.StatusInternalServerError,
+	3:  http.StatusBadRequest,
+	4:  http.StatusGatewayTimeout,
+	5:  http.StatusNotFound,
+	6:  http.StatusConflict,
+	7:  http.StatusForbidden,
+	8:  http.StatusTooManyRequests,
+	9:  http.StatusBadRequest,
+	10: http.StatusConflict,
+	11: http.StatusBadRequest,
+	12: http.StatusNotImplemented,
+	13: http.StatusInternalServerError,
+	14: http.StatusServiceUnavailable,
+	15: http.StatusInternalServerError,
+	16: http.StatusUnauthorized,
+}
+
+var errGRPCCompressed = errors.New("compressed gRPC messages are not supported")
+
+func (*grpcRecipient) Transport(u *url.URL, tlsConfig *tls.Config) http.RoundTripper {
+	if u.Scheme == "http" {
+		return cachedRecipientTransport("grpc+h2c", u.Host, nil, newGRPCPlaintextTransport)
+	}
+
+	return cachedRecipientTransport("grpc", u.Host, tlsConfig, newGRPCTransport)
+}
+
+func (g *grpcRecipient) PrepareRequest(req *http.Request, body []byte) error {
+	req.Header.Set("Te", "trailers")
+
+	if !g.Transcode {
+		if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+			return errors.New("tunneled gRPC requests must have an application/grpc content type")
+		}
+
+		return nil
+	}
+
+	// Frame the body as an uncompressed message
+	framed := make([]byte, 5+len(body))
+	binary.BigEndian.PutUint32(framed[1:5], uint32(len(body)))
+	copy(framed[5:], body)
+
+	req.Method = http.MethodPost
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.ContentLength = int64(len(framed))
+	req.Body = ioutil.NopCloser(bytes.NewReader(framed))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(framed)), nil
+	}
+
+	return nil
+}
+
+func (g *grpcRecipient) AdaptResponse(resp *http.Response, body []byte) ([]byte, error) {
+	if !g.Transcode {
+		return body, nil
+	}
+
+	// Trailers-only responses carry the status in the headers
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+
+	resp.Header.Set("Grpc-Status", status)
+	resp.Header.Del("Content-Type")
+	resp.Header.Del("Content-Length")
+	resp.Trailer = nil
+
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		code = 2
+	}
+
+	if code != 0 {
+		httpStatus, ok := grpcHTTPStatus[code]
+		if !ok {
+			httpStatus = http.StatusInternalServerError
+		}
+
+		resp.StatusCode = httpStatus
+
+		resp.Header.Set("Grpc-Message", message)
+		return []byte(message), nil
+	}
+
+	// Unframe the response message
+	resp.Header.Set("Content-Type", "application/x-protobuf")
+	if len(body) == 0 {
+		return body, nil
+	}
+
+	if len(body) < 5 || int64(binary.BigEndian.Uint32(body[1:5])) > int64(len(body)-5) {
+		return nil, errors.New("malformed gRPC response message")
+	}
+
+	if body[0] != 0 {
+		return nil, errGRPCCompressed
+	}
+
+	return body[5 : 5+binary.BigEndian.Uint32(body[1:5])], nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Returns the message framed in the gRPC wire format, uncompressed
+func grpcFrame(message string) []byte {
+	framed := make([]byte, 5+len(message))
+	binary.BigEndian.PutUint32(framed[1:5], uint32(len(message)))
+	copy(framed[5:], message)
+	return framed
+}
+
+// Returns a plaintext gRPC recipient answering the messages of /Echo with them, and failing /Missing as not found
+func newGRPCRecipient(t *testing.T) *httptest.Server {
+	recipient := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Te") != "trailers" || r.Header.Get("Content-Type") != "application/grpc+proto" && r.Header.Get("Content-Type") != "application/grpc" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+		if r.URL.Path == "/Missing" {
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "no such method")
+			return
+		}
+
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+
+	t.Cleanup(recipient.Close)
+	return recipient
+}
+
+// Transcoded requests are sent as the message of a unary call, and answered with the response message or status
+func TestGRPCTranscode(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) { next.ProxyTimeout = 5000 })
+
+	recipient := newGRPCRecipient(t)
+
+	r := newForwardRequest(http.MethodPut, recipient.URL+"/Echo", "message")
+	r.Header.Set("Proxy-Recipient", "grpc-transcode")
+
+	w := serveProxy(r)
+	if w.Code != http.StatusOK || w.Body.String() != "message" || w.Header().Get("Content-Type") != "application/x-protobuf" || w.Header().Get("Grpc-Status") != "0" {
+		t.Errorf("got status %v, %v and body %q, expected the response message", w.Code, w.Header(), w.Body.String())
+	}
+
+	r = newForwardRequest(http.MethodPost, recipient.URL+"/Missing", "message")
+	r.Header.Set("Proxy-Recipient", "grpc-transcode")
+
+	if w := serveProxy(r); w.Code != http.StatusNotFound || w.Body.String() != "no such method" || w.Header().Get("Grpc-Status") != "5" {
+		t.Errorf("got status %v, %v and body %q, expected NOT_FOUND as a 404", w.Code, w.Header(), w.Body.String())
+	}
+}
+
+// Tunneled requests are sent as they are, their response returned with its trailers
+func TestGRPCTunnel(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) { next.ProxyTimeout = 5000 })
+
+	recipient := newGRPCRecipient(t)
+
+	r := newForwardRequest(http.MethodPost, recipient.URL+"/Echo", string(grpcFrame("message")))
+	r.Header.Set("Proxy-Recipient", "grpc")
+	r.Header.Set("Content-Type", "application/grpc")
+
+	w := serveProxy(r)
+	if w.Code != http.StatusOK || w.Body.String() != string(grpcFrame("message")) || w.Result().Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("got status %v, body %q and trailers %v, expected the framed message and an OK status", w.Code, w.Body.String(), w.Result().Trailer)
+	}
+
+	// Requests not in the gRPC wire format are not tunneled
+	r = newForwardRequest(http.MethodPost, recipient.URL+"/Echo", "message")
+	r.Header.Set("Proxy-Recipient", "grpc")
+
+	if w := serveProxy(r); w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %v tunneling a request without a gRPC content type, expected 500", w.Code)
+	}
+
+	r = newForwardRequest(http.MethodPost, recipient.URL+"/Echo", "message")
+	r.Header.Set("Proxy-Recipient", "carrier-pigeon")
+
+	if w := serveProxy(r); w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %v for an unknown Proxy-Recipient, expected 500", w.Code)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RecipientTLSConfig is the TLS config of the proxy→recipient hop toward hosts matching a pattern
+type RecipientTLSConfig struct {
+	// CertFile and KeyFile are the client certificate presented to the recipient
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// CAFile is the CA bundle the recipient's certificate is verified with, instead of the system's
+	CAFile string `json:"caFile"`
+
+	// ServerName overrides the name the recipient's certificate is verified against
+	ServerName string `json:"serverName"`
+}
+
+// Parsed recipient TLS config of a host pattern
+type recipientTLS struct {
+	Pattern string
+
+	// Config verifies the recipient, InsecureConfig is used when the sender asked to skip verification
+	Config         *tls.Config
+	InsecureConfig *tls.Config
+}
+
+// TLS config of recipients without a matching pattern when the sender asked to skip verification
+var insecureRecipientTLS = &tls.Config{InsecureSkipVerify: true}
+
+// Client certificate reloaded whenever its files change
+type clientCertificate struct {
+	sync.Mutex
+	CertFile    string
+	KeyFile     string
+	Certificate *tls.Certificate
+	ModTime     time.Time
+}
+
+// Returns the latest client certificate, keeping the previous one if the files are invalid
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var modTime time.Time
+	for _, file := range []string{c.CertFile, c.KeyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	if c.Certificate == nil || modTime.After(c.ModTime) {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			if c.Certificate == nil {
+				return nil, fmt.Errorf("error loading recipient client certificate: %v", err)
+			}
+
+			debugPrint(1, "[!] Failed to reload recipient client certificate: %v", err)
+		} else {
+			c.Certificate = &certificate
+			c.ModTime = modTime
+		}
+	}
+
+	return c.Certificate, nil
+}
+
+// Parses the recipientTLS annotation, a JSON object of TLS configs by host pattern
+func parseRecipientTLS(value string) ([]*recipientTLS, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var configs map[string]RecipientTLSConfig
+	if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return nil, fmt.Errorf("recipientTLS is not a valid JSON object of TLS configs: %v", err)
+	}
+
+	parsed := []*recipientTLS{}
+	for pattern, recipientConfig := range configs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("recipientTLS pattern %v is invalid: %v", pattern, err)
+		}
+
+		tlsConfig := &tls.Config{ServerName: recipientConfig.ServerName}
+
+		if recipientConfig.CAFile != "" {
+			pem, err := ioutil.ReadFile(recipientConfig.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading recipientTLS CAs of %v: %v", pattern, err)
+			}
+
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("found no valid certificates in %v", recipientConfig.CAFile)
+			}
+		}
+
+		if (recipientConfig.CertFile == "") != (recipientConfig.KeyFile == "") {
+			return nil, fmt.Errorf("recipientTLS of %v needs both certFile and keyFile", pattern)
+		}
+
+		if recipientConfig.CertFile != "" {
+			certificate := &clientCertificate{CertFile: recipientConfig.CertFile, KeyFile: recipientConfig.KeyFile}
+			if _, err := certificate.get(nil); err != nil {
+				return nil, err
+			}
+
+			tlsConfig.GetClientCertificate = certificate.get
+		}
+
+		insecureConfig := tlsConfig.Clone()
+		insecureConfig.InsecureSkipVerify = true
+
+		parsed = append(parsed, &recipientTLS{Pattern: pattern, Config: tlsConfig, InsecureConfig: insecureConfig})
+	}
+
+	// Match the most specific (longest) patterns first
+	sort.Slice(parsed, func(i, j int) bool {
+		if len(parsed[i].Pattern) != len(parsed[j].Pattern) {
+			return len(parsed[i].Pattern) > len(parsed[j].Pattern)
+		}
+
+		return parsed[i].Pattern < parsed[j].Pattern
+	})
+
+	return parsed, nil
+}
+
+// Returns the TLS config toward the recipient host, nil for the default
+func (c *proxyConfig) recipientTLSConfig(host string, insecureSkipVerify bool) *tls.Config {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	for _, recipient := range c.RecipientTLS {
+		if matched, _ := path.Match(recipient.Pattern, host); matched {
+			if insecureSkipVerify {
+				return recipient.InsecureConfig
+			}
+
+			return recipient.Config
+		}
+	}
+
+	if insecureSkipVerify {
+		return insecureRecipientTLS
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed client certificate of the common name to the directory, returning its files
+func writeClientCertificate(t *testing.T, dir string, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, commonName+".crt"), filepath.Join(dir, commonName+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return certFile, keyFile
+}
+
+// Recipients matching a pattern are verified with its CAs and presented its client certificate
+func TestRecipientTLS(t *testing.T) {
+	recipient := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.Write([]byte("none"))
+			return
+		}
+
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+
+	recipient.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	recipient.StartTLS()
+	defer recipient.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: recipient.Certificate().Raw}), 0600)
+
+	certFile, keyFile := writeClientCertificate(t, dir, "proxy")
+
+	// Configures the TLS of the recipients matching the pattern
+	withRecipientTLS := func(pattern string) {
+		value, _ := json.Marshal(map[string]RecipientTLSConfig{pattern: {CertFile: certFile, KeyFile: keyFile, CAFile: caFile}})
+
+		parsed, err := parseRecipientTLS(string(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		withConfig(t, func(next *proxyConfig) { next.RecipientTLS, next.ProxyTimeout = parsed, 5000 })
+	}
+
+	withRecipientTLS("127.0.0.*")
+
+	if w := serveProxy(newForwardRequest(http.MethodGet, recipient.URL, "")); w.Code != http.StatusOK || w.Body.String() != "proxy" {
+		t.Errorf("got status %v and body %q, expected the recipient verified and given the client certificate", w.Code, w.Body.String())
+	}
+
+	// Other recipients are verified with the system's CAs, without a client certificate
+	withRecipientTLS("*.example")
+
+	if w := serveProxy(newForwardRequest(http.MethodGet, recipient.URL, "")); w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %v for a recipient not trusted by the system, expected 500", w.Code)
+	}
+
+	r := newForwardRequest(http.MethodGet, recipient.URL, "")
+	r.Header.Set("Insecure-Skip-Verify", "true")
+
+	if w := serveProxy(r); w.Code != http.StatusOK || w.Body.String() != "none" {
+		t.Errorf("got status %v and body %q skipping verification, expected no client certificate", w.Code, w.Body.String())
+	}
+}
+
+func TestRecipientTLSInvalid(t *testing.T) {
+	for _, value := range []string{
+		`["127.0.0.1"]`,
+		`{"[": {}}`,
+		`{"*": {"certFile": "client.crt"}}`,
+		`{"*": {"caFile": "missing.crt"}}`,
+	} {
+		if _, err := parseRecipientTLS(value); err == nil {
+			t.Errorf("recipientTLS %v was accepted", value)
+		}
+	}
+}
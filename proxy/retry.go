@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Returns whether a request with the method can safely be sent to the recipient more than once
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+// Returns whether a failed request to the recipient should be retried
+func shouldRetryRecipientRequest(req *http.Request, resp *http.Response, err error, attempt int64) bool {
+	if attempt > currentConfig().RecipientRetries {
+		return false
+	}
+
+	if !isIdempotentMethod(req.Method) && !currentConfig().RetryAllMethods {
+		return false
+	}
+
+	// The request body has to be resent
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// Does a request to the recipient, retrying according to the retry policy, returning the number of attempts made
+func doRecipientRequest(httpClient *http.Client, req *http.Request) (*http.Response, int64, error) {
+	for attempt := int64(1); ; attempt++ {
+		resp, err := httpClient.Do(req)
+		if !shouldRetryRecipientRequest(req, resp, err, attempt) {
+			return resp, attempt, err
+		}
+
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		debugPrint(2, "[!] Retrying request to %v (attempt %v)", req.URL.String(), attempt)
+
+		// Back off linearly before the next attempt
+		time.Sleep(time.Duration(attempt*currentConfig().RecipientRetryDelay) * time.Millisecond)
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, attempt, err
+			}
+
+			req.Body = body
+		}
+	}
+}
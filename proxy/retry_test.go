@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// Requests failing with a 503 are retried with their body up to recipientRetries times, unless not idempotent
+func TestRecipientRetries(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) {
+		next.RecipientRetries, next.RecipientRetryDelay, next.ProxyTimeout = 2, 1, 5000
+	})
+
+	var attempts int64
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt64(&attempts, 1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write(body)
+	}))
+
+	defer recipient.Close()
+
+	w := serveProxy(newForwardRequest(http.MethodPut, recipient.URL, "order"))
+	if w.Code != http.StatusOK || w.Body.String() != "order" || atomic.LoadInt64(&attempts) != 3 {
+		t.Errorf("got status %v and body %q after %v attempts, expected the third attempt's 200", w.Code, w.Body.String(), atomic.LoadInt64(&attempts))
+	}
+
+	atomic.StoreInt64(&attempts, 0)
+
+	if w := serveProxy(newForwardRequest(http.MethodPost, recipient.URL, "order")); w.Code != http.StatusServiceUnavailable || atomic.LoadInt64(&attempts) != 1 {
+		t.Errorf("got status %v after %v attempts of a POST, expected a single 503", w.Code, atomic.LoadInt64(&attempts))
+	}
+
+	atomic.StoreInt64(&attempts, 0)
+	updateConfig(func(next *proxyConfig) { next.RetryAllMethods = true })
+
+	if w := serveProxy(newForwardRequest(http.MethodPost, recipient.URL, "order")); w.Code != http.StatusOK || w.Body.String() != "order" {
+		t.Errorf("got status %v and body %q with retryAllMethods, expected the POST retried", w.Code, w.Body.String())
+	}
+
+	// A single retry fails again
+	atomic.StoreInt64(&attempts, 0)
+	updateConfig(func(next *proxyConfig) { next.RecipientRetries = 1 })
+
+	if w := serveProxy(newForwardRequest(http.MethodGet, recipient.URL, "")); w.Code != http.StatusServiceUnavailable || atomic.LoadInt64(&attempts) != 2 {
+		t.Errorf("got status %v after %v attempts, expected a 503 past the retry", w.Code, atomic.LoadInt64(&attempts))
+	}
+}
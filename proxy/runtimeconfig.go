@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ProxyConfigDir is the directory of a mounted ConfigMap overriding the StatefulSet's annotations
+var ProxyConfigDir = os.Getenv("PROXY_CONFIG_DIR")
+
+// Sources of the proxy config, merged whenever either changes
+var runtimeConfig struct {
+	sync.Mutex
+
+	// Annotations are the StatefulSet's latest annotations, nil until first seen
+	Annotations map[string]string
+
+	// Overrides are the applied values of ProxyConfigDir, one file per config name
+	Overrides map[string]string
+
+	// Read are the latest values read from ProxyConfigDir, even if invalid
+	Read map[string]string
+}
+
+// Reads the config values of ProxyConfigDir, named after their files
+func readConfigDir() (map[string]string, error) {
+	values := map[string]string{}
+	if ProxyConfigDir == "" {
+		return values, nil
+	}
+
+	entries, err := ioutil.ReadDir(ProxyConfigDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// Skip the ..data and timestamped directories of ConfigMap mounts
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(ProxyConfigDir, entry.Name())
+
+		// ConfigMap keys are symlinks, so stat through them
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		values[entry.Name()] = string(value)
+	}
+
+	return values, nil
+}
+
+// Applies the merged annotations and overrides, must be called with runtimeConfig locked
+func applyRuntimeConfig() error {
+	if runtimeConfig.Annotations == nil {
+		return nil
+	}
+
+	merged := map[string]string{}
+	for name, value := range runtimeConfig.Annotations {
+		merged[name] = value
+	}
+
+	for name, value := range runtimeConfig.Overrides {
+		merged[name] = value
+	}
+
+	return updateProxyConfig(merged)
+}
+
+// Updates the config from new StatefulSet annotations
+func updateAnnotations(annotations map[string]string) error {
+	runtimeConfig.Lock()
+	defer runtimeConfig.Unlock()
+
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	runtimeConfig.Annotations = annotations
+	return applyRuntimeConfig()
+}
+
+// Returns whether two sets of config values are the same
+func sameConfigValues(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reloads ProxyConfigDir on SIGHUP or when its values change, keeping the previous config if invalid
+func watchConfigDir() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-hangup:
+			debugPrint(1, "[+] Got SIGHUP, reloading config directory")
+		case <-time.After(10 * time.Second):
+		}
+
+		overrides, err := readConfigDir()
+		if err != nil {
+			debugPrint(1, "[!] Failed to read config directory: %v", err)
+			continue
+		}
+
+		runtimeConfig.Lock()
+		if !sameConfigValues(overrides, runtimeConfig.Read) {
+			runtimeConfig.Read = overrides
+			previous := runtimeConfig.Overrides
+			runtimeConfig.Overrides = overrides
+
+			if err := applyRuntimeConfig(); err != nil {
+				debugPrint(1, "[!] Ignoring invalid config directory: %v", err)
+				runtimeConfig.Overrides = previous
+			} else {
+				debugPrint(1, "[+] Applied config directory")
+			}
+		}
+		runtimeConfig.Unlock()
+	}
+}
+
+// Loads ProxyConfigDir and starts watching it for changes
+func startConfigDirWatcher() {
+	if ProxyConfigDir == "" {
+		return
+	}
+
+	overrides, err := readConfigDir()
+	if err != nil {
+		log.Fatalf("[!] Failed to read config directory: %v", err)
+	}
+
+	runtimeConfig.Lock()
+	runtimeConfig.Overrides = overrides
+	runtimeConfig.Read = overrides
+	runtimeConfig.Unlock()
+
+	go watchConfigDir()
+}
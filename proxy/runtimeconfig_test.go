@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Reloads publish a new config, leaving the one requests already loaded as it was
+func TestConfigSnapshot(t *testing.T) {
+	defer updateProxyConfig(map[string]string{})
+
+	before := currentConfig()
+
+	err := updateProxyConfig(map[string]string{
+		"transforms":     `[{"type": "setHeader", "name": "X-Env", "value": "prod", "response": true}]`,
+		"responseFilter": `{"stripHeaders": ["Set-Cookie"]}`,
+		"tenantLimits":   `{"*": {"maxRequests": 1}}`,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := currentConfig()
+	if len(after.Transforms) != 1 || after.ResponseFilter == nil || len(after.TenantLimits) != 1 {
+		t.Fatalf("the reloaded config was not published")
+	}
+
+	if len(before.Transforms) != 0 || before.ResponseFilter != nil || len(before.TenantLimits) != 0 {
+		t.Errorf("the config loaded before the reload was modified")
+	}
+
+	// Requests applying their config while it is reloaded, caught by the race detector if it is modified in place
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			resp := &http.Response{Header: http.Header{}}
+			if _, err := applyResponseTransforms(currentConfig(), resp, nil); err != nil {
+				t.Error(err)
+				return
+			}
+
+			limitsOf("tenant")
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		updateProxyConfig(map[string]string{"tenantLimits": `{"*": {"maxRequests": 2}}`})
+	}
+
+	wg.Wait()
+}
+
+// Requests in flight while the config is reloaded see one version of it from start to end, caught by the race detector
+// if the config is written in place
+func TestReloadWhileForwarding(t *testing.T) {
+	defer updateProxyConfig(map[string]string{})
+
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Received-Version", r.Header.Get("X-Version"))
+	}))
+
+	defer recipient.Close()
+
+	// Each version sets its number on the requests and on their responses, along with other limits and sinks
+	reload := func(version int) error {
+		return updateProxyConfig(map[string]string{
+			"transforms": fmt.Sprintf(`[{"type": "setHeader", "name": "X-Version", "value": "%v"},
+				{"type": "setHeader", "name": "X-Version", "value": "%v", "response": true}]`, version, version),
+			"maxRequests":      fmt.Sprint(100 + version%2),
+			"capacityStrategy": []string{"fixed", "latency"}[version%2],
+			"accessLog":        []string{"none", "stderr"}[version%3/2],
+			"retryAllMethods":  fmt.Sprint(version % 2),
+		})
+	}
+
+	if err := reload(0); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for version := 1; version <= 100; version++ {
+			if err := reload(version); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				r := httptest.NewRequest(http.MethodPost, "/", nil)
+				r.Header.Set("Forward-To", recipient.URL)
+				w := httptest.NewRecorder()
+				httpHandler(w, r)
+
+				if w.Code != http.StatusOK {
+					t.Errorf("got status %v while reloading", w.Code)
+					return
+				}
+
+				if sent, received := w.Header().Get("X-Version"), w.Header().Get("X-Received-Version"); sent == "" || sent != received {
+					t.Errorf("the response was transformed by version %v of the config, the request by version %v", sent, received)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	<-done
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Returns the time before which the request must not be forwarded, the zero time if it is not scheduled
+// Proxy-Delay is a delay in milliseconds and Proxy-Not-Before an RFC 3339 time, the later one is used if both are set
+func requestNotBefore(header http.Header) (time.Time, error) {
+	var notBefore time.Time
+
+	if delay := strings.TrimSpace(header.Get("Proxy-Delay")); delay != "" {
+		value, err := strconv.ParseUint(delay, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Proxy-Delay is not a number of milliseconds: %v", err)
+		}
+
+		notBefore = time.Now().Add(time.Duration(value) * time.Millisecond)
+	}
+
+	if value := strings.TrimSpace(header.Get("Proxy-Not-Before")); value != "" {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Proxy-Not-Before is not an RFC 3339 time: %v", err)
+		}
+
+		if t.After(notBefore) {
+			notBefore = t
+		}
+	}
+
+	return notBefore, nil
+}
+
+// Handles a request scheduled for later if it is, returns false if it must be forwarded now
+// The request is answered with a 202 and its affinity token, and held until its time before being admitted
+func handleScheduledRequest(w http.ResponseWriter, r *http.Request, forwardTo string) bool {
+	notBefore, err := requestNotBefore(r.Header)
+	if err != nil {
+		writeProxyMetrics(w, http.StatusBadRequest)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return true
+	}
+
+	if !notBefore.After(time.Now()) {
+		return false
+	}
+
+	if time.Until(notBefore) > time.Duration(currentConfig().MaxDelay)*time.Second {
+		writeProxyMetrics(w, http.StatusBadRequest)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("requests can not be scheduled more than %v seconds ahead", currentConfig().MaxDelay)))
+		return true
+	}
+
+	// Are we draining, or holding too many scheduled requests?
+	if atomic.LoadInt32(&state.Draining) != 0 {
+		writeProxyMetrics(w, http.StatusTooManyRequests)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return true
+	}
+
+	if atomic.AddInt64(&state.ScheduledRequests, 1) > currentConfig().MaxScheduledRequests {
+		atomic.AddInt64(&state.ScheduledRequests, -1)
+		writeProxyMetrics(w, http.StatusTooManyRequests)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return true
+	}
+
+	// Read the body to hold it
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		atomic.AddInt64(&state.ScheduledRequests, -1)
+
+		current := currentConfig()
+		// Did the body exceed maxBodyBytes?
+		if current.MaxBodyBytes > 0 && int64(len(body)) >= current.MaxBodyBytes {
+			writeProxyMetrics(w, http.StatusRequestEntityTooLarge)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return true
+		}
+
+		writeProxyMetrics(w, http.StatusInternalServerError)
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+
+	header := r.Header.Clone()
+	header.Del("Forward-To")
+	header.Del("Proxy-Delay")
+	header.Del("Proxy-Not-Before")
+
+	// Proxy-Request-Id identifies the request in the access log, generate one if the sender did not
+	requestID := strings.TrimSpace(header.Get("Proxy-Request-Id"))
+	if requestID == "" {
+		requestID = newRequestID()
+		header.Set("Proxy-Request-Id", requestID)
+	}
+
+	item := batchItem{ForwardTo: forwardTo, Method: r.Method, Header: header, Body: body}
+	priority := r.Header.Get("Proxy-Priority")
+	sender := requestSender(r)
+	tenant := requestTenant(r)
+
+	// The outcome is kept for follow-ups, which can also cancel the request before its time
+	job := newAffinityJob(context.Background())
+	token := registerAffinityJob(job)
+
+	debugPrint(3, "[>] Scheduled request %v to %v at %v", requestID, forwardTo, notBefore)
+
+	go func() {
+		defer atomic.AddInt64(&state.ScheduledRequests, -1)
+
+		timer := time.NewTimer(time.Until(notBefore))
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-job.Context.Done():
+			finishAffinityJob(job, nil, nil, job.Context.Err())
+			return
+		}
+
+		result := submitBackgroundRequest(item, priority, sender, tenant, time.Time{}, job)
+		if result.Status != http.StatusAccepted {
+			debugPrint(2, "[!] Scheduled request %v was not forwarded: %v %v", requestID, result.Status, result.Error)
+			job.Expired = result.Status == http.StatusGatewayTimeout
+			finishAffinityJob(job, nil, nil, fmt.Errorf("scheduled request was not forwarded (%v): %v", result.Status, result.Error))
+		}
+	}()
+
+	if token != "" {
+		w.Header().Set("Proxy-Affinity", token)
+	}
+
+	w.Header().Set("Proxy-Request-Id", requestID)
+	w.Header().Set("Proxy-Not-Before", notBefore.UTC().Format(time.RFC3339Nano))
+	writeProxyMetrics(w, http.StatusAccepted)
+	w.WriteHeader(http.StatusAccepted)
+
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Requests with a Proxy-Delay are answered with a 202 and forwarded once their time comes
+func TestScheduledRequest(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) { next.AffinityTTL, next.ProxyTimeout = 60, 5000 })
+
+	received := make(chan *http.Request, 1)
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+
+	defer recipient.Close()
+
+	r := newForwardRequest(http.MethodPost, recipient.URL, "order")
+	r.Header.Set("Proxy-Delay", "100")
+	start := time.Now()
+
+	w := serveProxy(r)
+	token := w.Header().Get("Proxy-Affinity")
+	if w.Code != http.StatusAccepted || token == "" || w.Header().Get("Proxy-Not-Before") == "" || w.Header().Get("Proxy-Request-Id") == "" {
+		t.Fatalf("got status %v and headers %v, expected a 202 with a token", w.Code, w.Header())
+	}
+
+	select {
+	case r := <-received:
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("the recipient received the request after %v, expected 100ms", elapsed)
+		}
+
+		if r.Header.Get("Proxy-Delay") != "" || r.Header.Get("Forward-To") != "" {
+			t.Errorf("the recipient received the scheduling headers %v", r.Header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the recipient never received the scheduled request")
+	}
+
+	if w := serveProxy(newAffinityRequest(http.MethodGet, token)); w.Code != http.StatusCreated || w.Body.String() != "order" {
+		t.Errorf("got status %v and body %q following up, expected the recipient's response", w.Code, w.Body.String())
+	}
+}
+
+// Scheduled requests are cancelled by a DELETE of their token, and bounded in number and delay
+func TestScheduledRequestLimits(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) { next.AffinityTTL, next.MaxDelay, next.MaxScheduledRequests = 60, 60, 1 })
+
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the recipient received a %v", r.Method)
+	}))
+
+	defer recipient.Close()
+
+	// Returns the response to a request scheduled with the header
+	schedule := func(name string, value string) *httptest.ResponseRecorder {
+		r := newForwardRequest(http.MethodPost, recipient.URL, "order")
+		r.Header.Set(name, value)
+		return serveProxy(r)
+	}
+
+	w := schedule("Proxy-Not-Before", time.Now().Add(time.Minute/2).Format(time.RFC3339))
+	token := w.Header().Get("Proxy-Affinity")
+	if w.Code != http.StatusAccepted || token == "" {
+		t.Fatalf("got status %v and Proxy-Affinity %q, expected a 202 with a token", w.Code, token)
+	}
+
+	if w := schedule("Proxy-Delay", "1000"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %v past maxScheduledRequests, expected 429", w.Code)
+	}
+
+	if w := serveProxy(newAffinityRequest(http.MethodDelete, token)); w.Code != http.StatusOK {
+		t.Fatalf("got status %v cancelling the scheduled request, expected 200", w.Code)
+	}
+
+	for name, value := range map[string]string{
+		"Proxy-Delay":      "soon",
+		"Proxy-Not-Before": "tomorrow",
+	} {
+		if w := schedule(name, value); w.Code != http.StatusBadRequest {
+			t.Errorf("got status %v for %v %q, expected 400", w.Code, name, value)
+		}
+	}
+
+	if w := schedule("Proxy-Delay", "61000"); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %v past maxDelay, expected 400", w.Code)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedSenders bounds the senders counted by a proxy
+const maxTrackedSenders = 10000
+
+// maxSenderLength bounds the Proxy-Sender identities, which are kept as keys and reported as metric labels
+const maxSenderLength = 128
+
+// SendersPath is the path of the per-sender statistics
+const SendersPath = "/senders"
+
+// Statistics of a sender
+type senderStats struct {
+	LastSeen time.Time
+
+	// Requests, Denied and Admitted count the requests of the sender asking for a slot, and the ones denied or
+	// admitted, lastRequests being Requests at the previous second
+	Requests     uint64
+	Denied       uint64
+	Admitted     uint64
+	lastRequests uint64
+
+	// Rate is the moving average of the sender's requests per second
+	Rate float64
+}
+
+// Senders identified by Proxy-Sender, and their statistics, reported in Proxy-Senders so clients predict the free
+// requests with the actual number of senders
+var senders struct {
+	sync.Mutex
+	Stats map[string]*senderStats
+}
+
+func init() {
+	senders.Stats = map[string]*senderStats{}
+
+	go expireSenders()
+}
+
+// Forgets the senders not seen within the sender TTL every second, and updates the others' rates
+func expireSenders() {
+	for {
+		time.Sleep(time.Second)
+
+		senders.Lock()
+		for sender, stats := range senders.Stats {
+			if time.Since(stats.LastSeen) > time.Duration(currentConfig().SenderTTL)*time.Second {
+				delete(senders.Stats, sender)
+				continue
+			}
+
+			// Averaged over about the last 5 seconds
+			stats.Rate += (float64(stats.Requests-stats.lastRequests) - stats.Rate) / 5
+			stats.lastRequests = stats.Requests
+		}
+		senders.Unlock()
+	}
+}
+
+// Returns the sender identity in the Proxy-Sender header, "" if there is none or it is not up to maxSenderLength
+// printable ASCII characters
+func proxySender(header http.Header) string {
+	sender := strings.TrimSpace(header.Get("Proxy-Sender"))
+	if len(sender) > maxSenderLength {
+		return ""
+	}
+
+	for i := 0; i < len(sender); i++ {
+		if sender[i] < ' ' || sender[i] > '~' {
+			return ""
+		}
+	}
+
+	return sender
+}
+
+// Records a request, including pings, of the sender identified by its Proxy-Sender
+func recordSender(sender string) {
+	if sender == "" || currentConfig().SenderTTL == 0 {
+		return
+	}
+
+	senders.Lock()
+	defer senders.Unlock()
+
+	stats, ok := senders.Stats[sender]
+	if !ok {
+		// Bound the senders tracked, so senders generating identities can not grow the map without limit
+		if len(senders.Stats) >= maxTrackedSenders {
+			return
+		}
+
+		stats = &senderStats{}
+		senders.Stats[sender] = stats
+	}
+
+	stats.LastSeen = time.Now()
+}
+
+// Counts a request of the sender asking for a slot, and whether it was admitted, if the sender is tracked
+func recordSenderAdmission(sender string, admitted bool) {
+	senders.Lock()
+	defer senders.Unlock()
+
+	stats, ok := senders.Stats[sender]
+	if !ok {
+		return
+	}
+
+	stats.Requests++
+	if admitted {
+		stats.Admitted++
+	} else {
+		stats.Denied++
+	}
+}
+
+// Returns the number of senders seen within the sender TTL
+func activeSenders() int {
+	senders.Lock()
+	defer senders.Unlock()
+
+	return len(senders.Stats)
+}
+
+// Statistics of a sender as reported by the senders handler
+type senderReport struct {
+	Sender   string    `json:"sender"`
+	LastSeen time.Time `json:"lastSeen"`
+
+	Requests uint64  `json:"requests"`
+	Rate     float64 `json:"requestsPerSecond"`
+	Denied   uint64  `json:"denied"`
+	Admitted uint64  `json:"admitted"`
+
+	// Queued is the number of the sender's requests waiting for a slot, and QueueShare their share of all of the
+	// waiting requests
+	Queued     int     `json:"queued"`
+	QueueShare float64 `json:"queueShare"`
+}
+
+// Serves the statistics of the senders seen within the sender TTL as JSON, for dashboards and tooling
+func sendersHandler(w http.ResponseWriter, r *http.Request) {
+	// Count the queued requests by sender first, as the queues are guarded by another lock
+	state.ActiveRequestsMu.Lock()
+	queued := map[string]int{}
+	for priority := range admission.Queues {
+		for _, queue := range admission.Queues[priority] {
+			queued[queue.Sender] += len(queue.Waiting)
+		}
+	}
+
+	totalQueued := admission.Queued
+	state.ActiveRequestsMu.Unlock()
+
+	senders.Lock()
+	reports := make([]senderReport, 0, len(senders.Stats))
+	for sender, stats := range senders.Stats {
+		report := senderReport{
+			Sender:   sender,
+			LastSeen: stats.LastSeen,
+			Requests: stats.Requests,
+			Rate:     stats.Rate,
+			Denied:   stats.Denied,
+			Admitted: stats.Admitted,
+			Queued:   queued[sender],
+		}
+
+		if totalQueued > 0 {
+			report.QueueShare = float64(report.Queued) / float64(totalQueued)
+		}
+
+		reports = append(reports, report)
+	}
+	senders.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Sender < reports[j].Sender
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Queued  int64          `json:"queued"`
+		Senders []senderReport `json:"senders"`
+	}{totalQueued, reports})
+}
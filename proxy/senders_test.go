@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The senders of forwarded requests are reported on /senders with their counts
+func TestSendersHandler(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) { next.SenderTTL, next.ProxyTimeout = 60, 5000 })
+
+	senders.Lock()
+	stats := senders.Stats
+	senders.Stats = map[string]*senderStats{}
+	senders.Unlock()
+
+	defer func() {
+		senders.Lock()
+		senders.Stats = stats
+		senders.Unlock()
+	}()
+
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer recipient.Close()
+
+	for _, sender := range []string{"sender-a", "sender-b", "sender-a"} {
+		r := newForwardRequest(http.MethodGet, recipient.URL, "")
+		r.Header.Set("Proxy-Sender", sender)
+
+		if w := serveProxy(r); w.Code != http.StatusOK {
+			t.Fatalf("got status %v for %v", w.Code, sender)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	sendersHandler(w, httptest.NewRequest(http.MethodGet, SendersPath, nil))
+
+	var report struct {
+		Queued  int64          `json:"queued"`
+		Senders []senderReport `json:"senders"`
+	}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %s (%v), expected the senders as JSON", w.Body.Bytes(), err)
+	}
+
+	if len(report.Senders) != 2 || report.Senders[0].Sender != "sender-a" || report.Senders[1].Sender != "sender-b" {
+		t.Fatalf("got senders %+v, expected sender-a and sender-b in order", report.Senders)
+	}
+
+	for i, requests := range []uint64{2, 1} {
+		if sender := report.Senders[i]; sender.Requests != requests || sender.Admitted != requests || sender.Denied != 0 || sender.LastSeen.IsZero() {
+			t.Errorf("got %+v, expected %v admitted requests", sender, requests)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// StatusQueryContentType is the content type of status queries, a JSON object listing affinity tokens
+const StatusQueryContentType = "application/x-proxy-status+json"
+
+// States of the requests answered with a 202, as reported by status queries
+const (
+	// The request is scheduled or queued, not yet forwarded
+	statusPending = "pending"
+
+	// The request is being forwarded to the recipient
+	statusForwarding = "forwarding"
+
+	// The recipient responded to the request
+	statusDelivered = "delivered"
+
+	// The request failed to be forwarded
+	statusFailed = "failed"
+
+	// The request was dropped for its Proxy-TTL, or its outcome forgotten past the affinity TTL
+	statusExpired = "expired"
+
+	// The proxy holding the request is gone along with it
+	statusLost = "lost"
+
+	// The token is malformed, or the proxy holding the request could not be reached
+	statusUnknown = "unknown"
+)
+
+// Status query, the affinity tokens of the requests to report on
+type statusQuery struct {
+	Affinity []string `json:"affinity"`
+}
+
+// Status of a request of a status query
+type requestStatus struct {
+	Affinity string `json:"affinity"`
+	State    string `json:"state"`
+
+	// Status is the recipient's status once delivered
+	Status int `json:"status,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Answer to a status query, the statuses in the order of the query
+type statusQueryResult struct {
+	Statuses []requestStatus `json:"statuses"`
+}
+
+// Returns whether the request is a status query, a POST of StatusQueryContentType without Forward-To
+func isStatusQuery(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == StatusQueryContentType
+}
+
+// Handles a status query, answering the statuses of this proxy's requests and asking the other proxies for theirs,
+// with one query each
+func handleStatusQuery(w http.ResponseWriter, r *http.Request) {
+	if rejectOversizedRequest(w, r) {
+		return
+	}
+
+	var query statusQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		writeProxyMetrics(w, http.StatusBadRequest)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("status query is invalid: %v", err)))
+		return
+	}
+
+	if int64(len(query.Affinity)) > currentConfig().MaxBatchSize {
+		writeProxyMetrics(w, http.StatusRequestEntityTooLarge)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	result := statusQueryResult{Statuses: make([]requestStatus, len(query.Affinity))}
+
+	// Group the tokens of the other proxies by ordinal, by their index in the query
+	others := map[int64][]int{}
+	for i, token := range query.Affinity {
+		result.Statuses[i] = requestStatus{Affinity: token}
+
+		parts := strings.SplitN(strings.TrimSpace(token), ".", 2)
+		ordinal, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) != 2 {
+			result.Statuses[i].State = statusUnknown
+			result.Statuses[i].Error = "malformed affinity token"
+			continue
+		}
+
+		if ordinal != ProxyOrdinal {
+			others[ordinal] = append(others[ordinal], i)
+			continue
+		}
+
+		affinityJobs.Lock()
+		job, ok := affinityJobs.Jobs[parts[1]]
+		affinityJobs.Unlock()
+
+		if !ok {
+			result.Statuses[i].State = statusExpired
+			continue
+		}
+
+		jobStatus(job, &result.Statuses[i])
+	}
+
+	// Query the other proxies concurrently, a few at once, each filling in its own indexes
+	var wg sync.WaitGroup
+	queries := make(chan struct{}, MaxPeerQueries)
+	for ordinal, indexes := range others {
+		wg.Add(1)
+		queries <- struct{}{}
+
+		go func(ordinal int64, indexes []int) {
+			defer func() {
+				<-queries
+				wg.Done()
+			}()
+
+			queryPeerStatuses(r.Context(), ordinal, indexes, result.Statuses)
+		}(ordinal, indexes)
+	}
+
+	wg.Wait()
+
+	body, _ := json.Marshal(result)
+
+	w.Header().Set("Content-Type", "application/json")
+	writeProxyMetrics(w, http.StatusOK)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// Fills in the status of the job
+func jobStatus(job *affinityJob, status *requestStatus) {
+	select {
+	case <-job.Outcome.Done:
+	default:
+		if atomic.LoadInt32(&job.Forwarding) != 0 {
+			status.State = statusForwarding
+		} else {
+			status.State = statusPending
+		}
+
+		return
+	}
+
+	switch {
+	case job.Expired:
+		status.State = statusExpired
+	case job.Outcome.Err != nil:
+		status.State = statusFailed
+		status.Error = job.Outcome.Err.Error()
+	default:
+		status.State = statusDelivered
+		status.Status = job.Outcome.StatusCode
+	}
+}
+
+// Asks the proxy with the ordinal for the statuses of its requests at the indexes, filling them in
+func queryPeerStatuses(ctx context.Context, ordinal int64, indexes []int, statuses []requestStatus) {
+	fail := func(state string, err error) {
+		for _, i := range indexes {
+			statuses[i].State = state
+			if err != nil {
+				statuses[i].Error = err.Error()
+			}
+		}
+	}
+
+	proxies.List.RLock()
+	ip, ok := proxies.List.PodIPs[fmt.Sprintf("%v-%v", ProxyStatefulSet, ordinal)]
+	proxies.List.RUnlock()
+
+	// The proxy holding the requests is gone along with them
+	if !ok {
+		fail(statusLost, nil)
+		return
+	}
+
+	query := statusQuery{Affinity: make([]string, len(indexes))}
+	for j, i := range indexes {
+		query.Affinity[j] = statuses[i].Affinity
+	}
+
+	body, _ := json.Marshal(query)
+
+	scheme, client := peerClient()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%v://%v:%v%v", scheme, ip, currentConfig().HTTP.Port, currentConfig().HTTP.Path), bytes.NewReader(body))
+	if err != nil {
+		fail(statusUnknown, err)
+		return
+	}
+
+	req.Header.Set("Content-Type", StatusQueryContentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		debugPrint(1, "[!] Failed to query the statuses of proxy %v: %v", ordinal, err)
+		fail(statusUnknown, err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	var result statusQueryResult
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxPeerResponseBytes)).Decode(&result); err != nil || len(result.Statuses) != len(indexes) {
+		fail(statusUnknown, fmt.Errorf("proxy %v answered an invalid status query result (%v)", ordinal, resp.StatusCode))
+		return
+	}
+
+	for j, i := range indexes {
+		statuses[i] = result.Statuses[j]
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs the test with proxy-1 of the StatefulSet served by the handler
+func withPeerServer(t *testing.T, handler http.HandlerFunc) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	withPeers(t, map[string]string{"proxy-1": host})
+
+	withConfig(t, func(next *proxyConfig) {
+		next.HTTP.Port, _ = strconv.Atoi(port)
+		next.HTTP.Path = "/"
+	})
+}
+
+// Peers answering oversized results do not have them read whole
+func TestQueryPeerStatusesBoundsResult(t *testing.T) {
+	withPeerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"statuses":[{"affinity":"1.a","state":"delivered","error":"`))
+		chunk := []byte(strings.Repeat("x", 1<<20))
+		for i := 0; i < 2*MaxPeerResponseBytes>>20; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+		w.Write([]byte(`"}]}`))
+	})
+
+	statuses := []requestStatus{{Affinity: "1.a"}}
+	queryPeerStatuses(context.Background(), 1, []int{0}, statuses)
+
+	if statuses[0].State != statusUnknown {
+		t.Errorf("got state %v of an oversized result, expected %v", statuses[0].State, statusUnknown)
+	}
+}
+
+// Status queries stop waiting for peers once their sender is gone
+func TestQueryPeerStatusesFollowsContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	withPeerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	statuses := []requestStatus{{Affinity: "1.a"}}
+	queryPeerStatuses(ctx, 1, []int{0}, statuses)
+
+	if elapsed := time.Since(start); elapsed >= PeerTimeout {
+		t.Errorf("the query took %v after its context was done", elapsed)
+	}
+
+	if statuses[0].State != statusUnknown {
+		t.Errorf("got state %v of a peer not answering, expected %v", statuses[0].State, statusUnknown)
+	}
+}
+
+// Status queries answer the states of this proxy's requests, and of the other proxies' by asking them, in order
+func TestStatusQuery(t *testing.T) {
+	defer func(ordinal int64) { ProxyOrdinal = ordinal }(ProxyOrdinal)
+	ProxyOrdinal = 0
+
+	delivered := &idempotentOutcome{Done: make(chan struct{}), StatusCode: http.StatusCreated}
+	close(delivered.Done)
+
+	failed := &idempotentOutcome{Done: make(chan struct{}), Err: errors.New("recipient unreachable")}
+	close(failed.Done)
+
+	jobs := map[string]*affinityJob{
+		"status-delivered": {Outcome: delivered},
+		"status-failed":    {Outcome: failed},
+		"status-pending":   {Outcome: &idempotentOutcome{Done: make(chan struct{})}},
+	}
+
+	affinityJobs.Lock()
+	for id, job := range jobs {
+		affinityJobs.Jobs[id] = job
+	}
+	affinityJobs.Unlock()
+
+	defer func() {
+		affinityJobs.Lock()
+		for id := range jobs {
+			delete(affinityJobs.Jobs, id)
+		}
+		affinityJobs.Unlock()
+	}()
+
+	// proxy-1 answers for its own requests, proxy-2 is gone
+	withPeerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var query statusQuery
+		if !isStatusQuery(r) || json.NewDecoder(r.Body).Decode(&query) != nil || len(query.Affinity) != 1 || query.Affinity[0] != "1.a" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Write([]byte(`{"statuses":[{"affinity":"1.a","state":"forwarding"}]}`))
+	})
+
+	tokens := []string{"0.status-delivered", "1.a", "0.status-failed", "0.status-pending", "0.missing", "malformed", "2.b"}
+	body, _ := json.Marshal(statusQuery{Affinity: tokens})
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", StatusQueryContentType)
+
+	w := serveProxy(r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %v, expected 200", w.Code)
+	}
+
+	var result statusQueryResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || len(result.Statuses) != len(tokens) {
+		t.Fatalf("got result %v, expected a status per token", w.Body.String())
+	}
+
+	for i, expected := range []requestStatus{
+		{Affinity: "0.status-delivered", State: statusDelivered, Status: http.StatusCreated},
+		{Affinity: "1.a", State: statusForwarding},
+		{Affinity: "0.status-failed", State: statusFailed, Error: "recipient unreachable"},
+		{Affinity: "0.status-pending", State: statusPending},
+		{Affinity: "0.missing", State: statusExpired},
+		{Affinity: "malformed", State: statusUnknown, Error: "malformed affinity token"},
+		{Affinity: "2.b", State: statusLost},
+	} {
+		if result.Statuses[i] != expected {
+			t.Errorf("got status %+v, expected %+v", result.Statuses[i], expected)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returns whether the request can be streamed to the recipient rather than buffered
+// Streaming skips everything needing the whole request or response: caching, idempotency, retries and transforms
+func shouldStreamRequest(r *http.Request, recipient RecipientAdapter, current *proxyConfig) bool {
+	if !current.StreamingMode || current.CapacityStrategy.Free() <= 0 {
+		return false
+	}
+
+	if r.Header.Get("Proxy-Idempotency-Key") != "" || (r.Method == http.MethodGet && current.CacheTTL > 0) {
+		return false
+	}
+
+	if len(current.Transforms) != 0 || current.ResponseFilter != nil {
+		return false
+	}
+
+	switch adapter := recipient.(type) {
+	case *httpRecipient:
+		return true
+	case *grpcRecipient:
+		return !adapter.Transcode
+	}
+
+	return false
+}
+
+// Streams the request to the recipient and its response back like a reverse proxy, without buffering either
+func streamRequest(w http.ResponseWriter, r *http.Request, target *url.URL, recipient RecipientAdapter, recipientTimeout time.Duration, tenant string, span *Span, current *proxyConfig) {
+	defer func() {
+		activeRequests := releaseRequest(tenant)
+		debugPrint(3, "[<] Active requests: %v", activeRequests)
+
+		if activeRequests >= idleRequests() {
+			resetIdleShutdown()
+		}
+	}()
+
+	receivedAt := span.Start
+	insecureSkipVerify := strings.ToLower(strings.TrimSpace(r.Header.Get("Insecure-Skip-Verify"))) == "true"
+
+	// Fast fail if the recipient is unhealthy
+	breaker := breakerFor(target.Host)
+	if !breaker.Allow() {
+		w.Header().Set("Proxy-Breaker", BreakerOpen)
+		writeProxyMetrics(w, http.StatusServiceUnavailable)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	requestID := strings.TrimSpace(r.Header.Get("Proxy-Request-Id"))
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	options := forwardOptions{
+		InsecureSkipVerify: insecureSkipVerify,
+		RecipientTimeout:   recipientTimeout,
+		Breaker:            breaker,
+		AccessLog: &AccessLogEntry{
+			Time:         receivedAt,
+			RequestID:    requestID,
+			Sender:       r.Header.Get("Proxy-Sender"),
+			Method:       r.Method,
+			Target:       target.String(),
+			QueueWait:    float64(time.Since(receivedAt)) / float64(time.Millisecond),
+			RequestBytes: r.ContentLength,
+			TraceID:      span.TraceID,
+		},
+		Span:      span,
+		Tenant:    tenant,
+		Recipient: recipient,
+		Config:    current,
+	}
+
+	ctx, cancel := withDrain(r.Context())
+	defer cancel()
+
+	if recipientTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, recipientTimeout)
+		defer cancel()
+	}
+
+	// Prepare the request to the recipient
+	outRequest := r.Clone(ctx)
+	outRequest.URL = target
+	outRequest.Host = target.Host
+	outRequest.RequestURI = ""
+	outRequest.Header.Del("Forward-To")
+	outRequest.Header.Del("Proxy-Timeout")
+	outRequest.Header.Del("Proxy-TTL")
+	outRequest.Header.Del("Proxy-Protocol-Version")
+	outRequest.Header.Del("Proxy-Recipient")
+
+	if err := recipient.PrepareRequest(outRequest, nil); err != nil {
+		writeForwardHeaders(w, options)
+		writeProxyMetrics(w, http.StatusInternalServerError)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	forwardSpan := span.startChild("forward")
+	outRequest.Header.Set("Traceparent", forwardSpan.traceParent())
+	requestStart := time.Now()
+
+	// Records the outcome of the request once the recipient responded or failed
+	finish := func(resp *http.Response, err error) {
+		latency := time.Since(requestStart)
+		if err == nil {
+			recordRecipientLatency(latency)
+			updateRecipientLatencyAverage(latency)
+		} else {
+			debugPrint(2, "[!] Streamed request to %v failed: %v", target.String(), err)
+		}
+
+		recordRecipientResult(err)
+		breaker.Record(resp, err)
+
+		recipientStatus := 0
+		forwardAttributes := map[string]string{"http.url": target.String(), "http.method": r.Method}
+		if err == nil {
+			recipientStatus = resp.StatusCode
+			forwardAttributes["http.status_code"] = strconv.Itoa(recipientStatus)
+		} else {
+			forwardAttributes["error"] = err.Error()
+		}
+
+		options.AccessLog.finishRecipient(recipientStatus, 0, latency, err)
+		forwardSpan.end(forwardAttributes)
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director:      func(*http.Request) {},
+		Transport:     recipient.Transport(target, current.recipientTLSConfig(target.Host, insecureSkipVerify)),
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			finish(resp, nil)
+
+			w.Header().Set("Proxy-Streamed", "true")
+			writeForwardHeaders(w, options)
+			writeProxyMetrics(w, http.StatusOK)
+			options.AccessLog.finishResponse(http.StatusOK)
+			span.end(map[string]string{"proxy.status": strconv.Itoa(http.StatusOK), "proxy.streamed": "true"})
+
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			finish(nil, err)
+
+			writeForwardHeaders(w, options)
+			writeProxyMetrics(w, http.StatusInternalServerError)
+			options.AccessLog.finishResponse(http.StatusInternalServerError)
+			span.end(map[string]string{"proxy.status": strconv.Itoa(http.StatusInternalServerError), "proxy.streamed": "true"})
+			w.WriteHeader(http.StatusInternalServerError)
+
+			w.Write([]byte(err.Error()))
+		},
+	}
+
+	proxy.ServeHTTP(w, outRequest)
+}
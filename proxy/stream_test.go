@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Requests are streamed to the recipient and back while the proxy has capacity to spare, then buffered
+func TestStreamingMode(t *testing.T) {
+	withConfig(t, func(next *proxyConfig) {
+		next.StreamingMode, next.CapacityStrategy, next.MaxRequests, next.MaxLoadFactor, next.ProxyTimeout = true, fixedCapacity{}, 10, 1, 5000
+	})
+
+	release := make(chan struct{})
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("first " + string(body) + ","))
+
+		if r.URL.Path == "/hold" {
+			w.(http.Flusher).Flush()
+			<-release
+		}
+
+		w.Write([]byte("second"))
+	}))
+
+	defer recipient.Close()
+
+	// Release the recipient even if the test fails before doing so
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	proxy := httptest.NewServer(http.HandlerFunc(httpHandler))
+	defer proxy.Close()
+
+	// Sends the request through the proxy
+	forward := func(path string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL, strings.NewReader("order"))
+		req.Header.Set("Forward-To", recipient.URL+path)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	resp := forward("/hold")
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Proxy-Streamed") != "true" || resp.Header.Get("Proxy-Status") != "200" {
+		t.Errorf("got headers %v, expected a streamed response", resp.Header)
+	}
+
+	// The first part of the response arrives while the recipient still holds the rest
+	first := make([]byte, len("first order,"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "first order," {
+		t.Errorf("got %q (%v) before the recipient finished, expected the first part of the response", first, err)
+	}
+
+	close(release)
+
+	if rest, _ := ioutil.ReadAll(resp.Body); string(rest) != "second" {
+		t.Errorf("got the rest %q, expected the second part of the response", rest)
+	}
+
+	// Without capacity to spare
+	updateConfig(func(next *proxyConfig) { next.MaxRequests = 1 })
+
+	resp = forward("/")
+	defer resp.Body.Close()
+
+	if body, _ := ioutil.ReadAll(resp.Body); resp.Header.Get("Proxy-Streamed") != "" || string(body) != "first order,second" {
+		t.Errorf("got headers %v and body %q, expected a buffered response", resp.Header, body)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTenant is the tenant of requests without a Proxy-Tenant header
+const DefaultTenant = "default"
+
+// maxTrackedTenants bounds the tenants not named in the tenant limits whose usage is tracked, and reported in the
+// metrics, by name
+const maxTrackedTenants = 100
+
+// OtherTenants is the tenant the requests of the unnamed tenants past maxTrackedTenants count toward
+const OtherTenants = "other"
+
+// TenantLimits are the limits of a single tenant, 0 meaning unlimited
+type TenantLimits struct {
+	// MaxRequests is the maximum number of active requests of the tenant
+	MaxRequests int64 `json:"maxRequests"`
+
+	// MaxQueuedRequests is the maximum number of requests of the tenant waiting for a free slot
+	MaxQueuedRequests int64 `json:"maxQueuedRequests"`
+
+	// RequestsPerSecond is the rate at which the tenant's budget refills
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+
+	// Burst is the maximum budget of the tenant, defaults to RequestsPerSecond
+	Burst float64 `json:"burst"`
+}
+
+// Usage of a single tenant
+type tenantState struct {
+	Active int64
+	Queued int64
+
+	// Budget is the number of requests the tenant may currently make, refilled at RequestsPerSecond
+	Budget     float64
+	LastRefill time.Time
+
+	Admitted    uint64
+	RateLimited uint64
+}
+
+// Usage of every tenant, guarded by state.ActiveRequestsMu
+var tenants = map[string]*tenantState{}
+
+func init() {
+	go expireTenants()
+}
+
+// Forgets the idle tenants not named in the tenant limits every second while too many are tracked, making room for
+// new tenants
+func expireTenants() {
+	for {
+		time.Sleep(time.Second)
+
+		state.ActiveRequestsMu.Lock()
+		if len(tenants) >= maxTrackedTenants {
+			tenantLimits := currentConfig().TenantLimits
+			for name, usage := range tenants {
+				if _, listed := tenantLimits[name]; !listed && isIdleTenant(name, usage) {
+					delete(tenants, name)
+				}
+			}
+		}
+		state.ActiveRequestsMu.Unlock()
+	}
+}
+
+// Returns whether forgetting the tenant's usage changes nothing but its counters, as it has no active or queued
+// requests and its budget is full
+func isIdleTenant(tenant string, usage *tenantState) bool {
+	if usage.Active != 0 || usage.Queued != 0 {
+		return false
+	}
+
+	limits := limitsOf(tenant)
+	return limits.RequestsPerSecond == 0 || usage.Budget+time.Since(usage.LastRefill).Seconds()*limits.RequestsPerSecond >= limits.burst()
+}
+
+// Returns the tenant named by a request's Proxy-Tenant header
+func tenantName(r *http.Request) string {
+	if tenant := strings.TrimSpace(r.Header.Get("Proxy-Tenant")); tenant != "" {
+		return tenant
+	}
+
+	return DefaultTenant
+}
+
+// Returns the tenant whose limits a request counts toward, its own if it is named in the tenant limits or there is
+// room to track it, otherwise OtherTenants
+// The tenant is resolved once, so the request's admission and release count toward the same tenant
+func requestTenant(r *http.Request) string {
+	tenant := tenantName(r)
+
+	state.ActiveRequestsMu.Lock()
+	defer state.ActiveRequestsMu.Unlock()
+
+	if _, ok := tenants[tenant]; ok || len(tenants) < maxTrackedTenants {
+		return tenant
+	}
+
+	if _, listed := currentConfig().TenantLimits[tenant]; listed {
+		return tenant
+	}
+
+	return OtherTenants
+}
+
+// Parses the tenantLimits annotation, a JSON object of limits by tenant
+func parseTenantLimits(value string) (map[string]TenantLimits, error) {
+	limits := map[string]TenantLimits{}
+	if value == "" {
+		return limits, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &limits); err != nil {
+		return nil, fmt.Errorf("tenantLimits is not a valid JSON object of tenant limits: %v", err)
+	}
+
+	for tenant, tenantLimits := range limits {
+		if tenantLimits.MaxRequests < 0 || tenantLimits.MaxQueuedRequests < 0 || tenantLimits.RequestsPerSecond < 0 || tenantLimits.Burst < 0 {
+			return nil, fmt.Errorf("tenantLimits of %v must not be negative", tenant)
+		}
+	}
+
+	return limits, nil
+}
+
+// Returns the maximum budget of the limits
+func (limits TenantLimits) burst() float64 {
+	if limits.Burst == 0 {
+		return limits.RequestsPerSecond
+	}
+
+	return limits.Burst
+}
+
+// Returns the limits of a tenant, unlisted tenants use the limits of "*" if any
+func limitsOf(tenant string) TenantLimits {
+	tenantLimits := currentConfig().TenantLimits
+	if limits, ok := tenantLimits[tenant]; ok {
+		return limits
+	}
+
+	return tenantLimits["*"]
+}
+
+// Returns the usage of a tenant, must be called with state.ActiveRequestsMu locked
+func tenantOf(tenant string) *tenantState {
+	usage, ok := tenants[tenant]
+	if !ok {
+		usage = &tenantState{Budget: limitsOf(tenant).burst(), LastRefill: time.Now()}
+		tenants[tenant] = usage
+	}
+
+	return usage
+}
+
+// Returns whether the tenant may have another active request, must be called with state.ActiveRequestsMu locked
+func tenantHasCapacity(tenant string) bool {
+	limits := limitsOf(tenant)
+	return limits.MaxRequests == 0 || tenantOf(tenant).Active < limits.MaxRequests
+}
+
+// Returns whether the tenant may queue another request, must be called with state.ActiveRequestsMu locked
+func tenantCanQueue(tenant string) bool {
+	limits := limitsOf(tenant)
+	return limits.MaxQueuedRequests == 0 || tenantOf(tenant).Queued < limits.MaxQueuedRequests
+}
+
+// Takes a request from the tenant's budget, returns false if it is exhausted
+// Must be called with state.ActiveRequestsMu locked
+func takeTenantBudget(tenant string) bool {
+	limits := limitsOf(tenant)
+	usage := tenantOf(tenant)
+	if limits.RequestsPerSecond == 0 {
+		return true
+	}
+
+	now := time.Now()
+	usage.Budget += now.Sub(usage.LastRefill).Seconds() * limits.RequestsPerSecond
+	usage.LastRefill = now
+	if usage.Budget > limits.burst() {
+		usage.Budget = limits.burst()
+	}
+
+	if usage.Budget < 1 {
+		usage.RateLimited++
+		return false
+	}
+
+	usage.Budget--
+	return true
+}
+
+// Returns the request taken from the tenant's budget by a request that was then denied
+// Must be called with state.ActiveRequestsMu locked
+func refundTenantBudget(tenant string) {
+	limits := limitsOf(tenant)
+	if limits.RequestsPerSecond == 0 {
+		return
+	}
+
+	usage := tenantOf(tenant)
+	if usage.Budget++; usage.Budget > limits.burst() {
+		usage.Budget = limits.burst()
+	}
+}
+
+// Writes the usage of every tenant in the Prometheus text exposition format
+// Must be called with state.ActiveRequestsMu locked
+func writeTenantMetrics(w *strings.Builder) {
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# HELP proxy_tenant_active_requests Number of requests being processed by tenant.\n")
+	fmt.Fprintf(w, "# TYPE proxy_tenant_active_requests gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "proxy_tenant_active_requests{tenant=%v} %v\n", labelValue(name), tenants[name].Active)
+	}
+
+	fmt.Fprintf(w, "# HELP proxy_tenant_queued_requests Number of requests waiting for a free slot by tenant.\n")
+	fmt.Fprintf(w, "# TYPE proxy_tenant_queued_requests gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "proxy_tenant_queued_requests{tenant=%v} %v\n", labelValue(name), tenants[name].Queued)
+	}
+
+	fmt.Fprintf(w, "# HELP proxy_tenant_admitted_requests_total Number of requests admitted by tenant.\n")
+	fmt.Fprintf(w, "# TYPE proxy_tenant_admitted_requests_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "proxy_tenant_admitted_requests_total{tenant=%v} %v\n", labelValue(name), tenants[name].Admitted)
+	}
+
+	fmt.Fprintf(w, "# HELP proxy_tenant_rate_limited_requests_total Number of requests denied for exceeding the tenant's rate budget.\n")
+	fmt.Fprintf(w, "# TYPE proxy_tenant_rate_limited_requests_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "proxy_tenant_rate_limited_requests_total{tenant=%v} %v\n", labelValue(name), tenants[name].RateLimited)
+	}
+}
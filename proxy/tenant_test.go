@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Runs the test with no tenants tracked and the tenant limits
+func withTenantLimits(t *testing.T, tenantLimits string) {
+	if err := updateProxyConfig(map[string]string{"tenantLimits": tenantLimits}); err != nil {
+		t.Fatal(err)
+	}
+
+	state.ActiveRequestsMu.Lock()
+	usage := tenants
+	tenants = map[string]*tenantState{}
+	state.ActiveRequestsMu.Unlock()
+
+	t.Cleanup(func() {
+		updateProxyConfig(map[string]string{})
+
+		state.ActiveRequestsMu.Lock()
+		tenants = usage
+		state.ActiveRequestsMu.Unlock()
+	})
+}
+
+// Returns a request of the tenant
+func tenantRequest(tenant string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Proxy-Tenant", tenant)
+	return r
+}
+
+// Unlisted tenants past maxTrackedTenants count toward OtherTenants, unlike the listed ones
+func TestTenantsBounded(t *testing.T) {
+	withTenantLimits(t, `{"listed": {"maxRequests": 1}}`)
+
+	state.ActiveRequestsMu.Lock()
+	for i := 0; i < maxTrackedTenants; i++ {
+		tenantOf(fmt.Sprintf("tenant-%v", i)).Active++
+	}
+	state.ActiveRequestsMu.Unlock()
+
+	for tenant, expected := range map[string]string{
+		"tenant-0": "tenant-0",
+		"new":      OtherTenants,
+		"listed":   "listed",
+	} {
+		if got := requestTenant(tenantRequest(tenant)); got != expected {
+			t.Errorf("requests of %v count toward %v, expected %v", tenant, got, expected)
+		}
+	}
+
+	// Idle tenants are forgotten to make room for new ones, the others are kept
+	state.ActiveRequestsMu.Lock()
+	tenantOf("tenant-1").Active--
+	state.ActiveRequestsMu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for requestTenant(tenantRequest("new")) != "new" {
+		if time.Now().After(deadline) {
+			t.Fatalf("no room was made for a new tenant")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	state.ActiveRequestsMu.Lock()
+	_, idle := tenants["tenant-1"]
+	_, active := tenants["tenant-2"]
+	state.ActiveRequestsMu.Unlock()
+
+	if idle || !active {
+		t.Errorf("kept the idle tenant %v, and the active one %v", idle, active)
+	}
+}
+
+// Requests denied after taking from their tenant's rate budget give it back
+func TestTenantBudgetRefunded(t *testing.T) {
+	withTenantLimits(t, `{"limited": {"maxQueuedRequests": 1, "requestsPerSecond": 0.001, "burst": 2}}`)
+
+	// The proxy is full, so requests are queued until they time out
+	withConfig(t, func(next *proxyConfig) {
+		next.MaxRequests = 0
+		next.QueueTimeout = 10
+	})
+
+	for i := 0; i < 5; i++ {
+		if admitRequest(PriorityNormal, "sender", "limited", time.Time{}) {
+			t.Fatalf("admitted a request to a full proxy")
+		}
+	}
+
+	state.ActiveRequestsMu.Lock()
+	budget := tenantOf("limited").Budget
+	rateLimited := tenantOf("limited").RateLimited
+	state.ActiveRequestsMu.Unlock()
+
+	if budget < 1.9 || rateLimited != 0 {
+		t.Errorf("the denied requests left a budget of %v and were rate limited %v times", budget, rateLimited)
+	}
+}
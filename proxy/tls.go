@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ClusterCAFile is the cluster's CA bundle, mounted in every pod, which verifies the other proxies by default
+const ClusterCAFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+// Currently served TLS material, reloaded when the files change
+var serverTLS struct {
+	sync.RWMutex
+	Certificate *tls.Certificate
+	ClientCAs   *x509.CertPool
+	ModTime     time.Time
+
+	// PeerCAs verify the certificates of the other proxies, nil for the system's
+	PeerCAs *x509.CertPool
+}
+
+// Returns the CA bundle verifying the other proxies, and whether it must exist
+func peerCAFile() (string, bool) {
+	if file := currentConfig().TLS.PeerCAFile; file != "" {
+		return file, true
+	}
+
+	return ClusterCAFile, false
+}
+
+// Returns the latest modification time of the TLS files
+func tlsModTime() time.Time {
+	var modTime time.Time
+
+	current := currentConfig()
+	peerCAs, _ := peerCAFile()
+	for _, file := range []string{current.TLS.CertFile, current.TLS.KeyFile, current.TLS.ClientCAFile, peerCAs} {
+		if file == "" {
+			continue
+		}
+
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime
+}
+
+// Loads the certificate and client CAs from their files
+func loadTLS() error {
+	modTime := tlsModTime()
+
+	current := currentConfig()
+	certificate, err := tls.LoadX509KeyPair(current.TLS.CertFile, current.TLS.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if current.TLS.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(current.TLS.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading TLS client CAs: %v", err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("found no valid certificates in %v", current.TLS.ClientCAFile)
+		}
+	}
+
+	// Outside of a cluster, without a peer CA bundle configured, the system's verify the other proxies
+	var peerCAs *x509.CertPool
+	file, required := peerCAFile()
+	if pem, err := ioutil.ReadFile(file); err == nil {
+		peerCAs = x509.NewCertPool()
+		if !peerCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("found no valid certificates in %v", file)
+		}
+	} else if required {
+		return fmt.Errorf("error reading TLS peer CAs: %v", err)
+	}
+
+	serverTLS.Lock()
+	serverTLS.Certificate = &certificate
+	serverTLS.ClientCAs = clientCAs
+	serverTLS.PeerCAs = peerCAs
+	serverTLS.ModTime = modTime
+	serverTLS.Unlock()
+
+	return nil
+}
+
+// Reloads the TLS material on SIGHUP or when its files change
+func watchTLS() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-hangup:
+			debugPrint(1, "[+] Got SIGHUP, reloading TLS certificate")
+		case <-time.After(10 * time.Second):
+			serverTLS.RLock()
+			unchanged := !tlsModTime().After(serverTLS.ModTime)
+			serverTLS.RUnlock()
+
+			if unchanged {
+				continue
+			}
+
+			debugPrint(1, "[+] TLS files changed, reloading TLS certificate")
+		}
+
+		// Keep serving the previous certificate if the new one is invalid (e.g. partially written)
+		if err := loadTLS(); err != nil {
+			debugPrint(1, "[!] Failed to reload TLS certificate: %v", err)
+		}
+	}
+}
+
+// Returns the TLS config of the server, always using the latest loaded material
+func newServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverTLS.RLock()
+			defer serverTLS.RUnlock()
+
+			return serverTLS.Certificate, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			serverTLS.RLock()
+			defer serverTLS.RUnlock()
+
+			// Offer HTTP/2 so gRPC senders can be tunneled
+			tlsConfig := &tls.Config{
+				Certificates: []tls.Certificate{*serverTLS.Certificate},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+
+			// Verify sender certificates if client CAs are configured, which requireClientCert then requires outside
+			// of the probes, as the kubelet presents none
+			if serverTLS.ClientCAs != nil {
+				tlsConfig.ClientCAs = serverTLS.ClientCAs
+				tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+
+			return tlsConfig, nil
+		},
+	}
+}
+
+// Wraps the handler to deny requests without a verified client certificate while client CAs are configured, except
+// those of the liveness and readiness probes
+func requireClientCert(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverTLS.RLock()
+		required := serverTLS.ClientCAs != nil
+		serverTLS.RUnlock()
+
+		// Certificates given are verified in the handshake
+		if required && r.URL.Path != LivenessPath && r.URL.Path != ReadinessPath && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("client certificate required"))
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// With client CAs, the handshake verifies certificates given, and the handler requires them outside of the probes
+func TestRequireClientCert(t *testing.T) {
+	serverTLS.Lock()
+	serverTLS.Certificate = &tls.Certificate{}
+	serverTLS.ClientCAs = x509.NewCertPool()
+	serverTLS.Unlock()
+
+	defer func() {
+		serverTLS.Lock()
+		serverTLS.Certificate = nil
+		serverTLS.ClientCAs = nil
+		serverTLS.Unlock()
+	}()
+
+	tlsConfig, err := newServerTLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tlsConfig.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("got client auth %v, expected VerifyClientCertIfGiven", tlsConfig.ClientAuth)
+	}
+
+	handler := requireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, c := range []struct {
+		path   string
+		cert   bool
+		status int
+	}{
+		{LivenessPath, false, http.StatusOK},
+		{ReadinessPath, false, http.StatusOK},
+		{"/", false, http.StatusUnauthorized},
+		{"/metrics", false, http.StatusUnauthorized},
+		{"/", true, http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "https://proxy"+c.path, nil)
+		if c.cert {
+			r.TLS.PeerCertificates = []*x509.Certificate{{}}
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != c.status {
+			t.Errorf("%v with a certificate %v: got status %v, expected %v", c.path, c.cert, w.Code, c.status)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span is a timed operation of a trace, following the W3C Trace Context identifiers
+type Span struct {
+	TraceID      string            `json:"traceId"`
+	SpanID       string            `json:"spanId"`
+	ParentSpanID string            `json:"parentSpanId,omitempty"`
+	Name         string            `json:"name"`
+	Start        time.Time         `json:"startTime"`
+	End          time.Time         `json:"endTime"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+
+	// Sampled is the sampled flag of the incoming trace context
+	Sampled bool `json:"-"`
+}
+
+// SpanSink exports finished spans
+type SpanSink interface {
+	Export(span *Span)
+}
+
+// SpanSinks are the span sinks selectable through the traceSink annotation, besides OTLP URLs
+var SpanSinks = map[string]SpanSink{
+	"none":   nil,
+	"stdout": &jsonSpanSink{File: os.Stdout},
+	"stderr": &jsonSpanSink{File: os.Stderr},
+}
+
+// Writes every span as a line of JSON
+type jsonSpanSink struct {
+	sync.Mutex
+	File *os.File
+}
+
+func (s *jsonSpanSink) Export(span *Span) {
+	line, err := json.Marshal(span)
+	if err != nil {
+		log.Printf("[!] Failed to encode span: %v", err)
+		return
+	}
+
+	s.Lock()
+	s.File.Write(append(line, '\n'))
+	s.Unlock()
+}
+
+// Returns a random hex identifier of the given size in bytes
+func newTraceIdentifier(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// Parses a W3C traceparent header, returns false if it is invalid
+func parseTraceParent(traceParent string) (traceID string, spanID string, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+
+	if parts[0] == "ff" || parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", false, false
+	}
+
+	for _, part := range parts[:4] {
+		if _, err := hex.DecodeString(part); err != nil {
+			return "", "", false, false
+		}
+	}
+
+	flags, _ := hex.DecodeString(parts[3])
+	return parts[1], parts[2], flags[0]&1 == 1, true
+}
+
+// Starts a span continuing the trace of the incoming request, or a new trace if there is none
+func startSpanFromRequest(name string, header http.Header) *Span {
+	span := &Span{
+		Name:    name,
+		Start:   time.Now(),
+		SpanID:  newTraceIdentifier(8),
+		Sampled: true,
+	}
+
+	if traceID, parentSpanID, sampled, ok := parseTraceParent(header.Get("Traceparent")); ok {
+		span.TraceID = traceID
+		span.ParentSpanID = parentSpanID
+		span.Sampled = sampled
+	} else {
+		span.TraceID = newTraceIdentifier(16)
+	}
+
+	return span
+}
+
+// Starts a child span of the span
+func (span *Span) startChild(name string) *Span {
+	return &Span{
+		TraceID:      span.TraceID,
+		SpanID:       newTraceIdentifier(8),
+		ParentSpanID: span.SpanID,
+		Name:         name,
+		Start:        time.Now(),
+		Sampled:      span.Sampled,
+	}
+}
+
+// Returns the W3C traceparent header propagating the span
+func (span *Span) traceParent() string {
+	flags := "00"
+	if span.Sampled {
+		flags = "01"
+	}
+
+	return "00-" + span.TraceID + "-" + span.SpanID + "-" + flags
+}
+
+// Ends the span and exports it if sampled
+func (span *Span) end(attributes map[string]string) {
+	span.End = time.Now()
+	span.Attributes = attributes
+
+	if sink := currentConfig().SpanSink; sink != nil && span.Sampled {
+		sink.Export(span)
+	}
+}
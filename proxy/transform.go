@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Transform mutates forwarded requests and the recipients' responses, e.g. to enforce policies
+type Transform interface {
+	// TransformRequest mutates the request to the recipient, returning its new body
+	TransformRequest(req *http.Request, body []byte) ([]byte, error)
+
+	// TransformResponse mutates the recipient's response, returning its new body
+	TransformResponse(resp *http.Response, body []byte) ([]byte, error)
+}
+
+// TransformFactories create the transforms of the transforms annotation from their JSON options, by type
+var TransformFactories = map[string]func(options []byte) (Transform, error){
+	"setHeader":    newSetHeaderTransform,
+	"deleteHeader": newDeleteHeaderTransform,
+	"rewriteURL":   newRewriteURLTransform,
+	"redactBody":   newRedactBodyTransform,
+	"plugin":       newPluginTransform,
+}
+
+// Parses the transforms annotation, a JSON array of transforms applied in order
+func parseTransforms(value string) ([]Transform, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal([]byte(value), &entries); err != nil {
+		return nil, fmt.Errorf("transforms is not a valid JSON array: %v", err)
+	}
+
+	transforms := []Transform{}
+	for i, entry := range entries {
+		var kind struct {
+			Type string `json:"type"`
+		}
+
+		if err := json.Unmarshal(entry, &kind); err != nil {
+			return nil, fmt.Errorf("transform %v is invalid: %v", i, err)
+		}
+
+		factory, ok := TransformFactories[kind.Type]
+		if !ok {
+			return nil, fmt.Errorf("transform %v has unknown type %q", i, kind.Type)
+		}
+
+		transform, err := factory(entry)
+		if err != nil {
+			return nil, fmt.Errorf("transform %v (%v) is invalid: %v", i, kind.Type, err)
+		}
+
+		transforms = append(transforms, transform)
+	}
+
+	return transforms, nil
+}
+
+// Applies the configured transforms, then the response filter, to a request to the recipient
+func applyRequestTransforms(current *proxyConfig, req *http.Request, body []byte) ([]byte, error) {
+	transforms := current.Transforms
+	if filter := current.ResponseFilter; filter != nil {
+		transforms = append(transforms[:len(transforms):len(transforms)], filter)
+	}
+
+	if len(transforms) == 0 {
+		return body, nil
+	}
+
+	for _, transform := range transforms {
+		var err error
+		if body, err = transform.TransformRequest(req, body); err != nil {
+			return nil, err
+		}
+	}
+
+	// Resend the transformed body
+	req.ContentLength = int64(len(body))
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	return body, nil
+}
+
+// Applies the configured transforms, then the response filter, to a recipient's response
+func applyResponseTransforms(current *proxyConfig, resp *http.Response, body []byte) ([]byte, error) {
+	transforms := current.Transforms
+	if filter := current.ResponseFilter; filter != nil {
+		transforms = append(transforms[:len(transforms):len(transforms)], filter)
+	}
+
+	for _, transform := range transforms {
+		var err error
+		if body, err = transform.TransformResponse(resp, body); err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
+
+// Sets a header of requests, or of responses if Response is set
+type setHeaderTransform struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Response bool   `json:"response"`
+}
+
+func newSetHeaderTransform(options []byte) (Transform, error) {
+	transform := &setHeaderTransform{}
+	if err := json.Unmarshal(options, transform); err != nil {
+		return nil, err
+	}
+
+	if transform.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+
+	return transform, nil
+}
+
+func (t *setHeaderTransform) TransformRequest(req *http.Request, body []byte) ([]byte, error) {
+	if !t.Response {
+		req.Header.Set(t.Name, t.Value)
+	}
+
+	return body, nil
+}
+
+func (t *setHeaderTransform) TransformResponse(resp *http.Response, body []byte) ([]byte, error) {
+	if t.Response {
+		resp.Header.Set(t.Name, t.Value)
+	}
+
+	return body, nil
+}
+
+// Deletes a header of requests, or of responses if Response is set
+type deleteHeaderTransform struct {
+	Name     string `json:"name"`
+	Response bool   `json:"response"`
+}
+
+func newDeleteHeaderTransform(options []byte) (Transform, error) {
+	transform := &deleteHeaderTransform{}
+	if err := json.Unmarshal(options, transform); err != nil {
+		return nil, err
+	}
+
+	if transform.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+
+	return transform, nil
+}
+
+func (t *deleteHeaderTransform) TransformRequest(req *http.Request, body []byte) ([]byte, error) {
+	if !t.Response {
+		req.Header.Del(t.Name)
+	}
+
+	return body, nil
+}
+
+func (t *deleteHeaderTransform) TransformResponse(resp *http.Response, body []byte) ([]byte, error) {
+	if t.Response {
+		resp.Header.Del(t.Name)
+	}
+
+	return body, nil
+}
+
+// Rewrites the URL of requests matching a regular expression
+type rewriteURLTransform struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+
+	regexp *regexp.Regexp
+}
+
+func newRewriteURLTransform(options []byte) (Transform, error) {
+	transform := &rewriteURLTransform{}
+	if err := json.Unmarshal(options, transform); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if transform.regexp, err = regexp.Compile(transform.Pattern); err != nil {
+		return nil, err
+	}
+
+	return transform, nil
+}
+
+func (t *rewriteURLTransform) TransformRequest(req *http.Request, body []byte) ([]byte, error) {
+	rawURL := req.URL.String()
+	if !t.regexp.MatchString(rawURL) {
+		return body, nil
+	}
+
+	u, err := url.Parse(t.regexp.ReplaceAllString(rawURL, t.Replacement))
+	if err != nil {
+		return nil, fmt.Errorf("rewritten URL is invalid: %v", err)
+	}
+
+	req.URL = u
+	req.Host = u.Host
+
+	return body, nil
+}
+
+func (t *rewriteURLTransform) TransformResponse(resp *http.Response, body []byte) ([]byte, error) {
+	return body, nil
+}
+
+// Replaces the parts of request bodies, or of response bodies if Response is set, matching a regular expression
+type redactBodyTransform struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	Response    bool   `json:"response"`
+
+	regexp *regexp.Regexp
+}
+
+func newRedactBodyTransform(options []byte) (Transform, error) {
+	transform := &redactBodyTransform{}
+	if err := json.Unmarshal(options, transform); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if transform.regexp, err = regexp.Compile(transform.Pattern); err != nil {
+		return nil, err
+	}
+
+	return transform, nil
+}
+
+func (t *redactBodyTransform) TransformRequest(req *http.Request, body []byte) ([]byte, error) {
+	if t.Response {
+		stripAcceptEncoding(req)
+		return body, nil
+	}
+
+	return t.regexp.ReplaceAll(body, []byte(t.Replacement)), nil
+}
+
+func (t *redactBodyTransform) TransformResponse(resp *http.Response, body []byte) ([]byte, error) {
+	if !t.Response {
+		return body, nil
+	}
+
+	body, err := decodeResponseBody(resp, body)
+	if err != nil {
+		return nil, err
+	}
+
+	body = t.regexp.ReplaceAll(body, []byte(t.Replacement))
+	resp.Header.Del("Content-Length")
+
+	return body, nil
+}
+
+// Removes the sender's Accept-Encoding from a request whose response body is scrubbed, so the transport asks for
+// gzip itself and decodes the response before it is scrubbed
+func stripAcceptEncoding(req *http.Request) {
+	req.Header.Del("Accept-Encoding")
+}
+
+// Returns the decoded body of a response to scrub, as patterns can not match encoded bodies, and removes its
+// Content-Encoding, failing rather than returning bodies of other encodings unscrubbed
+func decodeResponseBody(resp *http.Response, body []byte) ([]byte, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the response to scrub: %v", err)
+		}
+
+		if body, err = ioutil.ReadAll(reader); err != nil {
+			return nil, fmt.Errorf("failed to decode the response to scrub: %v", err)
+		}
+
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		return body, nil
+	default:
+		return nil, fmt.Errorf("responses encoded with %v can not be scrubbed", encoding)
+	}
+}
+
+// ResponseFilter scrubs recipient responses before they are returned to senders, e.g. for compliance
+type ResponseFilter struct {
+	// StripHeaders are the response headers removed, e.g. Set-Cookie
+	StripHeaders []string `json:"stripHeaders"`
+
+	// ScrubHeaders replace the parts of a header's values matching a regular expression
+	ScrubHeaders []struct {
+		Name        string `json:"name"`
+		Pattern     string `json:"pattern"`
+		Replacement string `json:"replacement"`
+
+		regexp *regexp.Regexp
+	} `json:"scrubHeaders"`
+
+	// ScrubBody replace the parts of the body matching a regular expression
+	ScrubBody []struct {
+		Pattern     string `json:"pattern"`
+		Replacement string `json:"replacement"`
+
+		regexp *regexp.Regexp
+	} `json:"scrubBody"`
+}
+
+// Parses the responseFilter annotation, a JSON object of the filters applied to every response
+func parseResponseFilter(value string) (*ResponseFilter, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	filter := &ResponseFilter{}
+	if err := json.Unmarshal([]byte(value), filter); err != nil {
+		return nil, fmt.Errorf("responseFilter is not a valid JSON object: %v", err)
+	}
+
+	for i := range filter.ScrubHeaders {
+		var err error
+		if filter.ScrubHeaders[i].regexp, err = regexp.Compile(filter.ScrubHeaders[i].Pattern); err != nil {
+			return nil, fmt.Errorf("responseFilter pattern of header %v is invalid: %v", filter.ScrubHeaders[i].Name, err)
+		}
+	}
+
+	for i := range filter.ScrubBody {
+		var err error
+		if filter.ScrubBody[i].regexp, err = regexp.Compile(filter.ScrubBody[i].Pattern); err != nil {
+			return nil, fmt.Errorf("responseFilter body pattern is invalid: %v", err)
+		}
+	}
+
+	return filter, nil
+}
+
+func (f *ResponseFilter) TransformRequest(req *http.Request, body []byte) ([]byte, error) {
+	if len(f.ScrubBody) != 0 {
+		stripAcceptEncoding(req)
+	}
+
+	return body, nil
+}
+
+func (f *ResponseFilter) TransformResponse(resp *http.Response, body []byte) ([]byte, error) {
+	for _, name := range f.StripHeaders {
+		// A response setting cookies is personal, so keep it out of the cache once they are stripped
+		if http.CanonicalHeaderKey(name) == "Set-Cookie" && resp.Header.Get(name) != "" {
+			resp.Header.Add("Cache-Control", "private")
+		}
+
+		resp.Header.Del(name)
+		resp.Trailer.Del(name)
+	}
+
+	for _, scrub := range f.ScrubHeaders {
+		values := resp.Header.Values(scrub.Name)
+		for i, value := range values {
+			values[i] = scrub.regexp.ReplaceAllString(value, scrub.Replacement)
+		}
+	}
+
+	if len(f.ScrubBody) != 0 {
+		var err error
+		if body, err = decodeResponseBody(resp, body); err != nil {
+			return nil, err
+		}
+
+		for _, scrub := range f.ScrubBody {
+			body = scrub.regexp.ReplaceAll(body, []byte(scrub.Replacement))
+		}
+
+		resp.Header.Del("Content-Length")
+	}
+
+	return body, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Returns the body compressed with gzip
+func gzipBody(t *testing.T, body string) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write([]byte(body))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+// Scrubbed responses are decoded first, as patterns would not match their encoded bodies
+func TestScrubEncodedResponse(t *testing.T) {
+	filter, err := parseResponseFilter(`{"scrubBody": [{"pattern": "[0-9]{16}", "replacement": "****"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redact, err := newRedactBodyTransform([]byte(`{"pattern": "secret", "replacement": "***", "response": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		encoding string
+		body     []byte
+		scrubbed string
+		valid    bool
+	}{
+		{"identity", "", []byte("card 1234567812345678 secret"), "card **** ***", true},
+		{"gzip", "gzip", gzipBody(t, "card 1234567812345678 secret"), "card **** ***", true},
+		{"unknown encoding", "br", []byte("card 1234567812345678 secret"), "", false},
+	} {
+		for _, transform := range []Transform{filter, redact} {
+			resp := &http.Response{Header: http.Header{}}
+			if c.encoding != "" {
+				resp.Header.Set("Content-Encoding", c.encoding)
+			}
+
+			body, err := transform.TransformResponse(resp, append([]byte(nil), c.body...))
+			if !c.valid {
+				if err == nil {
+					t.Errorf("%v: %T returned a response it could not scrub", c.name, transform)
+				}
+
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("%v: %T failed: %v", c.name, transform, err)
+			}
+
+			if resp.Header.Get("Content-Encoding") != "" {
+				t.Errorf("%v: %T kept Content-Encoding %v of the decoded body", c.name, transform, resp.Header.Get("Content-Encoding"))
+			}
+
+			if transform == filter && string(body) != "card **** secret" || transform == redact && string(body) != "card 1234567812345678 ***" {
+				t.Errorf("%v: %T scrubbed the body to %q", c.name, transform, body)
+			}
+		}
+	}
+}
+
+// The sender's Accept-Encoding is dropped, so the transport decodes the responses it asked to be compressed
+func TestScrubStripsAcceptEncoding(t *testing.T) {
+	defer updateProxyConfig(map[string]string{})
+
+	if err := updateProxyConfig(map[string]string{"responseFilter": `{"scrubBody": [{"pattern": "secret", "replacement": "***"}]}`}); err != nil {
+		t.Fatal(err)
+	}
+
+	recipient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipBody(t, "a secret"))
+			return
+		}
+
+		w.Write([]byte("a secret"))
+	}))
+	defer recipient.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, recipient.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	current := currentConfig()
+	if _, err := applyRequestTransforms(current, req, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Header.Get("Accept-Encoding") != "" {
+		t.Fatalf("the sender's Accept-Encoding was kept")
+	}
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	var buffer bytes.Buffer
+	buffer.ReadFrom(resp.Body)
+
+	body, err := applyResponseTransforms(current, resp, buffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "a ***" {
+		t.Errorf("got the response body %q, expected it scrubbed", body)
+	}
+}
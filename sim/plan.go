@@ -0,0 +1,134 @@
+package sim
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// EnsureHeadroom is the fraction of the expected requests in flight added to the recommended Ensure value
+const EnsureHeadroom = 0.25
+
+// Plan is a capacity plan of a load, from its rate, the recipient's latency and the pods' capacity
+type Plan struct {
+	// InFlight is the expected number of requests in flight, the rate times the mean latency (Little's law)
+	InFlight float64
+
+	// Ensure is the recommended number of requests to Ensure before the load, the requests in flight with headroom
+	Ensure int
+
+	// Pods is the number of pods the Ensure value scales to
+	Pods int
+
+	// NumberOfSenders is the NumberOfSenders the clients must be configured with
+	NumberOfSenders uint
+
+	// Stats are the simulated outcomes of the load with the plan
+	Stats *Stats
+
+	// Misconfigured are the simulated outcomes of the load with NumberOfSenders left at 1, nil for a single sender
+	Misconfigured *Stats
+}
+
+// PlanLoad plans the capacity for the load of the config, which must have a Rate, then simulates the load with the
+// recommended Ensure value, and with NumberOfSenders left at 1 to show the cost of that misconfiguration
+func PlanLoad(config Config) (*Plan, error) {
+	if config.Rate <= 0 {
+		return nil, fmt.Errorf("planning a load requires its rate")
+	}
+
+	if config.Senders == 0 {
+		config.Senders = 1
+	}
+
+	if config.MaxRequests == 0 {
+		config.MaxRequests = 20
+	}
+
+	if config.RecipientLatency == nil {
+		config.RecipientLatency = Constant(10 * time.Millisecond)
+	}
+
+	inFlight := config.Rate * meanDuration(config.RecipientLatency, config.Seed).Seconds()
+	ensure := int(math.Ceil(inFlight * (1 + EnsureHeadroom)))
+
+	plan := &Plan{
+		InFlight:        inFlight,
+		Ensure:          ensure,
+		Pods:            int(math.Ceil(float64(ensure) / float64(config.MaxRequests))),
+		NumberOfSenders: uint(config.Senders),
+	}
+
+	config.Ensure = ensure
+	if config.MaxPods < plan.Pods {
+		config.MaxPods = plan.Pods
+	}
+
+	config.NumberOfSenders = plan.NumberOfSenders
+	stats, err := Run(config)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.Stats = stats
+
+	if config.Senders > 1 {
+		config.NumberOfSenders = 1
+		if plan.Misconfigured, err = Run(config); err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// Check returns an error if the observed deny rate of the load implies the clients' NumberOfSenders is wrong, as
+// denies well above the plan's mean that the senders predict more free requests than the pods have
+func (plan *Plan) Check(observedDenyRate float64) error {
+	predicted := plan.Stats.DenyRate()
+
+	// Denies are noisy, so only a rate both well above and twice the plan's is flagged
+	if observedDenyRate <= predicted+0.05 || observedDenyRate <= 2*predicted {
+		return nil
+	}
+
+	message := fmt.Sprintf("observed deny rate %.1f%% is above the planned %.1f%%, check that NumberOfSenders is %v and the senders ensured %v requests",
+		observedDenyRate*100, predicted*100, plan.NumberOfSenders, plan.Ensure)
+
+	if plan.Misconfigured != nil && observedDenyRate >= plan.Misconfigured.DenyRate()-0.05 {
+		message += fmt.Sprintf(" (NumberOfSenders left at 1 is predicted to deny %.1f%%)", plan.Misconfigured.DenyRate()*100)
+	}
+
+	return fmt.Errorf("%v", message)
+}
+
+// String formats the plan as a report
+func (plan *Plan) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "In flight: %.1f requests\n", plan.InFlight)
+	fmt.Fprintf(&b, "Recommended: NumberOfSenders %v, Ensure %v (%v pods)\n", plan.NumberOfSenders, plan.Ensure, plan.Pods)
+	fmt.Fprintf(&b, "Predicted deny rate: %.1f%%\n", plan.Stats.DenyRate()*100)
+
+	if plan.Misconfigured != nil {
+		fmt.Fprintf(&b, "Predicted deny rate with NumberOfSenders 1: %.1f%%\n", plan.Misconfigured.DenyRate()*100)
+	}
+
+	return b.String()
+}
+
+// Estimates the mean of the distribution by sampling it
+func meanDuration(distribution Distribution, seed int64) time.Duration {
+	const samples = 10000
+
+	random := rand.New(rand.NewSource(seed))
+
+	var sum float64
+	for i := 0; i < samples; i++ {
+		sum += float64(distribution(random))
+	}
+
+	return time.Duration(sum / samples)
+}
@@ -0,0 +1,575 @@
+// Package sim simulates senders, proxy pods and a recipient in memory, reporting the throughput, latency and denies
+// of the whole system, to plan capacity and validate balancing changes of the client before deploying them.
+// Senders are real clients, while the pods and the recipient answer through an http.RoundTripper without a network,
+// following the proxy protocol. Latencies are slept in real time, so simulations take their Duration.
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btbd/proxy/client"
+	"github.com/btbd/proxy/client/proxytest"
+)
+
+// serviceHost is the host of the simulated proxy service
+const serviceHost = "proxy.sim"
+
+// Distribution draws durations, e.g. the latencies of the recipient
+type Distribution func(random *rand.Rand) time.Duration
+
+// Constant always draws the duration
+func Constant(d time.Duration) Distribution {
+	return func(random *rand.Rand) time.Duration {
+		return d
+	}
+}
+
+// Uniform draws durations uniformly between min and max
+func Uniform(min time.Duration, max time.Duration) Distribution {
+	return func(random *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+
+		return min + time.Duration(random.Int63n(int64(max-min)))
+	}
+}
+
+// Exponential draws exponentially distributed durations of the mean, a common model of service times
+func Exponential(mean time.Duration) Distribution {
+	return func(random *rand.Rand) time.Duration {
+		return time.Duration(random.ExpFloat64() * float64(mean))
+	}
+}
+
+// Config configures a simulation
+type Config struct {
+	// Senders is the number of senders, each with its own client, default 1
+	Senders int
+
+	// NumberOfSenders is the NumberOfSenders the clients are configured with, default Senders
+	// Setting it to another value simulates a misconfiguration
+	NumberOfSenders uint
+
+	// Concurrency is the maximum number of requests in flight per sender, default 10
+	Concurrency int
+
+	// Rate is the total requests per second sent, 0 to send as fast as the concurrency allows
+	// Requests over the concurrency limit are skipped rather than slowing the senders down
+	Rate float64
+
+	// Duration is the time to send requests for, default 1 second
+	Duration time.Duration
+
+	// Ensure is the number of requests to ensure the pods can take before sending, 0 to skip
+	Ensure int
+
+	// Pods is the initial number of pods, default 1
+	Pods int
+
+	// MaxPods is the maximum number of pods denies and ensure requests scale up to, default Pods
+	MaxPods int
+
+	// ScaleUpDelay is the time a new pod takes to be ready after a scale-up
+	ScaleUpDelay time.Duration
+
+	// MaxRequests is the number of concurrent requests each pod takes before returning a 429, default 20
+	MaxRequests int
+
+	// ProxyTimeout is the time the pods wait for the recipient before returning a 202, default 100 milliseconds
+	ProxyTimeout time.Duration
+
+	// NetworkLatency is the latency of every request to a pod, default none
+	NetworkLatency Distribution
+
+	// RecipientLatency is the time the recipient takes to answer, default 10 milliseconds
+	RecipientLatency Distribution
+
+	// RecipientErrorRate is the fraction of requests the recipient answers with a 500
+	RecipientErrorRate float64
+
+	// PingInterval is the clients' ping interval, default theirs
+	PingInterval time.Duration
+
+	// Seed seeds the distributions
+	Seed int64
+}
+
+// Latencies are percentiles of the senders' request latencies
+type Latencies struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Stats are the outcomes of a simulation
+type Stats struct {
+	// Elapsed is the time the requests took to send and answer
+	Elapsed time.Duration
+
+	// Requests is the number of requests sent
+	Requests int64
+
+	// Skipped is the number of requests not sent as the concurrency limit was reached
+	Skipped int64
+
+	// Succeeded is the number of requests the recipient answered successfully within the proxy timeout
+	Succeeded int64
+
+	// Accepted is the number of requests answered with a 202 as the recipient outlived the proxy timeout
+	Accepted int64
+
+	// Denied is the number of requests answered with a 429 by a saturated pod
+	Denied int64
+
+	// Failed is the number of requests the recipient answered with an error
+	Failed int64
+
+	// Errors is the number of requests the client failed to send
+	Errors int64
+
+	// Throughput is the number of requests per second taken by the pods, i.e. neither denied nor failed to send
+	Throughput float64
+
+	// Latency are the latencies of the requests that got a response
+	Latency Latencies
+
+	// Pods is the number of pods once done
+	Pods int
+
+	// PodRequests is the number of requests forwarded by each pod, by ordinal, showing the balance of the load
+	PodRequests map[int]uint64
+}
+
+// DenyRate returns the fraction of the sent requests that were denied
+func (s *Stats) DenyRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+
+	return float64(s.Denied) / float64(s.Requests)
+}
+
+// String formats the stats as a report
+func (s *Stats) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Requests: %v in %v (%.1f/s taken), %v skipped at the concurrency limit\n", s.Requests, s.Elapsed.Round(time.Millisecond), s.Throughput, s.Skipped)
+	fmt.Fprintf(&b, "Succeeded: %v, accepted: %v, denied: %v (%.1f%%), failed: %v, errors: %v\n", s.Succeeded, s.Accepted, s.Denied, s.DenyRate()*100, s.Failed, s.Errors)
+	fmt.Fprintf(&b, "Latency: p50 %v, p90 %v, p99 %v, max %v\n", s.Latency.P50, s.Latency.P90, s.Latency.P99, s.Latency.Max)
+	fmt.Fprintf(&b, "Pods: %v\n", s.Pods)
+
+	ordinals := make([]int, 0, len(s.PodRequests))
+	for ordinal := range s.PodRequests {
+		ordinals = append(ordinals, ordinal)
+	}
+	sort.Ints(ordinals)
+
+	for _, ordinal := range ordinals {
+		fmt.Fprintf(&b, "  pod %v\t%v\n", ordinal, s.PodRequests[ordinal])
+	}
+
+	return b.String()
+}
+
+// A simulated proxy pod
+type pod struct {
+	ordinal int
+	ip      string
+
+	active    int64
+	counter   int64
+	forwarded uint64
+}
+
+// A simulated StatefulSet of proxy pods and the recipient they forward to
+type simulation struct {
+	sync.Mutex
+
+	config Config
+	random *rand.Rand
+
+	pods    map[int]*pod
+	version int64
+
+	// scaling is whether a scale-up is waiting for the new pod to be ready
+	scaling bool
+}
+
+// Run runs a simulation with the config, returning its stats
+func Run(config Config) (*Stats, error) {
+	if config.Senders == 0 {
+		config.Senders = 1
+	}
+
+	if config.NumberOfSenders == 0 {
+		config.NumberOfSenders = uint(config.Senders)
+	}
+
+	if config.Concurrency == 0 {
+		config.Concurrency = 10
+	}
+
+	if config.Duration == 0 {
+		config.Duration = time.Second
+	}
+
+	if config.Pods == 0 {
+		config.Pods = 1
+	}
+
+	if config.MaxPods < config.Pods {
+		config.MaxPods = config.Pods
+	}
+
+	if config.MaxRequests == 0 {
+		config.MaxRequests = 20
+	}
+
+	if config.ProxyTimeout == 0 {
+		config.ProxyTimeout = 100 * time.Millisecond
+	}
+
+	if config.NetworkLatency == nil {
+		config.NetworkLatency = Constant(0)
+	}
+
+	if config.RecipientLatency == nil {
+		config.RecipientLatency = Constant(10 * time.Millisecond)
+	}
+
+	s := &simulation{
+		config: config,
+		random: rand.New(rand.NewSource(config.Seed)),
+		pods:   map[int]*pod{},
+	}
+
+	s.scale(config.Pods)
+	httpClient := &http.Client{Transport: s}
+
+	senders := make([]*client.Proxy, config.Senders)
+	for i := range senders {
+		p, err := client.NewWithConfig(fmt.Sprintf("http://%v:8080/", serviceHost), client.Config{
+			NumberOfSenders: config.NumberOfSenders,
+			PingClient:      httpClient,
+			PingInterval:    config.PingInterval,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer p.Destroy()
+		senders[i] = p
+	}
+
+	if config.Ensure > 0 {
+		if err := senders[0].Ensure(httpClient, config.Ensure); err != nil {
+			return nil, fmt.Errorf("failed to ensure %v requests: %v", config.Ensure, err)
+		}
+	}
+
+	stats := &Stats{PodRequests: map[int]uint64{}}
+	var latencies []time.Duration
+	var mu sync.Mutex
+
+	// Sends a request through the sender and records its outcome
+	send := func(p *client.Proxy) {
+		req, err := http.NewRequest(http.MethodPost, "http://recipient.sim/", nil)
+		if err != nil {
+			panic(err)
+		}
+
+		start := time.Now()
+		resp, err := p.Do(httpClient, req)
+		latency := time.Since(start)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		stats.Requests++
+		if err != nil {
+			stats.Errors++
+			return
+		}
+
+		resp.Body.Close()
+		latencies = append(latencies, latency)
+
+		switch proxyStatus := resp.Header.Get("Proxy-Status"); {
+		case proxyStatus == strconv.Itoa(http.StatusTooManyRequests):
+			stats.Denied++
+		case proxyStatus == strconv.Itoa(http.StatusAccepted):
+			stats.Accepted++
+		case resp.StatusCode >= 300:
+			stats.Failed++
+		default:
+			stats.Succeeded++
+		}
+	}
+
+	start := time.Now()
+	deadline := start.Add(config.Duration)
+
+	var wg sync.WaitGroup
+	for _, p := range senders {
+		wg.Add(1)
+		go func(p *client.Proxy) {
+			defer wg.Done()
+
+			var inFlight sync.WaitGroup
+			defer inFlight.Wait()
+
+			slots := make(chan struct{}, config.Concurrency)
+			sendAsync := func() {
+				inFlight.Add(1)
+				go func() {
+					defer inFlight.Done()
+					defer func() { <-slots }()
+					send(p)
+				}()
+			}
+
+			if config.Rate > 0 {
+				// Send at the sender's share of the rate, skipping the requests over the concurrency limit
+				ticker := time.NewTicker(time.Duration(float64(time.Second) * float64(config.Senders) / config.Rate))
+				defer ticker.Stop()
+
+				for now := range ticker.C {
+					if now.After(deadline) {
+						return
+					}
+
+					select {
+					case slots <- struct{}{}:
+						sendAsync()
+					default:
+						mu.Lock()
+						stats.Skipped++
+						mu.Unlock()
+					}
+				}
+			}
+
+			// Keep the concurrency limit of requests in flight
+			for time.Now().Before(deadline) {
+				slots <- struct{}{}
+				sendAsync()
+			}
+		}(p)
+	}
+
+	wg.Wait()
+	stats.Elapsed = time.Since(start)
+
+	stats.Throughput = float64(stats.Requests-stats.Denied-stats.Errors) / stats.Elapsed.Seconds()
+	stats.Latency = percentiles(latencies)
+
+	s.Lock()
+	stats.Pods = len(s.pods)
+	for ordinal, pod := range s.pods {
+		stats.PodRequests[ordinal] = atomic.LoadUint64(&pod.forwarded)
+	}
+	s.Unlock()
+
+	return stats, nil
+}
+
+// Returns the percentiles of the latencies
+func percentiles(latencies []time.Duration) Latencies {
+	if len(latencies) == 0 {
+		return Latencies{}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	at := func(percentile float64) time.Duration {
+		return latencies[int(float64(len(latencies)-1)*percentile/100)]
+	}
+
+	return Latencies{P50: at(50), P90: at(90), P99: at(99), Max: latencies[len(latencies)-1]}
+}
+
+// Adds pods to reach the count, must be called with s locked
+func (s *simulation) scale(count int) {
+	if count <= len(s.pods) {
+		return
+	}
+
+	for ordinal := len(s.pods); ordinal < count; ordinal++ {
+		s.pods[ordinal] = &pod{ordinal: ordinal, ip: fmt.Sprintf("10.0.0.%v", ordinal+1)}
+	}
+
+	s.version++
+}
+
+// Scales up by a pod once ready, like a denying proxy does
+func (s *simulation) scaleUp() {
+	s.Lock()
+	if s.scaling || len(s.pods) >= s.config.MaxPods {
+		s.Unlock()
+		return
+	}
+
+	s.scaling = true
+	s.Unlock()
+
+	time.AfterFunc(s.config.ScaleUpDelay, func() {
+		s.Lock()
+		defer s.Unlock()
+
+		s.scale(len(s.pods) + 1)
+		s.scaling = false
+	})
+}
+
+// Draws a duration of the distribution
+func (s *simulation) draw(distribution Distribution) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+
+	return distribution(s.random)
+}
+
+// Draws whether the recipient fails a request
+func (s *simulation) recipientFails() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.random.Float64() < s.config.RecipientErrorRate
+}
+
+// Returns a response of the pod with its Proxy-* headers
+func (s *simulation) response(req *http.Request, pod *pod, proxyStatus int, status int) *http.Response {
+	free := int64(s.config.MaxRequests) - atomic.LoadInt64(&pod.active)
+	if free <= 0 {
+		go s.scaleUp()
+	}
+
+	s.Lock()
+	list := map[int]string{}
+	for ordinal, other := range s.pods {
+		list[ordinal] = other.ip
+	}
+
+	version := s.version
+	s.Unlock()
+
+	header := proxytest.Headers{
+		Ordinal: pod.ordinal,
+		Counter: atomic.AddInt64(&pod.counter, 1),
+		Free:    free,
+		Status:  proxyStatus,
+		Version: version,
+		List:    list,
+
+		ProtocolVersion: client.ProtocolVersion,
+	}.Header()
+
+	return &http.Response{
+		Status:     fmt.Sprintf("%v %v", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Request:    req,
+	}
+}
+
+// RoundTrip answers a request to the service or a pod following the proxy protocol
+// Requests to the service are answered by a random pod, like the headless service's DNS would
+func (s *simulation) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	time.Sleep(s.draw(s.config.NetworkLatency))
+
+	s.Lock()
+	var pod *pod
+	if req.URL.Hostname() == serviceHost {
+		pod = s.pods[s.random.Intn(len(s.pods))]
+	} else {
+		for _, other := range s.pods {
+			if other.ip == req.URL.Hostname() {
+				pod = other
+			}
+		}
+	}
+	s.Unlock()
+
+	if pod == nil {
+		return nil, fmt.Errorf("sim: connection to %v refused", req.URL.Host)
+	}
+
+	// Ensure requests scale the pods up to take the requests
+	if ensure := req.Header.Get("Proxy-Ensure-Requests"); ensure != "" {
+		requests, err := strconv.ParseUint(ensure, 10, 64)
+		if err != nil {
+			return s.response(req, pod, http.StatusInternalServerError, http.StatusInternalServerError), nil
+		}
+
+		count := int(math.Ceil(float64(requests) / float64(s.config.MaxRequests)))
+		if count > s.config.MaxPods {
+			count = s.config.MaxPods
+		}
+
+		s.Lock()
+		s.scale(count)
+		s.Unlock()
+
+		return s.response(req, pod, http.StatusOK, http.StatusOK), nil
+	}
+
+	// Ping
+	if req.Header.Get("Forward-To") == "" {
+		return s.response(req, pod, http.StatusOK, http.StatusOK), nil
+	}
+
+	// Deny the request if saturated
+	if atomic.AddInt64(&pod.active, 1) > int64(s.config.MaxRequests) {
+		atomic.AddInt64(&pod.active, -1)
+		return s.response(req, pod, http.StatusTooManyRequests, http.StatusTooManyRequests), nil
+	}
+
+	atomic.AddUint64(&pod.forwarded, 1)
+
+	latency := s.draw(s.config.RecipientLatency)
+	status := http.StatusOK
+	if s.recipientFails() {
+		status = http.StatusInternalServerError
+	}
+
+	if latency > s.config.ProxyTimeout {
+		// The recipient keeps the pod busy after the 202
+		time.AfterFunc(latency, func() {
+			atomic.AddInt64(&pod.active, -1)
+		})
+
+		time.Sleep(s.config.ProxyTimeout)
+		return s.response(req, pod, http.StatusAccepted, http.StatusAccepted), nil
+	}
+
+	time.Sleep(latency)
+	atomic.AddInt64(&pod.active, -1)
+
+	return s.response(req, pod, http.StatusOK, status), nil
+}